@@ -5,6 +5,8 @@ export PATH="$PATH:$(go env GOPATH)/bin"
 # Build the required protobufs in golang
 protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative protos/cm_worker.proto
 protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative protos/kv_store_interface.proto
+protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative protos/kv_admin.proto
+protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative protos/worker_admin.proto
 
 # Build the required protobufs in python
 python -m grpc_tools.protoc --proto_path=./protos --python_out=./protos --grpc_python_out=./protos kv_store_interface.proto
@@ -15,8 +17,14 @@ ln -s $(pwd)/protos/kv_store_interface_pb2_grpc.py kv_client/kv_store_interface_
 
 # Build the go binaries for the services.
 # Change the arch type if trying to build on windows system.
-env GOOS=linux GOARCH=amd64 GOARM=7 go build cmd/control-manager/control-manager.go
-env GOOS=linux GOARCH=amd64 GOARM=7 go build cmd/worker/worker.go
+env GOOS=linux GOARCH=amd64 GOARM=7 go build -o bin/ ./cmd/control-manager
+env GOOS=linux GOARCH=amd64 GOARM=7 go build -o bin/ ./cmd/worker
+
+# Build the kvctl command line tool, the kvstore local runner and the kvbench
+# load generator for the local machine.
+go build -o bin/ ./cmd/kvctl
+go build -o bin/ ./cmd/kvstore
+go build -o bin/ ./cmd/kvbench
 
 # Build the docker container for the services.
 docker build -f docker/Dockerfile.control-manager -t control-manager:latest .
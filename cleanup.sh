@@ -16,4 +16,4 @@ rm $(pwd)/kv_client/kv_store_interface_pb2.py
 rm $(pwd)/kv_client/kv_store_interface_pb2_grpc.py
 
 # Remove all binaries.
-rm control-manager worker
\ No newline at end of file
+rm control-manager worker kvctl
\ No newline at end of file
@@ -0,0 +1,559 @@
+// Package client is the Go client library for the kvstore.
+//
+// By default every request is sent to the control manager's KvStoreInterface
+// service. With WithSmartRouting the client fetches the shard map from the
+// control manager's KvAdmin service and sends requests to the workers'
+// KvStoreService directly, saving a network hop. Worker addresses are pod
+// addresses, so smart routing is only useful for clients running inside the
+// cluster. Requests fall back to the control manager whenever the owning
+// worker is unknown or unreachable.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"kvstore/membership"
+	pb "kvstore/protos"
+	"kvstore/validation"
+	"sync"
+	"time"
+)
+
+// Maximum number of concurrent requests issued by MultiGet.
+const multiGetConcurrency = 16
+
+//------------------------------------------------------------------------------
+// OPTIONS
+//------------------------------------------------------------------------------
+
+// Options used to create a client.
+type Options struct {
+	// Send requests directly to the workers owning the keys.
+	SmartRouting bool
+	// How often the shard map is refreshed in smart routing mode.
+	ShardMapRefreshInterval time.Duration
+	// Extra options used to dial the control manager and the workers.
+	DialOptions []grpc.DialOption
+}
+
+// Option configures a client.
+type Option func(*Options)
+
+// Enable smart routing, i.e. send requests directly to the workers.
+func WithSmartRouting() Option {
+	return func(o *Options) { o.SmartRouting = true }
+}
+
+// Set how often the shard map is refreshed in smart routing mode.
+func WithShardMapRefreshInterval(interval time.Duration) Option {
+	return func(o *Options) { o.ShardMapRefreshInterval = interval }
+}
+
+// Add options used to dial the control manager and the workers.
+func WithDialOptions(dial_options ...grpc.DialOption) Option {
+	return func(o *Options) { o.DialOptions = append(o.DialOptions, dial_options...) }
+}
+
+// Options for a single Put.
+type PutOptions struct {
+	// Idempotency key of the write. Retrying a Put with the same request id
+	// applies the write only once.
+	RequestId string
+	// Condition the current value of the key must satisfy for the write to
+	// be applied. Failed conditions are reported as kConditionFailed.
+	Condition *pb.WriteCondition
+	// Time to live of the key. The key never expires if 0.
+	Ttl time.Duration
+}
+
+// PutOption configures a single Put.
+type PutOption func(*PutOptions)
+
+// Set the idempotency key of a Put.
+func WithRequestId(request_id string) PutOption {
+	return func(o *PutOptions) { o.RequestId = request_id }
+}
+
+// Expire the key written by a Put after ttl.
+func WithTtl(ttl time.Duration) PutOption {
+	return func(o *PutOptions) { o.Ttl = ttl }
+}
+
+// Apply a Put only if the key was last written at db_modified_ts.
+func WithIfDbModifiedTs(db_modified_ts int64) PutOption {
+	return func(o *PutOptions) {
+		o.Condition = &pb.WriteCondition{IfDbModifiedTs: db_modified_ts}
+	}
+}
+
+// Apply a Put only if the key does not exist yet.
+func WithIfNotExists() PutOption {
+	return func(o *PutOptions) { o.Condition = &pb.WriteCondition{IfNotExists: true} }
+}
+
+// Apply a Put only if the key already exists.
+func WithIfExists() PutOption {
+	return func(o *PutOptions) { o.Condition = &pb.WriteCondition{IfExists: true} }
+}
+
+//------------------------------------------------------------------------------
+// RESULTS AND ERRORS
+//------------------------------------------------------------------------------
+
+// Value stored in the kvstore along with the timestamp of its last write.
+type Value struct {
+	Value        string
+	DbModifiedTs int64
+	// Unix time in milliseconds at which the key expires, 0 if it never does.
+	ExpiresAtMs int64
+}
+
+// Error returned for requests the kvstore rejected or failed to serve.
+type Error struct {
+	Code    pb.ErrorCode
+	Details string
+	// Address of the control manager leader, set with kNotLeader.
+	LeaderAddress string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("kvstore: %s: %s", e.Code, e.Details)
+}
+
+// Returns true if err reports a missing key.
+func IsNotFound(err error) bool {
+	var kv_error *Error
+	return errors.As(err, &kv_error) && kv_error.Code == pb.ErrorCode_kNotFound
+}
+
+// Returns true if err reports that the condition of a conditional Put did not
+// hold.
+func IsConditionFailed(err error) bool {
+	var kv_error *Error
+	return errors.As(err, &kv_error) && kv_error.Code == pb.ErrorCode_kConditionFailed
+}
+
+// Helper method to convert a KvError to an error. Returns nil on success.
+func errorFromKvError(kv_error *pb.KvError) error {
+	if kv_error.GetErrorType() == pb.ErrorCode_kNoError {
+		return nil
+	}
+	return &Error{
+		Code:          kv_error.GetErrorType(),
+		Details:       kv_error.GetErrorDetails(),
+		LeaderAddress: kv_error.GetLeaderAddress(),
+	}
+}
+
+// Helper method to convert a failed worker response to an error.
+func errorFromWorker(error_code pb.ErrorCode, error_details string) error {
+	if error_code == pb.ErrorCode_kNoError {
+		error_code = pb.ErrorCode_kBackendError
+	}
+	return &Error{Code: error_code, Details: error_details}
+}
+
+//------------------------------------------------------------------------------
+// CLIENT
+//------------------------------------------------------------------------------
+
+// Client for the kvstore. A Client is safe for concurrent use.
+type Client struct {
+	options      Options
+	conn         *grpc.ClientConn
+	kv_client    pb.KvStoreInterfaceClient
+	admin_client pb.KvAdminClient
+
+	// State used for smart routing.
+	shard_map_lock sync.RWMutex
+	num_shards     int
+	// Key is the shard id, value is the address of the owning worker.
+	shard_addresses map[string]string
+	// Key is the worker address.
+	worker_conns map[string]*grpc.ClientConn
+	// Signalled to refresh the shard map after a request to a worker failed.
+	// It holds at most one pending refresh, so that many failing requests
+	// cause a single refresh.
+	refresh_requests chan struct{}
+	done             chan struct{}
+	close_once       sync.Once
+}
+
+// Create a client talking to the control manager at address (host:port).
+func New(address string, opts ...Option) (*Client, error) {
+	options := Options{ShardMapRefreshInterval: 30 * time.Second}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	conn, err := grpc.NewClient(address, dialOptions(options)...)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		options:          options,
+		conn:             conn,
+		kv_client:        pb.NewKvStoreInterfaceClient(conn),
+		admin_client:     pb.NewKvAdminClient(conn),
+		shard_addresses:  make(map[string]string),
+		worker_conns:     make(map[string]*grpc.ClientConn),
+		refresh_requests: make(chan struct{}, 1),
+		done:             make(chan struct{}),
+	}
+	if options.SmartRouting {
+		// A failure here is not fatal, requests go through the control
+		// manager until the shard map is known.
+		c.RefreshShardMap(context.Background())
+		go c.refreshShardMapPeriodically()
+	}
+	return c, nil
+}
+
+// Helper method to get the options used to dial the cluster.
+func dialOptions(options Options) []grpc.DialOption {
+	dial_options := []grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	}
+	return append(dial_options, options.DialOptions...)
+}
+
+// Close the client and all its connections.
+func (c *Client) Close() error {
+	c.close_once.Do(func() { close(c.done) })
+	c.shard_map_lock.Lock()
+	for address, conn := range c.worker_conns {
+		conn.Close()
+		delete(c.worker_conns, address)
+	}
+	c.shard_map_lock.Unlock()
+	return c.conn.Close()
+}
+
+// Get the value of key. Returns an error satisfying IsNotFound if the key
+// does not exist.
+func (c *Client) Get(ctx context.Context, key string) (*Value, error) {
+	if worker_client := c.getWorkerClientForKey(key); worker_client != nil {
+		r, err := worker_client.GetKeyInternal(ctx, &pb.GetKeyInternalArg{
+			ReqId: uuid.New().String(),
+			Key:   key,
+		})
+		if !c.shouldFallBack(err, r.GetErrorCode()) {
+			if err != nil {
+				return nil, err
+			}
+			if !r.GetSuccess() {
+				return nil, errorFromWorker(r.GetErrorCode(), r.GetErrorDetails())
+			}
+			return &Value{
+				Value:        r.GetKvObject().GetValue(),
+				DbModifiedTs: r.GetKvObject().GetDbModifiedTs(),
+				ExpiresAtMs:  r.GetKvObject().GetExpiresAtMs(),
+			}, nil
+		}
+	}
+	r, err := c.kv_client.GetKey(ctx, &pb.GetKeyArg{Key: key})
+	if err != nil {
+		return nil, err
+	}
+	if err := errorFromKvError(r.GetKvError()); err != nil {
+		return nil, err
+	}
+	return &Value{
+		Value:        r.GetValue(),
+		DbModifiedTs: r.GetDbModifiedTs(),
+		ExpiresAtMs:  r.GetExpiresAtMs(),
+	}, nil
+}
+
+// Put value for key. Returns the db_modified_ts assigned to the write. A Put
+// carrying a condition that does not hold returns an error satisfying
+// IsConditionFailed.
+func (c *Client) Put(ctx context.Context, key string, value string, opts ...PutOption) (int64, error) {
+	var put_options PutOptions
+	for _, opt := range opts {
+		opt(&put_options)
+	}
+	// Checked here as well so that invalid writes are rejected the same way
+	// whichever route they take.
+	is_valid_arg, error_details := validation.ValidatePutKeyArg(&pb.PutKeyArg{
+		Key:       key,
+		Value:     value,
+		RequestId: put_options.RequestId,
+		Condition: put_options.Condition,
+		TtlMs:     put_options.Ttl.Milliseconds(),
+	})
+	if !is_valid_arg {
+		return 0, &Error{Code: pb.ErrorCode_kInvalidArgument, Details: error_details}
+	}
+	if worker_client := c.getWorkerClientForKey(key); worker_client != nil {
+		// Workers need a request id to dedup retried writes. Use the same one
+		// if we fall back to the control manager.
+		if put_options.RequestId == "" {
+			put_options.RequestId = uuid.New().String()
+		}
+		// Workers take an absolute expiry time, which the control manager
+		// computes from the time to live otherwise.
+		var expires_at_ms int64
+		if put_options.Ttl > 0 {
+			expires_at_ms = time.Now().Add(put_options.Ttl).UnixMilli()
+		}
+		r, err := worker_client.PutKeyInternal(ctx, &pb.PutKeyInternalArg{
+			ReqId:       put_options.RequestId,
+			Key:         key,
+			Value:       value,
+			Condition:   put_options.Condition,
+			ExpiresAtMs: expires_at_ms,
+		})
+		if !c.shouldFallBack(err, r.GetErrorCode()) {
+			if err != nil {
+				return 0, err
+			}
+			if !r.GetSuccess() {
+				return 0, errorFromWorker(r.GetErrorCode(), r.GetErrorDetails())
+			}
+			return r.GetDbModifiedTs(), nil
+		}
+	}
+	r, err := c.kv_client.PutKey(ctx, &pb.PutKeyArg{
+		Key:       key,
+		Value:     value,
+		RequestId: put_options.RequestId,
+		Condition: put_options.Condition,
+		TtlMs:     put_options.Ttl.Milliseconds(),
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := errorFromKvError(r.GetKvError()); err != nil {
+		return 0, err
+	}
+	return r.GetDbModifiedTs(), nil
+}
+
+// Delete key. Returns an error satisfying IsNotFound if the key does not
+// exist.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	// Set if the worker may have deleted the key before failing.
+	may_be_deleted := false
+	if worker_client := c.getWorkerClientForKey(key); worker_client != nil {
+		r, err := worker_client.DeleteKeyInternal(ctx, &pb.DeleteKeyInternalArg{
+			ReqId: uuid.New().String(),
+			Key:   key,
+		})
+		if !c.shouldFallBack(err, r.GetErrorCode()) {
+			if err != nil {
+				return err
+			}
+			if !r.GetSuccess() {
+				return errorFromWorker(r.GetErrorCode(), r.GetErrorDetails())
+			}
+			return nil
+		}
+		may_be_deleted = err != nil
+	}
+	r, err := c.kv_client.DeleteKey(ctx, &pb.DeleteKeyArg{Key: key})
+	if err != nil {
+		return err
+	}
+	// The failed request to the worker may have deleted the key before we
+	// fell back, which then finds it missing. The control manager treats its
+	// own retried deletes the same way.
+	if may_be_deleted && r.GetKvError().GetErrorType() == pb.ErrorCode_kNotFound {
+		return nil
+	}
+	return errorFromKvError(r.GetKvError())
+}
+
+// Get the values of several keys concurrently. Missing keys are left out of
+// the result. Returns the first error other than a missing key.
+func (c *Client) MultiGet(ctx context.Context, keys []string) (map[string]*Value, error) {
+	var (
+		result_lock sync.Mutex
+		result      = make(map[string]*Value, len(keys))
+		first_err   error
+		wg          sync.WaitGroup
+	)
+	semaphore := make(chan struct{}, multiGetConcurrency)
+	for _, key := range keys {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(key string) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			value, err := c.Get(ctx, key)
+			result_lock.Lock()
+			defer result_lock.Unlock()
+			if err == nil {
+				result[key] = value
+			} else if !IsNotFound(err) && first_err == nil {
+				first_err = err
+			}
+		}(key)
+	}
+	wg.Wait()
+	if first_err != nil {
+		return nil, first_err
+	}
+	return result, nil
+}
+
+// Scan the keys starting with prefix and sorting after start_after, in key
+// order. Returns at most limit entries (0 means the server default) and
+// whether more keys match. Pass the last returned key as start_after to get
+// the next page.
+func (c *Client) Scan(ctx context.Context, prefix string, start_after string,
+	limit int) ([]*pb.KeyValue, bool, error) {
+	r, err := c.kv_client.ScanKeys(ctx, &pb.ScanKeysArg{
+		Prefix:     prefix,
+		StartAfter: start_after,
+		Limit:      int32(limit),
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if err := errorFromKvError(r.GetKvError()); err != nil {
+		return nil, false, err
+	}
+	return r.GetEntries(), r.GetHasMore(), nil
+}
+
+// Get the cluster status as seen by the control manager.
+func (c *Client) GetClusterStatus(ctx context.Context) (*pb.GetClusterStatusRet, error) {
+	return c.admin_client.GetClusterStatus(ctx, &pb.GetClusterStatusArg{})
+}
+
+// Get the shard map as seen by the control manager.
+func (c *Client) GetShardMap(ctx context.Context) (*pb.GetShardMapRet, error) {
+	return c.admin_client.GetShardMap(ctx, &pb.GetShardMapArg{})
+}
+
+// List every shard with its owner and the keys it stores, as reported by the
+// workers.
+func (c *Client) ListShards(ctx context.Context) (*pb.ListShardsRet, error) {
+	return c.admin_client.ListShards(ctx, &pb.ListShardsArg{})
+}
+
+//------------------------------------------------------------------------------
+// SMART ROUTING
+//------------------------------------------------------------------------------
+
+// Fetch the shard map from the control manager and update the connections to
+// the workers.
+func (c *Client) RefreshShardMap(ctx context.Context) error {
+	r, err := c.admin_client.GetShardMap(ctx, &pb.GetShardMapArg{})
+	if err != nil {
+		return err
+	}
+	shard_addresses := make(map[string]string)
+	for _, shard := range r.GetShards() {
+		shard_addresses[shard.GetShardId()] = shard.GetAddress()
+	}
+	c.shard_map_lock.Lock()
+	defer c.shard_map_lock.Unlock()
+	c.num_shards = int(r.GetNumShards())
+	c.shard_addresses = shard_addresses
+	// Drop the connections to workers which no longer own any shard.
+	in_use := make(map[string]bool)
+	for _, address := range shard_addresses {
+		in_use[address] = true
+	}
+	for address, conn := range c.worker_conns {
+		if !in_use[address] {
+			conn.Close()
+			delete(c.worker_conns, address)
+		}
+	}
+	return nil
+}
+
+// Helper method to refresh the shard map periodically, and whenever a
+// refresh is requested, until the client is closed.
+func (c *Client) refreshShardMapPeriodically() {
+	ticker := time.NewTicker(c.options.ShardMapRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		case <-c.refresh_requests:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		c.RefreshShardMap(ctx)
+		cancel()
+	}
+}
+
+// Helper method to request a refresh of the shard map. Requests made while a
+// refresh is pending are coalesced with it.
+func (c *Client) requestShardMapRefresh() {
+	select {
+	case c.refresh_requests <- struct{}{}:
+	default:
+	}
+}
+
+// Helper method to get the client of the worker owning key. Returns nil if
+// smart routing is disabled or the owner is unknown.
+func (c *Client) getWorkerClientForKey(key string) pb.KvStoreServiceClient {
+	if !c.options.SmartRouting {
+		return nil
+	}
+	c.shard_map_lock.RLock()
+	address, conn, is_known := c.getWorkerConnForKey(key)
+	c.shard_map_lock.RUnlock()
+	if conn != nil {
+		return pb.NewKvStoreServiceClient(conn)
+	}
+	if !is_known {
+		return nil
+	}
+	// First request to this worker, connect to it unless another request
+	// did in the meantime or the shard map changed.
+	c.shard_map_lock.Lock()
+	defer c.shard_map_lock.Unlock()
+	address, conn, is_known = c.getWorkerConnForKey(key)
+	if !is_known {
+		return nil
+	}
+	if conn != nil {
+		return pb.NewKvStoreServiceClient(conn)
+	}
+	conn, err := grpc.NewClient(address, dialOptions(c.options)...)
+	if err != nil {
+		return nil
+	}
+	c.worker_conns[address] = conn
+	return pb.NewKvStoreServiceClient(conn)
+}
+
+// Helper method to look up the address of the worker owning key and the
+// connection to it, nil if not connected yet. Returns false if the owner is
+// unknown. Caller must hold shard_map_lock.
+func (c *Client) getWorkerConnForKey(key string) (string, *grpc.ClientConn, bool) {
+	if c.num_shards == 0 {
+		return "", nil, false
+	}
+	address, exists := c.shard_addresses[membership.GetShardForKey(key, c.num_shards)]
+	if !exists {
+		return "", nil, false
+	}
+	return address, c.worker_conns[address], true
+}
+
+// Helper method to check whether a request sent to a worker should be retried
+// through the control manager, i.e. the worker is unreachable or does not own
+// the key. The shard map is refreshed in the background since the worker may
+// have moved.
+func (c *Client) shouldFallBack(err error, error_code pb.ErrorCode) bool {
+	if status.Code(err) != codes.Unavailable && error_code != pb.ErrorCode_kWrongShard {
+		return false
+	}
+	c.requestShardMapRefresh()
+	return true
+}
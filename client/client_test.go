@@ -0,0 +1,408 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	pb "kvstore/protos"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Behaviours of a fake worker.
+const (
+	fakeWorkerServing = iota
+	// Requests fail as if the worker was unreachable.
+	fakeWorkerUnavailable
+	// Requests are applied, then fail as if the response was lost.
+	fakeWorkerFailsAfterApplying
+	// Requests are rejected with kWrongShard.
+	fakeWorkerWrongShard
+)
+
+// In memory store shared by the fake control manager and workers.
+type fakeStore struct {
+	store_lock sync.Mutex
+	values     map[string]string
+	last_ts    int64
+}
+
+func (s *fakeStore) get(key string) (string, bool) {
+	s.store_lock.Lock()
+	defer s.store_lock.Unlock()
+	value, exists := s.values[key]
+	return value, exists
+}
+
+func (s *fakeStore) put(key string, value string) int64 {
+	s.store_lock.Lock()
+	defer s.store_lock.Unlock()
+	s.last_ts++
+	s.values[key] = value
+	return s.last_ts
+}
+
+func (s *fakeStore) delete(key string) bool {
+	s.store_lock.Lock()
+	defer s.store_lock.Unlock()
+	_, exists := s.values[key]
+	delete(s.values, key)
+	return exists
+}
+
+// Fake worker serving the KvStoreService from a fakeStore.
+type fakeWorker struct {
+	pb.UnimplementedKvStoreServiceServer
+	store        *fakeStore
+	address      string
+	mode         atomic.Int32
+	num_requests atomic.Int32
+}
+
+// Helper method to get the error of a request to the worker, and whether the
+// request must be applied first.
+func (w *fakeWorker) getFailure() (bool, error) {
+	w.num_requests.Add(1)
+	switch w.mode.Load() {
+	case fakeWorkerUnavailable:
+		return false, status.Error(codes.Unavailable, "worker unreachable")
+	case fakeWorkerFailsAfterApplying:
+		return true, status.Error(codes.Unavailable, "response lost")
+	}
+	return true, nil
+}
+
+func (w *fakeWorker) GetKeyInternal(ctx context.Context,
+	in *pb.GetKeyInternalArg) (*pb.GetKeyInternalRet, error) {
+	if w.mode.Load() == fakeWorkerWrongShard {
+		w.num_requests.Add(1)
+		return &pb.GetKeyInternalRet{ErrorCode: pb.ErrorCode_kWrongShard}, nil
+	}
+	if _, err := w.getFailure(); err != nil {
+		return nil, err
+	}
+	value, exists := w.store.get(in.GetKey())
+	if !exists {
+		return &pb.GetKeyInternalRet{ErrorCode: pb.ErrorCode_kNotFound}, nil
+	}
+	return &pb.GetKeyInternalRet{Success: true, KvObject: &pb.KvStoreObject{Value: value}}, nil
+}
+
+func (w *fakeWorker) PutKeyInternal(ctx context.Context,
+	in *pb.PutKeyInternalArg) (*pb.PutKeyInternalRet, error) {
+	if w.mode.Load() == fakeWorkerWrongShard {
+		w.num_requests.Add(1)
+		return &pb.PutKeyInternalRet{ErrorCode: pb.ErrorCode_kWrongShard}, nil
+	}
+	apply, err := w.getFailure()
+	var ts int64
+	if apply {
+		ts = w.store.put(in.GetKey(), in.GetValue())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &pb.PutKeyInternalRet{Success: true, DbModifiedTs: ts}, nil
+}
+
+func (w *fakeWorker) DeleteKeyInternal(ctx context.Context,
+	in *pb.DeleteKeyInternalArg) (*pb.DeleteKeyInternalRet, error) {
+	if w.mode.Load() == fakeWorkerWrongShard {
+		w.num_requests.Add(1)
+		return &pb.DeleteKeyInternalRet{ErrorCode: pb.ErrorCode_kWrongShard}, nil
+	}
+	apply, err := w.getFailure()
+	exists := apply && w.store.delete(in.GetKey())
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return &pb.DeleteKeyInternalRet{ErrorCode: pb.ErrorCode_kNotFound}, nil
+	}
+	return &pb.DeleteKeyInternalRet{Success: true}, nil
+}
+
+// Fake control manager serving the KvStoreInterface from a fakeStore, and
+// the shard map from the KvAdmin service.
+type fakeControlManager struct {
+	pb.UnimplementedKvStoreInterfaceServer
+	pb.UnimplementedKvAdminServer
+	store        *fakeStore
+	address      string
+	num_requests atomic.Int32
+
+	shard_map_lock sync.Mutex
+	shard_map      *pb.GetShardMapRet
+	// GetShardMap waits until the gate is closed if set.
+	shard_map_gate         chan struct{}
+	num_shard_map_requests atomic.Int32
+}
+
+// Helper method to make the single shard owned by the worker at address.
+func (cm *fakeControlManager) setOwner(address string) {
+	cm.shard_map_lock.Lock()
+	defer cm.shard_map_lock.Unlock()
+	cm.shard_map = &pb.GetShardMapRet{
+		NumShards: 1,
+		Shards:    []*pb.ShardAssignment{{ShardId: "0", WorkerName: "worker-0", Address: address}},
+	}
+}
+
+func (cm *fakeControlManager) GetShardMap(ctx context.Context,
+	in *pb.GetShardMapArg) (*pb.GetShardMapRet, error) {
+	cm.num_shard_map_requests.Add(1)
+	cm.shard_map_lock.Lock()
+	shard_map, gate := cm.shard_map, cm.shard_map_gate
+	cm.shard_map_lock.Unlock()
+	if gate != nil {
+		<-gate
+	}
+	return shard_map, nil
+}
+
+func (cm *fakeControlManager) GetKey(ctx context.Context, in *pb.GetKeyArg) (*pb.GetKeyRet, error) {
+	cm.num_requests.Add(1)
+	value, exists := cm.store.get(in.GetKey())
+	if !exists {
+		return &pb.GetKeyRet{KvError: &pb.KvError{ErrorType: pb.ErrorCode_kNotFound}}, nil
+	}
+	return &pb.GetKeyRet{Success: true, Value: value, KvError: &pb.KvError{}}, nil
+}
+
+func (cm *fakeControlManager) PutKey(ctx context.Context, in *pb.PutKeyArg) (*pb.PutKeyRet, error) {
+	cm.num_requests.Add(1)
+	ts := cm.store.put(in.GetKey(), in.GetValue())
+	return &pb.PutKeyRet{Success: true, DbModifiedTs: ts, KvError: &pb.KvError{}}, nil
+}
+
+func (cm *fakeControlManager) DeleteKey(ctx context.Context,
+	in *pb.DeleteKeyArg) (*pb.DeleteKeyRet, error) {
+	cm.num_requests.Add(1)
+	if !cm.store.delete(in.GetKey()) {
+		return &pb.DeleteKeyRet{KvError: &pb.KvError{ErrorType: pb.ErrorCode_kNotFound}}, nil
+	}
+	return &pb.DeleteKeyRet{Success: true, KvError: &pb.KvError{}}, nil
+}
+
+// Helper method to serve the services registered by register on a free port
+// until the test finishes. Returns the address of the server.
+func startFakeServer(t *testing.T, register func(s *grpc.Server)) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	s := grpc.NewServer()
+	register(s)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+	return lis.Addr().String()
+}
+
+// Helper method to start a fake control manager along with num_workers fake
+// workers sharing its store. The shard is owned by the first worker.
+func startFakeCluster(t *testing.T, num_workers int) (*fakeControlManager, []*fakeWorker) {
+	t.Helper()
+	store := &fakeStore{values: make(map[string]string)}
+	var workers []*fakeWorker
+	for i := 0; i < num_workers; i++ {
+		w := &fakeWorker{store: store}
+		w.address = startFakeServer(t, func(s *grpc.Server) {
+			pb.RegisterKvStoreServiceServer(s, w)
+		})
+		workers = append(workers, w)
+	}
+	cm := &fakeControlManager{store: store}
+	cm.setOwner(workers[0].address)
+	cm.address = startFakeServer(t, func(s *grpc.Server) {
+		pb.RegisterKvStoreInterfaceServer(s, cm)
+		pb.RegisterKvAdminServer(s, cm)
+	})
+	return cm, workers
+}
+
+// Helper method to create a client until the test finishes.
+func newTestClient(t *testing.T, address string, opts ...Option) *Client {
+	t.Helper()
+	c, err := New(address, opts...)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// Helper method to wait until condition holds.
+func waitFor(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", description)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Helper method to put, get and delete a key and check the results.
+func putGetDelete(t *testing.T, c *Client, key string) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := c.Put(ctx, key, "value"); err != nil {
+		t.Fatalf("put %s: %v", key, err)
+	}
+	if value, err := c.Get(ctx, key); err != nil || value.Value != "value" {
+		t.Fatalf("get %s = %v, %v, want value", key, value, err)
+	}
+	if err := c.Delete(ctx, key); err != nil {
+		t.Fatalf("delete %s: %v", key, err)
+	}
+	if _, err := c.Get(ctx, key); !IsNotFound(err) {
+		t.Fatalf("get %s after delete = %v, want kNotFound", key, err)
+	}
+}
+
+func TestRequestsGoThroughControlManagerByDefault(t *testing.T) {
+	cm, workers := startFakeCluster(t, 1)
+	putGetDelete(t, newTestClient(t, cm.address), "key")
+	if n := cm.num_requests.Load(); n != 4 {
+		t.Errorf("control manager served %d requests, want 4", n)
+	}
+	if n := workers[0].num_requests.Load(); n != 0 {
+		t.Errorf("worker served %d requests without smart routing, want 0", n)
+	}
+	if n := cm.num_shard_map_requests.Load(); n != 0 {
+		t.Errorf("shard map fetched %d times without smart routing, want 0", n)
+	}
+}
+
+func TestSmartRoutingSendsRequestsToWorkers(t *testing.T) {
+	cm, workers := startFakeCluster(t, 1)
+	putGetDelete(t, newTestClient(t, cm.address, WithSmartRouting()), "key")
+	if n := workers[0].num_requests.Load(); n != 4 {
+		t.Errorf("worker served %d requests, want 4", n)
+	}
+	if n := cm.num_requests.Load(); n != 0 {
+		t.Errorf("control manager served %d requests with smart routing, want 0", n)
+	}
+}
+
+func TestSmartRoutingFallsBack(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		mode int32
+	}{
+		{"unreachable worker", fakeWorkerUnavailable},
+		{"wrong shard", fakeWorkerWrongShard},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cm, workers := startFakeCluster(t, 1)
+			c := newTestClient(t, cm.address, WithSmartRouting(),
+				WithShardMapRefreshInterval(time.Hour))
+			workers[0].mode.Store(test.mode)
+			putGetDelete(t, c, "key")
+			if n := cm.num_requests.Load(); n != 4 {
+				t.Errorf("control manager served %d requests after falling back, want 4", n)
+			}
+			// Every fallback requests a refresh of the shard map.
+			waitFor(t, "a refresh of the shard map", func() bool {
+				return cm.num_shard_map_requests.Load() > 1
+			})
+		})
+	}
+}
+
+func TestSmartRoutingFollowsMovedShard(t *testing.T) {
+	cm, workers := startFakeCluster(t, 2)
+	c := newTestClient(t, cm.address, WithSmartRouting(), WithShardMapRefreshInterval(time.Hour))
+	putGetDelete(t, c, "key")
+
+	// The shard moves to the second worker, the first one rejects its keys.
+	cm.setOwner(workers[1].address)
+	workers[0].mode.Store(fakeWorkerWrongShard)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := c.Put(ctx, "key", "value"); err != nil {
+		t.Fatalf("put after the shard moved: %v", err)
+	}
+	waitFor(t, "requests to the new owner", func() bool {
+		c.Get(ctx, "key")
+		return workers[1].num_requests.Load() > 0
+	})
+	c.shard_map_lock.RLock()
+	_, is_connected := c.worker_conns[workers[0].address]
+	c.shard_map_lock.RUnlock()
+	if is_connected {
+		t.Errorf("client still connected to %s, which owns no shard", workers[0].address)
+	}
+}
+
+func TestShardMapRefreshesAreCoalesced(t *testing.T) {
+	cm, workers := startFakeCluster(t, 1)
+	c := newTestClient(t, cm.address, WithSmartRouting(), WithShardMapRefreshInterval(time.Hour))
+	workers[0].mode.Store(fakeWorkerUnavailable)
+	gate := make(chan struct{})
+	cm.shard_map_lock.Lock()
+	cm.shard_map_gate = gate
+	cm.shard_map_lock.Unlock()
+
+	// Many requests fail while a refresh is in flight.
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if _, err := c.Put(ctx, fmt.Sprintf("key-%d", i), "value"); err != nil {
+				t.Errorf("put: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	waitFor(t, "a refresh of the shard map", func() bool {
+		return cm.num_shard_map_requests.Load() == 2
+	})
+	close(gate)
+	// The refresh in flight and at most one pending refresh, on top of the
+	// refresh of New.
+	time.Sleep(200 * time.Millisecond)
+	if n := cm.num_shard_map_requests.Load(); n > 3 {
+		t.Errorf("shard map fetched %d times for 50 failed requests, want at most 3", n)
+	}
+}
+
+func TestDeleteFallingBackAfterWorkerApplied(t *testing.T) {
+	cm, workers := startFakeCluster(t, 1)
+	c := newTestClient(t, cm.address, WithSmartRouting(), WithShardMapRefreshInterval(time.Hour))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := c.Put(ctx, "key", "value"); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	// The worker deleted the key but its response was lost. The control
+	// manager then finds the key missing, which is reported as deleted.
+	workers[0].mode.Store(fakeWorkerFailsAfterApplying)
+	if err := c.Delete(ctx, "key"); err != nil {
+		t.Fatalf("delete applied by the worker before failing = %v, want success", err)
+	}
+	if _, exists := cm.store.get("key"); exists {
+		t.Fatalf("key still stored after delete")
+	}
+	if n := cm.num_requests.Load(); n != 1 {
+		t.Errorf("control manager served %d requests, want the delete", n)
+	}
+
+	// A missing key is still reported once the worker answers.
+	workers[0].mode.Store(fakeWorkerServing)
+	if err := c.Delete(ctx, "key"); !IsNotFound(err) {
+		t.Fatalf("delete of a missing key = %v, want kNotFound", err)
+	}
+}
@@ -0,0 +1,398 @@
+// kvbench is the load generator of the kvstore. It loads a set of keys, then
+// runs a YCSB style workload of reads, updates, inserts, scans and
+// read-modify-writes against the control managers and writes a JSON report
+// of the latencies, the errors by ErrorCode and the throughput over time.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"kvstore/client"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Define the flags of the benchmark.
+var (
+	server_addresses = flag.String("addr", "localhost:50052",
+		"Comma separated addresses of the control managers, host:port. Clients are spread over them.")
+	smart_routing = flag.Bool("smart", false,
+		"Send requests directly to the workers. Only works inside the cluster.")
+	workload_name = flag.String("workload", "a",
+		"YCSB core workload, one of a (50% reads, 50% updates), b (95% reads, 5% updates), "+
+			"c (reads), d (95% reads of the latest keys, 5% inserts), e (95% scans, 5% inserts) "+
+			"or f (50% reads, 50% read-modify-writes).")
+	read_proportion = flag.Float64("read_proportion", -1,
+		"Proportion of reads. Defaults to the proportion of the workload.")
+	update_proportion = flag.Float64("update_proportion", -1,
+		"Proportion of updates of existing keys. Defaults to the proportion of the workload.")
+	insert_proportion = flag.Float64("insert_proportion", -1,
+		"Proportion of inserts of new keys. Defaults to the proportion of the workload.")
+	scan_proportion = flag.Float64("scan_proportion", -1,
+		"Proportion of scans. Defaults to the proportion of the workload.")
+	read_modify_write_proportion = flag.Float64("read_modify_write_proportion", -1,
+		"Proportion of reads followed by a conditional write of the key. Defaults to the proportion of the workload.")
+	distribution = flag.String("distribution", "",
+		"Distribution of the keys, one of uniform, zipfian, latest or hotspot. Defaults to the distribution of the workload.")
+	zipfian_constant = flag.Float64("zipfian_constant", 0.99,
+		"Skew of the zipfian and latest distributions, in (0, 1).")
+	hot_set_fraction = flag.Float64("hot_set_fraction", 0.2,
+		"Fraction of the keys which are hot with the hotspot distribution.")
+	hot_op_fraction = flag.Float64("hot_op_fraction", 0.8,
+		"Fraction of the operations going to hot keys with the hotspot distribution.")
+	record_count = flag.Int64("record_count", 10000,
+		"Number of keys written by the load phase.")
+	operation_count = flag.Int64("operations", 0,
+		"Number of operations of the run phase. Unlimited if 0, see -duration.")
+	run_duration = flag.Duration("duration", 30*time.Second,
+		"Duration of the run phase. Unlimited if 0, see -operations.")
+	concurrency = flag.Int("concurrency", 16,
+		"Number of clients, each running one operation at a time.")
+	value_size = flag.Int("value_size", 100,
+		"Size of the written values in bytes.")
+	max_value_size = flag.Int("max_value_size", 0,
+		"If larger than -value_size, value sizes are uniformly distributed between both.")
+	max_scan_length = flag.Int("max_scan_length", 100,
+		"Maximum number of keys returned by a scan. Scan lengths are uniformly distributed.")
+	key_prefix = flag.String("key_prefix", "kvbench-",
+		"Prefix of the benchmark keys.")
+	load_phase = flag.Bool("load", true,
+		"Write the record_count keys before the run phase.")
+	run_phase = flag.Bool("run", true,
+		"Run the workload. Set -run=false to only load the keys.")
+	request_timeout = flag.Duration("timeout", 10*time.Second,
+		"Timeout of every request.")
+	report_interval = flag.Duration("report_interval", time.Second,
+		"Interval of the throughput over time.")
+	output_path = flag.String("output", "",
+		"File to write the JSON report to. Defaults to stdout.")
+)
+
+// Config of a benchmark, as recorded in the report.
+type Config struct {
+	Addresses        []string `json:"addresses"`
+	SmartRouting     bool     `json:"smart_routing"`
+	Workload         string   `json:"workload"`
+	Mix              Workload `json:"mix"`
+	ZipfianConstant  float64  `json:"zipfian_constant"`
+	HotSetFraction   float64  `json:"hot_set_fraction"`
+	HotOpFraction    float64  `json:"hot_op_fraction"`
+	RecordCount      int64    `json:"record_count"`
+	Operations       int64    `json:"operations"`
+	DurationMs       int64    `json:"duration_ms"`
+	Concurrency      int      `json:"concurrency"`
+	MinValueSize     int      `json:"min_value_size"`
+	MaxValueSize     int      `json:"max_value_size"`
+	MaxScanLength    int      `json:"max_scan_length"`
+	KeyPrefix        string   `json:"key_prefix"`
+	RequestTimeoutMs int64    `json:"request_timeout_ms"`
+}
+
+// State shared by the clients of a benchmark.
+type benchmark struct {
+	config  Config
+	clients []*client.Client
+	keys    *KeySpace
+	values  *ValueGenerator
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: kvbench [flags]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	config, err := getConfig()
+	if err != nil {
+		fatalf("%v", err)
+	}
+	values, err := newValueGenerator(config.MinValueSize, config.MaxValueSize)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	b := &benchmark{
+		config: config,
+		keys:   &KeySpace{prefix: config.KeyPrefix, record_count: config.RecordCount},
+		values: values,
+	}
+	var opts []client.Option
+	if config.SmartRouting {
+		opts = append(opts, client.WithSmartRouting())
+	}
+	for _, address := range config.Addresses {
+		c, err := client.New(address, opts...)
+		if err != nil {
+			fatalf("failed to connect to %s: %v", address, err)
+		}
+		defer c.Close()
+		b.clients = append(b.clients, c)
+	}
+	// Choose the keys before loading, the zipfian distributions take a
+	// while to set up for many keys.
+	var chooser KeyChooser
+	if *run_phase {
+		if chooser, err = newKeyChooser(config.Mix.Distribution, b.keys, config.ZipfianConstant,
+			config.HotSetFraction, config.HotOpFraction); err != nil {
+			fatalf("%v", err)
+		}
+	}
+
+	report := &Report{Config: config}
+	if *load_phase {
+		report.Load = b.runLoad()
+		printSummary("load", report.Load)
+	}
+	if *run_phase {
+		report.Run = b.runWorkload(chooser)
+		printSummary("run", report.Run)
+	}
+	if err := writeReport(report); err != nil {
+		fatalf("%v", err)
+	}
+}
+
+//------------------------------------------------------------------------------
+// HELPER METHODS
+//------------------------------------------------------------------------------
+
+// Helper method to print an error and exit.
+func fatalf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "kvbench: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+// Helper method to build and validate the config from the flags.
+func getConfig() (Config, error) {
+	mix, err := getWorkload(*workload_name)
+	if err != nil {
+		return Config{}, err
+	}
+	for _, override := range []struct {
+		flag_value float64
+		proportion *float64
+	}{
+		{*read_proportion, &mix.ReadProportion},
+		{*update_proportion, &mix.UpdateProportion},
+		{*insert_proportion, &mix.InsertProportion},
+		{*scan_proportion, &mix.ScanProportion},
+		{*read_modify_write_proportion, &mix.ReadModifyWriteProportion},
+	} {
+		if override.flag_value >= 0 {
+			*override.proportion = override.flag_value
+		}
+	}
+	if mix.ReadProportion+mix.UpdateProportion+mix.InsertProportion+mix.ScanProportion+
+		mix.ReadModifyWriteProportion <= 0 {
+		return Config{}, fmt.Errorf("the proportions of the operations must not all be 0")
+	}
+	if *distribution != "" {
+		mix.Distribution = *distribution
+	}
+	config := Config{
+		SmartRouting:     *smart_routing,
+		Workload:         strings.ToLower(*workload_name),
+		Mix:              mix,
+		ZipfianConstant:  *zipfian_constant,
+		HotSetFraction:   *hot_set_fraction,
+		HotOpFraction:    *hot_op_fraction,
+		RecordCount:      *record_count,
+		Operations:       *operation_count,
+		DurationMs:       run_duration.Milliseconds(),
+		Concurrency:      *concurrency,
+		MinValueSize:     *value_size,
+		MaxValueSize:     max(*value_size, *max_value_size),
+		MaxScanLength:    *max_scan_length,
+		KeyPrefix:        *key_prefix,
+		RequestTimeoutMs: request_timeout.Milliseconds(),
+	}
+	for _, address := range strings.Split(*server_addresses, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			config.Addresses = append(config.Addresses, address)
+		}
+	}
+	switch {
+	case len(config.Addresses) == 0:
+		return Config{}, fmt.Errorf("-addr must name at least one control manager")
+	case config.RecordCount <= 0:
+		return Config{}, fmt.Errorf("-record_count must be positive")
+	case config.Concurrency <= 0:
+		return Config{}, fmt.Errorf("-concurrency must be positive")
+	case config.ZipfianConstant <= 0 || config.ZipfianConstant >= 1:
+		return Config{}, fmt.Errorf("-zipfian_constant must be in (0, 1)")
+	case config.MaxScanLength <= 0:
+		return Config{}, fmt.Errorf("-max_scan_length must be positive")
+	case *run_phase && config.Operations == 0 && config.DurationMs == 0:
+		return Config{}, fmt.Errorf("one of -operations or -duration must be set")
+	}
+	return config, nil
+}
+
+// Helper method to get a context bounded by the request timeout.
+func (b *benchmark) requestContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(),
+		time.Duration(b.config.RequestTimeoutMs)*time.Millisecond)
+}
+
+// Helper method to print the progress of a phase.
+func printProgress(phase string) func(IntervalReport) {
+	return func(interval IntervalReport) {
+		fmt.Fprintf(os.Stderr, "[%s] %6.1fs: %8.1f ops/sec, %d errors\n", phase,
+			float64(interval.ElapsedMs)/1000, interval.OpsPerSec, interval.Errors)
+	}
+}
+
+// Helper method to print a human readable summary of a phase.
+func printSummary(phase string, report *PhaseReport) {
+	fmt.Fprintf(os.Stderr, "[%s] %d operations in %.1fs, %.1f ops/sec, %d errors\n", phase,
+		report.Operations, float64(report.DurationMs)/1000, report.OpsPerSec, report.Errors)
+	var ops []string
+	for op := range report.ByOperation {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		op_report := report.ByOperation[op]
+		fmt.Fprintf(os.Stderr, "[%s]   %-18s %8d ops  p50 %6dus  p99 %6dus  p999 %6dus  %d errors\n",
+			phase, op, op_report.Operations, op_report.Latency.P50Us, op_report.Latency.P99Us,
+			op_report.Latency.P999Us, op_report.Errors)
+	}
+	var codes []string
+	for code := range report.ErrorsByCode {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		fmt.Fprintf(os.Stderr, "[%s]   %s: %d\n", phase, code, report.ErrorsByCode[code])
+	}
+}
+
+// Helper method to write the JSON report to the output.
+func writeReport(report *Report) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode report: %v", err)
+	}
+	data = append(data, '\n')
+	if *output_path == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	if err := os.WriteFile(*output_path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write report: %v", err)
+	}
+	return nil
+}
+
+//------------------------------------------------------------------------------
+// PHASES
+//------------------------------------------------------------------------------
+
+// Helper method to run concurrency clients until they return, sampling the
+// throughput meanwhile. Client i talks to the control manager
+// i % len(addresses).
+func (b *benchmark) runClients(phase string, run func(kv_client *client.Client,
+	recorder *clientRecorder, rng *rand.Rand)) *PhaseReport {
+	recorder := newRecorder()
+	ctx, cancel := context.WithCancel(context.Background())
+	go recorder.sampleThroughput(ctx, *report_interval, printProgress(phase))
+	var wg sync.WaitGroup
+	for i := 0; i < b.config.Concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(time.Now().UnixNano() + int64(i)))
+			run(b.clients[i%len(b.clients)], recorder.newClient(), rng)
+		}(i)
+	}
+	wg.Wait()
+	cancel()
+	return recorder.report()
+}
+
+// Write the record_count keys of the key space.
+func (b *benchmark) runLoad() *PhaseReport {
+	var next atomic.Int64
+	return b.runClients("load", func(kv_client *client.Client, recorder *clientRecorder,
+		rng *rand.Rand) {
+		for i := next.Add(1) - 1; i < b.config.RecordCount; i = next.Add(1) - 1 {
+			ctx, cancel := b.requestContext()
+			start := time.Now()
+			_, err := kv_client.Put(ctx, b.keys.keyName(i), b.values.next(rng))
+			recorder.record(OpInsert, time.Since(start), err)
+			cancel()
+		}
+	})
+}
+
+// Run the workload until the number of operations or the duration is reached.
+func (b *benchmark) runWorkload(chooser KeyChooser) *PhaseReport {
+	ctx := context.Background()
+	if b.config.DurationMs > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(b.config.DurationMs)*time.Millisecond)
+		defer cancel()
+	}
+	var issued atomic.Int64
+	return b.runClients("run", func(kv_client *client.Client, recorder *clientRecorder,
+		rng *rand.Rand) {
+		for ctx.Err() == nil {
+			if b.config.Operations > 0 && issued.Add(1) > b.config.Operations {
+				return
+			}
+			op := b.config.Mix.nextOp(rng)
+			start := time.Now()
+			err := b.runOperation(kv_client, op, chooser, rng)
+			recorder.record(op, time.Since(start), err)
+		}
+	})
+}
+
+// Helper method to run a single operation.
+func (b *benchmark) runOperation(kv_client *client.Client, op OpType, chooser KeyChooser,
+	rng *rand.Rand) error {
+	ctx, cancel := b.requestContext()
+	defer cancel()
+	switch op {
+	case OpRead:
+		_, err := kv_client.Get(ctx, b.keys.keyName(chooser.Next(rng)))
+		return err
+	case OpUpdate:
+		_, err := kv_client.Put(ctx, b.keys.keyName(chooser.Next(rng)), b.values.next(rng))
+		return err
+	case OpInsert:
+		_, err := kv_client.Put(ctx, b.keys.keyName(b.keys.nextInsert()), b.values.next(rng))
+		return err
+	case OpScan:
+		// Scans start at the chosen key.
+		start_after := ""
+		if i := chooser.Next(rng); i > 0 {
+			start_after = b.keys.keyName(i - 1)
+		}
+		_, _, err := kv_client.Scan(ctx, b.keys.prefix, start_after,
+			1+rng.Intn(b.config.MaxScanLength))
+		return err
+	case OpReadModifyWrite:
+		// The write only applies if the key did not change since the read,
+		// lost races fail with kConditionFailed.
+		key := b.keys.keyName(chooser.Next(rng))
+		value, err := kv_client.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		_, err = kv_client.Put(ctx, key, b.values.next(rng),
+			client.WithIfDbModifiedTs(value.DbModifiedTs))
+		return err
+	}
+	return fmt.Errorf("unknown operation %v", op)
+}
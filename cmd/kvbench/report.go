@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"google.golang.org/grpc/status"
+	"kvstore/client"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+// REPORT
+//------------------------------------------------------------------------------
+
+// Report written at the end of the benchmark.
+type Report struct {
+	Config Config       `json:"config"`
+	Load   *PhaseReport `json:"load,omitempty"`
+	Run    *PhaseReport `json:"run,omitempty"`
+}
+
+// Results of the load or the run phase.
+type PhaseReport struct {
+	DurationMs int64          `json:"duration_ms"`
+	Operations int64          `json:"operations"`
+	Errors     int64          `json:"errors"`
+	OpsPerSec  float64        `json:"ops_per_sec"`
+	Latency    LatencySummary `json:"latency"`
+	// Results by operation type, e.g. READ.
+	ByOperation map[string]*OperationReport `json:"by_operation"`
+	// Number of failed operations by ErrorCode, e.g. kBackendError. Failures
+	// without an ErrorCode are keyed by their gRPC status code.
+	ErrorsByCode map[string]int64 `json:"errors_by_code"`
+	// Throughput of every report interval.
+	Throughput []IntervalReport `json:"throughput"`
+}
+
+// Results of one type of operation.
+type OperationReport struct {
+	Operations int64 `json:"operations"`
+	Errors     int64 `json:"errors"`
+	// Reads of keys which did not exist, not counted as errors.
+	NotFound int64          `json:"not_found,omitempty"`
+	Latency  LatencySummary `json:"latency"`
+}
+
+// Latency percentiles in microseconds, of successful and failed operations.
+type LatencySummary struct {
+	MeanUs int64 `json:"mean_us"`
+	P50Us  int64 `json:"p50_us"`
+	P99Us  int64 `json:"p99_us"`
+	P999Us int64 `json:"p999_us"`
+	MaxUs  int64 `json:"max_us"`
+}
+
+// Operations completed during one report interval.
+type IntervalReport struct {
+	// Time since the start of the phase at the end of the interval.
+	ElapsedMs  int64   `json:"elapsed_ms"`
+	Operations int64   `json:"operations"`
+	Errors     int64   `json:"errors"`
+	OpsPerSec  float64 `json:"ops_per_sec"`
+}
+
+//------------------------------------------------------------------------------
+// RECORDING
+//------------------------------------------------------------------------------
+
+// Records the operations of a phase. Every client records into its own
+// clientRecorder, which are merged once the phase is over.
+type Recorder struct {
+	start time.Time
+	// Running totals sampled for the throughput over time.
+	operations atomic.Int64
+	errors     atomic.Int64
+	lock       sync.Mutex
+	clients    []*clientRecorder
+	intervals  []IntervalReport
+}
+
+// Operations recorded by a single client.
+type clientRecorder struct {
+	recorder       *Recorder
+	latencies      [numOpTypes][]time.Duration
+	errors         [numOpTypes]int64
+	not_found      [numOpTypes]int64
+	errors_by_code map[string]int64
+}
+
+// Helper method to instantiate a recorder for a phase starting now.
+func newRecorder() *Recorder {
+	return &Recorder{start: time.Now()}
+}
+
+// Helper method to create the recorder of a new client.
+func (r *Recorder) newClient() *clientRecorder {
+	c := &clientRecorder{recorder: r, errors_by_code: make(map[string]int64)}
+	r.lock.Lock()
+	r.clients = append(r.clients, c)
+	r.lock.Unlock()
+	return c
+}
+
+// Record an operation which took latency and failed with err, if not nil.
+func (c *clientRecorder) record(op OpType, latency time.Duration, err error) {
+	c.latencies[op] = append(c.latencies[op], latency)
+	c.recorder.operations.Add(1)
+	switch {
+	case err == nil:
+	case client.IsNotFound(err):
+		c.not_found[op]++
+	default:
+		c.errors[op]++
+		c.errors_by_code[errorCodeName(err)]++
+		c.recorder.errors.Add(1)
+	}
+}
+
+// Helper method to name the cause of a failed operation.
+func errorCodeName(err error) string {
+	var kv_error *client.Error
+	if errors.As(err, &kv_error) {
+		return kv_error.Code.String()
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "kDeadlineExceeded"
+	}
+	return "grpc:" + status.Code(err).String()
+}
+
+// Report the throughput every interval until ctx is done. progress is called
+// with every interval.
+func (r *Recorder) sampleThroughput(ctx context.Context, interval time.Duration,
+	progress func(IntervalReport)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last_time := r.start
+	var last_operations, last_errors int64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			operations, error_count := r.operations.Load(), r.errors.Load()
+			report := IntervalReport{
+				ElapsedMs:  now.Sub(r.start).Milliseconds(),
+				Operations: operations - last_operations,
+				Errors:     error_count - last_errors,
+				OpsPerSec:  float64(operations-last_operations) / now.Sub(last_time).Seconds(),
+			}
+			r.lock.Lock()
+			r.intervals = append(r.intervals, report)
+			r.lock.Unlock()
+			progress(report)
+			last_time, last_operations, last_errors = now, operations, error_count
+		}
+	}
+}
+
+// Merge the recorded operations into the report of the phase. Must only be
+// called once all clients are done.
+func (r *Recorder) report() *PhaseReport {
+	elapsed := time.Since(r.start)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	phase := &PhaseReport{
+		DurationMs:   elapsed.Milliseconds(),
+		ByOperation:  make(map[string]*OperationReport),
+		ErrorsByCode: make(map[string]int64),
+		Throughput:   append([]IntervalReport{}, r.intervals...),
+	}
+	var all_latencies []time.Duration
+	for op := OpType(0); op < numOpTypes; op++ {
+		var latencies []time.Duration
+		op_report := &OperationReport{}
+		for _, c := range r.clients {
+			latencies = append(latencies, c.latencies[op]...)
+			op_report.Errors += c.errors[op]
+			op_report.NotFound += c.not_found[op]
+		}
+		if len(latencies) == 0 {
+			continue
+		}
+		op_report.Operations = int64(len(latencies))
+		op_report.Latency = summarizeLatencies(latencies)
+		phase.ByOperation[op.String()] = op_report
+		phase.Operations += op_report.Operations
+		phase.Errors += op_report.Errors
+		all_latencies = append(all_latencies, latencies...)
+	}
+	for _, c := range r.clients {
+		for code, count := range c.errors_by_code {
+			phase.ErrorsByCode[code] += count
+		}
+	}
+	phase.Latency = summarizeLatencies(all_latencies)
+	phase.OpsPerSec = float64(phase.Operations) / elapsed.Seconds()
+	return phase
+}
+
+// Helper method to compute the percentiles of latencies. Sorts latencies.
+func summarizeLatencies(latencies []time.Duration) LatencySummary {
+	if len(latencies) == 0 {
+		return LatencySummary{}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	var total time.Duration
+	for _, latency := range latencies {
+		total += latency
+	}
+	percentile := func(p float64) int64 {
+		return latencies[int(p*float64(len(latencies)-1))].Microseconds()
+	}
+	return LatencySummary{
+		MeanUs: (total / time.Duration(len(latencies))).Microseconds(),
+		P50Us:  percentile(0.5),
+		P99Us:  percentile(0.99),
+		P999Us: percentile(0.999),
+		MaxUs:  percentile(1),
+	}
+}
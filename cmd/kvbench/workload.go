@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+)
+
+//------------------------------------------------------------------------------
+// WORKLOADS
+//------------------------------------------------------------------------------
+
+// Type of an operation of the benchmark.
+type OpType int
+
+const (
+	OpRead OpType = iota
+	OpUpdate
+	OpInsert
+	OpScan
+	OpReadModifyWrite
+	numOpTypes
+)
+
+func (op OpType) String() string {
+	switch op {
+	case OpRead:
+		return "READ"
+	case OpUpdate:
+		return "UPDATE"
+	case OpInsert:
+		return "INSERT"
+	case OpScan:
+		return "SCAN"
+	case OpReadModifyWrite:
+		return "READ_MODIFY_WRITE"
+	}
+	return "UNKNOWN"
+}
+
+// Mix of operations and key distribution of a workload. Proportions need not
+// add up to 1, they are normalized.
+type Workload struct {
+	ReadProportion            float64 `json:"read_proportion"`
+	UpdateProportion          float64 `json:"update_proportion"`
+	InsertProportion          float64 `json:"insert_proportion"`
+	ScanProportion            float64 `json:"scan_proportion"`
+	ReadModifyWriteProportion float64 `json:"read_modify_write_proportion"`
+	Distribution              string  `json:"distribution"`
+}
+
+// Core workloads of YCSB, see
+// https://github.com/brianfrankcooper/YCSB/wiki/Core-Workloads.
+var coreWorkloads = map[string]Workload{
+	// Update heavy, e.g. a session store recording recent actions.
+	"a": {ReadProportion: 0.5, UpdateProportion: 0.5, Distribution: "zipfian"},
+	// Read mostly, e.g. photo tagging.
+	"b": {ReadProportion: 0.95, UpdateProportion: 0.05, Distribution: "zipfian"},
+	// Read only, e.g. a user profile cache.
+	"c": {ReadProportion: 1, Distribution: "zipfian"},
+	// Read latest, e.g. user status updates.
+	"d": {ReadProportion: 0.95, InsertProportion: 0.05, Distribution: "latest"},
+	// Short ranges, e.g. threaded conversations.
+	"e": {ScanProportion: 0.95, InsertProportion: 0.05, Distribution: "zipfian"},
+	// Read-modify-write, e.g. a user database.
+	"f": {ReadProportion: 0.5, ReadModifyWriteProportion: 0.5, Distribution: "zipfian"},
+}
+
+// Helper method to get a core workload by its letter.
+func getWorkload(name string) (Workload, error) {
+	workload, exists := coreWorkloads[strings.ToLower(name)]
+	if !exists {
+		return Workload{}, fmt.Errorf("unknown workload %q, must be one of a to f", name)
+	}
+	return workload, nil
+}
+
+// Helper method to pick the type of the next operation.
+func (w *Workload) nextOp(rng *rand.Rand) OpType {
+	proportions := [numOpTypes]float64{
+		OpRead:            w.ReadProportion,
+		OpUpdate:          w.UpdateProportion,
+		OpInsert:          w.InsertProportion,
+		OpScan:            w.ScanProportion,
+		OpReadModifyWrite: w.ReadModifyWriteProportion,
+	}
+	total := 0.0
+	for _, proportion := range proportions {
+		total += proportion
+	}
+	p := rng.Float64() * total
+	for op, proportion := range proportions {
+		if p < proportion {
+			return OpType(op)
+		}
+		p -= proportion
+	}
+	return OpRead
+}
+
+//------------------------------------------------------------------------------
+// KEY SPACE
+//------------------------------------------------------------------------------
+
+// Keys of the benchmark. The first record_count keys are written by the load
+// phase, inserts append further keys.
+type KeySpace struct {
+	prefix       string
+	record_count int64
+	// Number of keys inserted by the run phase so far.
+	inserted atomic.Int64
+}
+
+// Helper method to get the name of the i-th key. Names are zero padded so
+// that scans visit keys in insertion order.
+func (k *KeySpace) keyName(i int64) string {
+	return fmt.Sprintf("%s%012d", k.prefix, i)
+}
+
+// Helper method to reserve the next key to insert.
+func (k *KeySpace) nextInsert() int64 {
+	return k.record_count + k.inserted.Add(1) - 1
+}
+
+// Number of keys existing so far.
+func (k *KeySpace) count() int64 {
+	return k.record_count + k.inserted.Load()
+}
+
+// Chooses the key of the next operation among the existing keys.
+type KeyChooser interface {
+	Next(rng *rand.Rand) int64
+}
+
+// Helper method to create the key chooser of a distribution.
+func newKeyChooser(distribution string, keys *KeySpace, zipfian_constant float64,
+	hot_set_fraction float64, hot_op_fraction float64) (KeyChooser, error) {
+	switch distribution {
+	case "uniform":
+		return &uniformChooser{keys: keys}, nil
+	case "zipfian":
+		return &scrambledZipfianChooser{
+			keys:    keys,
+			zipfian: newZipfian(keys.record_count, zipfian_constant),
+		}, nil
+	case "latest":
+		return &latestChooser{
+			keys:    keys,
+			zipfian: newZipfian(keys.record_count, zipfian_constant),
+		}, nil
+	case "hotspot":
+		if hot_set_fraction <= 0 || hot_set_fraction > 1 || hot_op_fraction < 0 || hot_op_fraction > 1 {
+			return nil, fmt.Errorf("hot set and hot operation fractions must be in (0, 1]")
+		}
+		return &hotspotChooser{keys: keys, hot_set_fraction: hot_set_fraction,
+			hot_op_fraction: hot_op_fraction}, nil
+	}
+	return nil, fmt.Errorf("unknown distribution %q, must be one of uniform, zipfian, latest or hotspot",
+		distribution)
+}
+
+// Every existing key is equally likely.
+type uniformChooser struct {
+	keys *KeySpace
+}
+
+func (c *uniformChooser) Next(rng *rand.Rand) int64 {
+	return rng.Int63n(c.keys.count())
+}
+
+// A few keys are much more popular than the others. Popular keys are spread
+// over the key space, and thus over the shards, by hashing. Only the loaded
+// keys are chosen.
+type scrambledZipfianChooser struct {
+	keys    *KeySpace
+	zipfian *zipfian
+}
+
+func (c *scrambledZipfianChooser) Next(rng *rand.Rand) int64 {
+	hash := fnv.New64a()
+	var item [8]byte
+	rank := uint64(c.zipfian.next(rng))
+	for i := range item {
+		item[i] = byte(rank >> (8 * i))
+	}
+	hash.Write(item[:])
+	return int64(hash.Sum64() % uint64(c.keys.record_count))
+}
+
+// The most recently inserted keys are the most popular.
+type latestChooser struct {
+	keys    *KeySpace
+	zipfian *zipfian
+}
+
+func (c *latestChooser) Next(rng *rand.Rand) int64 {
+	latest := c.keys.count() - 1
+	return max(latest-c.zipfian.next(rng), 0)
+}
+
+// A fraction of the operations goes to a small hot set of keys at the start
+// of the key space, the rest to the other keys.
+type hotspotChooser struct {
+	keys             *KeySpace
+	hot_set_fraction float64
+	hot_op_fraction  float64
+}
+
+func (c *hotspotChooser) Next(rng *rand.Rand) int64 {
+	count := c.keys.count()
+	hot_count := max(int64(float64(count)*c.hot_set_fraction), 1)
+	if rng.Float64() < c.hot_op_fraction || hot_count == count {
+		return rng.Int63n(hot_count)
+	}
+	return hot_count + rng.Int63n(count-hot_count)
+}
+
+// Zipfian distribution over [0, n) where item 0 is the most popular, using
+// the algorithm of Gray et al., "Quickly generating billion-record synthetic
+// databases", like YCSB. Unlike rand.Zipf it supports constants below 1.
+type zipfian struct {
+	n     int64
+	theta float64
+	alpha float64
+	zetan float64
+	eta   float64
+}
+
+// Helper method to precompute a zipfian distribution. Takes O(n).
+func newZipfian(n int64, theta float64) *zipfian {
+	zetan := 0.0
+	for i := int64(1); i <= n; i++ {
+		zetan += 1 / math.Pow(float64(i), theta)
+	}
+	zeta2 := 1 + 1/math.Pow(2, theta)
+	return &zipfian{
+		n:     n,
+		theta: theta,
+		alpha: 1 / (1 - theta),
+		zetan: zetan,
+		eta:   (1 - math.Pow(2/float64(n), 1-theta)) / (1 - zeta2/zetan),
+	}
+}
+
+func (z *zipfian) next(rng *rand.Rand) int64 {
+	u := rng.Float64()
+	uz := u * z.zetan
+	if uz < 1 {
+		return 0
+	}
+	if uz < 1+math.Pow(0.5, z.theta) {
+		return 1
+	}
+	return min(int64(float64(z.n)*math.Pow(z.eta*u-z.eta+1, z.alpha)), z.n-1)
+}
+
+//------------------------------------------------------------------------------
+// VALUES
+//------------------------------------------------------------------------------
+
+// Generates random values with sizes uniformly distributed in [min_size,
+// max_size]. Values are windows of a shared random buffer, which keeps value
+// generation out of the measured latencies.
+type ValueGenerator struct {
+	min_size int
+	max_size int
+	buffer   string
+}
+
+// Helper method to create a value generator.
+func newValueGenerator(min_size int, max_size int) (*ValueGenerator, error) {
+	if min_size <= 0 || max_size < min_size {
+		return nil, fmt.Errorf("value sizes must satisfy 0 < min <= max, got %d and %d",
+			min_size, max_size)
+	}
+	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	rng := rand.New(rand.NewSource(1))
+	buffer := make([]byte, 2*max_size+4096)
+	for i := range buffer {
+		buffer[i] = letters[rng.Intn(len(letters))]
+	}
+	return &ValueGenerator{min_size: min_size, max_size: max_size, buffer: string(buffer)}, nil
+}
+
+func (g *ValueGenerator) next(rng *rand.Rand) string {
+	size := g.min_size + rng.Intn(g.max_size-g.min_size+1)
+	start := rng.Intn(len(g.buffer) - size + 1)
+	return g.buffer[start : start+size]
+}
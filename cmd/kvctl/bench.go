@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"kvstore/client"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Simple closed loop benchmark: every worker goroutine issues requests back to
+// back against a fixed key space and the latencies are summarized at the end.
+func runBench(c *client.Client, args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	num_ops := fs.Int("n", 1000, "Total number of requests.")
+	concurrency := fs.Int("concurrency", 8, "Number of concurrent requests.")
+	read_ratio := fs.Float64("read_ratio", 0.5, "Fraction of requests which are reads.")
+	num_keys := fs.Int("keys", 1000, "Number of distinct keys.")
+	value_size := fs.Int("value_size", 100, "Size of the written values in bytes.")
+	key_prefix := fs.String("key_prefix", "kvctl-bench-", "Prefix of the benchmark keys.")
+	parseArgs(fs, args, 0, "[-n ops] [-concurrency c] [-read_ratio r] [-keys k] [-value_size s]")
+
+	value := strings.Repeat("x", *value_size)
+	var (
+		result_lock sync.Mutex
+		latencies   []time.Duration
+		num_errors  int
+		wg          sync.WaitGroup
+	)
+	ops := make(chan int)
+	start := time.Now()
+	for ii := 0; ii < *concurrency; ii++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range ops {
+				key := *key_prefix + strconv.Itoa(rand.Intn(*num_keys))
+				ctx, cancel := context.WithTimeout(context.Background(), *request_timeout)
+				op_start := time.Now()
+				var err error
+				if rand.Float64() < *read_ratio {
+					_, err = c.Get(ctx, key)
+					if client.IsNotFound(err) {
+						err = nil
+					}
+				} else {
+					_, err = c.Put(ctx, key, value)
+				}
+				latency := time.Since(op_start)
+				cancel()
+				result_lock.Lock()
+				latencies = append(latencies, latency)
+				if err != nil {
+					num_errors++
+				}
+				result_lock.Unlock()
+			}
+		}()
+	}
+	for ii := 0; ii < *num_ops; ii++ {
+		ops <- ii
+	}
+	close(ops)
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) time.Duration {
+		if len(latencies) == 0 {
+			return 0
+		}
+		return latencies[int(p*float64(len(latencies)-1))]
+	}
+	throughput := float64(len(latencies)) / elapsed.Seconds()
+	printResult(
+		[]string{"OPS", "ERRORS", "ELAPSED", "OPS/SEC", "P50", "P99", "MAX"},
+		[][]string{{
+			strconv.Itoa(len(latencies)),
+			strconv.Itoa(num_errors),
+			elapsed.Round(time.Millisecond).String(),
+			fmt.Sprintf("%.1f", throughput),
+			percentile(0.50).String(),
+			percentile(0.99).String(),
+			percentile(1).String(),
+		}},
+		map[string]any{
+			"ops":            len(latencies),
+			"errors":         num_errors,
+			"elapsed_ms":     elapsed.Milliseconds(),
+			"ops_per_sec":    throughput,
+			"p50_latency_us": percentile(0.50).Microseconds(),
+			"p99_latency_us": percentile(0.99).Microseconds(),
+			"max_latency_us": percentile(1).Microseconds(),
+		})
+}
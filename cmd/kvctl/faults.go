@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	pb "kvstore/protos"
+	"kvstore/worker"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Manage the faults injected into a worker started with fault injection
+// enabled. Talks to the WorkerAdmin service of the worker directly.
+func runFaults(args []string) {
+	if len(args) == 0 {
+		fatalf("usage: kvctl faults <get|set|clear> -worker host:port")
+	}
+	subcommand, args := args[0], args[1:]
+	fs := flag.NewFlagSet("faults "+subcommand, flag.ExitOnError)
+	worker_address := fs.String("worker", "", "Address of the worker, host:port.")
+	var rules []*pb.FaultRule
+	switch subcommand {
+	case "get", "clear":
+		parseArgs(fs, args, 0, "-worker host:port")
+	case "set":
+		rules_json := fs.String("rules", "",
+			`Rules as the JSON of a SetFaultRulesArg, e.g. {"rules": [{"point": "kWriteKvToDisk", "action": "kFaultFail", "probability": 0.5}]}.`)
+		file_path := fs.String("file", "", "File holding the rules, instead of -rules.")
+		parseArgs(fs, args, 0, "-worker host:port (-rules json | -file path)")
+		if *file_path != "" {
+			data, err := os.ReadFile(*file_path)
+			if err != nil {
+				fatalf("failed to read %s: %v", *file_path, err)
+			}
+			*rules_json = string(data)
+		}
+		if *rules_json == "" {
+			fatalf("faults set needs -rules or -file")
+		}
+		var err error
+		if rules, err = worker.ParseFaultRules(*rules_json); err != nil {
+			fatalf("%v", err)
+		}
+	default:
+		fatalf("unknown faults command %q", subcommand)
+	}
+	if *worker_address == "" {
+		fatalf("faults %s needs -worker", subcommand)
+	}
+
+	conn := dialWorker(*worker_address)
+	defer conn.Close()
+	admin_client := pb.NewWorkerAdminClient(conn)
+	ctx, cancel := requestContext()
+	defer cancel()
+
+	if subcommand != "get" {
+		r, err := admin_client.SetFaultRules(ctx, &pb.SetFaultRulesArg{Rules: rules})
+		if err != nil {
+			fatalf("faults %s: %v", subcommand, err)
+		}
+		if !r.GetSuccess() {
+			fatalf("faults %s: %s", subcommand, r.GetErrorDetails())
+		}
+	}
+	r, err := admin_client.GetFaultRules(ctx, &pb.GetFaultRulesArg{})
+	if err != nil {
+		fatalf("faults get: %v", err)
+	}
+	if !r.GetEnabled() {
+		fmt.Fprintf(os.Stderr, "kvctl: fault injection is disabled on %s\n", *worker_address)
+	}
+	var rows [][]string
+	for _, status := range r.GetRules() {
+		rule := status.GetRule()
+		var filters []string
+		if len(rule.GetKeys()) > 0 {
+			filters = append(filters, "keys="+strings.Join(rule.GetKeys(), ","))
+		}
+		if len(rule.GetShards()) > 0 {
+			filters = append(filters, "shards="+strings.Join(rule.GetShards(), ","))
+		}
+		if len(rule.GetMethods()) > 0 {
+			filters = append(filters, "methods="+strings.Join(rule.GetMethods(), ","))
+		}
+		rows = append(rows, []string{
+			rule.GetPoint().String(),
+			rule.GetAction().String(),
+			strconv.FormatFloat(rule.GetProbability(), 'g', -1, 64),
+			strconv.FormatInt(rule.GetDelayMs(), 10),
+			strings.Join(filters, " "),
+			strconv.FormatInt(status.GetInjectedFaults(), 10),
+		})
+	}
+	printResult([]string{"POINT", "ACTION", "PROBABILITY", "DELAY_MS", "FILTERS", "INJECTED"},
+		rows, r)
+}
@@ -0,0 +1,516 @@
+// kvctl is the command line interface for operating a kvstore cluster. It
+// talks to the control manager's KvStoreInterface and KvAdmin services, and to
+// the WorkerAdmin service of the workers to inspect them and inject faults.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"kvstore/client"
+	pb "kvstore/protos"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Define global flags shared by all the subcommands.
+var (
+	server_address = flag.String("addr", "localhost:50052",
+		"Address of the control manager, host:port.")
+	output_format = flag.String("output", "table",
+		"Output format, one of table or json.")
+	request_timeout = flag.Duration("timeout", 10*time.Second,
+		"Timeout of every request sent to the cluster.")
+	smart_routing = flag.Bool("smart", false,
+		"Send requests directly to the workers. Only works inside the cluster.")
+)
+
+const usage = `Usage: kvctl [flags] <command> [args]
+
+Commands:
+  get <key>                     Get the value of a key.
+  put <key> <value>             Put the value of a key.
+  delete <key>                  Delete a key.
+  scan                          List keys and values in key order.
+  watch [key]                   Print changes to a key or prefix as they happen.
+  bench                         Run a simple read/write benchmark.
+  cluster status                Show the leader and the workers known to the control manager.
+  shard map                     Show the worker owning every shard.
+  shard list                    Show the keys, bytes and oracle timestamp of every shard.
+  worker status                 Show the shards and disk usage of a worker.
+  export                        Write keys and values as JSON lines.
+  import                        Put keys and values read from JSON lines.
+  faults get|set|clear          Manage the faults injected into a worker.
+
+Run kvctl <command> -h for the flags of a command.
+
+Flags:
+`
+
+// Entry of the JSON lines format used by import and export.
+type jsonLine struct {
+	Key          string `json:"key"`
+	Value        string `json:"value"`
+	DbModifiedTs int64  `json:"db_modified_ts,omitempty"`
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *output_format != "table" && *output_format != "json" {
+		fatalf("unknown output format %q", *output_format)
+	}
+	var opts []client.Option
+	if *smart_routing {
+		opts = append(opts, client.WithSmartRouting())
+	}
+	c, err := client.New(*server_address, opts...)
+	if err != nil {
+		fatalf("failed to connect to %s: %v", *server_address, err)
+	}
+	defer c.Close()
+
+	command, args := flag.Arg(0), flag.Args()[1:]
+	switch command {
+	case "get":
+		runGet(c, args)
+	case "put":
+		runPut(c, args)
+	case "delete":
+		runDelete(c, args)
+	case "scan":
+		runScan(c, args)
+	case "watch":
+		runWatch(c, args)
+	case "bench":
+		runBench(c, args)
+	case "cluster":
+		expectSubcommand(command, args, "status")
+		runClusterStatus(c)
+	case "shard":
+		if len(args) == 1 && args[0] == "list" {
+			runListShards(c)
+		} else {
+			expectSubcommand(command, args, "map")
+			runShardMap(c)
+		}
+	case "worker":
+		runWorker(args)
+	case "export":
+		runExport(c, args)
+	case "import":
+		runImport(c, args)
+	case "faults":
+		runFaults(args)
+	default:
+		fatalf("unknown command %q", command)
+	}
+}
+
+//------------------------------------------------------------------------------
+// HELPER METHODS
+//------------------------------------------------------------------------------
+
+// Helper method to print an error and exit.
+func fatalf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "kvctl: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+// Helper method to get a context bounded by the request timeout.
+func requestContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), *request_timeout)
+}
+
+// Helper method to parse the flags of a subcommand and check the number of
+// positional arguments.
+func parseArgs(fs *flag.FlagSet, args []string, num_args int, arg_usage string) []string {
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: kvctl %s %s\n", fs.Name(), arg_usage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if num_args >= 0 && fs.NArg() != num_args {
+		fs.Usage()
+		os.Exit(2)
+	}
+	return fs.Args()
+}
+
+// Helper method to check the second word of two word commands.
+func expectSubcommand(command string, args []string, subcommand string) {
+	if len(args) != 1 || args[0] != subcommand {
+		fatalf("usage: kvctl %s %s", command, subcommand)
+	}
+}
+
+// Helper method to print a result either as a table or as JSON.
+func printResult(headers []string, rows [][]string, json_value any) {
+	if *output_format == "json" {
+		if message, ok := json_value.(proto.Message); ok {
+			data, err := protojson.MarshalOptions{Multiline: true}.Marshal(message)
+			if err != nil {
+				fatalf("failed to encode output: %v", err)
+			}
+			fmt.Println(string(data))
+			return
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(json_value); err != nil {
+			fatalf("failed to encode output: %v", err)
+		}
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(headers, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	w.Flush()
+}
+
+// Helper method to format a db_modified_ts for humans.
+func formatTs(ts int64) string {
+	return time.Unix(ts, 0).UTC().Format(time.RFC3339)
+}
+
+// Helper method to format the oracle timestamp of a shard, which is 0 if the
+// shard was never written.
+func formatOracleTs(oracle_ts int64) string {
+	if oracle_ts == 0 {
+		return "-"
+	}
+	return formatTs(oracle_ts)
+}
+
+//------------------------------------------------------------------------------
+// KEY VALUE COMMANDS
+//------------------------------------------------------------------------------
+
+func runGet(c *client.Client, args []string) {
+	args = parseArgs(flag.NewFlagSet("get", flag.ExitOnError), args, 1, "<key>")
+	ctx, cancel := requestContext()
+	defer cancel()
+	value, err := c.Get(ctx, args[0])
+	if err != nil {
+		fatalf("get %s: %v", args[0], err)
+	}
+	printResult([]string{"KEY", "VALUE", "DB_MODIFIED_TS"},
+		[][]string{{args[0], value.Value, formatTs(value.DbModifiedTs)}},
+		jsonLine{Key: args[0], Value: value.Value, DbModifiedTs: value.DbModifiedTs})
+}
+
+func runPut(c *client.Client, args []string) {
+	fs := flag.NewFlagSet("put", flag.ExitOnError)
+	request_id := fs.String("request_id", "",
+		"Idempotency key. Retrying with the same request id applies the write once.")
+	args = parseArgs(fs, args, 2, "[-request_id id] <key> <value>")
+	ctx, cancel := requestContext()
+	defer cancel()
+	ts, err := c.Put(ctx, args[0], args[1], client.WithRequestId(*request_id))
+	if err != nil {
+		fatalf("put %s: %v", args[0], err)
+	}
+	printResult([]string{"KEY", "DB_MODIFIED_TS"},
+		[][]string{{args[0], formatTs(ts)}},
+		jsonLine{Key: args[0], Value: args[1], DbModifiedTs: ts})
+}
+
+func runDelete(c *client.Client, args []string) {
+	args = parseArgs(flag.NewFlagSet("delete", flag.ExitOnError), args, 1, "<key>")
+	ctx, cancel := requestContext()
+	defer cancel()
+	if err := c.Delete(ctx, args[0]); err != nil {
+		fatalf("delete %s: %v", args[0], err)
+	}
+	printResult([]string{"KEY", "DELETED"}, [][]string{{args[0], "true"}},
+		map[string]any{"key": args[0], "deleted": true})
+}
+
+// Helper method to scan all the keys with a prefix, calling fn for every page.
+func scanAll(c *client.Client, prefix string, fn func(entries []*pb.KeyValue)) error {
+	start_after := ""
+	for {
+		ctx, cancel := requestContext()
+		entries, has_more, err := c.Scan(ctx, prefix, start_after, 0)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("scan %q: %w", prefix, err)
+		}
+		fn(entries)
+		if !has_more || len(entries) == 0 {
+			return nil
+		}
+		start_after = entries[len(entries)-1].GetKey()
+	}
+}
+
+func runScan(c *client.Client, args []string) {
+	fs := flag.NewFlagSet("scan", flag.ExitOnError)
+	prefix := fs.String("prefix", "", "Only list keys starting with this prefix.")
+	start_after := fs.String("start_after", "", "Only list keys sorting after this key.")
+	limit := fs.Int("limit", 100, "Maximum number of keys to list.")
+	parseArgs(fs, args, 0, "[-prefix p] [-start_after k] [-limit n]")
+	ctx, cancel := requestContext()
+	defer cancel()
+	entries, has_more, err := c.Scan(ctx, *prefix, *start_after, *limit)
+	if err != nil {
+		fatalf("scan %q: %v", *prefix, err)
+	}
+	rows := make([][]string, 0, len(entries))
+	lines := make([]jsonLine, 0, len(entries))
+	for _, entry := range entries {
+		rows = append(rows, []string{entry.GetKey(), entry.GetValue(),
+			formatTs(entry.GetDbModifiedTs())})
+		lines = append(lines, jsonLine{entry.GetKey(), entry.GetValue(), entry.GetDbModifiedTs()})
+	}
+	printResult([]string{"KEY", "VALUE", "DB_MODIFIED_TS"}, rows,
+		map[string]any{"entries": lines, "has_more": has_more})
+	if has_more && *output_format == "table" {
+		fmt.Fprintf(os.Stderr, "more keys match, continue with -start_after %q\n",
+			entries[len(entries)-1].GetKey())
+	}
+}
+
+// The store has no change feed, so watch polls the key or prefix and prints
+// every key whose db_modified_ts changed since the previous poll.
+func runWatch(c *client.Client, args []string) {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	prefix := fs.String("prefix", "", "Watch all the keys starting with this prefix.")
+	interval := fs.Duration("interval", time.Second, "Polling interval.")
+	args = parseArgs(fs, args, -1, "[-interval d] (-prefix p | <key>)")
+	if len(args) > 1 || (len(args) == 1) == (*prefix != "") {
+		fs.Usage()
+		os.Exit(2)
+	}
+	poll := func() map[string]*pb.KeyValue {
+		current := make(map[string]*pb.KeyValue)
+		if len(args) == 1 {
+			ctx, cancel := requestContext()
+			defer cancel()
+			value, err := c.Get(ctx, args[0])
+			if err != nil && !client.IsNotFound(err) {
+				fatalf("get %s: %v", args[0], err)
+			}
+			if err == nil {
+				current[args[0]] = &pb.KeyValue{Key: args[0], Value: value.Value,
+					DbModifiedTs: value.DbModifiedTs}
+			}
+			return current
+		}
+		err := scanAll(c, *prefix, func(entries []*pb.KeyValue) {
+			for _, entry := range entries {
+				current[entry.GetKey()] = entry
+			}
+		})
+		if err != nil {
+			fatalf("watch: %v", err)
+		}
+		return current
+	}
+	print_event := func(event string, key string, value string, ts int64) {
+		if *output_format == "json" {
+			json.NewEncoder(os.Stdout).Encode(map[string]any{
+				"event": event, "key": key, "value": value, "db_modified_ts": ts})
+			return
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\n", formatTs(ts), event, key, value)
+	}
+	previous := poll()
+	for {
+		time.Sleep(*interval)
+		current := poll()
+		for key, entry := range current {
+			old, exists := previous[key]
+			if !exists {
+				print_event("PUT", key, entry.GetValue(), entry.GetDbModifiedTs())
+			} else if old.GetDbModifiedTs() != entry.GetDbModifiedTs() {
+				print_event("UPDATE", key, entry.GetValue(), entry.GetDbModifiedTs())
+			}
+		}
+		for key, entry := range previous {
+			if _, exists := current[key]; !exists {
+				print_event("DELETE", key, "", entry.GetDbModifiedTs())
+			}
+		}
+		previous = current
+	}
+}
+
+//------------------------------------------------------------------------------
+// CLUSTER COMMANDS
+//------------------------------------------------------------------------------
+
+func runClusterStatus(c *client.Client) {
+	ctx, cancel := requestContext()
+	defer cancel()
+	r, err := c.GetClusterStatus(ctx)
+	if err != nil {
+		fatalf("cluster status: %v", err)
+	}
+	if *output_format != "json" {
+		identity := r.GetClusterIdentity()
+		fmt.Printf("Cluster %s: %d shards placed with %s\n", identity.GetClusterId(),
+			identity.GetNumShards(), identity.GetPartitioner())
+		fmt.Printf("Control manager %s (leader: %t), leader at %s, elected at revision %d\n\n",
+			r.GetControlManagerName(), r.GetIsLeader(), r.GetLeaderAddress(),
+			r.GetElectionRevision())
+	}
+	var rows [][]string
+	for _, worker := range r.GetWorkers() {
+		rows = append(rows, []string{
+			worker.GetWorkerName(),
+			worker.GetAddress(),
+			worker.GetState().String(),
+			worker.GetConnectionState().String(),
+			worker.GetBreakerState().String(),
+			strconv.Itoa(int(worker.GetConsecutiveFailures())),
+			strings.Join(worker.GetOwnedShards(), ","),
+		})
+	}
+	printResult([]string{"WORKER", "ADDRESS", "STATE", "CONNECTION", "BREAKER", "FAILURES",
+		"SHARDS"}, rows, r)
+}
+
+func runShardMap(c *client.Client) {
+	ctx, cancel := requestContext()
+	defer cancel()
+	r, err := c.GetShardMap(ctx)
+	if err != nil {
+		fatalf("shard map: %v", err)
+	}
+	var rows [][]string
+	for _, shard := range r.GetShards() {
+		rows = append(rows, []string{shard.GetShardId(), shard.GetWorkerName(),
+			shard.GetAddress()})
+	}
+	printResult([]string{"SHARD", "WORKER", "ADDRESS"}, rows, r)
+}
+
+func runListShards(c *client.Client) {
+	ctx, cancel := requestContext()
+	defer cancel()
+	r, err := c.ListShards(ctx)
+	if err != nil {
+		fatalf("shard list: %v", err)
+	}
+	var rows [][]string
+	for _, shard := range r.GetShards() {
+		rows = append(rows, []string{shard.GetShardId(), shard.GetWorkerName(),
+			strconv.FormatInt(shard.GetKeyCount(), 10), strconv.FormatInt(shard.GetBytes(), 10),
+			formatOracleTs(shard.GetOracleTs()), shard.GetErrorDetails()})
+	}
+	printResult([]string{"SHARD", "WORKER", "KEYS", "BYTES", "ORACLE_TS", "ERROR"}, rows, r)
+}
+
+//------------------------------------------------------------------------------
+// IMPORT AND EXPORT
+//------------------------------------------------------------------------------
+
+func runExport(c *client.Client, args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	prefix := fs.String("prefix", "", "Only export keys starting with this prefix.")
+	file_path := fs.String("file", "", "File to write to. Defaults to stdout.")
+	parseArgs(fs, args, 0, "[-prefix p] [-file path]")
+	var out io.Writer = os.Stdout
+	if *file_path != "" {
+		file, err := os.Create(*file_path)
+		if err != nil {
+			fatalf("export: %v", err)
+		}
+		defer file.Close()
+		out = file
+	}
+	count, err := exportKeys(c, *prefix, out)
+	if err != nil {
+		fatalf("export: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "exported %d keys\n", count)
+}
+
+// Helper method to write the keys starting with prefix to out as JSON lines,
+// in key order. Returns the number of keys written.
+func exportKeys(c *client.Client, prefix string, out io.Writer) (int, error) {
+	writer := bufio.NewWriter(out)
+	encoder := json.NewEncoder(writer)
+	count := 0
+	var write_err error
+	err := scanAll(c, prefix, func(entries []*pb.KeyValue) {
+		for _, entry := range entries {
+			if write_err != nil {
+				return
+			}
+			write_err = encoder.Encode(
+				jsonLine{entry.GetKey(), entry.GetValue(), entry.GetDbModifiedTs()})
+			count++
+		}
+	})
+	if err != nil {
+		return count, err
+	}
+	if write_err != nil {
+		return count, write_err
+	}
+	return count, writer.Flush()
+}
+
+func runImport(c *client.Client, args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	file_path := fs.String("file", "", "File to read from. Defaults to stdin.")
+	parseArgs(fs, args, 0, "[-file path]")
+	var in io.Reader = os.Stdin
+	if *file_path != "" {
+		file, err := os.Open(*file_path)
+		if err != nil {
+			fatalf("import: %v", err)
+		}
+		defer file.Close()
+		in = file
+	}
+	count, err := importKeys(c, in)
+	if err != nil {
+		fatalf("import: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "imported %d keys\n", count)
+}
+
+// Helper method to put the keys and values read from in as JSON lines,
+// skipping blank lines. Returns the number of keys put before any error.
+func importKeys(c *client.Client, in io.Reader) (int, error) {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	count := 0
+	for line_num := 1; scanner.Scan(); line_num++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var line jsonLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return count, fmt.Errorf("line %d: %w", line_num, err)
+		}
+		ctx, cancel := requestContext()
+		_, err := c.Put(ctx, line.Key, line.Value)
+		cancel()
+		if err != nil {
+			return count, fmt.Errorf("line %d: put %s: %w", line_num, line.Key, err)
+		}
+		count++
+	}
+	return count, scanner.Err()
+}
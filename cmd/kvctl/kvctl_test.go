@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"kvstore/harness"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportImportRoundTrip(t *testing.T) {
+	c := harness.Start(t, harness.DefaultConfig())
+	c.WaitForLeader(-1)
+	kv_client := c.Client(0)
+
+	// More keys than a scan page, with values that need escaping.
+	want := make(map[string]string)
+	for i := 0; i < 250; i++ {
+		want[fmt.Sprintf("export-%03d", i)] = fmt.Sprintf("value %d", i)
+	}
+	want["export-newline"] = "first line\nsecond line\r\n"
+	want["export-quotes"] = `"quoted" \ backslash`
+	want["export-unicode"] = "héllo wörld ✓"
+	for key, value := range want {
+		ctx, cancel := harness.RequestContext(10 * time.Second)
+		_, err := kv_client.Put(ctx, key, value)
+		cancel()
+		if err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+	}
+	ctx, cancel := harness.RequestContext(10 * time.Second)
+	_, err := kv_client.Put(ctx, "other-key", "not exported")
+	cancel()
+	if err != nil {
+		t.Fatalf("put other-key: %v", err)
+	}
+
+	var exported bytes.Buffer
+	count, err := exportKeys(kv_client, "export-", &exported)
+	if err != nil || count != len(want) {
+		t.Fatalf("exportKeys = %d, %v, want %d keys", count, err, len(want))
+	}
+	lines := strings.Split(strings.TrimSuffix(exported.String(), "\n"), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("export has %d lines, want %d", len(lines), len(want))
+	}
+	previous_key := ""
+	for _, text := range lines {
+		var line jsonLine
+		if err := json.Unmarshal([]byte(text), &line); err != nil {
+			t.Fatalf("export line %q: %v", text, err)
+		}
+		if line.Key <= previous_key {
+			t.Fatalf("export key %q follows %q, want key order", line.Key, previous_key)
+		}
+		previous_key = line.Key
+		if value, exists := want[line.Key]; !exists || value != line.Value {
+			t.Fatalf("export line %q, want value %q", text, value)
+		}
+		if line.DbModifiedTs == 0 {
+			t.Fatalf("export line %q has no db_modified_ts", text)
+		}
+	}
+
+	// Import the keys back after deleting them.
+	for key := range want {
+		ctx, cancel := harness.RequestContext(10 * time.Second)
+		err := kv_client.Delete(ctx, key)
+		cancel()
+		if err != nil {
+			t.Fatalf("delete %s: %v", key, err)
+		}
+	}
+	count, err = importKeys(kv_client, strings.NewReader("\n"+exported.String()+"\n\n"))
+	if err != nil || count != len(want) {
+		t.Fatalf("importKeys = %d, %v, want %d keys", count, err, len(want))
+	}
+	for key, value := range want {
+		ctx, cancel := harness.RequestContext(10 * time.Second)
+		got, err := kv_client.Get(ctx, key)
+		cancel()
+		if err != nil || got.Value != value {
+			t.Fatalf("get %s after import = %v, %v, want %q", key, got, err, value)
+		}
+	}
+}
+
+func TestImportReportsMalformedLine(t *testing.T) {
+	c := harness.Start(t, harness.DefaultConfig())
+	c.WaitForLeader(-1)
+	kv_client := c.Client(0)
+
+	in := `{"key": "import-1", "value": "1"}` + "\n\n" + `{"key": "import-2", "value": 2}` +
+		"\n" + `{"key": "import-3", "value": "3"}` + "\n"
+	count, err := importKeys(kv_client, strings.NewReader(in))
+	if err == nil || !strings.Contains(err.Error(), "line 3") || count != 1 {
+		t.Fatalf("importKeys = %d, %v, want 1 key and an error for line 3", count, err)
+	}
+	ctx, cancel := harness.RequestContext(10 * time.Second)
+	defer cancel()
+	if _, err := kv_client.Get(ctx, "import-3"); err == nil {
+		t.Fatalf("import-3 was put after the malformed line")
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	pb "kvstore/protos"
+	"sort"
+	"strconv"
+)
+
+// Helper method to connect to the WorkerAdmin service of a worker.
+func dialWorker(worker_address string) *grpc.ClientConn {
+	conn, err := grpc.NewClient(worker_address,
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		fatalf("failed to connect to %s: %v", worker_address, err)
+	}
+	return conn
+}
+
+// Show the state of a worker. Talks to the WorkerAdmin service of the worker
+// directly.
+func runWorker(args []string) {
+	if len(args) == 0 || args[0] != "status" {
+		fatalf("usage: kvctl worker status -worker host:port")
+	}
+	fs := flag.NewFlagSet("worker status", flag.ExitOnError)
+	worker_address := fs.String("worker", "", "Address of the worker, host:port.")
+	parseArgs(fs, args[1:], 0, "-worker host:port")
+	if *worker_address == "" {
+		fatalf("worker status needs -worker")
+	}
+
+	conn := dialWorker(*worker_address)
+	defer conn.Close()
+	ctx, cancel := requestContext()
+	defer cancel()
+	r, err := pb.NewWorkerAdminClient(conn).GetWorkerStatus(ctx, &pb.GetWorkerStatusArg{})
+	if err != nil {
+		fatalf("worker status: %v", err)
+	}
+	if !r.GetSuccess() {
+		fatalf("worker status: %s", r.GetErrorDetails())
+	}
+	if *output_format != "json" {
+		disk_usage := r.GetDiskUsage()
+		fmt.Printf("Worker %s uses %d bytes, %d of %d bytes available on disk\n\n",
+			r.GetWorkerName(), disk_usage.GetUsedBytes(), disk_usage.GetAvailableBytes(),
+			disk_usage.GetTotalBytes())
+	}
+	// Shards found in the oracle timestamp map but no longer owned, e.g.
+	// after the cluster was resized, are listed as well.
+	owned_shards := make(map[string]bool)
+	var rows [][]string
+	for _, shard := range r.GetShards() {
+		owned_shards[shard.GetShardId()] = true
+		rows = append(rows, []string{shard.GetShardId(),
+			strconv.FormatInt(shard.GetKeyCount(), 10), strconv.FormatInt(shard.GetBytes(), 10),
+			formatOracleTs(shard.GetOracleTs())})
+	}
+	var other_shards []string
+	for shard_id := range r.GetOracleTimestamps() {
+		if !owned_shards[shard_id] {
+			other_shards = append(other_shards, shard_id)
+		}
+	}
+	sort.Strings(other_shards)
+	for _, shard_id := range other_shards {
+		rows = append(rows, []string{shard_id + " (not owned)", "-", "-",
+			formatOracleTs(r.GetOracleTimestamps()[shard_id])})
+	}
+	printResult([]string{"SHARD", "KEYS", "BYTES", "ORACLE_TS"}, rows, r)
+}
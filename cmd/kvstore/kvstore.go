@@ -0,0 +1,155 @@
+// kvstore runs kvstore clusters outside of kubernetes. The local command
+// starts an embedded etcd, the control managers and the workers in a single
+// process on localhost, which is handy for development and demos.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"kvstore/local"
+	"kvstore/logging"
+	"kvstore/tracing"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const usage = `Usage: kvstore [flags] <command> [args]
+
+Commands:
+  local                         Run a cluster in this process on localhost.
+
+Run kvstore <command> -h for the flags of a command.
+
+Flags:
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	command, args := flag.Arg(0), flag.Args()[1:]
+	switch command {
+	case "local":
+		runLocal(args)
+	default:
+		fatalf("unknown command %q", command)
+	}
+}
+
+// Helper method to print an error and exit.
+func fatalf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "kvstore: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+func runLocal(args []string) {
+	config := local.DefaultClusterConfig()
+	fs := flag.NewFlagSet("local", flag.ExitOnError)
+	fs.IntVar(&config.NumWorkers, "workers", config.NumWorkers, "Number of workers.")
+	fs.IntVar(&config.NumControlManagers, "control_managers", config.NumControlManagers,
+		"Number of control managers. All but the leader forward requests to it.")
+	fs.IntVar(&config.NumShards, "shards", config.NumShards, "Total number of shards.")
+	fs.StringVar(&config.DataDir, "data_dir", "",
+		"Directory holding the etcd data and the worker mounts. Data is kept "+
+			"across runs if set, otherwise a temporary directory is used.")
+	fs.IntVar(&config.GrpcServerPort, "grpc_port", 50052,
+		"gRPC port of the first control manager. Further control managers use the next ports.")
+	fs.IntVar(&config.HttpGatewayPort, "http_port", 8080,
+		"HTTP/JSON gateway port of the first control manager. Disabled if 0.")
+	fs.IntVar(&config.RedisPort, "redis_port", 6379,
+		"Redis front end port of the first control manager. Disabled if 0.")
+	fs.IntVar(&config.MetricsPort, "metrics_port", 0,
+		"Prometheus metrics port of the first control manager. Further control managers "+
+			"and then the workers use the next ports. Disabled if 0.")
+	fs.StringVar(&config.Tracing.Exporter, "trace_exporter", "none",
+		"Exporter of the OpenTelemetry traces of every node: none, otlp, stdout or file.")
+	fs.StringVar(&config.Tracing.OtlpEndpoint, "trace_otlp_endpoint", "",
+		"host:port of the OTLP/gRPC collector. Defaults to $OTEL_EXPORTER_OTLP_ENDPOINT, "+
+			"or localhost:4317.")
+	fs.StringVar(&config.Tracing.FilePath, "trace_file", "kvstore-traces.json",
+		"File the traces of all nodes are appended to by the file exporter.")
+	var log_config logging.Config
+	fs.StringVar(&log_config.Level, "log_level", "info",
+		"Minimum level of the logs of all nodes: debug, info, warn or error.")
+	fs.StringVar(&log_config.ComponentLevels, "log_component_levels", "",
+		"Levels of components overriding -log_level, e.g. worker=debug,election=warn.")
+	fs.StringVar(&log_config.Format, "log_format", "text", "Format of the logs: text or json.")
+	fs.BoolVar(&log_config.LogValues, "log_values", false,
+		"Log the values of the keys in full at debug level instead of redacting them.")
+	fs.BoolVar(&config.EnableFaultInjection, "fault_injection", false,
+		"Allow injecting faults into the workers, e.g. with kvctl faults.")
+	fs.DurationVar(&config.ShutdownTimeout, "shutdown_timeout", config.ShutdownTimeout,
+		"Time given to the requests being served to finish when the cluster stops.")
+	ready_timeout := fs.Duration("ready_timeout", 30*time.Second,
+		"Time to wait for a leader and a complete shard map.")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: kvstore local [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err := logging.Configure(log_config); err != nil {
+		fatalf("%v", err)
+	}
+
+	cluster := local.NewCluster(config)
+	if err := cluster.Start(); err != nil {
+		fatalf("failed to start local cluster: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *ready_timeout)
+	err := cluster.WaitUntilReady(ctx)
+	cancel()
+	if err != nil {
+		cluster.Stop()
+		fatalf("%v", err)
+	}
+	fmt.Printf("Local kvstore cluster ready.\n")
+	fmt.Printf("  gRPC:  %s\n", strings.Join(cluster.Addresses(), ", "))
+	if config.HttpGatewayPort != 0 {
+		fmt.Printf("  HTTP:  http://%s:%d/v1/keys\n", "127.0.0.1", config.HttpGatewayPort)
+	}
+	if config.RedisPort != 0 {
+		fmt.Printf("  Redis: %s:%d\n", "127.0.0.1", config.RedisPort)
+	}
+	fmt.Printf("  etcd:  %s\n", strings.Join(cluster.EtcdEndpoints(), ", "))
+	if config.MetricsPort != 0 {
+		var metrics_urls []string
+		for _, cm := range cluster.ControlManagers {
+			metrics_urls = append(metrics_urls, "http://"+cm.MetricsAddress()+"/metrics")
+		}
+		for _, w := range cluster.Workers {
+			metrics_urls = append(metrics_urls, "http://"+w.MetricsAddress()+"/metrics")
+		}
+		fmt.Printf("  Metrics: %s\n", strings.Join(metrics_urls, ", "))
+	}
+	if config.Tracing.Exporter == tracing.ExporterFile {
+		fmt.Printf("  Traces: %s\n", config.Tracing.FilePath)
+	}
+	if config.EnableFaultInjection {
+		var worker_addresses []string
+		for _, w := range cluster.Workers {
+			worker_addresses = append(worker_addresses, w.Address())
+		}
+		fmt.Printf("  Fault injection enabled on workers: %s\n", strings.Join(worker_addresses, ", "))
+	}
+	fmt.Printf("Press Ctrl-C to stop.\n")
+
+	sig_chan := make(chan os.Signal, 1)
+	signal.Notify(sig_chan, syscall.SIGTERM, syscall.SIGINT)
+	<-sig_chan
+	fmt.Printf("Stopping local kvstore cluster.\n")
+	cluster.Stop()
+}
@@ -0,0 +1,329 @@
+// Package config holds the configuration of the control manager and the
+// worker, read from a YAML or JSON file which both binaries can share. The
+// binaries map it onto the configs of the controlmanager and worker packages,
+// which do not depend on it.
+//
+// Settings are taken, by increasing precedence, from their defaults, the
+// file, the environment and the command line flags. Every flag can also be
+// set through the environment variable named after it in upper case, e.g.
+// KV_NUM_SHARDS for --kv_num_shards, and the pod settings come from the
+// variables set in the pod spec, e.g. POD_NAME and MOUNT_PATH. The file is
+// checked for changes while the binary runs: the reloadable settings, i.e.
+// the timeouts, the retry policy, the circuit breaker and the logging, are
+// applied right away and the others on the next restart.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/encoding/protojson"
+	"kvstore/logging"
+	pb "kvstore/protos"
+	"kvstore/tracing"
+	"sigs.k8s.io/yaml"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Binary a config is loaded for. Settings of the other binary are ignored.
+type Component string
+
+const (
+	ComponentControlManager Component = "control_manager"
+	ComponentWorker         Component = "worker"
+)
+
+// Duration written as a string such as "30s" or "1m30s".
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var duration_str string
+	if err := json.Unmarshal(data, &duration_str); err != nil {
+		return fmt.Errorf("invalid duration %s, must be a string such as \"30s\"", data)
+	}
+	duration, err := time.ParseDuration(duration_str)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q, must be a string such as \"30s\"", duration_str)
+	}
+	d.Duration = duration
+	return nil
+}
+
+// Identity of the pod, usually set by kubernetes through the environment.
+type Pod struct {
+	Name string `json:"name"`
+	// Address at which the other nodes reach the pod.
+	Ip        string `json:"ip"`
+	Namespace string `json:"namespace"`
+}
+
+// Layout of the cluster, which all the nodes must agree on.
+type Cluster struct {
+	NumShards     int `json:"num_shards"`
+	NumWorkerPods int `json:"num_worker_pods"`
+}
+
+// etcd settings, used for the leader election and the worker membership.
+type Etcd struct {
+	// Defaults to the etcd service of the pod namespace.
+	Endpoints []string `json:"endpoints"`
+	// Prefix of the keys of the leader election.
+	ElectionPrefix string `json:"election_prefix"`
+	// TTL of the etcd session backing control manager leadership.
+	ElectionSessionTtlSecs int `json:"election_session_ttl_secs"`
+	// TTL of the etcd lease backing a worker registration.
+	WorkerLeaseTtlSecs int64 `json:"worker_lease_ttl_secs"`
+}
+
+// Retry policy of the idempotent worker RPCs. Reloadable.
+type Retry struct {
+	MaxAttempts    int      `json:"max_attempts"`
+	InitialBackoff Duration `json:"initial_backoff"`
+	MaxBackoff     Duration `json:"max_backoff"`
+}
+
+// Circuit breaker policy of the worker RPCs. Reloadable.
+type Breaker struct {
+	FailureThreshold int      `json:"failure_threshold"`
+	OpenDuration     Duration `json:"open_duration"`
+}
+
+// Settings of the control manager.
+type ControlManager struct {
+	GrpcPort int `json:"grpc_port"`
+	// Ports of the HTTP/JSON gateway and of the Redis front end, disabled if
+	// 0.
+	HttpGatewayPort int  `json:"http_gateway_port"`
+	RedisPort       int  `json:"redis_port"`
+	ForwardToLeader bool `json:"forward_to_leader"`
+	// Upper bound on a single worker RPC attempt, and on the attempts
+	// together. Reloadable.
+	WorkerRpcTimeout      Duration `json:"worker_rpc_timeout"`
+	WorkerRpcTotalTimeout Duration `json:"worker_rpc_total_timeout"`
+	Retry                 Retry    `json:"retry"`
+	Breaker               Breaker  `json:"breaker"`
+}
+
+// Settings of the worker.
+type Worker struct {
+	GrpcPort       int `json:"grpc_port"`
+	DedupTableSize int `json:"dedup_table_size"`
+	// Directories holding the keys, the oracle timestamps and the dedup
+	// tables of the shards.
+	MountPath           string `json:"mount_path"`
+	OracleTimestampPath string `json:"oracle_timestamp_path"`
+	DedupPath           string `json:"dedup_path"`
+	// Only meant for testing. fault_rules is the JSON of a SetFaultRulesArg.
+	EnableFaultInjection bool   `json:"enable_fault_injection"`
+	FaultRules           string `json:"fault_rules"`
+}
+
+// Settings of the OpenTelemetry traces.
+type Tracing struct {
+	Exporter     string  `json:"exporter"`
+	OtlpEndpoint string  `json:"otlp_endpoint"`
+	File         string  `json:"file"`
+	SampleRatio  float64 `json:"sample_ratio"`
+}
+
+// Settings of the logs. Reloadable.
+type Logging struct {
+	Level           string `json:"level"`
+	ComponentLevels string `json:"component_levels"`
+	Format          string `json:"format"`
+	LogValues       bool   `json:"log_values"`
+}
+
+// Config of a control manager or a worker.
+type Config struct {
+	Pod            Pod            `json:"pod"`
+	Cluster        Cluster        `json:"cluster"`
+	Etcd           Etcd           `json:"etcd"`
+	ControlManager ControlManager `json:"control_manager"`
+	Worker         Worker         `json:"worker"`
+	// Port of the Prometheus metrics, disabled if 0.
+	MetricsPort int `json:"metrics_port"`
+	// Time given to the requests being served to finish on SIGTERM.
+	// Reloadable.
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+	// Time between two checks of the file for changes. The file is not
+	// reloaded if 0. Reloadable.
+	ReloadInterval Duration `json:"reload_interval"`
+	Tracing        Tracing  `json:"tracing"`
+	Logging        Logging  `json:"logging"`
+}
+
+// Helper method to get the default config.
+func Default() *Config {
+	return &Config{
+		Cluster: Cluster{NumShards: 9, NumWorkerPods: 3},
+		Etcd: Etcd{
+			ElectionPrefix:         "/leader-election/",
+			ElectionSessionTtlSecs: 10,
+			WorkerLeaseTtlSecs:     10,
+		},
+		ControlManager: ControlManager{
+			GrpcPort:              50052,
+			ForwardToLeader:       true,
+			WorkerRpcTimeout:      Duration{30 * time.Second},
+			WorkerRpcTotalTimeout: Duration{60 * time.Second},
+			Retry: Retry{
+				MaxAttempts:    3,
+				InitialBackoff: Duration{50 * time.Millisecond},
+				MaxBackoff:     Duration{time.Second},
+			},
+			Breaker: Breaker{FailureThreshold: 5, OpenDuration: Duration{5 * time.Second}},
+		},
+		Worker:          Worker{GrpcPort: 50051, DedupTableSize: 1000},
+		MetricsPort:     9090,
+		ShutdownTimeout: Duration{20 * time.Second},
+		ReloadInterval:  Duration{10 * time.Second},
+		Tracing:         Tracing{Exporter: tracing.ExporterNone, SampleRatio: 1},
+		Logging:         Logging{Level: "info", Format: logging.FormatText},
+	}
+}
+
+// Helper method to read the YAML or JSON content of a config file into c.
+// Settings missing from the file are left as they are; unknown settings are an
+// error, so that typos are not silently ignored.
+func (c *Config) Unmarshal(data []byte) error {
+	return yaml.UnmarshalStrict(data, c)
+}
+
+//------------------------------------------------------------------------------
+// VALIDATION
+//------------------------------------------------------------------------------
+
+// Check that the settings used by component are valid. Returns all the
+// problems found at once.
+func (c *Config) Validate(component Component) error {
+	var errs []error
+	check := func(is_valid bool, format string, args ...any) {
+		if !is_valid {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	checkPort := func(name string, port int) {
+		check(port >= 0 && port <= 65535, "%s must be a port between 0 and 65535, got %d",
+			name, port)
+	}
+
+	check(c.Cluster.NumShards > 0, "cluster.num_shards must be positive, got %d",
+		c.Cluster.NumShards)
+	check(len(c.Etcd.Endpoints) > 0 || c.Pod.Namespace != "",
+		"etcd.endpoints or pod.namespace must be set")
+	for _, endpoint := range c.Etcd.Endpoints {
+		check(endpoint != "", "etcd.endpoints must not contain empty endpoints")
+	}
+	checkPort("metrics_port", c.MetricsPort)
+	check(c.ShutdownTimeout.Duration >= 0, "shutdown_timeout must not be negative")
+	check(c.ReloadInterval.Duration >= 0, "reload_interval must not be negative")
+	switch c.Tracing.Exporter {
+	case "", tracing.ExporterNone, tracing.ExporterOtlp, tracing.ExporterStdout:
+	case tracing.ExporterFile:
+		check(c.Tracing.File != "", "tracing.file must be set for the file exporter")
+	default:
+		errs = append(errs, fmt.Errorf(
+			"tracing.exporter must be one of none, otlp, stdout or file, got %q",
+			c.Tracing.Exporter))
+	}
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1,
+		"tracing.sample_ratio must be between 0 and 1, got %v", c.Tracing.SampleRatio)
+	if _, err := logging.ParseLevel(c.Logging.Level); err != nil {
+		errs = append(errs, fmt.Errorf("logging.level: %v", err))
+	}
+	if _, err := logging.ParseComponentLevels(c.Logging.ComponentLevels); err != nil {
+		errs = append(errs, fmt.Errorf("logging.component_levels: %v", err))
+	}
+	check(c.Logging.Format == "" || c.Logging.Format == logging.FormatText ||
+		c.Logging.Format == logging.FormatJson,
+		"logging.format must be text or json, got %q", c.Logging.Format)
+
+	switch component {
+	case ComponentControlManager:
+		cm := c.ControlManager
+		checkPort("control_manager.grpc_port", cm.GrpcPort)
+		checkPort("control_manager.http_gateway_port", cm.HttpGatewayPort)
+		checkPort("control_manager.redis_port", cm.RedisPort)
+		check(c.Etcd.ElectionPrefix != "", "etcd.election_prefix must be set")
+		check(c.Etcd.ElectionSessionTtlSecs > 0,
+			"etcd.election_session_ttl_secs must be positive, got %d",
+			c.Etcd.ElectionSessionTtlSecs)
+		check(cm.WorkerRpcTimeout.Duration > 0,
+			"control_manager.worker_rpc_timeout must be positive")
+		check(cm.WorkerRpcTotalTimeout.Duration > 0,
+			"control_manager.worker_rpc_total_timeout must be positive")
+		check(cm.Retry.MaxAttempts > 0,
+			"control_manager.retry.max_attempts must be positive, got %d", cm.Retry.MaxAttempts)
+		check(cm.Retry.InitialBackoff.Duration > 0,
+			"control_manager.retry.initial_backoff must be positive")
+		check(cm.Retry.MaxBackoff.Duration >= cm.Retry.InitialBackoff.Duration,
+			"control_manager.retry.max_backoff must not be shorter than initial_backoff")
+		check(cm.Breaker.FailureThreshold > 0,
+			"control_manager.breaker.failure_threshold must be positive, got %d",
+			cm.Breaker.FailureThreshold)
+		check(cm.Breaker.OpenDuration.Duration > 0,
+			"control_manager.breaker.open_duration must be positive")
+	case ComponentWorker:
+		w := c.Worker
+		checkPort("worker.grpc_port", w.GrpcPort)
+		check(c.Cluster.NumWorkerPods > 0 && c.Cluster.NumWorkerPods <= c.Cluster.NumShards,
+			"cluster.num_worker_pods must be between 1 and num_shards, got %d",
+			c.Cluster.NumWorkerPods)
+		ordinal, err := strconv.Atoi(strings.TrimPrefix(c.Pod.Name, "worker-"))
+		check(err == nil && strings.HasPrefix(c.Pod.Name, "worker-") && ordinal >= 0 &&
+			ordinal < c.Cluster.NumWorkerPods,
+			"pod.name must be worker-<ordinal> with an ordinal below num_worker_pods, got %q",
+			c.Pod.Name)
+		check(c.Etcd.WorkerLeaseTtlSecs > 0, "etcd.worker_lease_ttl_secs must be positive, got %d",
+			c.Etcd.WorkerLeaseTtlSecs)
+		check(w.DedupTableSize >= 0, "worker.dedup_table_size must not be negative, got %d",
+			w.DedupTableSize)
+		check(w.MountPath != "", "worker.mount_path must be set")
+		check(w.OracleTimestampPath != "", "worker.oracle_timestamp_path must be set")
+		check(w.DedupPath != "", "worker.dedup_path must be set")
+		if w.FaultRules != "" {
+			check(w.EnableFaultInjection,
+				"worker.fault_rules requires worker.enable_fault_injection")
+			if err := protojson.Unmarshal([]byte(w.FaultRules),
+				&pb.SetFaultRulesArg{}); err != nil {
+				errs = append(errs, fmt.Errorf("worker.fault_rules: %v", err))
+			}
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown component %q", component))
+	}
+	return errors.Join(errs...)
+}
+
+//------------------------------------------------------------------------------
+// CONFIG OF THE BINARIES
+//------------------------------------------------------------------------------
+
+// Helper method to get the config of the logging.
+func (c *Config) LoggingConfig() logging.Config {
+	return logging.Config{
+		Level:           c.Logging.Level,
+		ComponentLevels: c.Logging.ComponentLevels,
+		Format:          c.Logging.Format,
+		LogValues:       c.Logging.LogValues,
+	}
+}
+
+// Helper method to get the config of the tracing.
+func (c *Config) TracingConfig() tracing.Config {
+	return tracing.Config{
+		Exporter:     c.Tracing.Exporter,
+		OtlpEndpoint: c.Tracing.OtlpEndpoint,
+		FilePath:     c.Tracing.File,
+		SampleRatio:  c.Tracing.SampleRatio,
+	}
+}
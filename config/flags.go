@@ -0,0 +1,267 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+//------------------------------------------------------------------------------
+// FLAGS AND ENVIRONMENT
+//------------------------------------------------------------------------------
+
+// Name of the flag giving the path of the config file.
+const configFlag = "kv_config"
+
+// Settings read from the environment variables of the pod spec rather than
+// from flags.
+var podEnvSettings = []struct {
+	env string
+	set func(c *Config, value string)
+}{
+	{"POD_NAME", func(c *Config, value string) { c.Pod.Name = value }},
+	{"POD_IP", func(c *Config, value string) { c.Pod.Ip = value }},
+	{"POD_NAMESPACE", func(c *Config, value string) { c.Pod.Namespace = value }},
+	{"MOUNT_PATH", func(c *Config, value string) { c.Worker.MountPath = value }},
+	{"PERSIST_ORACLE", func(c *Config, value string) { c.Worker.OracleTimestampPath = value }},
+	{"PERSIST_DEDUP", func(c *Config, value string) { c.Worker.DedupPath = value }},
+}
+
+// Flag value holding a comma separated list.
+type stringList struct {
+	values *[]string
+}
+
+func (l stringList) String() string {
+	if l.values == nil {
+		return ""
+	}
+	return strings.Join(*l.values, ",")
+}
+
+func (l stringList) Set(value string) error {
+	*l.values = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l.values = append(*l.values, item)
+		}
+	}
+	return nil
+}
+
+// Helper method to get the environment variable overriding a flag.
+func envForFlag(name string) string {
+	return strings.ToUpper(name)
+}
+
+// Register the flags of component on fs, bound to the settings of c. Their
+// defaults are the current settings of c.
+func RegisterFlags(fs *flag.FlagSet, component Component, c *Config) {
+	fs.String(configFlag, "",
+		"YAML or JSON file holding the config, shared by the control manager and the "+
+			"workers. Flags and environment variables override it.")
+	fs.IntVar(&c.Cluster.NumShards, "kv_num_shards", c.Cluster.NumShards,
+		"Total number of shards for our kvstore. All shards will be distributed across worker nodes.")
+	fs.IntVar(&c.Worker.GrpcPort, "kv_worker_grpc_server_port", c.Worker.GrpcPort,
+		"The grpc server port for worker")
+	fs.Var(stringList{&c.Etcd.Endpoints}, "kv_etcd_endpoints",
+		"Comma separated etcd endpoints, host:port. Defaults to the etcd service of the "+
+			"pod namespace.")
+	fs.IntVar(&c.MetricsPort, "kv_metrics_port", c.MetricsPort,
+		"Port of the HTTP server exposing the Prometheus metrics at /metrics. Disabled if 0.")
+	fs.StringVar(&c.Tracing.Exporter, "kv_trace_exporter", c.Tracing.Exporter,
+		"Exporter of the OpenTelemetry traces: none, otlp, stdout or file.")
+	fs.StringVar(&c.Tracing.OtlpEndpoint, "kv_trace_otlp_endpoint", c.Tracing.OtlpEndpoint,
+		"host:port of the OTLP/gRPC collector the traces are sent to. Defaults to "+
+			"$OTEL_EXPORTER_OTLP_ENDPOINT, or localhost:4317.")
+	fs.StringVar(&c.Tracing.File, "kv_trace_file", c.Tracing.File,
+		"File the traces are appended to by the file exporter.")
+	fs.Float64Var(&c.Tracing.SampleRatio, "kv_trace_sample_ratio", c.Tracing.SampleRatio,
+		"Fraction of the traces started by this node which are recorded.")
+	fs.DurationVar(&c.ReloadInterval.Duration, "kv_config_reload_interval",
+		c.ReloadInterval.Duration,
+		"Time between two checks of the config file for changes. Not reloaded if 0.")
+	fs.StringVar(&c.Logging.Level, "kv_log_level", c.Logging.Level,
+		"Minimum level of the logs: debug, info, warn or error.")
+	fs.StringVar(&c.Logging.Format, "kv_log_format", c.Logging.Format,
+		"Format of the logs: text or json.")
+	fs.BoolVar(&c.Logging.LogValues, "kv_log_values", c.Logging.LogValues,
+		"If true, the values of the keys are logged in full at debug level instead of "+
+			"being redacted. Only meant for debugging.")
+
+	switch component {
+	case ComponentControlManager:
+		cm := &c.ControlManager
+		fs.IntVar(&cm.GrpcPort, "kv_control_manager_grpc_server_port", cm.GrpcPort,
+			"The grpc server port for control manager to get client requests.")
+		fs.StringVar(&c.Etcd.ElectionPrefix, "kv_election_prefix", c.Etcd.ElectionPrefix,
+			"Prefix of the etcd keys of the leader election.")
+		fs.IntVar(&c.Etcd.ElectionSessionTtlSecs, "kv_election_session_ttl_secs",
+			c.Etcd.ElectionSessionTtlSecs,
+			"TTL of the etcd session backing control manager leadership.")
+		fs.DurationVar(&cm.WorkerRpcTimeout.Duration, "kv_worker_rpc_timeout",
+			cm.WorkerRpcTimeout.Duration,
+			"Upper bound on the time spent on a single worker RPC attempt. Client "+
+				"deadlines shorter than this are respected.")
+		fs.DurationVar(&cm.WorkerRpcTotalTimeout.Duration, "kv_worker_rpc_total_timeout",
+			cm.WorkerRpcTotalTimeout.Duration,
+			"Upper bound on the time spent on a worker RPC including its retries.")
+		fs.IntVar(&cm.Retry.MaxAttempts, "kv_worker_rpc_max_attempts", cm.Retry.MaxAttempts,
+			"Maximum number of attempts for idempotent worker RPCs.")
+		fs.DurationVar(&cm.Retry.InitialBackoff.Duration, "kv_worker_rpc_initial_backoff",
+			cm.Retry.InitialBackoff.Duration,
+			"Backoff before the first retry of a worker RPC. Doubles on every retry.")
+		fs.DurationVar(&cm.Retry.MaxBackoff.Duration, "kv_worker_rpc_max_backoff",
+			cm.Retry.MaxBackoff.Duration,
+			"Upper bound on the backoff between retries of a worker RPC.")
+		fs.IntVar(&cm.Breaker.FailureThreshold, "kv_worker_breaker_failure_threshold",
+			cm.Breaker.FailureThreshold,
+			"Number of consecutive worker RPC failures after which the circuit breaker opens.")
+		fs.DurationVar(&cm.Breaker.OpenDuration.Duration, "kv_worker_breaker_open_duration",
+			cm.Breaker.OpenDuration.Duration,
+			"Time the circuit breaker stays open before probing the worker again.")
+		fs.BoolVar(&cm.ForwardToLeader, "kv_standby_forward_requests", cm.ForwardToLeader,
+			"If true, standby control managers proxy client requests to the leader. "+
+				"Otherwise they reply with a kNotLeader error carrying the leader address.")
+		fs.IntVar(&cm.HttpGatewayPort, "kv_http_gateway_port", cm.HttpGatewayPort,
+			"Port of the HTTP/JSON gateway for client requests. The gateway is disabled if 0.")
+		fs.IntVar(&cm.RedisPort, "kv_redis_port", cm.RedisPort,
+			"Port of the Redis (RESP2/RESP3) front end for client requests. The front end "+
+				"is disabled if 0.")
+		fs.DurationVar(&c.ShutdownTimeout.Duration, "kv_shutdown_timeout",
+			c.ShutdownTimeout.Duration,
+			"Time given to the requests being served to finish on SIGTERM, before leadership "+
+				"is resigned. Must be shorter than the termination grace period of the pod.")
+		fs.StringVar(&c.Logging.ComponentLevels, "kv_log_component_levels",
+			c.Logging.ComponentLevels,
+			"Levels of components overriding kv_log_level, e.g. "+
+				"control_manager=debug,election=warn. Components: control_manager, election, "+
+				"frontend, membership, metrics, tracing and config.")
+	case ComponentWorker:
+		w := &c.Worker
+		fs.IntVar(&c.Cluster.NumWorkerPods, "kv_num_worker_pods", c.Cluster.NumWorkerPods,
+			"Number of worker pods for our distributed kv-store")
+		fs.IntVar(&w.DedupTableSize, "kv_dedup_table_size", w.DedupTableSize,
+			"Number of recently applied request ids remembered per shard to dedup retried writes.")
+		fs.Int64Var(&c.Etcd.WorkerLeaseTtlSecs, "kv_worker_lease_ttl_secs",
+			c.Etcd.WorkerLeaseTtlSecs,
+			"TTL of the etcd lease backing the worker registration.")
+		fs.BoolVar(&w.EnableFaultInjection, "kv_enable_fault_injection", w.EnableFaultInjection,
+			"Allow injecting faults into disk operations and RPCs through the WorkerAdmin service. Only for testing.")
+		fs.StringVar(&w.FaultRules, "kv_fault_rules", w.FaultRules,
+			"Faults injected from the start, as the JSON of a SetFaultRulesArg. Requires --kv_enable_fault_injection.")
+		fs.DurationVar(&c.ShutdownTimeout.Duration, "kv_shutdown_timeout",
+			c.ShutdownTimeout.Duration,
+			"Time given to the requests being served to finish on SIGTERM, before the shard "+
+				"state is flushed. Must be shorter than the termination grace period of the pod.")
+		fs.StringVar(&c.Logging.ComponentLevels, "kv_log_component_levels",
+			c.Logging.ComponentLevels,
+			"Levels of components overriding kv_log_level, e.g. worker=debug,faults=warn. "+
+				"Components: worker, faults, membership, metrics, tracing and config.")
+	}
+}
+
+//------------------------------------------------------------------------------
+// LOADER
+//------------------------------------------------------------------------------
+
+// Loader of the config of a binary. It remembers the flags and the
+// environment so that they still override the file once it is reloaded.
+type Loader struct {
+	component Component
+	// Flags set on the command line, by name.
+	flag_values map[string]string
+	lookup_env  func(string) (string, bool)
+	// Path of the config file, empty if there is none.
+	file_path string
+	// Content of the config file when it was last loaded.
+	file_data []byte
+}
+
+// Helper method to parse the command line flags of component, given without
+// the program name, on fs. Flags may also be set through the environment, as
+// looked up by lookup_env. Returns flag.ErrHelp if the usage was asked for.
+func NewLoader(fs *flag.FlagSet, component Component, args []string,
+	lookup_env func(string) (string, bool)) (*Loader, error) {
+	RegisterFlags(fs, component, Default())
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	l := &Loader{
+		component:   component,
+		flag_values: make(map[string]string),
+		lookup_env:  lookup_env,
+	}
+	fs.Visit(func(f *flag.Flag) {
+		l.flag_values[f.Name] = f.Value.String()
+	})
+	l.file_path = l.flag_values[configFlag]
+	if value, exists := lookup_env(envForFlag(configFlag)); exists && l.file_path == "" {
+		l.file_path = value
+	}
+	return l, nil
+}
+
+// Path of the config file, empty if there is none.
+func (l *Loader) FilePath() string {
+	return l.file_path
+}
+
+// Load the config from its defaults, the file, the environment and the
+// flags, and validate it.
+func (l *Loader) Load() (*Config, error) {
+	if l.file_path != "" {
+		data, err := os.ReadFile(l.file_path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %v", err)
+		}
+		l.file_data = data
+	}
+	return l.load(l.file_data)
+}
+
+// Helper method to load the config with the given content of the config file.
+func (l *Loader) load(file_data []byte) (*Config, error) {
+	c := Default()
+	if err := c.Unmarshal(file_data); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", l.file_path, err)
+	}
+	for _, setting := range podEnvSettings {
+		if value, exists := l.lookup_env(setting.env); exists {
+			setting.set(c, value)
+		}
+	}
+	fs := flag.NewFlagSet(string(l.component), flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	RegisterFlags(fs, l.component, c)
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == configFlag || err != nil {
+			return
+		}
+		// Flags take precedence over the environment.
+		source := "--" + f.Name
+		value, is_set := l.flag_values[f.Name]
+		if !is_set {
+			source = envForFlag(f.Name)
+			value, is_set = l.lookup_env(source)
+		}
+		if is_set {
+			if set_err := fs.Set(f.Name, value); set_err != nil {
+				err = fmt.Errorf("invalid %s %q: %v", source, value, set_err)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Validate(l.component); err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	return c, nil
+}
@@ -0,0 +1,100 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"kvstore/logging"
+	"log/slog"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+// RELOAD
+//------------------------------------------------------------------------------
+
+var logger = logging.Logger("config")
+
+// Helper method to get a copy of c with the reloadable settings of other.
+func (c *Config) withReloadable(other *Config) *Config {
+	reloaded := *c
+	reloaded.ControlManager.WorkerRpcTimeout = other.ControlManager.WorkerRpcTimeout
+	reloaded.ControlManager.WorkerRpcTotalTimeout = other.ControlManager.WorkerRpcTotalTimeout
+	reloaded.ControlManager.Retry = other.ControlManager.Retry
+	reloaded.ControlManager.Breaker = other.ControlManager.Breaker
+	reloaded.ShutdownTimeout = other.ShutdownTimeout
+	reloaded.ReloadInterval = other.ReloadInterval
+	reloaded.Logging = other.Logging
+	return &reloaded
+}
+
+// Helper method to list the settings which differ between two values of the
+// same type, named after their path in the file, e.g.
+// control_manager.grpc_port.
+func diffSettings(prefix string, a reflect.Value, b reflect.Value) []string {
+	if a.Kind() != reflect.Struct || a.Type() == reflect.TypeOf(Duration{}) {
+		if reflect.DeepEqual(a.Interface(), b.Interface()) {
+			return nil
+		}
+		return []string{prefix}
+	}
+	var settings []string
+	for i := 0; i < a.NumField(); i++ {
+		name, _, _ := strings.Cut(a.Type().Field(i).Tag.Get("json"), ",")
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		settings = append(settings, diffSettings(name, a.Field(i), b.Field(i))...)
+	}
+	return settings
+}
+
+// Check the config file for changes every ReloadInterval of current, the
+// config last returned by Load, until ctx is done. When it changed, the
+// reloadable settings of the new config are passed to apply, along with the
+// settings of current for the others, which are logged as needing a restart.
+// A new config which is invalid is ignored.
+func (l *Loader) Watch(ctx context.Context, current *Config, apply func(*Config)) {
+	if l.file_path == "" {
+		return
+	}
+	last_data := l.file_data
+	for current.ReloadInterval.Duration > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(current.ReloadInterval.Duration):
+		}
+		data, err := os.ReadFile(l.file_path)
+		if err != nil {
+			logger.Warn("Failed to read config file", slog.String("file", l.file_path),
+				logging.Err(err))
+			continue
+		}
+		if bytes.Equal(data, last_data) {
+			continue
+		}
+		last_data = data
+		loaded, err := l.load(data)
+		if err != nil {
+			logger.Warn("Ignoring changes to the config file", slog.String("file", l.file_path),
+				logging.Err(err))
+			continue
+		}
+		reloaded := current.withReloadable(loaded)
+		if settings := diffSettings("", reflect.ValueOf(*reloaded),
+			reflect.ValueOf(*loaded)); len(settings) > 0 {
+			logger.Warn("Settings changed in the config file are only applied on restart",
+				slog.Any("settings", settings))
+		}
+		if settings := diffSettings("", reflect.ValueOf(*current),
+			reflect.ValueOf(*reloaded)); len(settings) > 0 {
+			logger.Info("Reloaded config file", slog.String("file", l.file_path),
+				slog.Any("settings", settings))
+			apply(reloaded)
+		}
+		current = reloaded
+	}
+}
@@ -0,0 +1,179 @@
+package controlmanager
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc/connectivity"
+	"kvstore/logging"
+	pb "kvstore/protos"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+//------------------------------------------------------------------------------
+// ADMIN GRPC SERVICE IMPLEMENTATION
+//------------------------------------------------------------------------------
+
+// Implement the KvAdminServer
+type adminServer struct {
+	pb.UnimplementedKvAdminServer
+	*ControlManager
+}
+
+// Helper method to map the state of a gRPC connection to a worker to its
+// proto.
+func getWorkerConnectionState(state connectivity.State) pb.WorkerConnectionState {
+	switch state {
+	case connectivity.Connecting:
+		return pb.WorkerConnectionState_kConnectionConnecting
+	case connectivity.Ready:
+		return pb.WorkerConnectionState_kConnectionReady
+	case connectivity.TransientFailure:
+		return pb.WorkerConnectionState_kConnectionTransientFailure
+	case connectivity.Shutdown:
+		return pb.WorkerConnectionState_kConnectionShutdown
+	}
+	return pb.WorkerConnectionState_kConnectionIdle
+}
+
+// Implement the GetClusterStatus RPC method. Reports the leader as observed
+// by this control manager and the workers it knows along with the state of
+// their connections and circuit breakers.
+func (s *adminServer) GetClusterStatus(ctx context.Context, in *pb.GetClusterStatusArg) (*pb.GetClusterStatusRet, error) {
+	ret := &pb.GetClusterStatusRet{
+		ControlManagerName: s.config.PodName,
+		IsLeader:           s.is_leader.Load(),
+		ClusterIdentity:    s.cluster_identity,
+	}
+	s.current_leader.leader_lock.RLock()
+	ret.LeaderAddress = s.current_leader.address
+	ret.ElectionRevision = s.current_leader.revision
+	s.current_leader.leader_lock.RUnlock()
+
+	s.worker_clients.worker_clients_lock.RLock()
+	defer s.worker_clients.worker_clients_lock.RUnlock()
+	for worker_pod, worker_client := range s.worker_clients.workers {
+		breaker_state, consecutive_failures := worker_client.breaker.GetState()
+		ret.Workers = append(ret.Workers, &pb.WorkerClientStatus{
+			WorkerName:          worker_pod,
+			Address:             worker_client.registration.GetAddress(),
+			State:               worker_client.registration.GetState(),
+			OwnedShards:         worker_client.registration.GetOwnedShards(),
+			BreakerState:        breaker_state,
+			ConsecutiveFailures: consecutive_failures,
+			ConnectionState:     getWorkerConnectionState(worker_client.conn.GetState()),
+		})
+	}
+	// Keep the output stable for operators.
+	sort.Slice(ret.Workers, func(i, j int) bool {
+		return ret.Workers[i].GetWorkerName() < ret.Workers[j].GetWorkerName()
+	})
+	return ret, nil
+}
+
+// Implement the GetShardMap RPC method. Reports the worker owning every shard
+// so that smart clients can route requests to workers directly.
+func (s *adminServer) GetShardMap(ctx context.Context, in *pb.GetShardMapArg) (*pb.GetShardMapRet, error) {
+	s.worker_clients.worker_clients_lock.RLock()
+	defer s.worker_clients.worker_clients_lock.RUnlock()
+	ret := &pb.GetShardMapRet{NumShards: int32(s.config.NumShards)}
+	for shard_num := 0; shard_num < s.config.NumShards; shard_num++ {
+		shard_id := strconv.Itoa(shard_num)
+		worker_pod, exists := s.worker_clients.shard_map[shard_id]
+		if !exists {
+			continue
+		}
+		ret.Shards = append(ret.Shards, &pb.ShardAssignment{
+			ShardId:    shard_id,
+			WorkerName: worker_pod,
+			Address:    s.worker_clients.workers[worker_pod].registration.GetAddress(),
+		})
+	}
+	return ret, nil
+}
+
+// Implement the ListShards RPC method. Reports the owner of every shard along
+// with the keys it stores and its latest oracle timestamp, as reported by the
+// workers. Shards whose worker cannot be reached are listed without
+// statistics. The workers are asked without going through their circuit
+// breakers, which only track the requests.
+func (s *adminServer) ListShards(ctx context.Context, in *pb.ListShardsArg) (*pb.ListShardsRet, error) {
+	ret := &pb.ListShardsRet{NumShards: int32(s.config.NumShards)}
+	// Workers owning the shards, keyed by worker pod name.
+	worker_clients := make(map[string]*WorkerClient)
+	s.worker_clients.worker_clients_lock.RLock()
+	for shard_num := 0; shard_num < s.config.NumShards; shard_num++ {
+		shard_id := strconv.Itoa(shard_num)
+		shard := &pb.ShardInfo{ShardId: shard_id}
+		if worker_pod, exists := s.worker_clients.shard_map[shard_id]; exists {
+			worker_clients[worker_pod] = s.worker_clients.workers[worker_pod]
+			shard.WorkerName = worker_pod
+			shard.Address = worker_clients[worker_pod].registration.GetAddress()
+		} else {
+			shard.ErrorDetails = "No worker registered for shard"
+		}
+		ret.Shards = append(ret.Shards, shard)
+	}
+	s.worker_clients.worker_clients_lock.RUnlock()
+
+	// Ask every worker owning a shard for its status at once.
+	worker_statuses := make(map[string]*pb.GetWorkerStatusRet)
+	worker_errors := make(map[string]string)
+	var (
+		wg          sync.WaitGroup
+		result_lock sync.Mutex
+	)
+	for worker_pod, worker_client := range worker_clients {
+		wg.Add(1)
+		go func(worker_pod string, worker_client *WorkerClient) {
+			defer wg.Done()
+			var r *pb.GetWorkerStatusRet
+			err := s.CallWorkerWithRetry(ctx, worker_pod, nil, true,
+				func(ctx context.Context) error {
+					var err error
+					r, err = worker_client.admin_client.GetWorkerStatus(ctx,
+						&pb.GetWorkerStatusArg{})
+					return err
+				})
+			result_lock.Lock()
+			defer result_lock.Unlock()
+			if err != nil {
+				s.logger.WarnContext(ctx, "Failed to get worker status",
+					logging.Worker(worker_pod), logging.Err(err))
+				worker_errors[worker_pod] = fmt.Sprintf("No response from worker %s: %v",
+					worker_pod, err)
+				return
+			}
+			if !r.GetSuccess() {
+				worker_errors[worker_pod] = r.GetErrorDetails()
+				return
+			}
+			worker_statuses[worker_pod] = r
+		}(worker_pod, worker_client)
+	}
+	wg.Wait()
+
+	for _, shard := range ret.Shards {
+		if shard.GetWorkerName() == "" {
+			continue
+		}
+		worker_status, exists := worker_statuses[shard.GetWorkerName()]
+		if !exists {
+			shard.ErrorDetails = worker_errors[shard.GetWorkerName()]
+			continue
+		}
+		shard.ErrorDetails = fmt.Sprintf("Shard not reported by worker %s",
+			shard.GetWorkerName())
+		for _, shard_status := range worker_status.GetShards() {
+			if shard_status.GetShardId() == shard.GetShardId() {
+				shard.KeyCount = shard_status.GetKeyCount()
+				shard.Bytes = shard_status.GetBytes()
+				shard.OracleTs = shard_status.GetOracleTs()
+				shard.ErrorDetails = ""
+				break
+			}
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,1117 @@
+package controlmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"kvstore/health"
+	"kvstore/kverror"
+	"kvstore/logging"
+	"kvstore/membership"
+	"kvstore/metrics"
+	pb "kvstore/protos"
+	"kvstore/tracing"
+	"kvstore/validation"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config of a control manager.
+type Config struct {
+	// Name, address and namespace of the control manager pod. The address is
+	// published to the other control managers for request forwarding.
+	PodName      string
+	PodIp        string
+	PodNamespace string
+	// etcd endpoints used for leader election and worker membership.
+	// Defaults to the etcd service of PodNamespace.
+	EtcdEndpoints []string
+	// Prefix of the etcd keys of the leader election. Defaults to
+	// /leader-election/.
+	ElectionPrefix string
+	// Host the client facing servers listen on. Listens on all interfaces
+	// if empty.
+	ListenHost string
+	// Port of the gRPC server for client requests. A free port is picked if
+	// 0.
+	GrpcServerPort int
+	// Address published to the other control managers. Defaults to PodIp and
+	// the port of the gRPC server; set it if the control manager is reached
+	// through a proxy.
+	AdvertiseAddress string
+	// Ports of the HTTP/JSON gateway and of the Redis front end. Each is
+	// disabled if 0.
+	HttpGatewayPort int
+	RedisPort       int
+	// Total number of shards of the kvstore.
+	NumShards int
+	// TTL of the etcd session backing leadership.
+	ElectionSessionTtlSecs int
+	// Upper bound on the time spent on a single worker RPC attempt. May be
+	// changed with Reconfigure, as the total timeout, the retry policy and
+	// the shutdown timeout.
+	WorkerRpcTimeout time.Duration
+	// Upper bound on the time spent on a worker RPC including its retries,
+	// so that a client without a deadline cannot hold a request for every
+	// attempt.
+	WorkerRpcTotalTimeout time.Duration
+	// Retry policy of idempotent worker RPCs.
+	RetryMaxAttempts    int
+	RetryInitialBackoff time.Duration
+	RetryMaxBackoff     time.Duration
+	// Circuit breaker policy of worker RPCs.
+	BreakerFailureThreshold int
+	BreakerOpenDuration     time.Duration
+	// If true, standby control managers proxy client requests to the
+	// leader. Otherwise they reply with a kNotLeader error.
+	ForwardToLeader bool
+	// Port of the HTTP server exposing the Prometheus metrics at /metrics.
+	// Disabled if 0.
+	MetricsPort int
+	// Exporter and sampling of the OpenTelemetry traces.
+	Tracing tracing.Config
+	// Time given to the requests being served to finish when the control
+	// manager is stopped. Requests still running afterwards are cancelled.
+	ShutdownTimeout time.Duration
+}
+
+// Error returned by Wait once the control manager was killed.
+var ErrKilled = errors.New("control manager killed")
+
+// Control manager routing client requests to the workers. Several control
+// managers may run at once; the one elected through etcd serves the requests
+// and the others forward them to it.
+type ControlManager struct {
+	config Config
+	// Copy of config holding the settings changed by Reconfigure, which are
+	// read from here.
+	runtime_config atomic.Pointer[Config]
+	// Handlers of the gRPC services.
+	kv_server    *server
+	admin_server *adminServer
+	// etcd client shared by leader election and worker membership.
+	etcd_client      *clientv3.Client
+	election_session *concurrency.Session
+	// Identity of the cluster stored in etcd, set before we serve.
+	cluster_identity *pb.ClusterIdentity
+	election         *concurrency.Election
+	// Set once this control manager wins the election.
+	is_leader atomic.Bool
+	// Set once we start resigning so that the session loss is not treated as
+	// an unexpected step down.
+	is_resigning atomic.Bool
+	// Leader as observed through the election.
+	current_leader *LeaderInfo
+	// RPC clients of the registered workers.
+	worker_clients *WorkerClientMap
+	// Set once the worker membership was first loaded from etcd.
+	is_membership_loaded atomic.Bool
+	// Cursors handed out by SCAN of the Redis front end.
+	resp_scan_cursors *respScanCursorMap
+	// Id of the last Redis client connection.
+	resp_client_id atomic.Int64
+	// Open Redis client connections, closed when we stop. The value is true
+	// while the connection serves a command. Set resp_draining once we stop
+	// accepting commands.
+	resp_conns_lock sync.Mutex
+	resp_conns      map[net.Conn]bool
+	resp_draining   bool
+	// Prometheus metrics, served by metrics_server if enabled.
+	metrics        *controlManagerMetrics
+	metrics_server *metrics.Server
+	// Tracer of the requests served, set once we start.
+	tracer *tracing.Tracer
+	// Loggers of the request path, of the election and of the HTTP and Redis
+	// front ends.
+	logger          *slog.Logger
+	election_logger *slog.Logger
+	frontend_logger *slog.Logger
+	// Health service, serving while we can serve client requests.
+	health *health.Server
+	// Client facing servers.
+	listener       net.Listener
+	grpc_server    *grpc.Server
+	http_server    *http.Server
+	redis_listener net.Listener
+	// Done once the control manager stops. Cancels the membership watch, the
+	// campaign and the leader observation.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Closed once the control manager stopped, after which err holds the
+	// reason.
+	done      chan struct{}
+	stop_once sync.Once
+	err       error
+}
+
+// Helper method to instantiate a new control manager. The control manager
+// does not serve until Start is called.
+func New(config Config) *ControlManager {
+	cm := &ControlManager{
+		config:            config,
+		current_leader:    &LeaderInfo{},
+		worker_clients:    CreateWorkerClientMap(),
+		resp_scan_cursors: CreateRespScanCursorMap(),
+		resp_conns:        make(map[net.Conn]bool),
+		done:              make(chan struct{}),
+		logger:            logging.Logger("control_manager").With(logging.Node(config.PodName)),
+		election_logger:   logging.Logger("election").With(logging.Node(config.PodName)),
+		frontend_logger:   logging.Logger("frontend").With(logging.Node(config.PodName)),
+	}
+	cm.runtime_config.Store(&config)
+	cm.ctx, cm.cancel = context.WithCancel(context.Background())
+	cm.kv_server = &server{ControlManager: cm}
+	cm.admin_server = &adminServer{ControlManager: cm}
+	cm.metrics = newControlManagerMetrics(cm)
+	cm.health = health.NewServer(cm.CheckReadiness, cm.logger,
+		pb.KvStoreInterface_ServiceDesc.ServiceName)
+	return cm
+}
+
+// Apply the settings of config which may change while the control manager
+// runs: the worker RPC timeouts, the retry policy, the circuit breakers and
+// the shutdown timeout. The other settings are ignored. Affects the requests
+// served from now on.
+func (cm *ControlManager) Reconfigure(config Config) {
+	runtime_config := *cm.runtime_config.Load()
+	runtime_config.WorkerRpcTimeout = config.WorkerRpcTimeout
+	runtime_config.WorkerRpcTotalTimeout = config.WorkerRpcTotalTimeout
+	runtime_config.RetryMaxAttempts = config.RetryMaxAttempts
+	runtime_config.RetryInitialBackoff = config.RetryInitialBackoff
+	runtime_config.RetryMaxBackoff = config.RetryMaxBackoff
+	runtime_config.BreakerFailureThreshold = config.BreakerFailureThreshold
+	runtime_config.BreakerOpenDuration = config.BreakerOpenDuration
+	runtime_config.ShutdownTimeout = config.ShutdownTimeout
+	cm.runtime_config.Store(&runtime_config)
+	// Breakers of workers joining from now on are created with the new
+	// settings, the existing ones are updated.
+	cm.worker_clients.worker_clients_lock.RLock()
+	for _, worker_client := range cm.worker_clients.workers {
+		worker_client.breaker.Reconfigure(config.BreakerFailureThreshold,
+			config.BreakerOpenDuration)
+	}
+	cm.worker_clients.worker_clients_lock.RUnlock()
+	cm.logger.Info("Reconfigured control manager",
+		slog.Duration("worker_rpc_timeout", config.WorkerRpcTimeout),
+		slog.Duration("worker_rpc_total_timeout", config.WorkerRpcTotalTimeout),
+		slog.Int("retry_max_attempts", config.RetryMaxAttempts),
+		slog.Int("breaker_failure_threshold", config.BreakerFailureThreshold),
+		slog.Duration("breaker_open_duration", config.BreakerOpenDuration),
+		slog.Duration("shutdown_timeout", config.ShutdownTimeout))
+}
+
+// Worker known to the control manager through etcd membership.
+type WorkerClient struct {
+	registration *pb.WorkerRegistration
+	conn         *grpc.ClientConn
+	rpc_client   pb.KvStoreServiceClient
+	admin_client pb.WorkerAdminClient
+	breaker      *CircuitBreaker
+}
+
+type WorkerClientMap struct {
+	worker_clients_lock sync.RWMutex
+	// Key is the worker pod name.
+	workers map[string]*WorkerClient
+	// Key is the shard id, value is the worker pod name owning the shard.
+	shard_map map[string]string
+}
+
+//------------------------------------------------------------------------------
+// METHODS TO INITIALIZE THE CONTROL MANAGER FOR KV STORE.
+//------------------------------------------------------------------------------
+
+// Helper method to instantiate a new worker client map.
+func CreateWorkerClientMap() *WorkerClientMap {
+	return &WorkerClientMap{
+		workers:   make(map[string]*WorkerClient),
+		shard_map: make(map[string]string),
+	}
+}
+
+// Helper method to check that the config agrees with the identity of the
+// cluster stored in etcd, so that keys are routed to the shards holding them.
+// The identity is drawn from the config if the cluster has none yet.
+func (cm *ControlManager) CheckClusterIdentity() error {
+	ctx, cancel := context.WithTimeout(cm.ctx, 10*time.Second)
+	defer cancel()
+	identity, is_stored, err := membership.LoadClusterIdentity(ctx, cm.etcd_client,
+		membership.NewClusterIdentity(cm.config.NumShards))
+	if err != nil {
+		return err
+	}
+	if is_stored {
+		cm.logger.Info("Stored cluster identity in etcd",
+			slog.String("cluster_id", identity.GetClusterId()),
+			slog.Int("num_shards", int(identity.GetNumShards())))
+	}
+	if err := membership.CheckClusterIdentity(identity, cm.config.NumShards); err != nil {
+		return err
+	}
+	cm.cluster_identity = identity
+	return nil
+}
+
+// Helper method to initialize worker membership. Workers register themselves
+// in etcd and we keep an RPC client for every registered worker, creating,
+// replacing or dropping clients as the membership changes.
+func (cm *ControlManager) InitWorkerMembership() {
+	go membership.WatchWorkers(cm.ctx, cm.etcd_client, cm.UpdateWorkerClients)
+}
+
+// Helper method to reconcile the RPC clients with the latest worker
+// membership received from etcd.
+func (cm *ControlManager) UpdateWorkerClients(workers map[string]*pb.WorkerRegistration) {
+	runtime_config := cm.runtime_config.Load()
+	cm.worker_clients.worker_clients_lock.Lock()
+	defer cm.worker_clients.worker_clients_lock.Unlock()
+	// Drop the clients for workers which are no longer registered.
+	for worker_pod, worker_client := range cm.worker_clients.workers {
+		if _, exists := workers[worker_pod]; !exists {
+			cm.logger.Info("Worker left the cluster", logging.Worker(worker_pod))
+			worker_client.conn.Close()
+			delete(cm.worker_clients.workers, worker_pod)
+			cm.metrics.worker_rpcs.DeletePeer(worker_pod)
+		}
+	}
+	// Create or replace the clients for registered workers.
+	shard_map := make(map[string]string)
+	for worker_pod, registration := range workers {
+		worker_client, exists := cm.worker_clients.workers[worker_pod]
+		if !exists || worker_client.registration.GetAddress() != registration.GetAddress() {
+			conn, err := getRpcConnForAddress(registration.GetAddress(),
+				grpc.WithChainUnaryInterceptor(
+					cm.metrics.worker_rpcs.UnaryClientInterceptor(worker_pod)),
+				cm.tracer.DialOption())
+			if err != nil {
+				cm.logger.Error("Could not initialize rpc client", logging.Worker(worker_pod),
+					logging.Err(err))
+				continue
+			}
+			if exists {
+				cm.logger.Info("Worker moved", logging.Worker(worker_pod),
+					slog.String("address", registration.GetAddress()))
+				worker_client.conn.Close()
+			} else {
+				cm.logger.Info("Worker joined the cluster", logging.Worker(worker_pod),
+					slog.String("address", registration.GetAddress()))
+			}
+			worker_client = &WorkerClient{
+				conn:         conn,
+				rpc_client:   pb.NewKvStoreServiceClient(conn),
+				admin_client: pb.NewWorkerAdminClient(conn),
+				breaker: CreateCircuitBreaker(runtime_config.BreakerFailureThreshold,
+					runtime_config.BreakerOpenDuration,
+					cm.logger.With(logging.Worker(worker_pod))),
+			}
+			cm.worker_clients.workers[worker_pod] = worker_client
+		}
+		worker_client.registration = registration
+		for _, shard_id := range registration.GetOwnedShards() {
+			owner, is_claimed := shard_map[shard_id]
+			if !is_claimed {
+				shard_map[shard_id] = worker_pod
+				continue
+			}
+			// Several workers claim the shard, e.g. while a worker is
+			// replaced. The same one is picked on every refresh.
+			ignored := worker_pod
+			if isPreferredShardOwner(registration, workers[owner]) {
+				shard_map[shard_id], ignored = worker_pod, owner
+			}
+			cm.logger.Warn("Shard claimed by several workers", logging.Shard(shard_id),
+				logging.Worker(shard_map[shard_id]), slog.String("ignored_worker", ignored))
+		}
+	}
+	cm.worker_clients.shard_map = shard_map
+	cm.is_membership_loaded.Store(true)
+}
+
+// Helper method to decide which of two workers claiming the same shard owns
+// it. A serving worker is preferred, then the one with the lowest ordinal.
+// Returns true if registration is preferred over other.
+func isPreferredShardOwner(registration *pb.WorkerRegistration,
+	other *pb.WorkerRegistration) bool {
+	is_serving := registration.GetState() == pb.WorkerState_kWorkerServing
+	is_other_serving := other.GetState() == pb.WorkerState_kWorkerServing
+	if is_serving != is_other_serving {
+		return is_serving
+	}
+	ordinal, err := membership.WorkerOrdinal(registration.GetWorkerName())
+	other_ordinal, other_err := membership.WorkerOrdinal(other.GetWorkerName())
+	if err == nil && other_err == nil && ordinal != other_ordinal {
+		return ordinal < other_ordinal
+	}
+	return registration.GetWorkerName() < other.GetWorkerName()
+}
+
+//------------------------------------------------------------------------------
+// HELPER METHODS FOR PUT KEY AND GET KEY
+//------------------------------------------------------------------------------
+
+// Writes the key value pair to the worker owning its shard and returns the
+// db_modified_ts of the write. The key expires at expires_at_ms unless it is
+// 0. The write is only retried, and deduplicated by the worker, if req_id was
+// supplied by the client. The worker RPC is derived from ctx so that client
+// deadlines and cancellation are passed on.
+func (cm *ControlManager) PutKeyInternal(ctx context.Context, req_id string, is_client_req_id bool,
+	key string, value string, condition *pb.WriteCondition, expires_at_ms int64,
+	error_msg *pb.KvError) int64 {
+	// Get the worker pod based on the shard of this key.
+	worker_pod, worker_client := cm.getWorkerClientForKey(ctx, key)
+	if worker_client == nil {
+		error_msg.ErrorType = pb.ErrorCode_kUnavailable
+		error_msg.ErrorDetails =
+			fmt.Sprintf("No worker registered for shard: %s", cm.getShardFromKey(key))
+		return 0
+	}
+	cm.logger.DebugContext(ctx, "Call PutKeyInternal", logging.Worker(worker_pod))
+	// Contact the server and print out its response. Writes are retried only
+	// when they carry a request id that the worker can deduplicate on.
+	var r *pb.PutKeyInternalRet
+	err := cm.CallWorkerWithRetry(ctx, worker_pod, worker_client.breaker, is_client_req_id,
+		func(ctx context.Context) error {
+			var err error
+			r, err = worker_client.rpc_client.PutKeyInternal(
+				ctx, &pb.PutKeyInternalArg{
+					ReqId:       req_id,
+					Key:         key,
+					Value:       value,
+					Condition:   condition,
+					ExpiresAtMs: expires_at_ms,
+					SkipDedup:   !is_client_req_id,
+				})
+			return err
+		})
+	if err != nil {
+		setErrorForWorkerRpcFailure(err, worker_pod, error_msg)
+		return 0
+	}
+	// Check if we did not receive any errors from writing onto backend disk.
+	// Workers report the type of the failure, older workers which do not are
+	// perceived as kBackend errors.
+	if !r.GetSuccess() {
+		error_msg.ErrorType =
+			getErrorCodeFromWorker(r.GetErrorCode(), pb.ErrorCode_kBackendError)
+		error_msg.ErrorDetails = r.GetErrorDetails()
+		return 0
+	}
+	cm.logger.DebugContext(ctx, "Response PutKeyInternal", logging.Worker(worker_pod),
+		slog.Bool("success", r.GetSuccess()))
+	// In case of success return kNoError. Let error details be empty.
+	error_msg.ErrorType = pb.ErrorCode_kNoError
+	return r.GetDbModifiedTs()
+}
+
+// Helper method to get the error code for a failed worker response. Falls
+// back to default_code if the worker did not set one.
+func getErrorCodeFromWorker(error_code pb.ErrorCode, default_code pb.ErrorCode) pb.ErrorCode {
+	if error_code == pb.ErrorCode_kNoError {
+		return default_code
+	}
+	return error_code
+}
+
+// Helper method to fill error_msg for a failed worker RPC. Deadline and
+// cancellation errors, as well as unreachable workers and open circuit
+// breakers, are reported separately from other failures.
+func setErrorForWorkerRpcFailure(err error, worker_pod string, error_msg *pb.KvError) {
+	switch status.Code(err) {
+	case codes.Unavailable:
+		error_msg.ErrorType = pb.ErrorCode_kUnavailable
+		error_msg.ErrorDetails =
+			fmt.Sprintf("Worker %s unavailable: %v", worker_pod, err)
+	case codes.DeadlineExceeded:
+		error_msg.ErrorType = pb.ErrorCode_kDeadlineExceeded
+		error_msg.ErrorDetails =
+			fmt.Sprintf("Deadline exceeded waiting for worker %s", worker_pod)
+	case codes.Canceled:
+		error_msg.ErrorType = pb.ErrorCode_kDeadlineExceeded
+		error_msg.ErrorDetails =
+			fmt.Sprintf("Request cancelled while waiting for worker %s", worker_pod)
+	default:
+		error_msg.ErrorType = pb.ErrorCode_kInternalError
+		error_msg.ErrorDetails =
+			fmt.Sprintf("No response from worker %s: %v", worker_pod, err)
+	}
+}
+
+// Helper method to create a gRPC connection to a worker address. The
+// connection is established lazily and re-established by gRPC on failure.
+func getRpcConnForAddress(address string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := grpc.Dial(address, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Helper method to get shard from key
+func (cm *ControlManager) getShardFromKey(key string) string {
+	return membership.GetShardForKey(key, cm.config.NumShards)
+}
+
+// Helper method to get the worker pod owning the shard of this key along with
+// its RPC client. Returns a nil client if no registered worker owns the shard.
+func (cm *ControlManager) getWorkerClientForKey(ctx context.Context, key string) (string, *WorkerClient) {
+	shard_id := cm.getShardFromKey(key)
+	_, span := cm.tracer.Start(ctx, "RouteKey", tracing.ShardKey.String(shard_id))
+	cm.worker_clients.worker_clients_lock.RLock()
+	defer cm.worker_clients.worker_clients_lock.RUnlock()
+	worker_pod, exists := cm.worker_clients.shard_map[shard_id]
+	if !exists {
+		tracing.EndSpan(span, pb.ErrorCode_kUnavailable,
+			fmt.Sprintf("No worker registered for shard: %s", shard_id))
+		return "", nil
+	}
+	span.SetAttributes(tracing.WorkerKey.String(worker_pod))
+	span.End()
+	return worker_pod, cm.worker_clients.workers[worker_pod]
+}
+
+// Returns the Value from Kv Store.
+// The worker RPC is derived from ctx so that client deadlines and
+// cancellation are passed on.
+func (cm *ControlManager) GetKeyInternal(ctx context.Context, req_id string, key string,
+	error_msg *pb.KvError) *pb.KvStoreObject {
+	// Get the worker pod based on the shard of this key.
+	worker_pod, worker_client := cm.getWorkerClientForKey(ctx, key)
+	if worker_client == nil {
+		error_msg.ErrorType = pb.ErrorCode_kUnavailable
+		error_msg.ErrorDetails =
+			fmt.Sprintf("No worker registered for shard: %s", cm.getShardFromKey(key))
+		return nil
+	}
+	cm.logger.DebugContext(ctx, "Call GetKeyInternal", logging.Worker(worker_pod))
+	// Contact the server and print out its response. Reads are idempotent and
+	// always retried.
+	var r *pb.GetKeyInternalRet
+	err := cm.CallWorkerWithRetry(ctx, worker_pod, worker_client.breaker, true,
+		func(ctx context.Context) error {
+			var err error
+			r, err = worker_client.rpc_client.GetKeyInternal(
+				ctx, &pb.GetKeyInternalArg{ReqId: req_id, Key: key})
+			return err
+		})
+	if err != nil {
+		setErrorForWorkerRpcFailure(err, worker_pod, error_msg)
+		return nil
+	}
+	cm.logger.DebugContext(ctx, "Response GetKeyInternal", logging.Worker(worker_pod),
+		slog.Bool("success", r.GetSuccess()))
+	// Workers distinguish a missing key from disk failures. Older workers
+	// which do not report the type of the failure are perceived as kNotFound.
+	if !r.GetSuccess() {
+		error_msg.ErrorType =
+			getErrorCodeFromWorker(r.GetErrorCode(), pb.ErrorCode_kNotFound)
+		error_msg.ErrorDetails = r.GetErrorDetails()
+		return nil
+	}
+	// In case of success return kNoError, let error details be empty.
+	// Return the value received from disk.
+	error_msg.ErrorType = pb.ErrorCode_kNoError
+	return r.GetKvObject()
+}
+
+// Deletes the key from the worker owning its shard. The worker RPC is derived
+// from ctx so that client deadlines and cancellation are passed on.
+func (cm *ControlManager) DeleteKeyInternal(ctx context.Context, req_id string, key string,
+	error_msg *pb.KvError) {
+	// Get the worker pod based on the shard of this key.
+	worker_pod, worker_client := cm.getWorkerClientForKey(ctx, key)
+	if worker_client == nil {
+		error_msg.ErrorType = pb.ErrorCode_kUnavailable
+		error_msg.ErrorDetails =
+			fmt.Sprintf("No worker registered for shard: %s", cm.getShardFromKey(key))
+		return
+	}
+	cm.logger.DebugContext(ctx, "Call DeleteKeyInternal", logging.Worker(worker_pod))
+	// Deleting a key twice leaves the store in the same state, so deletes are
+	// retried like reads.
+	var r *pb.DeleteKeyInternalRet
+	attempts := 0
+	err := cm.CallWorkerWithRetry(ctx, worker_pod, worker_client.breaker, true,
+		func(ctx context.Context) error {
+			var err error
+			attempts++
+			r, err = worker_client.rpc_client.DeleteKeyInternal(
+				ctx, &pb.DeleteKeyInternalArg{ReqId: req_id, Key: key})
+			return err
+		})
+	if err != nil {
+		setErrorForWorkerRpcFailure(err, worker_pod, error_msg)
+		return
+	}
+	cm.logger.DebugContext(ctx, "Response DeleteKeyInternal", logging.Worker(worker_pod),
+		slog.Bool("success", r.GetSuccess()))
+	// A failed attempt may have deleted the key before the retry, which then
+	// finds it missing.
+	if !r.GetSuccess() && r.GetErrorCode() == pb.ErrorCode_kNotFound && attempts > 1 {
+		cm.logger.DebugContext(ctx, "Key deleted by a failed attempt",
+			logging.Worker(worker_pod), slog.Int("attempts", attempts))
+		error_msg.ErrorType = pb.ErrorCode_kNoError
+		return
+	}
+	if !r.GetSuccess() {
+		error_msg.ErrorType =
+			getErrorCodeFromWorker(r.GetErrorCode(), pb.ErrorCode_kBackendError)
+		error_msg.ErrorDetails = r.GetErrorDetails()
+		return
+	}
+	// In case of success return kNoError, let error details be empty.
+	error_msg.ErrorType = pb.ErrorCode_kNoError
+}
+
+// Helper method to get a snapshot of the RPC clients of all registered
+// workers, keyed by worker pod name.
+func (cm *ControlManager) getAllWorkerClients() map[string]*WorkerClient {
+	cm.worker_clients.worker_clients_lock.RLock()
+	defer cm.worker_clients.worker_clients_lock.RUnlock()
+	worker_clients := make(map[string]*WorkerClient, len(cm.worker_clients.workers))
+	for worker_pod, worker_client := range cm.worker_clients.workers {
+		worker_clients[worker_pod] = worker_client
+	}
+	return worker_clients
+}
+
+// Scans the keys of all workers and returns at most limit entries in key
+// order, along with whether more keys match. Every worker returns its first
+// limit matching keys, so the first limit keys of the merged result are the
+// first limit matching keys of the whole store.
+func (cm *ControlManager) ScanKeysInternal(ctx context.Context, req_id string, prefix string,
+	start_after string, limit int32, error_msg *pb.KvError) ([]*pb.KeyValue, bool) {
+	worker_clients := cm.getAllWorkerClients()
+	if len(worker_clients) == 0 {
+		error_msg.ErrorType = pb.ErrorCode_kUnavailable
+		error_msg.ErrorDetails = "No worker registered"
+		return nil, false
+	}
+	var (
+		wg          sync.WaitGroup
+		result_lock sync.Mutex
+		entries     []*pb.KeyValue
+		has_more    bool
+	)
+	for worker_pod, worker_client := range worker_clients {
+		wg.Add(1)
+		go func(worker_pod string, worker_client *WorkerClient) {
+			defer wg.Done()
+			cm.logger.DebugContext(ctx, "Call ScanKeysInternal", logging.Worker(worker_pod))
+			var r *pb.ScanKeysInternalRet
+			err := cm.CallWorkerWithRetry(ctx, worker_pod, worker_client.breaker, true,
+				func(ctx context.Context) error {
+					var err error
+					r, err = worker_client.rpc_client.ScanKeysInternal(ctx,
+						&pb.ScanKeysInternalArg{
+							ReqId:      req_id,
+							Prefix:     prefix,
+							StartAfter: start_after,
+							Limit:      limit,
+						})
+					return err
+				})
+			result_lock.Lock()
+			defer result_lock.Unlock()
+			if error_msg.ErrorType != pb.ErrorCode_kNoError {
+				// Report the first failure only.
+				return
+			}
+			if err != nil {
+				setErrorForWorkerRpcFailure(err, worker_pod, error_msg)
+				return
+			}
+			if !r.GetSuccess() {
+				error_msg.ErrorType =
+					getErrorCodeFromWorker(r.GetErrorCode(), pb.ErrorCode_kBackendError)
+				error_msg.ErrorDetails = r.GetErrorDetails()
+				return
+			}
+			entries = append(entries, r.GetEntries()...)
+			has_more = has_more || r.GetHasMore()
+		}(worker_pod, worker_client)
+	}
+	wg.Wait()
+	if error_msg.ErrorType != pb.ErrorCode_kNoError {
+		return nil, false
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].GetKey() < entries[j].GetKey()
+	})
+	if len(entries) > int(limit) {
+		entries = entries[:limit]
+		has_more = true
+	}
+	return entries, has_more
+}
+
+// ------------------------------------------------------------------------------
+// GRPC Service Implementations
+// ------------------------------------------------------------------------------
+// Implememt the MapReduceServiceServer
+type server struct {
+	pb.UnimplementedKvStoreInterfaceServer
+	*ControlManager
+}
+
+// Default and maximum number of entries returned by ScanKeys.
+const (
+	defaultScanLimit = 100
+	maxScanLimit     = 1000
+)
+
+// Add validation for ScanKeys
+// Returns true if arg is valid, else returns false along with error details.
+func ValidateScanKeysArg(in *pb.ScanKeysArg) (bool, string) {
+	if in.GetLimit() < 0 || in.GetLimit() > maxScanLimit {
+		return false, fmt.Sprintf("Scan limit must be between 0 and %d", maxScanLimit)
+	}
+	return true, ""
+}
+
+// Helper method to trace the validation of a request. name is the name of
+// the validation method.
+func (cm *ControlManager) traceValidation(ctx context.Context, name string,
+	validate func() (bool, string)) (bool, string) {
+	_, span := cm.tracer.Start(ctx, name)
+	is_valid_arg, error_details := validate()
+	if is_valid_arg {
+		tracing.EndSpan(span, pb.ErrorCode_kNoError, "")
+	} else {
+		tracing.EndSpan(span, pb.ErrorCode_kInvalidArgument, error_details)
+	}
+	return is_valid_arg, error_details
+}
+
+// Implement the PutKey RPC method.
+func (s *server) PutKey(ctx context.Context, in *pb.PutKeyArg) (*pb.PutKeyRet, error) {
+	// Standby control managers hand the request over to the leader.
+	if !s.is_leader.Load() {
+		return s.ForwardPutKey(ctx, in), nil
+	}
+	// Validate the PutArg.
+	is_valid_arg, error_details := s.traceValidation(ctx, "ValidatePutKeyArg",
+		func() (bool, string) { return validation.ValidatePutKeyArg(in) })
+	if is_valid_arg == false {
+		return &pb.PutKeyRet{
+			Success: false,
+			KvError: &pb.KvError{
+				ErrorType:    pb.ErrorCode_kInvalidArgument,
+				ErrorDetails: error_details,
+			}}, nil
+	}
+	key := in.GetKey()
+	value := in.GetValue()
+	// Only a client supplied request id is used by the worker to deduplicate
+	// retried writes. Writes without one are not retried, and get an internal
+	// request id which only identifies them in logs and traces.
+	req_id := in.GetRequestId()
+	is_client_req_id := req_id != ""
+	if !is_client_req_id {
+		req_id = uuid.New().String()
+	}
+	tracing.SetRequestId(ctx, req_id)
+	ctx = logging.WithAttrs(ctx, logging.RequestId(req_id))
+	s.logger.DebugContext(ctx, "Received RPC PutKey", logging.Key(key), logging.Value(value))
+	// Expiry is tracked as an absolute time so that retries and worker
+	// restarts do not extend the lifetime of the key.
+	var expires_at_ms int64
+	if in.GetTtlMs() > 0 {
+		expires_at_ms = time.Now().UnixMilli() + in.GetTtlMs()
+	}
+	var error_msg pb.KvError
+	db_modified_ts := s.PutKeyInternal(ctx, req_id, is_client_req_id, key, value,
+		in.GetCondition(), expires_at_ms, &error_msg)
+	is_write_success := (error_msg.ErrorType == pb.ErrorCode_kNoError)
+	return &pb.PutKeyRet{Success: is_write_success,
+		DbModifiedTs: db_modified_ts,
+		KvError:      &error_msg}, nil
+}
+
+// Implement the GetKey RPC method
+func (s *server) GetKey(ctx context.Context, in *pb.GetKeyArg) (*pb.GetKeyRet, error) {
+	// Standby control managers hand the request over to the leader.
+	if !s.is_leader.Load() {
+		return s.ForwardGetKey(ctx, in), nil
+	}
+	// Valid the GetArg
+	is_valid_arg, error_details := s.traceValidation(ctx, "ValidateGetKeyArg",
+		func() (bool, string) { return validation.ValidateGetKey(in.GetKey()) })
+	if is_valid_arg == false {
+		return &pb.GetKeyRet{
+			Success: false,
+			Value:   "",
+			KvError: &pb.KvError{
+				ErrorType:    pb.ErrorCode_kInvalidArgument,
+				ErrorDetails: error_details,
+			}}, nil
+	}
+	key := in.GetKey()
+	// Generate internal request id.
+	req_id := uuid.New().String()
+	tracing.SetRequestId(ctx, req_id)
+	ctx = logging.WithAttrs(ctx, logging.RequestId(req_id))
+	s.logger.DebugContext(ctx, "Received RPC GetKey", logging.Key(key))
+	var error_msg pb.KvError
+	kv_object := s.GetKeyInternal(ctx, req_id, key, &error_msg)
+	is_read_success := (error_msg.ErrorType == pb.ErrorCode_kNoError &&
+		kv_object != nil)
+	return &pb.GetKeyRet{
+		Success:      is_read_success,
+		Value:        kv_object.GetValue(),
+		DbModifiedTs: kv_object.GetDbModifiedTs(),
+		ExpiresAtMs:  kv_object.GetExpiresAtMs(),
+		KvError:      &error_msg}, nil
+}
+
+// Implement the DeleteKey RPC method
+func (s *server) DeleteKey(ctx context.Context, in *pb.DeleteKeyArg) (*pb.DeleteKeyRet, error) {
+	// Standby control managers hand the request over to the leader.
+	if !s.is_leader.Load() {
+		return s.ForwardDeleteKey(ctx, in), nil
+	}
+	// Validate the DeleteArg
+	is_valid_arg, error_details := s.traceValidation(ctx, "ValidateDeleteKeyArg",
+		func() (bool, string) { return validation.ValidateDeleteKey(in.GetKey()) })
+	if is_valid_arg == false {
+		return &pb.DeleteKeyRet{
+			Success: false,
+			KvError: &pb.KvError{
+				ErrorType:    pb.ErrorCode_kInvalidArgument,
+				ErrorDetails: error_details,
+			}}, nil
+	}
+	key := in.GetKey()
+	// Generate internal request id.
+	req_id := uuid.New().String()
+	tracing.SetRequestId(ctx, req_id)
+	ctx = logging.WithAttrs(ctx, logging.RequestId(req_id))
+	s.logger.DebugContext(ctx, "Received RPC DeleteKey", logging.Key(key))
+	var error_msg pb.KvError
+	s.DeleteKeyInternal(ctx, req_id, key, &error_msg)
+	return &pb.DeleteKeyRet{
+		Success: error_msg.ErrorType == pb.ErrorCode_kNoError,
+		KvError: &error_msg}, nil
+}
+
+// Implement the ScanKeys RPC method
+func (s *server) ScanKeys(ctx context.Context, in *pb.ScanKeysArg) (*pb.ScanKeysRet, error) {
+	// Standby control managers hand the request over to the leader.
+	if !s.is_leader.Load() {
+		return s.ForwardScanKeys(ctx, in), nil
+	}
+	// Validate the ScanArg
+	is_valid_arg, error_details := s.traceValidation(ctx, "ValidateScanKeysArg",
+		func() (bool, string) { return ValidateScanKeysArg(in) })
+	if is_valid_arg == false {
+		return &pb.ScanKeysRet{
+			Success: false,
+			KvError: &pb.KvError{
+				ErrorType:    pb.ErrorCode_kInvalidArgument,
+				ErrorDetails: error_details,
+			}}, nil
+	}
+	limit := in.GetLimit()
+	if limit == 0 {
+		limit = defaultScanLimit
+	}
+	// Generate internal request id.
+	req_id := uuid.New().String()
+	tracing.SetRequestId(ctx, req_id)
+	ctx = logging.WithAttrs(ctx, logging.RequestId(req_id))
+	s.logger.DebugContext(ctx, "Received RPC ScanKeys", slog.String("prefix", in.GetPrefix()))
+	var error_msg pb.KvError
+	entries, has_more := s.ScanKeysInternal(ctx, req_id, in.GetPrefix(),
+		in.GetStartAfter(), limit, &error_msg)
+	return &pb.ScanKeysRet{
+		Success: error_msg.ErrorType == pb.ErrorCode_kNoError,
+		Entries: entries,
+		HasMore: has_more,
+		KvError: &error_msg}, nil
+}
+
+// Helper method to listen for gRPC client requests. We listen before joining
+// the election so that the advertised address carries the port actually
+// used.
+func (cm *ControlManager) InitGrpcListener() error {
+	lis, err := net.Listen("tcp", net.JoinHostPort(cm.config.ListenHost,
+		strconv.Itoa(cm.config.GrpcServerPort)))
+	if err != nil {
+		return fmt.Errorf("failed to listen: %v", err)
+	}
+	cm.listener = lis
+	return nil
+}
+
+// Helper method to start the gRPC server in order to receive calls from
+// kv store clients.
+func (cm *ControlManager) MayBeStartGrpcServer() {
+	// RPCs are measured and traced first so that the status errors of
+	// callers which opted in are recorded as well. Callers may opt in to gRPC
+	// status errors for failed requests.
+	cm.grpc_server = grpc.NewServer(cm.tracer.ServerOption(),
+		grpc.ChainUnaryInterceptor(
+			cm.metrics.rpcs.UnaryServerInterceptor(),
+			tracing.UnaryServerInterceptor(),
+			kverror.UnaryServerInterceptor()))
+	pb.RegisterKvStoreInterfaceServer(cm.grpc_server, cm.kv_server)
+	pb.RegisterKvAdminServer(cm.grpc_server, cm.admin_server)
+	cm.health.Register(cm.grpc_server)
+	cm.logger.Info("Control manager grpc service listening",
+		slog.String("address", cm.listener.Addr().String()))
+	go func() {
+		if err := cm.grpc_server.Serve(cm.listener); err != nil {
+			cm.stop(fmt.Errorf("failed to serve: %v", err))
+		}
+	}()
+}
+
+// Helper method to create the tracer of the requests served. Spans are only
+// exported if an exporter is configured.
+func (cm *ControlManager) InitTracing() error {
+	tracer, err := tracing.New("control-manager", cm.config.PodName, cm.config.Tracing)
+	if err != nil {
+		return err
+	}
+	cm.tracer = tracer
+	return nil
+}
+
+// Helper method to serve the Prometheus metrics if enabled.
+func (cm *ControlManager) MayBeStartMetricsServer() error {
+	if cm.config.MetricsPort == 0 {
+		return nil
+	}
+	metrics_server, err := metrics.StartServer(cm.config.ListenHost, cm.config.MetricsPort,
+		cm.metrics.registry, cm.stop)
+	if err != nil {
+		return err
+	}
+	cm.metrics_server = metrics_server
+	return nil
+}
+
+//------------------------------------------------------------------------------
+// CONTROL MANAGER LIFECYCLE
+//------------------------------------------------------------------------------
+
+// Address at which this control manager serves gRPC client requests. Only
+// valid once the control manager started.
+func (cm *ControlManager) Address() string {
+	return cm.getAdvertiseAddress()
+}
+
+// host:port at which the metrics are served, or an empty string if they are
+// not. Only valid once the control manager started.
+func (cm *ControlManager) MetricsAddress() string {
+	if cm.metrics_server == nil {
+		return ""
+	}
+	return cm.metrics_server.Address()
+}
+
+// Returns true if this control manager is the elected leader.
+func (cm *ControlManager) IsLeader() bool {
+	return cm.is_leader.Load()
+}
+
+// Start the control manager. Returns once client requests are served; the
+// election is campaigned for in the background and requests are forwarded
+// to the current leader until this control manager is elected.
+func (cm *ControlManager) Start() error {
+	cm.logger.Info("Starting control manager", slog.String("pod_ip", cm.config.PodIp),
+		slog.String("pod_namespace", cm.config.PodNamespace))
+
+	if err := cm.InitTracing(); err != nil {
+		cm.stop(err)
+		return err
+	}
+
+	if err := cm.InitGrpcListener(); err != nil {
+		cm.stop(err)
+		return err
+	}
+
+	// Expose the metrics if enabled.
+	if err := cm.MayBeStartMetricsServer(); err != nil {
+		cm.stop(err)
+		return err
+	}
+
+	// Create the etcd client used for leader election and membership.
+	if err := cm.InitEtcdClient(); err != nil {
+		cm.stop(err)
+		return err
+	}
+
+	// Refuse to serve if the config disagrees with the cluster.
+	if err := cm.CheckClusterIdentity(); err != nil {
+		cm.stop(err)
+		return err
+	}
+
+	// Watch worker membership and init the RPC clients to workers. Standby
+	// control managers keep the clients warm so that failover is fast.
+	cm.InitWorkerMembership()
+
+	// Create the election session and follow the current leader.
+	if err := cm.InitElection(); err != nil {
+		cm.stop(err)
+		return err
+	}
+
+	// Campaign in the background. Until elected, client requests are
+	// forwarded to the current leader.
+	go cm.PerformLeaderElection()
+
+	// Serve HTTP/JSON clients alongside gRPC clients if enabled.
+	if err := cm.MayBeStartHttpGateway(); err != nil {
+		cm.stop(err)
+		return err
+	}
+
+	// Serve Redis clients if enabled.
+	if err := cm.MayBeStartRedisServer(); err != nil {
+		cm.stop(err)
+		return err
+	}
+
+	// Start the gRPC server right away so that standby control managers can
+	// serve client connections as well.
+	cm.MayBeStartGrpcServer()
+	go cm.health.Run(cm.ctx)
+	return nil
+}
+
+// Stop serving gracefully. New requests are rejected and the requests being
+// served are given ShutdownTimeout to finish before we resign leadership, so
+// that a standby control manager can take over right away.
+func (cm *ControlManager) Stop() {
+	cm.stop(nil)
+}
+
+// Stop serving abruptly, as if the process crashed. Leadership is kept until
+// the election session expires.
+func (cm *ControlManager) Kill() {
+	cm.stop(ErrKilled)
+}
+
+// Wait until the control manager stopped. Returns the failure which made the
+// control manager stop, or nil if it was stopped through Stop.
+func (cm *ControlManager) Wait() error {
+	<-cm.done
+	return cm.err
+}
+
+// Helper method to stop the control manager once, recording the reason.
+// Leadership is only resigned if we stop on request; after a failure the
+// session is gone already.
+func (cm *ControlManager) stop(err error) {
+	cm.stop_once.Do(func() {
+		if err != nil {
+			cm.logger.Error("Stopping control manager", logging.Err(err))
+			cm.health.Shutdown()
+			cm.is_resigning.Store(true)
+			cm.is_leader.Store(false)
+		} else {
+			// The requests being served are completed while we still lead.
+			cm.drain()
+			cm.ResignLeadership()
+		}
+		cm.cancel()
+		if cm.grpc_server != nil {
+			cm.grpc_server.Stop()
+		} else if cm.listener != nil {
+			cm.listener.Close()
+		}
+		if cm.http_server != nil {
+			cm.http_server.Close()
+		}
+		if cm.redis_listener != nil {
+			cm.redis_listener.Close()
+		}
+		if cm.metrics_server != nil {
+			cm.metrics_server.Close()
+		}
+		cm.closeRespConns()
+		cm.closeRpcConns()
+		if cm.etcd_client != nil {
+			cm.etcd_client.Close()
+		}
+		// Flush the spans of the requests served last.
+		cm.tracer.Shutdown()
+		cm.err = err
+		close(cm.done)
+	})
+}
+
+// Helper method to stop accepting client requests and wait until the requests
+// being served finished, or the shutdown timeout expired.
+func (cm *ControlManager) drain() {
+	shutdown_timeout := cm.runtime_config.Load().ShutdownTimeout
+	cm.logger.Info("Draining control manager", slog.Duration("timeout", shutdown_timeout))
+	ctx, cancel := context.WithTimeout(context.Background(), shutdown_timeout)
+	defer cancel()
+	var (
+		wg         sync.WaitGroup
+		is_drained atomic.Bool
+	)
+	is_drained.Store(true)
+	drain := func(drain_server func() bool) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !drain_server() {
+				is_drained.Store(false)
+			}
+		}()
+	}
+	if cm.grpc_server != nil {
+		drain(func() bool { return cm.health.Drain(ctx, cm.grpc_server) })
+	} else {
+		cm.health.Shutdown()
+	}
+	if cm.http_server != nil {
+		drain(func() bool { return cm.http_server.Shutdown(ctx) == nil })
+	}
+	if cm.redis_listener != nil {
+		cm.redis_listener.Close()
+		drain(func() bool { return cm.drainRespConns(ctx) })
+	}
+	wg.Wait()
+	if !is_drained.Load() {
+		cm.logger.Warn("Shutdown timeout expired, cancelling the remaining requests")
+	}
+}
+
+// Helper method to close the connections to the workers and to the leader.
+func (cm *ControlManager) closeRpcConns() {
+	cm.worker_clients.worker_clients_lock.Lock()
+	for worker_pod, worker_client := range cm.worker_clients.workers {
+		worker_client.conn.Close()
+		delete(cm.worker_clients.workers, worker_pod)
+	}
+	cm.worker_clients.shard_map = make(map[string]string)
+	cm.worker_clients.worker_clients_lock.Unlock()
+
+	cm.current_leader.leader_lock.Lock()
+	if cm.current_leader.conn != nil {
+		cm.current_leader.conn.Close()
+	}
+	cm.current_leader.conn = nil
+	cm.current_leader.rpc_client = nil
+	cm.current_leader.leader_lock.Unlock()
+}
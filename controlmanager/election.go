@@ -0,0 +1,308 @@
+package controlmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.etcd.io/etcd/client/v3/concurrency"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"kvstore/logging"
+	"kvstore/membership"
+	pb "kvstore/protos"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// gRPC metadata key set on requests forwarded by a standby control manager.
+// A control manager receiving a forwarded request never forwards it again.
+const forwardedByMetadataKey = "kv-forwarded-by"
+
+// Prefix of the etcd keys of the leader election, unless configured.
+const defaultElectionPrefix = "/leader-election/"
+
+// Leader as observed through the election along with the RPC client used by
+// standby control managers to forward requests to it.
+type LeaderInfo struct {
+	leader_lock sync.RWMutex
+	// host:port of the leader's KvStoreInterface server.
+	address string
+	// etcd revision at which the leader was elected.
+	revision   int64
+	conn       *grpc.ClientConn
+	rpc_client pb.KvStoreInterfaceClient
+}
+
+//------------------------------------------------------------------------------
+// LEADER ELECTION
+//------------------------------------------------------------------------------
+
+// Helper method to get the address at which this control manager serves
+// client requests. It is published as the campaign value so that standby
+// control managers know where to forward requests.
+func (cm *ControlManager) getAdvertiseAddress() string {
+	if cm.config.AdvertiseAddress != "" {
+		return cm.config.AdvertiseAddress
+	}
+	port := cm.config.GrpcServerPort
+	if cm.listener != nil {
+		// The port actually used, which differs if a free port was picked.
+		port = cm.listener.Addr().(*net.TCPAddr).Port
+	}
+	return net.JoinHostPort(cm.config.PodIp, strconv.Itoa(port))
+}
+
+// Helper method to create the etcd client shared by leader election and
+// worker membership. The client lives until the control manager stops.
+func (cm *ControlManager) InitEtcdClient() error {
+	endpoints := cm.config.EtcdEndpoints
+	if len(endpoints) == 0 {
+		endpoints = []string{membership.EtcdEndpoint(cm.config.PodNamespace)}
+	}
+	cli, err := membership.NewEtcdClientForEndpoints(endpoints)
+	if err != nil {
+		return fmt.Errorf("failed to create etcd client: %v", err)
+	}
+	cm.etcd_client = cli
+	return nil
+}
+
+// Helper method to create the election session and start observing the
+// current leader. The election session is kept alive until the control
+// manager stops; leadership is only valid as long as the session is.
+func (cm *ControlManager) InitElection() error {
+	// Create a session to elect a Leader
+	cm.election_logger.Info("Creating a session to elect a new leader")
+	s, err := concurrency.NewSession(cm.etcd_client,
+		concurrency.WithTTL(cm.config.ElectionSessionTtlSecs))
+	if err != nil {
+		return fmt.Errorf("failed to create election session: %v", err)
+	}
+	cm.election_session = s
+	election_prefix := cm.config.ElectionPrefix
+	if election_prefix == "" {
+		election_prefix = defaultElectionPrefix
+	}
+	cm.election = concurrency.NewElection(s, election_prefix)
+	go cm.ObserveLeader()
+	return nil
+}
+
+// Helper method for performing the active control manager node.
+// We simply rely on the etcd leader election to do so. Blocks until this
+// control manager is elected.
+func (cm *ControlManager) PerformLeaderElection() {
+	// Elect a leader (or wait that the leader resign)
+	cm.election_logger.Info("Campaigning for leadership")
+	if err := cm.election.Campaign(cm.ctx, cm.getAdvertiseAddress()); err != nil {
+		if cm.ctx.Err() == nil {
+			cm.stop(fmt.Errorf("failed to campaign for leadership: %v", err))
+		}
+		return
+	}
+	cm.is_leader.Store(true)
+	// Do not wait for the observation to report ourselves as the leader.
+	cm.UpdateLeader(cm.getAdvertiseAddress(), cm.election.Rev())
+	cm.election_logger.Info("Elected leader")
+	go cm.MonitorLeadership()
+}
+
+// Helper method to step down when the etcd session backing leadership is
+// lost. Once the session expires another control manager may already have
+// been elected, so we must stop serving. The process then exits and lets
+// kubernetes restart the pod, which campaigns again.
+func (cm *ControlManager) MonitorLeadership() {
+	<-cm.election_session.Done()
+	if cm.is_resigning.Load() {
+		return
+	}
+	cm.stop(errors.New("lost etcd session for leader election, stepping down"))
+}
+
+// Helper method to resign leadership and revoke the election session so that
+// a standby control manager can take over immediately instead of waiting for
+// the session TTL to expire.
+func (cm *ControlManager) ResignLeadership() {
+	if cm.election_session == nil {
+		return
+	}
+	cm.is_resigning.Store(true)
+	cm.is_leader.Store(false)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := cm.election.Resign(ctx); err != nil {
+		cm.election_logger.Error("Failed to resign leadership", logging.Err(err))
+	}
+	if err := cm.election_session.Close(); err != nil {
+		cm.election_logger.Error("Failed to close election session", logging.Err(err))
+	}
+	cm.election_logger.Info("Resigned leadership")
+}
+
+//------------------------------------------------------------------------------
+// LEADER OBSERVATION AND REQUEST FORWARDING
+//------------------------------------------------------------------------------
+
+// Helper method to follow the current leader of the election. Runs until the
+// control manager stops.
+func (cm *ControlManager) ObserveLeader() {
+	for {
+		for resp := range cm.election.Observe(cm.ctx) {
+			if len(resp.Kvs) > 0 {
+				cm.UpdateLeader(string(resp.Kvs[0].Value), resp.Kvs[0].CreateRevision)
+			}
+		}
+		if cm.ctx.Err() != nil {
+			return
+		}
+		cm.election_logger.Warn("Leader observation stopped, retrying")
+		select {
+		case <-cm.ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// Helper method to record a new leader address and create the RPC client used
+// to forward requests to it. revision is the etcd revision at which the
+// leader was elected.
+func (cm *ControlManager) UpdateLeader(address string, revision int64) {
+	cm.current_leader.leader_lock.Lock()
+	defer cm.current_leader.leader_lock.Unlock()
+	// A leader restarted at the same address is elected at a new revision.
+	cm.current_leader.revision = revision
+	if cm.current_leader.address == address {
+		return
+	}
+	cm.election_logger.Info("Observed control manager leader", slog.String("address", address))
+	if cm.current_leader.address != "" {
+		cm.metrics.leader_changes.Inc()
+	}
+	if cm.current_leader.conn != nil {
+		cm.current_leader.conn.Close()
+	}
+	cm.current_leader.address = address
+	cm.current_leader.conn = nil
+	cm.current_leader.rpc_client = nil
+	if address == cm.getAdvertiseAddress() {
+		// No need to forward requests to ourselves.
+		return
+	}
+	conn, err := getRpcConnForAddress(address, cm.tracer.DialOption())
+	if err != nil {
+		cm.election_logger.Error("Could not initialize rpc client for leader",
+			slog.String("address", address), logging.Err(err))
+		return
+	}
+	cm.current_leader.conn = conn
+	cm.current_leader.rpc_client = pb.NewKvStoreInterfaceClient(conn)
+}
+
+// Helper method to get the RPC client to forward a request received by a
+// standby control manager. Returns a non nil KvError if the request cannot be
+// forwarded, which carries the leader address when it is known so that the
+// client can redirect itself.
+func (cm *ControlManager) getLeaderClientForRequest(ctx context.Context) (string, pb.KvStoreInterfaceClient, *pb.KvError) {
+	cm.current_leader.leader_lock.RLock()
+	address := cm.current_leader.address
+	rpc_client := cm.current_leader.rpc_client
+	cm.current_leader.leader_lock.RUnlock()
+
+	kv_error := &pb.KvError{
+		ErrorType:     pb.ErrorCode_kNotLeader,
+		LeaderAddress: address,
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok &&
+		len(md.Get(forwardedByMetadataKey)) > 0 {
+		kv_error.ErrorDetails = fmt.Sprintf(
+			"Request forwarded by %s reached standby control manager %s",
+			md.Get(forwardedByMetadataKey)[0], cm.config.PodName)
+		return address, nil, kv_error
+	}
+	if !cm.config.ForwardToLeader {
+		kv_error.ErrorDetails = fmt.Sprintf(
+			"Control manager %s is not the leader, leader is at %s", cm.config.PodName, address)
+		return address, nil, kv_error
+	}
+	if rpc_client == nil {
+		kv_error.ErrorType = pb.ErrorCode_kUnavailable
+		kv_error.ErrorDetails = "No control manager leader is known yet"
+		return address, nil, kv_error
+	}
+	return address, rpc_client, nil
+}
+
+// Helper method to mark an outgoing context as forwarded by this control
+// manager.
+func (cm *ControlManager) getForwardContext(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, forwardedByMetadataKey, cm.config.PodName)
+}
+
+// Helper method to forward a request received by a standby control manager
+// to the leader through call. Returns the reply of the leader, or the reply
+// built by failed if the request could not be forwarded.
+func forwardToLeader[Ret any](ctx context.Context, cm *ControlManager,
+	call func(ctx context.Context, rpc_client pb.KvStoreInterfaceClient) (Ret, error),
+	failed func(kv_error *pb.KvError) Ret) Ret {
+	address, rpc_client, kv_error := cm.getLeaderClientForRequest(ctx)
+	if kv_error != nil {
+		return failed(kv_error)
+	}
+	r, err := call(cm.getForwardContext(ctx), rpc_client)
+	if err != nil {
+		return failed(&pb.KvError{
+			ErrorType:     pb.ErrorCode_kUnavailable,
+			ErrorDetails:  fmt.Sprintf("Failed to forward request to leader %s: %v", address, err),
+			LeaderAddress: address,
+		})
+	}
+	return r
+}
+
+// Forward a PutKey request to the leader.
+func (cm *ControlManager) ForwardPutKey(ctx context.Context, in *pb.PutKeyArg) *pb.PutKeyRet {
+	return forwardToLeader(ctx, cm,
+		func(ctx context.Context, rpc_client pb.KvStoreInterfaceClient) (*pb.PutKeyRet, error) {
+			return rpc_client.PutKey(ctx, in)
+		},
+		func(kv_error *pb.KvError) *pb.PutKeyRet {
+			return &pb.PutKeyRet{Success: false, KvError: kv_error}
+		})
+}
+
+// Forward a GetKey request to the leader.
+func (cm *ControlManager) ForwardGetKey(ctx context.Context, in *pb.GetKeyArg) *pb.GetKeyRet {
+	return forwardToLeader(ctx, cm,
+		func(ctx context.Context, rpc_client pb.KvStoreInterfaceClient) (*pb.GetKeyRet, error) {
+			return rpc_client.GetKey(ctx, in)
+		},
+		func(kv_error *pb.KvError) *pb.GetKeyRet {
+			return &pb.GetKeyRet{Success: false, KvError: kv_error}
+		})
+}
+
+// Forward a DeleteKey request to the leader.
+func (cm *ControlManager) ForwardDeleteKey(ctx context.Context, in *pb.DeleteKeyArg) *pb.DeleteKeyRet {
+	return forwardToLeader(ctx, cm,
+		func(ctx context.Context, rpc_client pb.KvStoreInterfaceClient) (*pb.DeleteKeyRet, error) {
+			return rpc_client.DeleteKey(ctx, in)
+		},
+		func(kv_error *pb.KvError) *pb.DeleteKeyRet {
+			return &pb.DeleteKeyRet{Success: false, KvError: kv_error}
+		})
+}
+
+// Forward a ScanKeys request to the leader.
+func (cm *ControlManager) ForwardScanKeys(ctx context.Context, in *pb.ScanKeysArg) *pb.ScanKeysRet {
+	return forwardToLeader(ctx, cm,
+		func(ctx context.Context, rpc_client pb.KvStoreInterfaceClient) (*pb.ScanKeysRet, error) {
+			return rpc_client.ScanKeys(ctx, in)
+		},
+		func(kv_error *pb.KvError) *pb.ScanKeysRet {
+			return &pb.ScanKeysRet{Success: false, KvError: kv_error}
+		})
+}
@@ -0,0 +1,280 @@
+package controlmanager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kvstore/logging"
+	pb "kvstore/protos"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//------------------------------------------------------------------------------
+// HTTP/JSON GATEWAY
+//------------------------------------------------------------------------------
+
+// The gateway exposes the KvStoreInterface over plain HTTP/JSON:
+//
+//	GET    /v1/keys/{key}                          -> GetKey
+//	PUT    /v1/keys/{key}                          -> PutKey
+//	DELETE /v1/keys/{key}                          -> DeleteKey
+//	GET    /v1/keys?prefix=&start_after=&limit=    -> ScanKeys
+//
+// Requests are served by the same handlers as the gRPC server, so standby
+// control managers forward them to the leader as usual. The db_modified_ts of
+// a key is returned in the ETag header and may be passed back in If-Match to
+// make a write conditional on the key not having changed in between.
+
+// Maximum size of a PUT request body.
+const maxHttpBodyBytes = 4 << 20
+
+// Header carrying the idempotency key of a PUT, passed on as its request id.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// Body of a PUT request.
+type httpPutKeyBody struct {
+	Value string `json:"value"`
+}
+
+// Body of a successful GET or PUT response.
+type httpKeyValue struct {
+	Key          string `json:"key"`
+	Value        string `json:"value,omitempty"`
+	DbModifiedTs int64  `json:"db_modified_ts"`
+}
+
+// Body of a successful scan response.
+type httpScanKeysBody struct {
+	Entries []httpKeyValue `json:"entries"`
+	HasMore bool           `json:"has_more"`
+}
+
+// Body of a failed response.
+type httpErrorBody struct {
+	Error httpError `json:"error"`
+}
+
+type httpError struct {
+	Code          string `json:"code"`
+	Details       string `json:"details,omitempty"`
+	LeaderAddress string `json:"leader_address,omitempty"`
+}
+
+// Helper method to map a kvstore ErrorCode onto an HTTP status code.
+func httpStatusForErrorCode(error_code pb.ErrorCode) int {
+	switch error_code {
+	case pb.ErrorCode_kNoError:
+		return http.StatusOK
+	case pb.ErrorCode_kNotFound:
+		return http.StatusNotFound
+	case pb.ErrorCode_kInvalidArgument:
+		return http.StatusBadRequest
+	case pb.ErrorCode_kUnavailable, pb.ErrorCode_kNotLeader, pb.ErrorCode_kWrongShard:
+		// Neither a worker nor the leader could be reached, the request may be
+		// retried.
+		return http.StatusServiceUnavailable
+	case pb.ErrorCode_kInternalError, pb.ErrorCode_kBackendError:
+		return http.StatusInternalServerError
+	case pb.ErrorCode_kDeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case pb.ErrorCode_kConditionFailed:
+		return http.StatusPreconditionFailed
+	}
+	return http.StatusInternalServerError
+}
+
+// Helper method to format a db_modified_ts as an ETag.
+func formatETag(db_modified_ts int64) string {
+	return strconv.Quote(strconv.FormatInt(db_modified_ts, 10))
+}
+
+// Helper method to convert the If-Match and If-None-Match headers of a PUT to
+// a write condition. Returns nil if the write is unconditional.
+func getWriteConditionFromHeaders(header http.Header) (*pb.WriteCondition, error) {
+	if_match := strings.TrimSpace(header.Get("If-Match"))
+	if_none_match := strings.TrimSpace(header.Get("If-None-Match"))
+	if if_match != "" && if_none_match != "" {
+		return nil, errors.New("If-Match and If-None-Match cannot be combined")
+	}
+	if if_none_match != "" {
+		if if_none_match != "*" {
+			return nil, errors.New("If-None-Match only supports *")
+		}
+		return &pb.WriteCondition{IfNotExists: true}, nil
+	}
+	if if_match == "" {
+		return nil, nil
+	}
+	if if_match == "*" {
+		return &pb.WriteCondition{IfExists: true}, nil
+	}
+	etag, err := strconv.Unquote(if_match)
+	if err != nil {
+		return nil, fmt.Errorf("If-Match must be a single quoted ETag: %s", if_match)
+	}
+	db_modified_ts, err := strconv.ParseInt(etag, 10, 64)
+	if err != nil || db_modified_ts <= 0 {
+		return nil, fmt.Errorf("If-Match is not an ETag issued by kvstore: %s", if_match)
+	}
+	return &pb.WriteCondition{IfDbModifiedTs: db_modified_ts}, nil
+}
+
+// Helper method to write a JSON response.
+func writeJson(w http.ResponseWriter, status_code int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status_code)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		logging.Logger("frontend").Warn("Failed to write http response", logging.Err(err))
+	}
+}
+
+// Helper method to write the JSON response for a failed request.
+func writeKvError(w http.ResponseWriter, kv_error *pb.KvError) {
+	writeJson(w, httpStatusForErrorCode(kv_error.GetErrorType()), &httpErrorBody{
+		Error: httpError{
+			Code:          kv_error.GetErrorType().String(),
+			Details:       kv_error.GetErrorDetails(),
+			LeaderAddress: kv_error.GetLeaderAddress(),
+		}})
+}
+
+// Helper method to write the JSON response for a request rejected by the
+// gateway itself.
+func writeInvalidArgument(w http.ResponseWriter, error_details string) {
+	writeKvError(w, &pb.KvError{
+		ErrorType:    pb.ErrorCode_kInvalidArgument,
+		ErrorDetails: error_details,
+	})
+}
+
+// Serve GET /v1/keys/{key}.
+func (cm *ControlManager) handleHttpGetKey(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	ret, _ := cm.kv_server.GetKey(r.Context(), &pb.GetKeyArg{Key: key})
+	if ret.GetKvError().GetErrorType() != pb.ErrorCode_kNoError {
+		writeKvError(w, ret.GetKvError())
+		return
+	}
+	w.Header().Set("ETag", formatETag(ret.GetDbModifiedTs()))
+	writeJson(w, http.StatusOK, &httpKeyValue{
+		Key:          key,
+		Value:        ret.GetValue(),
+		DbModifiedTs: ret.GetDbModifiedTs(),
+	})
+}
+
+// Serve PUT /v1/keys/{key}.
+func (cm *ControlManager) handleHttpPutKey(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	condition, err := getWriteConditionFromHeaders(r.Header)
+	if err != nil {
+		writeInvalidArgument(w, err.Error())
+		return
+	}
+	var body httpPutKeyBody
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxHttpBodyBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&body); err != nil {
+		writeInvalidArgument(w, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	ret, _ := cm.kv_server.PutKey(r.Context(), &pb.PutKeyArg{
+		Key:       key,
+		Value:     body.Value,
+		RequestId: r.Header.Get(idempotencyKeyHeader),
+		Condition: condition,
+	})
+	if ret.GetKvError().GetErrorType() != pb.ErrorCode_kNoError {
+		writeKvError(w, ret.GetKvError())
+		return
+	}
+	w.Header().Set("ETag", formatETag(ret.GetDbModifiedTs()))
+	writeJson(w, http.StatusOK, &httpKeyValue{
+		Key:          key,
+		DbModifiedTs: ret.GetDbModifiedTs(),
+	})
+}
+
+// Serve DELETE /v1/keys/{key}.
+func (cm *ControlManager) handleHttpDeleteKey(w http.ResponseWriter, r *http.Request) {
+	ret, _ := cm.kv_server.DeleteKey(r.Context(), &pb.DeleteKeyArg{Key: r.PathValue("key")})
+	if ret.GetKvError().GetErrorType() != pb.ErrorCode_kNoError {
+		writeKvError(w, ret.GetKvError())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Serve GET /v1/keys?prefix=&start_after=&limit=.
+func (cm *ControlManager) handleHttpScanKeys(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var limit int64
+	if query.Has("limit") {
+		var err error
+		limit, err = strconv.ParseInt(query.Get("limit"), 10, 32)
+		if err != nil {
+			writeInvalidArgument(w, fmt.Sprintf("Invalid limit: %s", query.Get("limit")))
+			return
+		}
+	}
+	ret, _ := cm.kv_server.ScanKeys(r.Context(), &pb.ScanKeysArg{
+		Prefix:     query.Get("prefix"),
+		StartAfter: query.Get("start_after"),
+		Limit:      int32(limit),
+	})
+	if ret.GetKvError().GetErrorType() != pb.ErrorCode_kNoError {
+		writeKvError(w, ret.GetKvError())
+		return
+	}
+	body := &httpScanKeysBody{
+		Entries: make([]httpKeyValue, 0, len(ret.GetEntries())),
+		HasMore: ret.GetHasMore(),
+	}
+	for _, entry := range ret.GetEntries() {
+		body.Entries = append(body.Entries, httpKeyValue{
+			Key:          entry.GetKey(),
+			Value:        entry.GetValue(),
+			DbModifiedTs: entry.GetDbModifiedTs(),
+		})
+	}
+	writeJson(w, http.StatusOK, body)
+}
+
+// Helper method to create the HTTP handler of the gateway.
+func (cm *ControlManager) CreateHttpGatewayHandler() http.Handler {
+	mux := http.NewServeMux()
+	// Every request is traced like the gRPC request it maps to.
+	mux.HandleFunc("GET /v1/keys/{key...}",
+		cm.tracer.HttpHandler("HTTP GET /v1/keys/{key}", cm.handleHttpGetKey))
+	mux.HandleFunc("PUT /v1/keys/{key...}",
+		cm.tracer.HttpHandler("HTTP PUT /v1/keys/{key}", cm.handleHttpPutKey))
+	mux.HandleFunc("DELETE /v1/keys/{key...}",
+		cm.tracer.HttpHandler("HTTP DELETE /v1/keys/{key}", cm.handleHttpDeleteKey))
+	mux.HandleFunc("GET /v1/keys",
+		cm.tracer.HttpHandler("HTTP GET /v1/keys", cm.handleHttpScanKeys))
+	return mux
+}
+
+// Helper method to serve the HTTP/JSON gateway if it is enabled.
+func (cm *ControlManager) MayBeStartHttpGateway() error {
+	if cm.config.HttpGatewayPort == 0 {
+		return nil
+	}
+	lis, err := net.Listen("tcp", net.JoinHostPort(cm.config.ListenHost,
+		strconv.Itoa(cm.config.HttpGatewayPort)))
+	if err != nil {
+		return fmt.Errorf("failed to listen for HTTP gateway: %v", err)
+	}
+	cm.frontend_logger.Info("HTTP gateway listening", slog.String("address", lis.Addr().String()))
+	cm.http_server = &http.Server{Handler: cm.CreateHttpGatewayHandler()}
+	go func() {
+		if err := cm.http_server.Serve(lis); err != http.ErrServerClosed {
+			cm.stop(fmt.Errorf("failed to serve HTTP gateway: %v", err))
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,73 @@
+package controlmanager
+
+import (
+	"google.golang.org/protobuf/proto"
+	pb "kvstore/protos"
+	"net/http"
+	"testing"
+)
+
+func TestHttpStatusForErrorCode(t *testing.T) {
+	want := map[pb.ErrorCode]int{
+		pb.ErrorCode_kNoError:          http.StatusOK,
+		pb.ErrorCode_kNotFound:         http.StatusNotFound,
+		pb.ErrorCode_kInvalidArgument:  http.StatusBadRequest,
+		pb.ErrorCode_kInternalError:    http.StatusInternalServerError,
+		pb.ErrorCode_kBackendError:     http.StatusInternalServerError,
+		pb.ErrorCode_kNotLeader:        http.StatusServiceUnavailable,
+		pb.ErrorCode_kDeadlineExceeded: http.StatusGatewayTimeout,
+		pb.ErrorCode_kConditionFailed:  http.StatusPreconditionFailed,
+		pb.ErrorCode_kWrongShard:       http.StatusServiceUnavailable,
+		pb.ErrorCode_kUnavailable:      http.StatusServiceUnavailable,
+	}
+	// Every ErrorCode must be mapped, including those added later.
+	for value, name := range pb.ErrorCode_name {
+		error_code := pb.ErrorCode(value)
+		status_code, exists := want[error_code]
+		if !exists {
+			t.Errorf("no HTTP status expected for %s", name)
+			continue
+		}
+		if got := httpStatusForErrorCode(error_code); got != status_code {
+			t.Errorf("httpStatusForErrorCode(%s) = %d, want %d", name, got, status_code)
+		}
+	}
+}
+
+func TestGetWriteConditionFromHeaders(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		if_match      string
+		if_none_match string
+		want          *pb.WriteCondition
+		want_err      bool
+	}{
+		{"unconditional", "", "", nil, false},
+		{"etag", `"42"`, "", &pb.WriteCondition{IfDbModifiedTs: 42}, false},
+		{"etag with spaces", ` "42" `, "", &pb.WriteCondition{IfDbModifiedTs: 42}, false},
+		{"any etag", "*", "", &pb.WriteCondition{IfExists: true}, false},
+		{"no etag", "", "*", &pb.WriteCondition{IfNotExists: true}, false},
+		{"unquoted etag", "42", "", nil, true},
+		{"weak etag", `W/"42"`, "", nil, true},
+		{"etag list", `"41", "42"`, "", nil, true},
+		{"foreign etag", `"abc"`, "", nil, true},
+		{"zero etag", `"0"`, "", nil, true},
+		{"If-None-Match etag", "", `"42"`, nil, true},
+		{"both headers", `"42"`, "*", nil, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			header := http.Header{}
+			if test.if_match != "" {
+				header.Set("If-Match", test.if_match)
+			}
+			if test.if_none_match != "" {
+				header.Set("If-None-Match", test.if_none_match)
+			}
+			got, err := getWriteConditionFromHeaders(header)
+			if (err != nil) != test.want_err || !proto.Equal(got, test.want) {
+				t.Errorf("condition = %v, %v, want %v with error %t", got, err, test.want,
+					test.want_err)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package controlmanager
+
+import (
+	"errors"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"strconv"
+)
+
+//------------------------------------------------------------------------------
+// READINESS
+//------------------------------------------------------------------------------
+
+// Readiness check of the control manager. We are ready once we loaded the
+// worker membership, lead or can forward requests to the leader, and every
+// shard has a reachable owner whose circuit breaker is not open. The check
+// only reads the state kept by the control manager, so it returns without
+// waiting on any worker.
+func (cm *ControlManager) CheckReadiness() error {
+	if !cm.is_membership_loaded.Load() {
+		return errors.New("worker membership not loaded from etcd yet")
+	}
+	if !cm.is_leader.Load() {
+		if err := cm.checkLeaderReachable(); err != nil {
+			return err
+		}
+		return cm.checkWorkersReachable()
+	}
+	select {
+	case <-cm.election_session.Done():
+		return errors.New("etcd session backing leadership expired")
+	default:
+	}
+	return cm.checkWorkersReachable()
+}
+
+// Helper method to check whether every shard has an owner which is
+// reachable and whose circuit breaker is not open. A breaker due for a probe
+// does not make the control manager unready, since no request would reach the
+// worker to close it otherwise.
+func (cm *ControlManager) checkWorkersReachable() error {
+	cm.worker_clients.worker_clients_lock.RLock()
+	defer cm.worker_clients.worker_clients_lock.RUnlock()
+	for shard_num := 0; shard_num < cm.config.NumShards; shard_num++ {
+		shard_id := strconv.Itoa(shard_num)
+		worker_pod, exists := cm.worker_clients.shard_map[shard_id]
+		if !exists {
+			return fmt.Errorf("no worker registered for shard %s", shard_id)
+		}
+		worker_client := cm.worker_clients.workers[worker_pod]
+		if worker_client.breaker.IsOpen() {
+			return fmt.Errorf("circuit breaker of worker %s owning shard %s is open",
+				worker_pod, shard_id)
+		}
+		if !isConnReachable(worker_client.conn) {
+			return fmt.Errorf("worker %s owning shard %s is unreachable", worker_pod,
+				shard_id)
+		}
+	}
+	return nil
+}
+
+// Helper method to check whether a standby control manager can forward
+// requests to the leader.
+func (cm *ControlManager) checkLeaderReachable() error {
+	if !cm.config.ForwardToLeader {
+		return errors.New("not the leader and requests are not forwarded")
+	}
+	cm.current_leader.leader_lock.RLock()
+	address := cm.current_leader.address
+	conn := cm.current_leader.conn
+	cm.current_leader.leader_lock.RUnlock()
+	if conn == nil {
+		return errors.New("no control manager leader is known yet")
+	}
+	if !isConnReachable(conn) {
+		return fmt.Errorf("leader at %s is unreachable", address)
+	}
+	return nil
+}
+
+// Helper method to check whether a connection is usable. Idle connections
+// are asked to connect, so that the next check tells whether the peer is
+// reachable.
+func isConnReachable(conn *grpc.ClientConn) bool {
+	switch conn.GetState() {
+	case connectivity.Idle:
+		conn.Connect()
+	case connectivity.TransientFailure, connectivity.Shutdown:
+		return false
+	}
+	return true
+}
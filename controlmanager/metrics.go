@@ -0,0 +1,159 @@
+package controlmanager
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/connectivity"
+	"kvstore/metrics"
+	pb "kvstore/protos"
+	"strconv"
+)
+
+//------------------------------------------------------------------------------
+// CONTROL MANAGER METRICS
+//------------------------------------------------------------------------------
+
+// Prometheus metrics of a control manager.
+type controlManagerMetrics struct {
+	registry *prometheus.Registry
+	rpcs     *metrics.ServerMetrics
+	// Latency of every attempt of an RPC sent to a worker.
+	worker_rpcs *metrics.ClientMetrics
+	// Number of times the observed leader changed.
+	leader_changes prometheus.Counter
+}
+
+// Helper method to create the metrics of a control manager.
+func newControlManagerMetrics(cm *ControlManager) *controlManagerMetrics {
+	registry := metrics.NewRegistry()
+	m := &controlManagerMetrics{
+		registry: registry,
+		rpcs:     metrics.NewServerMetrics(registry),
+		worker_rpcs: metrics.NewClientMetrics(registry,
+			"control_manager_worker_rpc_duration_seconds",
+			"Latency of every attempt of an RPC sent to a worker, by worker, method and ErrorCode.",
+			"worker"),
+		leader_changes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: "control_manager",
+			Name:      "leader_changes_total",
+			Help:      "Number of times the observed control manager leader changed.",
+		}),
+	}
+	is_leader := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "control_manager",
+		Name:      "is_leader",
+		Help:      "1 if this control manager is the elected leader, 0 otherwise.",
+	}, func() float64 {
+		if cm.IsLeader() {
+			return 1
+		}
+		return 0
+	})
+	registry.MustRegister(m.leader_changes, is_leader, &workerClientCollector{cm: cm})
+	return m
+}
+
+// Registry holding the metrics of the control manager.
+func (cm *ControlManager) Metrics() *prometheus.Registry {
+	return cm.metrics.registry
+}
+
+// Descriptions of the per worker metrics. States are reported with one
+// series per possible state, set to 1 for the current state.
+var (
+	workerStateDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "control_manager", "worker_state"),
+		"Registration state of the worker.",
+		[]string{"worker", "state"}, nil)
+	workerConnectionStateDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "control_manager", "worker_connection_state"),
+		"State of the gRPC connection to the worker.",
+		[]string{"worker", "state"}, nil)
+	workerBreakerStateDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "control_manager", "worker_breaker_state"),
+		"State of the circuit breaker of the worker.",
+		[]string{"worker", "state"}, nil)
+	workerConsecutiveFailuresDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "control_manager", "worker_consecutive_failures"),
+		"Number of consecutive failed RPCs to the worker.",
+		[]string{"worker"}, nil)
+	unownedShardsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "control_manager", "unowned_shards"),
+		"Number of shards without a registered worker.",
+		nil, nil)
+)
+
+// States of a gRPC connection.
+var connectivityStates = []connectivity.State{
+	connectivity.Idle,
+	connectivity.Connecting,
+	connectivity.Ready,
+	connectivity.TransientFailure,
+	connectivity.Shutdown,
+}
+
+// Collector of the state of the RPC clients of the registered workers, as
+// reported by GetClusterStatus.
+type workerClientCollector struct {
+	cm *ControlManager
+}
+
+func (c *workerClientCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- workerStateDesc
+	ch <- workerConnectionStateDesc
+	ch <- workerBreakerStateDesc
+	ch <- workerConsecutiveFailuresDesc
+	ch <- unownedShardsDesc
+}
+
+// Helper method to report the current state of an enum-like metric.
+func collectState(ch chan<- prometheus.Metric, desc *prometheus.Desc, worker_pod string,
+	states []string, current string) {
+	for _, state := range states {
+		value := 0.0
+		if state == current {
+			value = 1
+		}
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, worker_pod, state)
+	}
+}
+
+// Helper method to get the names of the values of a proto enum.
+func enumNames(names map[int32]string) []string {
+	var states []string
+	for _, name := range names {
+		states = append(states, name)
+	}
+	return states
+}
+
+func (c *workerClientCollector) Collect(ch chan<- prometheus.Metric) {
+	worker_states := enumNames(pb.WorkerState_name)
+	breaker_states := enumNames(pb.CircuitBreakerState_name)
+	var connection_states []string
+	for _, state := range connectivityStates {
+		connection_states = append(connection_states, state.String())
+	}
+	c.cm.worker_clients.worker_clients_lock.RLock()
+	defer c.cm.worker_clients.worker_clients_lock.RUnlock()
+	for worker_pod, worker_client := range c.cm.worker_clients.workers {
+		breaker_state, consecutive_failures := worker_client.breaker.GetState()
+		collectState(ch, workerStateDesc, worker_pod, worker_states,
+			worker_client.registration.GetState().String())
+		collectState(ch, workerConnectionStateDesc, worker_pod, connection_states,
+			worker_client.conn.GetState().String())
+		collectState(ch, workerBreakerStateDesc, worker_pod, breaker_states,
+			breaker_state.String())
+		ch <- prometheus.MustNewConstMetric(workerConsecutiveFailuresDesc,
+			prometheus.GaugeValue, float64(consecutive_failures), worker_pod)
+	}
+	num_unowned := 0
+	for shard_num := 0; shard_num < c.cm.config.NumShards; shard_num++ {
+		if _, exists := c.cm.worker_clients.shard_map[strconv.Itoa(shard_num)]; !exists {
+			num_unowned++
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(unownedShardsDesc, prometheus.GaugeValue,
+		float64(num_unowned))
+}
@@ -0,0 +1,966 @@
+package controlmanager
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"kvstore/logging"
+	pb "kvstore/protos"
+	"log/slog"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+// REDIS (RESP) FRONT END
+//------------------------------------------------------------------------------
+
+// The Redis front end lets redis-cli and Redis client libraries talk to the
+// kvstore. Connections speak RESP2 until they switch to RESP3 through HELLO.
+// Commands are served by the same handlers as the gRPC server, so standby
+// control managers forward them to the leader as usual. Multi key commands
+// are applied key by key and are not atomic.
+
+// Limits on the size of a single command.
+const (
+	maxRespBulkLength   = 16 << 20
+	maxRespArrayLength  = 1 << 20
+	maxRespInlineLength = 64 << 10
+)
+
+// Number of SCAN cursors remembered by the front end. Older cursors are
+// dropped and fail with an invalid cursor error.
+const maxRespScanCursors = 10000
+
+// Default COUNT of a SCAN.
+const defaultRespScanCount = 10
+
+// Number of attempts of the compare-and-set loop of INCR before giving up
+// because of concurrent writers.
+const maxRespIncrAttempts = 16
+
+// Returned by the command parser for requests breaking the protocol. The
+// connection is closed after replying with the error.
+var errRespProtocol = errors.New("protocol error")
+
+// Client connection to the Redis front end.
+type respConn struct {
+	cm     *ControlManager
+	id     int64
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+	// RESP version negotiated through HELLO, 2 or 3.
+	protocol int
+}
+
+// Reply error of a command. The message is sent to the client as is.
+type respError string
+
+func (e respError) Error() string { return string(e) }
+
+// Command handler. Returns a respError to reply with an error, any other
+// error closes the connection.
+type respCommand struct {
+	// Minimum number of arguments including the command name. Negative if
+	// the command takes exactly -arity arguments.
+	arity   int
+	handler func(ctx context.Context, c *respConn, args []string) error
+}
+
+// Commands supported by the front end, keyed by their upper case name.
+var respCommands = map[string]respCommand{
+	"PING":    {1, handleRespPing},
+	"ECHO":    {-2, handleRespEcho},
+	"HELLO":   {1, handleRespHello},
+	"SELECT":  {-2, handleRespSelect},
+	"CLIENT":  {2, handleRespClient},
+	"COMMAND": {1, handleRespCommand},
+	"QUIT":    {1, handleRespQuit},
+	"GET":     {-2, handleRespGet},
+	"SET":     {3, handleRespSet},
+	"DEL":     {2, handleRespDel},
+	"EXISTS":  {2, handleRespExists},
+	"MGET":    {2, handleRespMget},
+	"MSET":    {3, handleRespMset},
+	"INCR":    {-2, handleRespIncr},
+	"TTL":     {-2, handleRespTtl},
+	"PTTL":    {-2, handleRespTtl},
+	"SCAN":    {2, handleRespScan},
+}
+
+//------------------------------------------------------------------------------
+// RESP ENCODING
+//------------------------------------------------------------------------------
+
+// Helper method to strip line breaks, which simple strings and errors cannot
+// carry.
+func sanitizeRespLine(line string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(line)
+}
+
+func (c *respConn) writeSimpleString(s string) {
+	c.writer.WriteString("+" + sanitizeRespLine(s) + "\r\n")
+}
+
+func (c *respConn) writeError(message string) {
+	c.writer.WriteString("-" + sanitizeRespLine(message) + "\r\n")
+}
+
+func (c *respConn) writeInteger(n int64) {
+	c.writer.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (c *respConn) writeBulkString(s string) {
+	c.writer.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func (c *respConn) writeNull() {
+	if c.protocol == 3 {
+		c.writer.WriteString("_\r\n")
+		return
+	}
+	c.writer.WriteString("$-1\r\n")
+}
+
+func (c *respConn) writeArrayHeader(n int) {
+	c.writer.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+// RESP2 has no maps, they are sent as flat arrays of keys and values.
+func (c *respConn) writeMapHeader(n int) {
+	if c.protocol == 3 {
+		c.writer.WriteString("%" + strconv.Itoa(n) + "\r\n")
+		return
+	}
+	c.writeArrayHeader(2 * n)
+}
+
+// Helper method to convert a KvError into a reply error.
+func respErrorFromKvError(kv_error *pb.KvError) respError {
+	if kv_error.GetErrorType() == pb.ErrorCode_kInvalidArgument {
+		return respError("ERR " + kv_error.GetErrorDetails())
+	}
+	message := fmt.Sprintf("ERR %s %s", kv_error.GetErrorType(), kv_error.GetErrorDetails())
+	if kv_error.GetLeaderAddress() != "" {
+		message += " leader at " + kv_error.GetLeaderAddress()
+	}
+	return respError(message)
+}
+
+func respWrongArgs(command string) respError {
+	return respError(fmt.Sprintf("ERR wrong number of arguments for '%s' command",
+		strings.ToLower(command)))
+}
+
+const (
+	respSyntaxError     = respError("ERR syntax error")
+	respNotIntegerError = respError("ERR value is not an integer or out of range")
+	// The kvstore does not store empty values, which Redis allows.
+	respEmptyValueError = respError("ERR empty values are not supported")
+)
+
+//------------------------------------------------------------------------------
+// RESP DECODING
+//------------------------------------------------------------------------------
+
+// Helper method to read a line terminated by CRLF, without the terminator.
+func (c *respConn) readLine() (string, error) {
+	line, err := c.reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		// Long inline commands do not fit the buffer, keep reading.
+		buf := append([]byte(nil), line...)
+		for err == bufio.ErrBufferFull && len(buf) <= maxRespInlineLength {
+			line, err = c.reader.ReadSlice('\n')
+			buf = append(buf, line...)
+		}
+		if err == bufio.ErrBufferFull {
+			return "", fmt.Errorf("%w: line too long", errRespProtocol)
+		}
+		line = buf
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("%w: expected CRLF", errRespProtocol)
+	}
+	return string(line[:len(line)-2]), nil
+}
+
+// Helper method to read the length following a type byte.
+func (c *respConn) readLength(type_byte byte, max_length int) (int, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return 0, err
+	}
+	if len(line) == 0 || line[0] != type_byte {
+		return 0, fmt.Errorf("%w: expected '%c', got '%s'", errRespProtocol, type_byte, line)
+	}
+	length, err := strconv.Atoi(line[1:])
+	if err != nil || length < 0 || length > max_length {
+		return 0, fmt.Errorf("%w: invalid length", errRespProtocol)
+	}
+	return length, nil
+}
+
+// Helper method to read the next command, either as an array of bulk strings
+// or as an inline command. Returns no arguments for empty inline commands.
+func (c *respConn) readCommand() ([]string, error) {
+	first, err := c.reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] != '*' {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		return strings.Fields(line), nil
+	}
+	num_args, err := c.readLength('*', maxRespArrayLength)
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, 0, min(num_args, 1024))
+	for i := 0; i < num_args; i++ {
+		length, err := c.readLength('$', maxRespBulkLength)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, length+2)
+		if _, err := io.ReadFull(c.reader, buf); err != nil {
+			return nil, err
+		}
+		if buf[length] != '\r' || buf[length+1] != '\n' {
+			return nil, fmt.Errorf("%w: expected CRLF", errRespProtocol)
+		}
+		args = append(args, string(buf[:length]))
+	}
+	return args, nil
+}
+
+//------------------------------------------------------------------------------
+// CONNECTION HANDLING
+//------------------------------------------------------------------------------
+
+// Helper method to serve the Redis front end if it is enabled.
+func (cm *ControlManager) MayBeStartRedisServer() error {
+	if cm.config.RedisPort == 0 {
+		return nil
+	}
+	lis, err := net.Listen("tcp", net.JoinHostPort(cm.config.ListenHost,
+		strconv.Itoa(cm.config.RedisPort)))
+	if err != nil {
+		return fmt.Errorf("failed to listen for redis front end: %v", err)
+	}
+	cm.frontend_logger.Info("Redis front end listening", slog.String("address", lis.Addr().String()))
+	cm.redis_listener = lis
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				if cm.ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+					return
+				}
+				cm.frontend_logger.Error("Failed to accept redis connection", logging.Err(err))
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			go cm.serveRespConn(conn)
+		}
+	}()
+	return nil
+}
+
+// Helper method to track an open client connection. Returns false if the
+// control manager stops already, in which case the connection is closed.
+func (cm *ControlManager) addRespConn(conn net.Conn) bool {
+	cm.resp_conns_lock.Lock()
+	defer cm.resp_conns_lock.Unlock()
+	if cm.ctx.Err() != nil || cm.resp_draining {
+		conn.Close()
+		return false
+	}
+	cm.resp_conns[conn] = false
+	return true
+}
+
+// Helper method to mark a client connection as serving a command or as idle.
+// Returns false once the control manager drains, in which case the
+// connection must be closed instead.
+func (cm *ControlManager) setRespConnBusy(conn net.Conn, is_busy bool) bool {
+	cm.resp_conns_lock.Lock()
+	defer cm.resp_conns_lock.Unlock()
+	if cm.resp_draining {
+		return false
+	}
+	cm.resp_conns[conn] = is_busy
+	return true
+}
+
+// Helper method to check whether the control manager drains the client
+// connections.
+func (cm *ControlManager) isDrainingRespConns() bool {
+	cm.resp_conns_lock.Lock()
+	defer cm.resp_conns_lock.Unlock()
+	return cm.resp_draining
+}
+
+// Helper method to close the idle client connections and wait until the
+// others finished the command they serve. Returns false if ctx is done
+// first.
+func (cm *ControlManager) drainRespConns(ctx context.Context) bool {
+	cm.resp_conns_lock.Lock()
+	cm.resp_draining = true
+	for conn, is_busy := range cm.resp_conns {
+		if !is_busy {
+			conn.Close()
+		}
+	}
+	cm.resp_conns_lock.Unlock()
+	for {
+		cm.resp_conns_lock.Lock()
+		num_conns := len(cm.resp_conns)
+		cm.resp_conns_lock.Unlock()
+		if num_conns == 0 {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// Helper method to stop tracking a closed client connection.
+func (cm *ControlManager) removeRespConn(conn net.Conn) {
+	cm.resp_conns_lock.Lock()
+	defer cm.resp_conns_lock.Unlock()
+	delete(cm.resp_conns, conn)
+}
+
+// Helper method to close all open client connections.
+func (cm *ControlManager) closeRespConns() {
+	cm.resp_conns_lock.Lock()
+	defer cm.resp_conns_lock.Unlock()
+	for conn := range cm.resp_conns {
+		conn.Close()
+		delete(cm.resp_conns, conn)
+	}
+}
+
+// Helper method to serve the commands of a client connection until it is
+// closed.
+func (cm *ControlManager) serveRespConn(conn net.Conn) {
+	if !cm.addRespConn(conn) {
+		return
+	}
+	defer cm.removeRespConn(conn)
+	defer conn.Close()
+	// Requests of the connection are cancelled once it is closed.
+	ctx, cancel := context.WithCancel(cm.ctx)
+	defer cancel()
+	c := &respConn{
+		cm:       cm,
+		id:       cm.resp_client_id.Add(1),
+		conn:     conn,
+		reader:   bufio.NewReader(conn),
+		writer:   bufio.NewWriter(conn),
+		protocol: 2,
+	}
+	for {
+		args, err := c.readCommand()
+		if errors.Is(err, errRespProtocol) {
+			c.writeError("ERR Protocol error: " + err.Error())
+			c.writer.Flush()
+			return
+		}
+		if err != nil {
+			// Idle connections are closed when we drain.
+			if err != io.EOF && !cm.isDrainingRespConns() {
+				c.cm.frontend_logger.Warn("Closing redis connection",
+					slog.String("remote_address", conn.RemoteAddr().String()), logging.Err(err))
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if !cm.setRespConnBusy(conn, true) {
+			c.writer.Flush()
+			return
+		}
+		err = c.dispatch(ctx, args)
+		var reply_error respError
+		if errors.As(err, &reply_error) {
+			c.writeError(string(reply_error))
+		} else if err != nil {
+			c.writer.Flush()
+			return
+		}
+		// Flush once all pipelined commands are answered.
+		if c.reader.Buffered() == 0 {
+			if err := c.writer.Flush(); err != nil {
+				return
+			}
+		}
+		// The connection is closed once its command is answered if we drain.
+		if !cm.setRespConnBusy(conn, false) {
+			c.writer.Flush()
+			return
+		}
+	}
+}
+
+// Helper method to run a single command.
+func (c *respConn) dispatch(ctx context.Context, args []string) error {
+	name := strings.ToUpper(args[0])
+	command, exists := respCommands[name]
+	if !exists {
+		return respError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	}
+	if (command.arity > 0 && len(args) < command.arity) ||
+		(command.arity < 0 && len(args) != -command.arity) {
+		return respWrongArgs(name)
+	}
+	args[0] = name
+	ctx, span := c.cm.tracer.StartServer(ctx, "RESP "+name)
+	defer span.End()
+	return command.handler(ctx, c, args)
+}
+
+//------------------------------------------------------------------------------
+// CONNECTION COMMANDS
+//------------------------------------------------------------------------------
+
+func handleRespPing(ctx context.Context, c *respConn, args []string) error {
+	switch len(args) {
+	case 1:
+		c.writeSimpleString("PONG")
+	case 2:
+		c.writeBulkString(args[1])
+	default:
+		return respWrongArgs(args[0])
+	}
+	return nil
+}
+
+func handleRespEcho(ctx context.Context, c *respConn, args []string) error {
+	c.writeBulkString(args[1])
+	return nil
+}
+
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+func handleRespHello(ctx context.Context, c *respConn, args []string) error {
+	protocol := c.protocol
+	if len(args) > 1 {
+		version, err := strconv.Atoi(args[1])
+		if err != nil {
+			return respError("ERR Protocol version is not an integer or out of range")
+		}
+		if version != 2 && version != 3 {
+			return respError("NOPROTO unsupported protocol version")
+		}
+		protocol = version
+	}
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "AUTH":
+			// The kvstore has no users, any credentials are accepted.
+			i += 2
+		case "SETNAME":
+			i++
+		default:
+			return respSyntaxError
+		}
+		if i >= len(args) {
+			return respSyntaxError
+		}
+	}
+	c.protocol = protocol
+	c.writeMapHeader(7)
+	c.writeBulkString("server")
+	c.writeBulkString("kvstore")
+	c.writeBulkString("version")
+	c.writeBulkString("1.0.0")
+	c.writeBulkString("proto")
+	c.writeInteger(int64(c.protocol))
+	c.writeBulkString("id")
+	c.writeInteger(c.id)
+	c.writeBulkString("mode")
+	c.writeBulkString("standalone")
+	c.writeBulkString("role")
+	c.writeBulkString("master")
+	c.writeBulkString("modules")
+	c.writeArrayHeader(0)
+	return nil
+}
+
+// The kvstore has a single database.
+func handleRespSelect(ctx context.Context, c *respConn, args []string) error {
+	if args[1] != "0" {
+		return respError("ERR DB index is out of range")
+	}
+	c.writeSimpleString("OK")
+	return nil
+}
+
+// Client libraries announce themselves through CLIENT SETNAME and SETINFO on
+// connect. We accept and ignore both.
+func handleRespClient(ctx context.Context, c *respConn, args []string) error {
+	switch strings.ToUpper(args[1]) {
+	case "SETNAME", "SETINFO":
+		c.writeSimpleString("OK")
+	case "ID":
+		c.writeInteger(c.id)
+	default:
+		return respError(fmt.Sprintf("ERR unknown subcommand '%s'", args[1]))
+	}
+	return nil
+}
+
+// redis-cli fetches the command docs on connect. We have none to offer.
+func handleRespCommand(ctx context.Context, c *respConn, args []string) error {
+	c.writeArrayHeader(0)
+	return nil
+}
+
+func handleRespQuit(ctx context.Context, c *respConn, args []string) error {
+	c.writeSimpleString("OK")
+	return io.EOF
+}
+
+//------------------------------------------------------------------------------
+// KEY VALUE COMMANDS
+//------------------------------------------------------------------------------
+
+// Helper method to fetch a key. Returns nil if the key does not exist.
+func (cm *ControlManager) getKeyForResp(ctx context.Context, key string) (*pb.GetKeyRet, error) {
+	ret, _ := cm.kv_server.GetKey(ctx, &pb.GetKeyArg{Key: key})
+	switch ret.GetKvError().GetErrorType() {
+	case pb.ErrorCode_kNoError:
+		return ret, nil
+	case pb.ErrorCode_kNotFound:
+		return nil, nil
+	}
+	return nil, respErrorFromKvError(ret.GetKvError())
+}
+
+// Helper method to write a key. Returns false if the condition of the write
+// did not hold.
+func (cm *ControlManager) putKeyForResp(ctx context.Context, in *pb.PutKeyArg) (bool, error) {
+	ret, _ := cm.kv_server.PutKey(ctx, in)
+	switch ret.GetKvError().GetErrorType() {
+	case pb.ErrorCode_kNoError:
+		return true, nil
+	case pb.ErrorCode_kConditionFailed:
+		return false, nil
+	}
+	return false, respErrorFromKvError(ret.GetKvError())
+}
+
+// GET key
+func handleRespGet(ctx context.Context, c *respConn, args []string) error {
+	ret, err := c.cm.getKeyForResp(ctx, args[1])
+	if err != nil {
+		return err
+	}
+	if ret == nil {
+		c.writeNull()
+		return nil
+	}
+	c.writeBulkString(ret.GetValue())
+	return nil
+}
+
+// Helper method to parse a positive expiry argument of SET.
+func parseRespExpiry(arg string, unit time.Duration) (int64, error) {
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, respNotIntegerError
+	}
+	if n <= 0 || n > math.MaxInt64/int64(unit/time.Millisecond) {
+		return 0, respError("ERR invalid expire time in 'set' command")
+	}
+	return n * int64(unit/time.Millisecond), nil
+}
+
+// SET key value [NX | XX] [EX seconds | PX milliseconds]
+func handleRespSet(ctx context.Context, c *respConn, args []string) error {
+	if args[2] == "" {
+		return respEmptyValueError
+	}
+	in := &pb.PutKeyArg{Key: args[1], Value: args[2]}
+	has_expiry := false
+	for i := 3; i < len(args); i++ {
+		option := strings.ToUpper(args[i])
+		switch {
+		case option == "NX" && in.Condition == nil:
+			in.Condition = &pb.WriteCondition{IfNotExists: true}
+		case option == "XX" && in.Condition == nil:
+			in.Condition = &pb.WriteCondition{IfExists: true}
+		case (option == "EX" || option == "PX") && !has_expiry && i+1 < len(args):
+			unit := time.Second
+			if option == "PX" {
+				unit = time.Millisecond
+			}
+			ttl_ms, err := parseRespExpiry(args[i+1], unit)
+			if err != nil {
+				return err
+			}
+			in.TtlMs = ttl_ms
+			has_expiry = true
+			i++
+		default:
+			return respSyntaxError
+		}
+	}
+	applied, err := c.cm.putKeyForResp(ctx, in)
+	if err != nil {
+		return err
+	}
+	if !applied {
+		c.writeNull()
+		return nil
+	}
+	c.writeSimpleString("OK")
+	return nil
+}
+
+// DEL key [key ...]
+func handleRespDel(ctx context.Context, c *respConn, args []string) error {
+	var num_deleted int64
+	for _, key := range args[1:] {
+		ret, _ := c.cm.kv_server.DeleteKey(ctx, &pb.DeleteKeyArg{Key: key})
+		switch ret.GetKvError().GetErrorType() {
+		case pb.ErrorCode_kNoError:
+			num_deleted++
+		case pb.ErrorCode_kNotFound:
+		default:
+			return respErrorFromKvError(ret.GetKvError())
+		}
+	}
+	c.writeInteger(num_deleted)
+	return nil
+}
+
+// EXISTS key [key ...]
+func handleRespExists(ctx context.Context, c *respConn, args []string) error {
+	var num_existing int64
+	for _, key := range args[1:] {
+		ret, err := c.cm.getKeyForResp(ctx, key)
+		if err != nil {
+			return err
+		}
+		if ret != nil {
+			num_existing++
+		}
+	}
+	c.writeInteger(num_existing)
+	return nil
+}
+
+// MGET key [key ...]
+func handleRespMget(ctx context.Context, c *respConn, args []string) error {
+	values := make([]*pb.GetKeyRet, len(args)-1)
+	for i, key := range args[1:] {
+		ret, err := c.cm.getKeyForResp(ctx, key)
+		if err != nil {
+			return err
+		}
+		values[i] = ret
+	}
+	c.writeArrayHeader(len(values))
+	for _, ret := range values {
+		if ret == nil {
+			c.writeNull()
+		} else {
+			c.writeBulkString(ret.GetValue())
+		}
+	}
+	return nil
+}
+
+// MSET key value [key value ...]
+func handleRespMset(ctx context.Context, c *respConn, args []string) error {
+	if len(args)%2 != 1 {
+		return respWrongArgs(args[0])
+	}
+	// Checked upfront so that no key is written if any value is rejected.
+	for i := 2; i < len(args); i += 2 {
+		if args[i] == "" {
+			return respEmptyValueError
+		}
+	}
+	for i := 1; i < len(args); i += 2 {
+		if _, err := c.cm.putKeyForResp(ctx, &pb.PutKeyArg{Key: args[i], Value: args[i+1]}); err != nil {
+			return err
+		}
+	}
+	c.writeSimpleString("OK")
+	return nil
+}
+
+// INCR key. Implemented as a compare-and-set on the db_modified_ts of the
+// value read, which keeps the expiry of the key.
+func handleRespIncr(ctx context.Context, c *respConn, args []string) error {
+	key := args[1]
+	for attempt := 0; attempt < maxRespIncrAttempts; attempt++ {
+		ret, err := c.cm.getKeyForResp(ctx, key)
+		if err != nil {
+			return err
+		}
+		in := &pb.PutKeyArg{Key: key}
+		var value int64
+		if ret == nil {
+			in.Condition = &pb.WriteCondition{IfNotExists: true}
+		} else {
+			value, err = strconv.ParseInt(ret.GetValue(), 10, 64)
+			if err != nil {
+				return respNotIntegerError
+			}
+			in.Condition = &pb.WriteCondition{IfDbModifiedTs: ret.GetDbModifiedTs()}
+			if ret.GetExpiresAtMs() != 0 {
+				in.TtlMs = max(ret.GetExpiresAtMs()-time.Now().UnixMilli(), 1)
+			}
+		}
+		if value == math.MaxInt64 {
+			return respError("ERR increment or decrement would overflow")
+		}
+		value++
+		in.Value = strconv.FormatInt(value, 10)
+		applied, err := c.cm.putKeyForResp(ctx, in)
+		if err != nil {
+			return err
+		}
+		if applied {
+			c.writeInteger(value)
+			return nil
+		}
+	}
+	return respError("ERR too many concurrent updates of key " + key)
+}
+
+// TTL key and PTTL key. Reply -2 if the key does not exist and -1 if it has
+// no expiry.
+func handleRespTtl(ctx context.Context, c *respConn, args []string) error {
+	ret, err := c.cm.getKeyForResp(ctx, args[1])
+	if err != nil {
+		return err
+	}
+	switch {
+	case ret == nil:
+		c.writeInteger(-2)
+	case ret.GetExpiresAtMs() == 0:
+		c.writeInteger(-1)
+	default:
+		ttl_ms := max(ret.GetExpiresAtMs()-time.Now().UnixMilli(), 0)
+		if args[0] == "PTTL" {
+			c.writeInteger(ttl_ms)
+		} else {
+			c.writeInteger((ttl_ms + 500) / 1000)
+		}
+	}
+	return nil
+}
+
+//------------------------------------------------------------------------------
+// SCAN
+//------------------------------------------------------------------------------
+
+// Redis cursors are integers, while ScanKeys continues after the last key
+// returned. The front end maps the cursors it hands out to those keys. Client
+// libraries parse cursors as integers, so the key cannot be encoded in the
+// cursor itself. Cursors therefore live in the memory of the control manager
+// handing them out: a scan must be continued on the same control manager, and
+// fails with an invalid cursor error after it restarts. A change of leader
+// does not break the scans of a standby, whose requests carry the key.
+type respScanCursorMap struct {
+	cursors_lock sync.Mutex
+	last_cursor  uint64
+	// Key is the cursor, value is the key the scan continues after.
+	start_after map[uint64]string
+	// Cursors in the order they were handed out, oldest first.
+	order []uint64
+}
+
+// Helper method to instantiate an empty cursor map.
+func CreateRespScanCursorMap() *respScanCursorMap {
+	return &respScanCursorMap{start_after: make(map[uint64]string)}
+}
+
+// Helper method to hand out a cursor continuing after key.
+func (m *respScanCursorMap) Add(key string) uint64 {
+	m.cursors_lock.Lock()
+	defer m.cursors_lock.Unlock()
+	m.last_cursor++
+	m.start_after[m.last_cursor] = key
+	m.order = append(m.order, m.last_cursor)
+	if len(m.order) > maxRespScanCursors {
+		delete(m.start_after, m.order[0])
+		m.order = m.order[1:]
+	}
+	return m.last_cursor
+}
+
+// Helper method to get the key a cursor continues after.
+func (m *respScanCursorMap) Get(cursor uint64) (string, bool) {
+	m.cursors_lock.Lock()
+	defer m.cursors_lock.Unlock()
+	key, exists := m.start_after[cursor]
+	return key, exists
+}
+
+// Helper method to get the literal prefix of a glob pattern, which is used as
+// the prefix of the scan.
+func getGlobPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, "*?[\\"); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// Helper method to match s against a Redis style glob pattern supporting
+// *, ?, [abc], [^abc], [a-z] and backslash escapes. On a mismatch, only the
+// last * seen is extended by one byte, which keeps the matching linear in
+// the length of s for every star instead of exponential.
+func matchGlob(pattern string, s string) bool {
+	p, i := 0, 0
+	// Position after the last * of pattern, and the position in s matched by
+	// the pattern following it, -1 if no * was seen yet.
+	star_p, star_i := -1, 0
+	for i < len(s) {
+		if p < len(pattern) && pattern[p] == '*' {
+			p++
+			star_p, star_i = p, i
+			continue
+		}
+		if p < len(pattern) {
+			if width, matched := matchGlobByte(pattern[p:], s[i]); matched {
+				p += width
+				i++
+				continue
+			}
+		}
+		if star_p < 0 {
+			return false
+		}
+		// Let the last * swallow one more byte and retry from there.
+		star_i++
+		p, i = star_p, star_i
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// Helper method to match the byte c against the first element of pattern,
+// which is not a *. Returns the width of the element in pattern and whether
+// c matches it.
+func matchGlobByte(pattern string, c byte) (int, bool) {
+	switch pattern[0] {
+	case '?':
+		return 1, true
+	case '[':
+		end := strings.IndexByte(pattern[1:], ']')
+		if end < 0 {
+			// Unterminated classes match literally.
+			return 1, c == '['
+		}
+		class := pattern[1 : end+1]
+		negate := strings.HasPrefix(class, "^")
+		if negate {
+			class = class[1:]
+		}
+		matched := false
+		for i := 0; i < len(class); i++ {
+			if i+2 < len(class) && class[i+1] == '-' {
+				if class[i] <= c && c <= class[i+2] {
+					matched = true
+				}
+				i += 2
+			} else if class[i] == c {
+				matched = true
+			}
+		}
+		return end + 2, matched != negate
+	case '\\':
+		if len(pattern) > 1 {
+			return 2, pattern[1] == c
+		}
+	}
+	return 1, pattern[0] == c
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count]
+func handleRespScan(ctx context.Context, c *respConn, args []string) error {
+	cursor, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return respError("ERR invalid cursor")
+	}
+	var start_after string
+	if cursor != 0 {
+		var exists bool
+		if start_after, exists = c.cm.resp_scan_cursors.Get(cursor); !exists {
+			return respError("ERR invalid cursor")
+		}
+	}
+	pattern := "*"
+	count := int64(defaultRespScanCount)
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return respSyntaxError
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			count, err = strconv.ParseInt(args[i+1], 10, 32)
+			if err != nil {
+				return respNotIntegerError
+			}
+			if count < 1 {
+				return respSyntaxError
+			}
+			count = min(count, maxScanLimit)
+		default:
+			return respSyntaxError
+		}
+	}
+	ret, _ := c.cm.kv_server.ScanKeys(ctx, &pb.ScanKeysArg{
+		Prefix:     getGlobPrefix(pattern),
+		StartAfter: start_after,
+		Limit:      int32(count),
+	})
+	if ret.GetKvError().GetErrorType() != pb.ErrorCode_kNoError {
+		return respErrorFromKvError(ret.GetKvError())
+	}
+	// As with Redis, MATCH is applied after fetching count keys so a page may
+	// come back empty while the scan is not done yet.
+	var keys []string
+	for _, entry := range ret.GetEntries() {
+		if matchGlob(pattern, entry.GetKey()) {
+			keys = append(keys, entry.GetKey())
+		}
+	}
+	next_cursor := uint64(0)
+	if entries := ret.GetEntries(); ret.GetHasMore() && len(entries) > 0 {
+		next_cursor = c.cm.resp_scan_cursors.Add(entries[len(entries)-1].GetKey())
+	}
+	c.writeArrayHeader(2)
+	c.writeBulkString(strconv.FormatUint(next_cursor, 10))
+	c.writeArrayHeader(len(keys))
+	for _, key := range keys {
+		c.writeBulkString(key)
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package controlmanager
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"kvstore/logging"
+	pb "kvstore/protos"
+	"kvstore/tracing"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+// CIRCUIT BREAKER FOR WORKER RPCS
+//------------------------------------------------------------------------------
+
+// Per worker circuit breaker. After failure_threshold consecutive failures
+// the breaker opens and RPCs to the worker fail fast. Once open_duration has
+// passed a single probe RPC is let through; the breaker closes if it succeeds
+// and opens again if it fails. A nil breaker lets every RPC through.
+type CircuitBreaker struct {
+	breaker_lock         sync.Mutex
+	state                pb.CircuitBreakerState
+	consecutive_failures int32
+	opened_at            time.Time
+	probe_in_flight      bool
+	failure_threshold    int
+	open_duration        time.Duration
+	logger               *slog.Logger
+}
+
+// Helper method to instantiate a new closed circuit breaker. State changes
+// are logged through logger.
+func CreateCircuitBreaker(failure_threshold int, open_duration time.Duration,
+	logger *slog.Logger) *CircuitBreaker {
+	return &CircuitBreaker{
+		state:             pb.CircuitBreakerState_kBreakerClosed,
+		failure_threshold: failure_threshold,
+		open_duration:     open_duration,
+		logger:            logger,
+	}
+}
+
+// Helper method to change the settings of the breaker, e.g. when the config
+// is reloaded. The state of the breaker is kept.
+func (b *CircuitBreaker) Reconfigure(failure_threshold int, open_duration time.Duration) {
+	b.breaker_lock.Lock()
+	defer b.breaker_lock.Unlock()
+	b.failure_threshold = failure_threshold
+	b.open_duration = open_duration
+}
+
+// Returns true if an RPC may be sent to the worker.
+func (b *CircuitBreaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+	b.breaker_lock.Lock()
+	defer b.breaker_lock.Unlock()
+	switch b.state {
+	case pb.CircuitBreakerState_kBreakerOpen:
+		if time.Since(b.opened_at) < b.open_duration {
+			return false
+		}
+		// Let a single probe through to check whether the worker recovered.
+		b.state = pb.CircuitBreakerState_kBreakerHalfOpen
+		b.probe_in_flight = true
+		return true
+	case pb.CircuitBreakerState_kBreakerHalfOpen:
+		if b.probe_in_flight {
+			return false
+		}
+		b.probe_in_flight = true
+		return true
+	}
+	return true
+}
+
+// Record a successful RPC to the worker.
+func (b *CircuitBreaker) RecordSuccess() {
+	if b == nil {
+		return
+	}
+	b.breaker_lock.Lock()
+	defer b.breaker_lock.Unlock()
+	b.state = pb.CircuitBreakerState_kBreakerClosed
+	b.consecutive_failures = 0
+	b.probe_in_flight = false
+}
+
+// Record a failed RPC to the worker.
+func (b *CircuitBreaker) RecordFailure() {
+	if b == nil {
+		return
+	}
+	b.breaker_lock.Lock()
+	defer b.breaker_lock.Unlock()
+	b.consecutive_failures++
+	b.probe_in_flight = false
+	if b.state == pb.CircuitBreakerState_kBreakerHalfOpen ||
+		b.consecutive_failures >= int32(b.failure_threshold) {
+		if b.state != pb.CircuitBreakerState_kBreakerOpen {
+			b.logger.Warn("Opening circuit breaker",
+				slog.Int("consecutive_failures", int(b.consecutive_failures)))
+		}
+		b.state = pb.CircuitBreakerState_kBreakerOpen
+		b.opened_at = time.Now()
+	}
+}
+
+// Record an RPC whose outcome says nothing about the worker health, for
+// example one cancelled by the client.
+func (b *CircuitBreaker) RecordIgnored() {
+	if b == nil {
+		return
+	}
+	b.breaker_lock.Lock()
+	defer b.breaker_lock.Unlock()
+	b.probe_in_flight = false
+}
+
+// Returns true if the breaker rejects every RPC, i.e. it opened less than
+// open_duration ago. Past that the next RPC is let through as a probe.
+func (b *CircuitBreaker) IsOpen() bool {
+	if b == nil {
+		return false
+	}
+	b.breaker_lock.Lock()
+	defer b.breaker_lock.Unlock()
+	return b.state == pb.CircuitBreakerState_kBreakerOpen &&
+		time.Since(b.opened_at) < b.open_duration
+}
+
+// Returns the current state and the number of consecutive failures.
+func (b *CircuitBreaker) GetState() (pb.CircuitBreakerState, int32) {
+	b.breaker_lock.Lock()
+	defer b.breaker_lock.Unlock()
+	return b.state, b.consecutive_failures
+}
+
+//------------------------------------------------------------------------------
+// RETRY POLICY FOR WORKER RPCS
+//------------------------------------------------------------------------------
+
+// Helper method to check whether a failed worker RPC may be retried.
+func isRetryableError(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted, codes.Aborted:
+		return true
+	}
+	return false
+}
+
+// Helper method to get the delay before the next attempt. We use exponential
+// backoff with equal jitter: half of the backoff is fixed and the other half
+// is random.
+func getBackoffWithJitter(backoff time.Duration) time.Duration {
+	half := int64(backoff / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// Call a worker RPC guarded by the worker's circuit breaker. The attempts are
+// derived from ctx and together bounded by WorkerRpcTotalTimeout; each is
+// bounded by WorkerRpcTimeout or by the time left, whichever is shorter.
+// Failed attempts are retried with backoff only if is_idempotent is set, i.e.
+// for reads and for writes carrying a request id that the worker deduplicates
+// on. Admin RPCs pass a nil breaker, so that polling the workers neither trips
+// nor masks the breaker of the requests.
+func (cm *ControlManager) CallWorkerWithRetry(ctx context.Context, worker_pod string, breaker *CircuitBreaker,
+	is_idempotent bool, call func(ctx context.Context) error) (err error) {
+	// The attempts are children of this span, retries are recorded as events.
+	ctx, span := cm.tracer.Start(ctx, "CallWorker", tracing.WorkerKey.String(worker_pod))
+	defer func() { tracing.EndSpanWithError(span, err) }()
+	runtime_config := cm.runtime_config.Load()
+	client_ctx := ctx
+	ctx, cancel := context.WithTimeout(ctx, runtime_config.WorkerRpcTotalTimeout)
+	defer cancel()
+	backoff := runtime_config.RetryInitialBackoff
+	for attempt := 1; ; attempt++ {
+		if !breaker.Allow() {
+			return status.Errorf(codes.Unavailable,
+				"circuit breaker open for worker %s", worker_pod)
+		}
+		attempt_ctx, cancel := context.WithTimeout(ctx, runtime_config.WorkerRpcTimeout)
+		err := call(attempt_ctx)
+		cancel()
+		if err == nil {
+			breaker.RecordSuccess()
+			return nil
+		}
+		if client_ctx.Err() != nil {
+			// The client gave up, this is not the worker's fault.
+			breaker.RecordIgnored()
+			return err
+		}
+		breaker.RecordFailure()
+		if ctx.Err() != nil || !is_idempotent || attempt >= runtime_config.RetryMaxAttempts || !isRetryableError(err) {
+			return err
+		}
+		delay := getBackoffWithJitter(backoff)
+		cm.logger.WarnContext(ctx, "Worker RPC failed, retrying", logging.Worker(worker_pod),
+			slog.Int("attempt", attempt), slog.Duration("delay", delay), logging.Err(err))
+		span.AddEvent(fmt.Sprintf("Attempt %d failed: %v. Retrying in %v.",
+			attempt, err, delay))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		backoff = min(backoff*2, runtime_config.RetryMaxBackoff)
+	}
+}
@@ -0,0 +1,222 @@
+package controlmanager
+
+import (
+	"context"
+	"errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"kvstore/logging"
+	pb "kvstore/protos"
+	"testing"
+	"time"
+)
+
+// Helper method to check the state of a breaker.
+func expectBreakerState(t *testing.T, b *CircuitBreaker, state pb.CircuitBreakerState,
+	consecutive_failures int32) {
+	t.Helper()
+	got_state, got_failures := b.GetState()
+	if got_state != state || got_failures != consecutive_failures {
+		t.Fatalf("breaker is %v after %d failures, want %v after %d", got_state, got_failures,
+			state, consecutive_failures)
+	}
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	open_duration := 50 * time.Millisecond
+	b := CreateCircuitBreaker(2, open_duration, logging.Logger("control_manager"))
+	expectBreakerState(t, b, pb.CircuitBreakerState_kBreakerClosed, 0)
+
+	// Closed until failure_threshold consecutive failures.
+	b.RecordFailure()
+	b.RecordSuccess()
+	b.RecordFailure()
+	if !b.Allow() {
+		t.Fatalf("breaker rejects RPCs after one failure")
+	}
+	expectBreakerState(t, b, pb.CircuitBreakerState_kBreakerClosed, 1)
+	b.RecordFailure()
+	expectBreakerState(t, b, pb.CircuitBreakerState_kBreakerOpen, 2)
+	if b.Allow() || !b.IsOpen() {
+		t.Fatalf("open breaker lets RPCs through")
+	}
+
+	// Half open after open_duration, letting a single probe through. A
+	// failed probe opens the breaker again.
+	time.Sleep(open_duration)
+	if b.IsOpen() {
+		t.Fatalf("breaker still rejects RPCs after %v", open_duration)
+	}
+	if !b.Allow() {
+		t.Fatalf("breaker does not let a probe through after %v", open_duration)
+	}
+	expectBreakerState(t, b, pb.CircuitBreakerState_kBreakerHalfOpen, 2)
+	if b.Allow() {
+		t.Fatalf("half open breaker lets a second probe through")
+	}
+	b.RecordFailure()
+	expectBreakerState(t, b, pb.CircuitBreakerState_kBreakerOpen, 3)
+	if !b.IsOpen() {
+		t.Fatalf("breaker lets RPCs through after a failed probe")
+	}
+
+	// A probe whose outcome is ignored lets another probe through, and a
+	// successful probe closes the breaker.
+	time.Sleep(open_duration)
+	if !b.Allow() {
+		t.Fatalf("breaker does not let a probe through after %v", open_duration)
+	}
+	b.RecordIgnored()
+	if !b.Allow() {
+		t.Fatalf("breaker does not let a probe through after an ignored one")
+	}
+	b.RecordSuccess()
+	expectBreakerState(t, b, pb.CircuitBreakerState_kBreakerClosed, 0)
+
+	// New settings apply to the next failures.
+	b.Reconfigure(1, open_duration)
+	b.RecordFailure()
+	expectBreakerState(t, b, pb.CircuitBreakerState_kBreakerOpen, 1)
+}
+
+func TestNilCircuitBreakerLetsEveryRpcThrough(t *testing.T) {
+	var b *CircuitBreaker
+	for i := 0; i < 10; i++ {
+		b.RecordFailure()
+	}
+	b.RecordIgnored()
+	b.RecordSuccess()
+	if !b.Allow() {
+		t.Fatalf("nil breaker rejects RPCs")
+	}
+}
+
+func TestBackoffWithJitter(t *testing.T) {
+	for _, backoff := range []time.Duration{time.Millisecond, 100 * time.Millisecond, time.Second} {
+		for i := 0; i < 1000; i++ {
+			if delay := getBackoffWithJitter(backoff); delay < backoff/2 || delay > backoff {
+				t.Fatalf("delay %v for backoff %v, want within [%v, %v]", delay, backoff,
+					backoff/2, backoff)
+			}
+		}
+	}
+}
+
+func TestCallWorkerWithRetry(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "worker unreachable")
+	invalid := status.Error(codes.InvalidArgument, "invalid request")
+	for _, test := range []struct {
+		name          string
+		is_idempotent bool
+		errs          []error
+		want_err      error
+		want_attempts int
+	}{
+		{"success", true, nil, nil, 1},
+		{"retried until success", true, []error{unavailable, unavailable}, nil, 3},
+		{"retried until max attempts", true, []error{unavailable, unavailable, unavailable, unavailable},
+			unavailable, 3},
+		{"not idempotent", false, []error{unavailable}, unavailable, 1},
+		{"not retryable", true, []error{invalid}, invalid, 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cm := New(Config{
+				WorkerRpcTimeout:      time.Second,
+				WorkerRpcTotalTimeout: 5 * time.Second,
+				RetryMaxAttempts:      3,
+				RetryInitialBackoff:   time.Millisecond,
+				RetryMaxBackoff:       4 * time.Millisecond,
+			})
+			attempts := 0
+			err := cm.CallWorkerWithRetry(context.Background(), "worker-0", nil,
+				test.is_idempotent, func(ctx context.Context) error {
+					attempts++
+					if attempts > len(test.errs) {
+						return nil
+					}
+					return test.errs[attempts-1]
+				})
+			if !errors.Is(err, test.want_err) || attempts != test.want_attempts {
+				t.Errorf("call = %v after %d attempts, want %v after %d", err, attempts,
+					test.want_err, test.want_attempts)
+			}
+		})
+	}
+}
+
+func TestCallWorkerWithRetryRespectsBreakerAndDeadlines(t *testing.T) {
+	cm := New(Config{
+		WorkerRpcTimeout:      20 * time.Millisecond,
+		WorkerRpcTotalTimeout: 100 * time.Millisecond,
+		RetryMaxAttempts:      100,
+		RetryInitialBackoff:   time.Millisecond,
+		RetryMaxBackoff:       time.Millisecond,
+	})
+	breaker := CreateCircuitBreaker(2, time.Minute, logging.Logger("control_manager"))
+	fail := func(ctx context.Context) error {
+		return status.Error(codes.Unavailable, "worker unreachable")
+	}
+
+	// The breaker opens after two failures and fails the next calls fast.
+	attempts := 0
+	err := cm.CallWorkerWithRetry(context.Background(), "worker-0", breaker, true,
+		func(ctx context.Context) error {
+			attempts++
+			return fail(ctx)
+		})
+	if status.Code(err) != codes.Unavailable || attempts != 2 {
+		t.Fatalf("call = %v after %d attempts, want Unavailable after 2", err, attempts)
+	}
+	expectBreakerState(t, breaker, pb.CircuitBreakerState_kBreakerOpen, 2)
+	err = cm.CallWorkerWithRetry(context.Background(), "worker-0", breaker, true,
+		func(ctx context.Context) error {
+			t.Fatalf("call sent through an open breaker")
+			return nil
+		})
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("call through an open breaker = %v, want Unavailable", err)
+	}
+
+	// Every attempt is bounded by WorkerRpcTimeout, and the retries by
+	// WorkerRpcTotalTimeout.
+	start := time.Now()
+	attempts = 0
+	err = cm.CallWorkerWithRetry(context.Background(), "worker-0", nil, true,
+		func(ctx context.Context) error {
+			attempts++
+			deadline, _ := ctx.Deadline()
+			if time.Until(deadline) > 20*time.Millisecond {
+				t.Errorf("attempt given %v, want at most 20ms", time.Until(deadline))
+			}
+			<-ctx.Done()
+			return fail(ctx)
+		})
+	elapsed := time.Since(start)
+	if status.Code(err) != codes.Unavailable || attempts < 2 ||
+		elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("call = %v after %d attempts in %v, want Unavailable after 100ms", err,
+			attempts, elapsed)
+	}
+
+	// A client giving up is not held against the worker.
+	breaker = CreateCircuitBreaker(1, time.Minute, logging.Logger("control_manager"))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cm.CallWorkerWithRetry(ctx, "worker-0", breaker, true, fail)
+	expectBreakerState(t, breaker, pb.CircuitBreakerState_kBreakerClosed, 0)
+}
+
+func TestRetryableErrors(t *testing.T) {
+	for code, want := range map[codes.Code]bool{
+		codes.Unavailable:       true,
+		codes.ResourceExhausted: true,
+		codes.Aborted:           true,
+		codes.DeadlineExceeded:  false,
+		codes.InvalidArgument:   false,
+		codes.Internal:          false,
+	} {
+		if got := isRetryableError(status.Error(code, "")); got != want {
+			t.Errorf("isRetryableError(%v) = %t, want %t", code, got, want)
+		}
+	}
+}
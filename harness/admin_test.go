@@ -0,0 +1,273 @@
+package harness_test
+
+import (
+	"fmt"
+	"google.golang.org/protobuf/encoding/protojson"
+	"kvstore/client"
+	"kvstore/harness"
+	"kvstore/local"
+	"kvstore/membership"
+	pb "kvstore/protos"
+	"testing"
+	"time"
+)
+
+// Helper method to get the cluster status as seen by a control manager.
+func getClusterStatus(t *testing.T, kv_client *client.Client) *pb.GetClusterStatusRet {
+	t.Helper()
+	ctx, cancel := harness.RequestContext(5 * time.Second)
+	defer cancel()
+	r, err := kv_client.GetClusterStatus(ctx)
+	if err != nil {
+		t.Fatalf("cluster status: %v", err)
+	}
+	return r
+}
+
+// Helper method to list the shards through a control manager.
+func listShards(t *testing.T, kv_client *client.Client) *pb.ListShardsRet {
+	t.Helper()
+	ctx, cancel := harness.RequestContext(10 * time.Second)
+	defer cancel()
+	r, err := kv_client.ListShards(ctx)
+	if err != nil {
+		t.Fatalf("list shards: %v", err)
+	}
+	if len(r.GetShards()) != int(r.GetNumShards()) {
+		t.Fatalf("listed %d shards, want %d", len(r.GetShards()), r.GetNumShards())
+	}
+	return r
+}
+
+func TestClusterStatusReportsLeaderAndWorkers(t *testing.T) {
+	config := harness.DefaultConfig()
+	config.NumControlManagers = 2
+	c := harness.Start(t, config)
+	leader := c.WaitForLeader(-1)
+	standby := 1 - leader
+	mustPut(t, c.Client(leader), "admin-key", "value")
+
+	leader_status := getClusterStatus(t, c.Client(leader))
+	if !leader_status.GetIsLeader() ||
+		leader_status.GetControlManagerName() != local.ControlManagerName(leader) {
+		t.Errorf("leader reports itself as %s, leader %t", leader_status.GetControlManagerName(),
+			leader_status.GetIsLeader())
+	}
+	if leader_status.GetLeaderAddress() == "" || leader_status.GetElectionRevision() == 0 {
+		t.Errorf("leader reports no leader: %v", leader_status)
+	}
+	if len(leader_status.GetWorkers()) != c.NumWorkers() {
+		t.Errorf("leader knows %d workers, want %d", len(leader_status.GetWorkers()),
+			c.NumWorkers())
+	}
+	for _, worker := range leader_status.GetWorkers() {
+		if worker.GetConnectionState() != pb.WorkerConnectionState_kConnectionReady &&
+			worker.GetConnectionState() != pb.WorkerConnectionState_kConnectionIdle {
+			t.Errorf("connection to worker %s is %v", worker.GetWorkerName(),
+				worker.GetConnectionState())
+		}
+	}
+	// The standby observes the same election.
+	harness.Eventually(t, 5*time.Second, func() error {
+		standby_status := getClusterStatus(t, c.Client(standby))
+		if standby_status.GetIsLeader() ||
+			standby_status.GetLeaderAddress() != leader_status.GetLeaderAddress() ||
+			standby_status.GetElectionRevision() != leader_status.GetElectionRevision() {
+			return fmt.Errorf("standby sees leader %s at revision %d, want %s at revision %d",
+				standby_status.GetLeaderAddress(), standby_status.GetElectionRevision(),
+				leader_status.GetLeaderAddress(), leader_status.GetElectionRevision())
+		}
+		return nil
+	})
+
+	// A new leader is elected at a later revision.
+	c.StopControlManager(leader)
+	c.WaitForLeader(leader)
+	harness.Eventually(t, 5*time.Second, func() error {
+		new_status := getClusterStatus(t, c.Client(standby))
+		if !new_status.GetIsLeader() ||
+			new_status.GetElectionRevision() <= leader_status.GetElectionRevision() {
+			return fmt.Errorf("new leader elected at revision %d, previous at %d",
+				new_status.GetElectionRevision(), leader_status.GetElectionRevision())
+		}
+		return nil
+	})
+}
+
+func TestListShardsReportsKeysAndOracleTimestamps(t *testing.T) {
+	c := harness.Start(t, harness.DefaultConfig())
+	kv_client := c.Client(c.WaitForLeader(-1))
+	shard_id := "1"
+	keys := harness.KeysOnShard("admin-", shard_id, c.NumShards(), 3)
+	var ts int64
+	for _, key := range keys {
+		ts = mustPut(t, kv_client, key, "value")
+	}
+
+	r := listShards(t, kv_client)
+	for _, shard := range r.GetShards() {
+		if shard.GetErrorDetails() != "" || shard.GetWorkerName() != c.OwnerOfShard(shard.GetShardId()) {
+			t.Errorf("shard %s: owner %s, error %q", shard.GetShardId(), shard.GetWorkerName(),
+				shard.GetErrorDetails())
+		}
+	}
+	shard := r.GetShards()[1]
+	if shard.GetKeyCount() != int64(len(keys)) || shard.GetBytes() == 0 || shard.GetOracleTs() != ts {
+		t.Errorf("shard %s has %d keys, %d bytes, oracle ts %d, want %d keys at %d",
+			shard_id, shard.GetKeyCount(), shard.GetBytes(), shard.GetOracleTs(), len(keys), ts)
+	}
+
+	// The worker reports the same shard along with its disk usage.
+	worker := workerIndex(t, c, c.OwnerOfShard(shard_id))
+	ctx, cancel := harness.RequestContext(5 * time.Second)
+	defer cancel()
+	worker_status, err := c.WorkerAdminClient(worker).GetWorkerStatus(ctx, &pb.GetWorkerStatusArg{})
+	if err != nil || !worker_status.GetSuccess() {
+		t.Fatalf("worker status: %v %v", err, worker_status.GetErrorDetails())
+	}
+	if worker_status.GetOracleTimestamps()[shard_id] != ts {
+		t.Errorf("oracle timestamps of %s = %v, want %d for shard %s",
+			worker_status.GetWorkerName(), worker_status.GetOracleTimestamps(), ts, shard_id)
+	}
+	disk_usage := worker_status.GetDiskUsage()
+	if disk_usage.GetUsedBytes() < shard.GetBytes() || disk_usage.GetTotalBytes() == 0 ||
+		disk_usage.GetAvailableBytes() > disk_usage.GetTotalBytes() {
+		t.Errorf("disk usage of %s: %v", worker_status.GetWorkerName(), disk_usage)
+	}
+
+	// The shards of an unreachable worker are listed without statistics.
+	c.Kill(local.WorkerName(worker))
+	for i := 0; i < 3; i++ {
+		for _, shard := range listShards(t, kv_client).GetShards() {
+			is_lost := shard.GetWorkerName() == local.WorkerName(worker)
+			if is_lost != (shard.GetErrorDetails() != "") {
+				t.Errorf("shard %s of %s: error %q", shard.GetShardId(), shard.GetWorkerName(),
+					shard.GetErrorDetails())
+			}
+		}
+	}
+	// Listing the shards does not go through the circuit breaker of the
+	// requests.
+	for _, worker_status := range getClusterStatus(t, kv_client).GetWorkers() {
+		if worker_status.GetBreakerState() != pb.CircuitBreakerState_kBreakerClosed ||
+			worker_status.GetConsecutiveFailures() != 0 {
+			t.Errorf("breaker of %s is %v after %d failures, want closed",
+				worker_status.GetWorkerName(), worker_status.GetBreakerState(),
+				worker_status.GetConsecutiveFailures())
+		}
+	}
+}
+
+// Helper method to get the state of a worker as published in its
+// registration and reported by a control manager.
+func workerState(t *testing.T, kv_client *client.Client, worker_name string) pb.WorkerState {
+	t.Helper()
+	for _, worker := range getClusterStatus(t, kv_client).GetWorkers() {
+		if worker.GetWorkerName() == worker_name {
+			return worker.GetState()
+		}
+	}
+	return -1
+}
+
+func TestWorkersPublishTheirState(t *testing.T) {
+	c := harness.Start(t, harness.DefaultConfig())
+	kv_client := c.Client(c.WaitForLeader(-1))
+	for i := 0; i < c.NumWorkers(); i++ {
+		if state := workerState(t, kv_client, local.WorkerName(i)); state != pb.WorkerState_kWorkerServing {
+			t.Errorf("%s is %v, want serving", local.WorkerName(i), state)
+		}
+	}
+
+	// A stopping worker is draining while it serves its last requests.
+	shard_id := "1"
+	worker := workerIndex(t, c, c.OwnerOfShard(shard_id))
+	key := harness.KeysOnShard("state-", shard_id, c.NumShards(), 1)[0]
+	put_err := startDelayedPut(t, c, kv_client, worker, key, "value")
+	stopped := make(chan struct{})
+	go func() {
+		c.StopWorker(worker)
+		close(stopped)
+	}()
+	harness.Eventually(t, writeDelay, func() error {
+		if state := workerState(t, kv_client, local.WorkerName(worker)); state != pb.WorkerState_kWorkerDraining {
+			return fmt.Errorf("%s is %v, want draining", local.WorkerName(worker), state)
+		}
+		return nil
+	})
+	if err := <-put_err; err != nil {
+		t.Fatalf("put %s while the worker was draining: %v", key, err)
+	}
+	<-stopped
+
+	// A restarted worker serves again.
+	if err := c.StartWorker(worker); err != nil {
+		t.Fatal(err)
+	}
+	harness.Eventually(t, 5*time.Second, func() error {
+		if state := workerState(t, kv_client, local.WorkerName(worker)); state != pb.WorkerState_kWorkerServing {
+			return fmt.Errorf("%s is %v, want serving", local.WorkerName(worker), state)
+		}
+		return nil
+	})
+}
+
+func TestShardClaimedTwiceKeepsItsOwner(t *testing.T) {
+	c := harness.Start(t, harness.DefaultConfig())
+	kv_client := c.Client(c.WaitForLeader(-1))
+	etcd_client, err := membership.NewEtcdClientForEndpoints(c.EtcdEndpoints())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer etcd_client.Close()
+
+	// Register workers claiming shard 0 along with its owner: a serving one
+	// with a higher ordinal and a starting one with the same ordinal.
+	owner := c.OwnerOfShard("0")
+	for _, registration := range []*pb.WorkerRegistration{
+		{WorkerName: "worker-9", State: pb.WorkerState_kWorkerServing},
+		{WorkerName: "worker-00", State: pb.WorkerState_kWorkerStarting},
+	} {
+		registration.Address = c.Workers[1].Address()
+		registration.OwnedShards = []string{"0"}
+		value, err := protojson.Marshal(registration)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := harness.RequestContext(5 * time.Second)
+		_, err = etcd_client.Put(ctx, membership.WorkerPrefix+registration.GetWorkerName(),
+			string(value))
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	harness.Eventually(t, 5*time.Second, func() error {
+		if workers := getClusterStatus(t, kv_client).GetWorkers(); len(workers) != c.NumWorkers()+2 {
+			return fmt.Errorf("leader knows %d workers, want %d", len(workers), c.NumWorkers()+2)
+		}
+		return nil
+	})
+
+	// The owner keeps the shard on every refresh of the membership.
+	for i := 0; i < 5; i++ {
+		ctx, cancel := harness.RequestContext(5 * time.Second)
+		shard_map, err := kv_client.GetShardMap(ctx)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := shard_map.GetShards()[0].GetWorkerName(); got != owner {
+			t.Fatalf("shard 0 owned by %s, want %s", got, owner)
+		}
+		ctx, cancel = harness.RequestContext(5 * time.Second)
+		_, err = etcd_client.Put(ctx, membership.WorkerPrefix+"worker-refresh",
+			fmt.Sprintf(`{"workerName": "worker-refresh", "address": "%s"}`,
+				c.Workers[1].Address()))
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustPut(t, kv_client, harness.KeysOnShard("claimed-", "0", c.NumShards(), 1)[0], "value")
+}
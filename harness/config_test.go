@@ -0,0 +1,198 @@
+package harness_test
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"kvstore/config"
+	"kvstore/harness"
+	"kvstore/logging"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Helper method to write a config file in a temporary directory.
+func writeConfigFile(t *testing.T, file_path string, content string) string {
+	t.Helper()
+	if file_path == "" {
+		file_path = filepath.Join(t.TempDir(), "config.yaml")
+	}
+	if err := os.WriteFile(file_path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file_path
+}
+
+// Helper method to create a config loader of a worker from the command line
+// args and the environment.
+func newConfigLoader(t *testing.T, component config.Component, args []string,
+	env map[string]string) (*config.Loader, error) {
+	t.Helper()
+	fs := flag.NewFlagSet(string(component), flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return config.NewLoader(fs, component, args, func(name string) (string, bool) {
+		value, exists := env[name]
+		return value, exists
+	})
+}
+
+// Environment of worker-1, as set by kubernetes.
+func workerEnv() map[string]string {
+	return map[string]string{
+		"POD_NAME":       "worker-1",
+		"POD_NAMESPACE":  "test-ns",
+		"MOUNT_PATH":     "/data",
+		"PERSIST_ORACLE": "/data/oracle_timestamp",
+		"PERSIST_DEDUP":  "/data/dedup",
+	}
+}
+
+func TestConfigFlagsOverrideEnvironmentAndFile(t *testing.T) {
+	file_path := writeConfigFile(t, "", `
+cluster:
+  num_shards: 12
+  num_worker_pods: 4
+worker:
+  grpc_port: 6000
+  dedup_table_size: 50
+shutdown_timeout: 5s
+logging:
+  level: warn
+`)
+	env := workerEnv()
+	env["KV_CONFIG"] = file_path
+	env["KV_WORKER_GRPC_SERVER_PORT"] = "7000"
+	env["KV_LOG_LEVEL"] = "error"
+	loader, err := newConfigLoader(t, config.ComponentWorker,
+		[]string{"--kv_log_level=debug"}, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loader.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Cluster.NumShards != 12 || cfg.Cluster.NumWorkerPods != 4 ||
+		cfg.Worker.DedupTableSize != 50 || cfg.ShutdownTimeout.Duration != 5*time.Second {
+		t.Errorf("settings of the file not applied: %+v", cfg)
+	}
+	if cfg.Worker.GrpcPort != 7000 {
+		t.Errorf("grpc port = %d, want 7000 from the environment", cfg.Worker.GrpcPort)
+	}
+	if cfg.Logging.Level != "debug" {
+		t.Errorf("log level = %s, want debug from the flags", cfg.Logging.Level)
+	}
+	if cfg.Pod.Name != "worker-1" || cfg.Worker.MountPath != "/data" {
+		t.Errorf("pod environment not applied: %+v", cfg)
+	}
+	// The unchanged settings keep their defaults.
+	if cfg.Etcd.WorkerLeaseTtlSecs != config.Default().Etcd.WorkerLeaseTtlSecs {
+		t.Errorf("lease ttl = %d, want the default", cfg.Etcd.WorkerLeaseTtlSecs)
+	}
+}
+
+func TestConfigValidationRejectsInvalidSettings(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		content string
+		args    []string
+		want    string
+	}{
+		{"unknown setting", "cluster:\n  num_shard: 3\n", nil, "num_shard"},
+		{"no shards", "cluster:\n  num_shards: 0\n", nil, "cluster.num_shards"},
+		{"ordinal out of range", "cluster:\n  num_worker_pods: 1\n", nil, "pod.name"},
+		{"bad duration", "shutdown_timeout: soon\n", nil, "soon"},
+		{"bad log level", "", []string{"--kv_log_level=loud"}, "loud"},
+		{"faults disabled", `worker: {fault_rules: '{"rules": []}'}`, nil, "enable_fault_injection"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			args := append([]string{"--kv_config=" + writeConfigFile(t, "", test.content)},
+				test.args...)
+			loader, err := newConfigLoader(t, config.ComponentWorker, args, workerEnv())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := loader.Load(); err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("load error = %v, want it to mention %s", err, test.want)
+			}
+		})
+	}
+}
+
+func TestConfigReloadAppliesOnlyReloadableSettings(t *testing.T) {
+	logs := captureLogs(t, logging.Config{})
+	file_path := writeConfigFile(t, "", `
+reload_interval: 20ms
+control_manager:
+  worker_rpc_timeout: 30s
+`)
+	loader, err := newConfigLoader(t, config.ComponentControlManager,
+		[]string{"--kv_config=" + file_path}, map[string]string{"POD_NAMESPACE": "test-ns"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loader.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded := make(chan *config.Config, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go loader.Watch(ctx, cfg, func(c *config.Config) { reloaded <- c })
+
+	// An invalid file is ignored.
+	writeConfigFile(t, file_path, "reload_interval: 20ms\ncluster:\n  num_shards: -1\n")
+	harness.Eventually(t, 5*time.Second, func() error {
+		if findRecord(logs.Records(t), "Ignoring changes to the config file") == nil {
+			return fmt.Errorf("invalid config file not reported")
+		}
+		return nil
+	})
+	writeConfigFile(t, file_path, `
+reload_interval: 20ms
+control_manager:
+  grpc_port: 6000
+  worker_rpc_timeout: 2s
+  breaker:
+    failure_threshold: 2
+logging:
+  level: debug
+`)
+	var c *config.Config
+	select {
+	case c = <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("config file not reloaded")
+	}
+	if c.ControlManager.WorkerRpcTimeout.Duration != 2*time.Second ||
+		c.ControlManager.Breaker.FailureThreshold != 2 || c.Logging.Level != "debug" {
+		t.Errorf("reloadable settings not applied: timeout %v, breaker %+v, log level %s",
+			c.ControlManager.WorkerRpcTimeout, c.ControlManager.Breaker, c.Logging.Level)
+	}
+	if c.ControlManager.GrpcPort != cfg.ControlManager.GrpcPort {
+		t.Errorf("grpc port reloaded to %d, want %d until restart", c.ControlManager.GrpcPort,
+			cfg.ControlManager.GrpcPort)
+	}
+	restart := findRecord(logs.Records(t),
+		"Settings changed in the config file are only applied on restart")
+	if restart == nil || !strings.Contains(strings.Join(stringsOf(restart["settings"]), ","),
+		"control_manager.grpc_port") {
+		t.Errorf("restart only settings not reported: %v", restart)
+	}
+}
+
+// Helper method to convert a list decoded from JSON to strings.
+func stringsOf(value any) []string {
+	var values []string
+	items, _ := value.([]any)
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			values = append(values, s)
+		}
+	}
+	return values
+}
@@ -0,0 +1,156 @@
+package harness_test
+
+import (
+	"fmt"
+	"kvstore/controlmanager"
+	"kvstore/harness"
+	"kvstore/local"
+	"testing"
+	"time"
+)
+
+// Time allowed for a failover: the session TTL plus the time to campaign.
+const failoverTimeout = 20 * time.Second
+
+// Helper method to put count keys through the i-th control manager.
+func putKeys(t *testing.T, c *harness.Cluster, i int, prefix string, count int) map[string]string {
+	t.Helper()
+	kv_client := c.Client(i)
+	values := make(map[string]string)
+	for k := 0; k < count; k++ {
+		key, value := fmt.Sprintf("%s%d", prefix, k), fmt.Sprintf("value-%d", k)
+		ctx, cancel := harness.RequestContext(5 * time.Second)
+		_, err := kv_client.Put(ctx, key, value)
+		cancel()
+		if err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+		values[key] = value
+	}
+	return values
+}
+
+// Helper method to check the values of keys through the i-th control manager,
+// retrying until they can be read.
+func checkKeys(t *testing.T, c *harness.Cluster, i int, values map[string]string) {
+	t.Helper()
+	kv_client := c.Client(i)
+	for key, value := range values {
+		harness.Eventually(t, failoverTimeout, func() error {
+			ctx, cancel := harness.RequestContext(5 * time.Second)
+			defer cancel()
+			got, err := kv_client.Get(ctx, key)
+			if err != nil {
+				return fmt.Errorf("get %s: %v", key, err)
+			}
+			if got.Value != value {
+				t.Fatalf("get %s returned %q, want %q", key, got.Value, value)
+			}
+			return nil
+		})
+	}
+}
+
+// Helper method to get the ordinal of a control manager other than i.
+func otherThan(c *harness.Cluster, i int) int {
+	for j := range c.ControlManagers {
+		if j != i && c.ControlManagers[j] != nil {
+			return j
+		}
+	}
+	return -1
+}
+
+func TestLeaderFailoverAfterKill(t *testing.T) {
+	config := harness.DefaultConfig()
+	config.NumControlManagers = 3
+	c := harness.Start(t, config)
+
+	leader := c.WaitForLeader(-1)
+	values := putKeys(t, c, leader, "failover-kill-", 20)
+
+	// The killed leader keeps its election key until its session expires,
+	// after which a standby takes over.
+	c.Kill(local.ControlManagerName(leader))
+	new_leader := c.WaitForLeader(leader)
+	t.Logf("leadership moved from %d to %d", leader, new_leader)
+
+	// Every acknowledged write survives the failover, and a standby
+	// forwards requests to the new leader.
+	checkKeys(t, c, new_leader, values)
+	checkKeys(t, c, otherThan(c, new_leader), values)
+	putKeys(t, c, new_leader, "failover-kill-after-", 5)
+
+	// The old leader rejoins as a standby.
+	c.Restart(local.ControlManagerName(leader))
+	c.WaitUntilReady()
+	if c.Leader() != new_leader {
+		t.Fatalf("leadership moved to %d after the old leader restarted, want %d",
+			c.Leader(), new_leader)
+	}
+	checkKeys(t, c, leader, values)
+}
+
+func TestLeaderStepsDownAfterPause(t *testing.T) {
+	config := harness.DefaultConfig()
+	config.NumControlManagers = 2
+	c := harness.Start(t, config)
+
+	leader := c.WaitForLeader(-1)
+	values := putKeys(t, c, leader, "failover-pause-", 10)
+	paused := c.ControlManagers[leader]
+
+	// A paused leader cannot keep its session alive, so the standby takes
+	// over once the session expires.
+	c.Pause(local.ControlManagerName(leader))
+	new_leader := c.WaitForLeader(leader)
+
+	// Once resumed the old leader notices its session is gone and stops
+	// instead of serving as a second leader.
+	c.Resume(local.ControlManagerName(leader))
+	stopped := make(chan error, 1)
+	go func() { stopped <- paused.Wait() }()
+	select {
+	case err := <-stopped:
+		if err == nil || err == controlmanager.ErrKilled {
+			t.Fatalf("old leader stopped with %v, want a lost session", err)
+		}
+	case <-time.After(failoverTimeout):
+		t.Fatal("old leader still running after its session expired")
+	}
+	if paused.IsLeader() {
+		t.Fatal("old leader still claims leadership")
+	}
+	checkKeys(t, c, new_leader, values)
+
+	// Restarting the old leader brings it back as a standby.
+	c.Restart(local.ControlManagerName(leader))
+	checkKeys(t, c, leader, values)
+}
+
+func TestStandbyReportsLeaderWhenPartitioned(t *testing.T) {
+	config := harness.DefaultConfig()
+	config.NumControlManagers = 2
+	c := harness.Start(t, config)
+
+	leader := c.WaitForLeader(-1)
+	standby := otherThan(c, leader)
+	values := putKeys(t, c, leader, "failover-partition-", 5)
+
+	// Cut the leader from its clients only. It keeps its session, so the
+	// standby must not take over and cannot forward requests either.
+	c.PartitionGrpc(local.ControlManagerName(leader))
+	kv_client := c.Client(standby)
+	ctx, cancel := harness.RequestContext(5 * time.Second)
+	_, err := kv_client.Get(ctx, "failover-partition-0")
+	cancel()
+	if err == nil {
+		t.Fatal("standby served a request while the leader was unreachable")
+	}
+	if c.Leader() != leader {
+		t.Fatalf("leadership moved to %d while the leader kept its session", c.Leader())
+	}
+
+	c.Heal(local.ControlManagerName(leader))
+	checkKeys(t, c, standby, values)
+}
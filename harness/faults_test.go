@@ -0,0 +1,230 @@
+package harness_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"kvstore/client"
+	"kvstore/harness"
+	"kvstore/local"
+	pb "kvstore/protos"
+	"testing"
+	"time"
+)
+
+// Helper method to put a key and fail the test on error.
+func mustPut(t *testing.T, kv_client *client.Client, key string, value string,
+	opts ...client.PutOption) int64 {
+	t.Helper()
+	ctx, cancel := harness.RequestContext(5 * time.Second)
+	defer cancel()
+	ts, err := kv_client.Put(ctx, key, value, opts...)
+	if err != nil {
+		t.Fatalf("put %s: %v", key, err)
+	}
+	return ts
+}
+
+// Helper method to check the value and db_modified_ts of a key.
+func expectValue(t *testing.T, kv_client *client.Client, key string, value string, ts int64) {
+	t.Helper()
+	ctx, cancel := harness.RequestContext(5 * time.Second)
+	defer cancel()
+	got, err := kv_client.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("get %s: %v", key, err)
+	}
+	if got.Value != value || got.DbModifiedTs != ts {
+		t.Fatalf("get %s = (%q, %d), want (%q, %d)", key, got.Value, got.DbModifiedTs,
+			value, ts)
+	}
+}
+
+// Helper method to check that err is a kvstore error with code.
+func expectErrorCode(t *testing.T, err error, code pb.ErrorCode) {
+	t.Helper()
+	var kv_error *client.Error
+	if !errors.As(err, &kv_error) || kv_error.Code != code {
+		t.Fatalf("got error %v, want %v", err, code)
+	}
+}
+
+// Helper method to check that a failing disk operation fails the Put without
+// changing the key, and that the key can be written again once healed.
+func testFailedWrite(t *testing.T, point pb.FaultPoint) {
+	c := harness.Start(t, harness.DefaultConfig())
+	shard_id := "2"
+	worker := c.OwnerOfShard(shard_id)
+	keys := harness.KeysOnShard("fault-", shard_id, c.NumShards(), 2)
+	kv_client := c.Client(c.WaitForLeader(-1))
+	first_ts := mustPut(t, kv_client, keys[0], "first")
+
+	c.SetFaultRules(worker, &pb.FaultRule{
+		Point:  point,
+		Action: pb.FaultAction_kFaultFail,
+		Shards: []string{shard_id},
+	})
+	ctx, cancel := harness.RequestContext(5 * time.Second)
+	_, err := kv_client.Put(ctx, keys[0], "second")
+	cancel()
+	expectErrorCode(t, err, pb.ErrorCode_kBackendError)
+	expectValue(t, kv_client, keys[0], "first", first_ts)
+
+	c.SetFaultRules(worker)
+	third_ts := mustPut(t, kv_client, keys[0], "third")
+	if third_ts <= first_ts {
+		t.Fatalf("db_modified_ts %d after the failure is not after %d", third_ts, first_ts)
+	}
+	expectValue(t, kv_client, keys[0], "third", third_ts)
+}
+
+func TestPutFailsWhenOraclePersistFails(t *testing.T) {
+	testFailedWrite(t, pb.FaultPoint_kPersistOracleTimestamp)
+}
+
+func TestPutFailsWhenDiskWriteFails(t *testing.T) {
+	testFailedWrite(t, pb.FaultPoint_kWriteKvToDisk)
+}
+
+func TestCorruptedWriteFailsReads(t *testing.T) {
+	c := harness.Start(t, harness.DefaultConfig())
+	keys := harness.KeysOnShard("corrupt-", "0", c.NumShards(), 2)
+	kv_client := c.Client(c.WaitForLeader(-1))
+	c.SetFaultRules(c.OwnerOfShard("0"), &pb.FaultRule{
+		Point:  pb.FaultPoint_kWriteKvToDisk,
+		Action: pb.FaultAction_kFaultCorrupt,
+		Keys:   []string{keys[0]},
+	})
+	mustPut(t, kv_client, keys[0], "value")
+	other_ts := mustPut(t, kv_client, keys[1], "value")
+
+	ctx, cancel := harness.RequestContext(5 * time.Second)
+	defer cancel()
+	_, err := kv_client.Get(ctx, keys[0])
+	expectErrorCode(t, err, pb.ErrorCode_kBackendError)
+	expectValue(t, kv_client, keys[1], "value", other_ts)
+}
+
+func TestDroppedResponseIsRetried(t *testing.T) {
+	c := harness.Start(t, harness.DefaultConfig())
+	shard_id := "1"
+	worker := c.OwnerOfShard(shard_id)
+	key := harness.KeysOnShard("drop-", shard_id, c.NumShards(), 1)[0]
+	kv_client := c.Client(c.WaitForLeader(-1))
+	c.SetFaultRules(worker, &pb.FaultRule{
+		Point:     pb.FaultPoint_kWorkerRpc,
+		Action:    pb.FaultAction_kFaultDropResponse,
+		Methods:   []string{"PutKeyInternal"},
+		Keys:      []string{key},
+		MaxFaults: 1,
+	})
+
+	// The control manager retries the write with the same request id, and
+	// the worker answers the retry from its dedup table.
+	ts := mustPut(t, kv_client, key, "value", client.WithRequestId("drop-request"))
+	expectValue(t, kv_client, key, "value", ts)
+
+	ordinal := 0
+	for local.WorkerName(ordinal) != worker {
+		ordinal++
+	}
+	ctx, cancel := harness.RequestContext(5 * time.Second)
+	defer cancel()
+	r, err := c.WorkerAdminClient(ordinal).GetFaultRules(ctx, &pb.GetFaultRulesArg{})
+	if err != nil {
+		t.Fatalf("get fault rules: %v", err)
+	}
+	if !r.GetEnabled() || len(r.GetRules()) != 1 || r.GetRules()[0].GetInjectedFaults() != 1 {
+		t.Fatalf("get fault rules = %v, want one rule which injected one fault", r)
+	}
+}
+
+func TestUnreachableWorkerReportsUnavailable(t *testing.T) {
+	c := harness.Start(t, harness.DefaultConfig())
+	shard_id := "2"
+	key := harness.KeysOnShard("unreachable-", shard_id, c.NumShards(), 1)[0]
+	kv_client := c.Client(c.WaitForLeader(-1))
+	mustPut(t, kv_client, key, "value")
+
+	// Whether the worker is unreachable, its breaker open or its registration
+	// expired, the request may be retried once the shard has an owner again.
+	c.Kill(c.OwnerOfShard(shard_id))
+	for i := 0; i < 3; i++ {
+		ctx, cancel := harness.RequestContext(5 * time.Second)
+		_, err := kv_client.Get(ctx, key)
+		cancel()
+		expectErrorCode(t, err, pb.ErrorCode_kUnavailable)
+	}
+}
+
+func TestClientDeadlineCancelsWorkerCall(t *testing.T) {
+	c := harness.Start(t, harness.DefaultConfig())
+	shard_id := "2"
+	worker := c.OwnerOfShard(shard_id)
+	key := harness.KeysOnShard("deadline-", shard_id, c.NumShards(), 1)[0]
+	leader := c.WaitForLeader(-1)
+	kv_client := c.Client(leader)
+	mustPut(t, kv_client, key, "value")
+
+	// Attempts sent to the worker which ended because the caller gave up.
+	cm_metrics := c.ControlManagers[leader].Metrics()
+	cancelled_rpcs := func() float64 {
+		total := 0.0
+		for _, error_code := range []string{"grpc:DeadlineExceeded", "grpc:Canceled"} {
+			total += metricValue(t, cm_metrics,
+				"kvstore_control_manager_worker_rpc_duration_seconds",
+				map[string]string{"worker": worker, "error_code": error_code})
+		}
+		return total
+	}
+	c.Pause(worker)
+	for _, call := range []struct {
+		method string
+		run    func(ctx context.Context) error
+	}{
+		{"PutKey", func(ctx context.Context) error {
+			_, err := kv_client.Put(ctx, key, "second")
+			return err
+		}},
+		{"GetKey", func(ctx context.Context) error {
+			_, err := kv_client.Get(ctx, key)
+			return err
+		}},
+	} {
+		before := cancelled_rpcs()
+		ctx, cancel := harness.RequestContext(100 * time.Millisecond)
+		start := time.Now()
+		err := call.run(ctx)
+		cancel()
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s took %v with a 100ms deadline", call.method, elapsed)
+		}
+		var kv_error *client.Error
+		if status.Code(err) != codes.DeadlineExceeded &&
+			!(errors.As(err, &kv_error) && kv_error.Code == pb.ErrorCode_kDeadlineExceeded) {
+			t.Errorf("%s with a 100ms deadline = %v, want a deadline error", call.method, err)
+		}
+		// The worker call ended with the deadline instead of waiting for the
+		// paused worker.
+		harness.Eventually(t, time.Second, func() error {
+			if cancelled_rpcs() <= before {
+				return fmt.Errorf("%s call to %s not cancelled", call.method, worker)
+			}
+			return nil
+		})
+	}
+
+	// No call is left to complete once the worker resumes.
+	cancelled := cancelled_rpcs()
+	worker_rpcs := metricValue(t, cm_metrics,
+		"kvstore_control_manager_worker_rpc_duration_seconds",
+		map[string]string{"worker": worker})
+	c.Resume(worker)
+	time.Sleep(500 * time.Millisecond)
+	if got := metricValue(t, cm_metrics, "kvstore_control_manager_worker_rpc_duration_seconds",
+		map[string]string{"worker": worker}); got != worker_rpcs || cancelled_rpcs() != cancelled {
+		t.Errorf("%v calls to %s completed after it resumed", got-worker_rpcs, worker)
+	}
+}
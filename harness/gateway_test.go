@@ -0,0 +1,205 @@
+package harness_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"kvstore/harness"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Response of the HTTP gateway.
+type gatewayResponse struct {
+	status_code int
+	etag        string
+	body        struct {
+		Key          string `json:"key"`
+		Value        string `json:"value"`
+		DbModifiedTs int64  `json:"db_modified_ts"`
+		Error        struct {
+			Code    string `json:"code"`
+			Details string `json:"details"`
+		} `json:"error"`
+	}
+}
+
+// Helper method to serve the HTTP gateway of the leader until the test
+// finishes.
+func startGateway(t *testing.T, c *harness.Cluster) *httptest.Server {
+	leader := c.WaitForLeader(-1)
+	server := httptest.NewServer(c.ControlManagers[leader].CreateHttpGatewayHandler())
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Helper method to send a request to the gateway. headers holds pairs of
+// header names and values.
+func gatewayRequest(t *testing.T, server *httptest.Server, method string, key string,
+	body string, headers ...string) *gatewayResponse {
+	t.Helper()
+	ctx, cancel := harness.RequestContext(10 * time.Second)
+	defer cancel()
+	r, err := http.NewRequestWithContext(ctx, method, server.URL+"/v1/keys/"+key,
+		strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := server.Client().Do(r)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, key, err)
+	}
+	defer resp.Body.Close()
+	return decodeGatewayResponse(t, resp.StatusCode, resp.Header, resp.Body)
+}
+
+// Helper method to decode a response of the gateway.
+func decodeGatewayResponse(t *testing.T, status_code int, header http.Header,
+	body io.Reader) *gatewayResponse {
+	t.Helper()
+	ret := &gatewayResponse{status_code: status_code, etag: header.Get("ETag")}
+	if status_code != http.StatusNoContent {
+		if err := json.NewDecoder(body).Decode(&ret.body); err != nil {
+			t.Fatalf("failed to decode response body: %v", err)
+		}
+	}
+	return ret
+}
+
+// Helper method to check the status and error code of a response.
+func expectGatewayStatus(t *testing.T, ret *gatewayResponse, status_code int, code string) {
+	t.Helper()
+	if ret.status_code != status_code || ret.body.Error.Code != code {
+		t.Fatalf("response is %d %q (%s), want %d %q", ret.status_code, ret.body.Error.Code,
+			ret.body.Error.Details, status_code, code)
+	}
+}
+
+func TestGatewayConditionalWrites(t *testing.T) {
+	c := harness.Start(t, harness.DefaultConfig())
+	server := startGateway(t, c)
+
+	// The db_modified_ts of the key is its ETag.
+	ret := gatewayRequest(t, server, "PUT", "etag-key", `{"value": "1"}`)
+	expectGatewayStatus(t, ret, http.StatusOK, "")
+	first_etag := ret.etag
+	if first_etag != strconv.Quote(strconv.FormatInt(ret.body.DbModifiedTs, 10)) {
+		t.Fatalf("ETag of the put is %s, want the quoted db_modified_ts %d", first_etag,
+			ret.body.DbModifiedTs)
+	}
+	ret = gatewayRequest(t, server, "GET", "etag-key", "")
+	expectGatewayStatus(t, ret, http.StatusOK, "")
+	if ret.etag != first_etag || ret.body.Value != "1" {
+		t.Fatalf("get = %q with ETag %s, want 1 with ETag %s", ret.body.Value, ret.etag,
+			first_etag)
+	}
+
+	// If-Match writes only if the key did not change since the ETag was read.
+	ret = gatewayRequest(t, server, "PUT", "etag-key", `{"value": "2"}`, "If-Match", first_etag)
+	expectGatewayStatus(t, ret, http.StatusOK, "")
+	if ret.etag == first_etag {
+		t.Fatalf("ETag %s did not change with the value", ret.etag)
+	}
+	ret = gatewayRequest(t, server, "PUT", "etag-key", `{"value": "3"}`, "If-Match", first_etag)
+	expectGatewayStatus(t, ret, http.StatusPreconditionFailed, "kConditionFailed")
+	ret = gatewayRequest(t, server, "PUT", "etag-key", `{"value": "3"}`, "If-None-Match", "*")
+	expectGatewayStatus(t, ret, http.StatusPreconditionFailed, "kConditionFailed")
+	ret = gatewayRequest(t, server, "PUT", "etag-key", `{"value": "3"}`, "If-Match", "*")
+	expectGatewayStatus(t, ret, http.StatusOK, "")
+
+	// If-Match * requires the key to exist, If-None-Match * to be missing.
+	ret = gatewayRequest(t, server, "PUT", "etag-new", `{"value": "1"}`, "If-Match", "*")
+	expectGatewayStatus(t, ret, http.StatusPreconditionFailed, "kConditionFailed")
+	ret = gatewayRequest(t, server, "PUT", "etag-new", `{"value": "1"}`, "If-None-Match", "*")
+	expectGatewayStatus(t, ret, http.StatusOK, "")
+
+	// Malformed conditions are rejected without writing.
+	for _, headers := range [][]string{
+		{"If-Match", "42"},
+		{"If-Match", `"not-a-ts"`},
+		{"If-None-Match", first_etag},
+		{"If-Match", first_etag, "If-None-Match", "*"},
+	} {
+		ret = gatewayRequest(t, server, "PUT", "etag-key", `{"value": "4"}`, headers...)
+		expectGatewayStatus(t, ret, http.StatusBadRequest, "kInvalidArgument")
+	}
+	ret = gatewayRequest(t, server, "PUT", "etag-key", `{"val": "4"}`)
+	expectGatewayStatus(t, ret, http.StatusBadRequest, "kInvalidArgument")
+	ret = gatewayRequest(t, server, "GET", "etag-key", "")
+	if ret.body.Value != "3" {
+		t.Fatalf("value is %q after rejected writes, want 3", ret.body.Value)
+	}
+
+	ret = gatewayRequest(t, server, "DELETE", "etag-key", "")
+	expectGatewayStatus(t, ret, http.StatusNoContent, "")
+	ret = gatewayRequest(t, server, "GET", "etag-key", "")
+	expectGatewayStatus(t, ret, http.StatusNotFound, "kNotFound")
+	ret = gatewayRequest(t, server, "DELETE", "etag-key", "")
+	expectGatewayStatus(t, ret, http.StatusNotFound, "kNotFound")
+}
+
+func TestGatewayIdempotencyKey(t *testing.T) {
+	c := harness.Start(t, harness.DefaultConfig())
+	server := startGateway(t, c)
+
+	// A retried PUT carrying the same Idempotency-Key is applied once.
+	first := gatewayRequest(t, server, "PUT", "idempotent-key", `{"value": "1"}`,
+		"Idempotency-Key", "request-1")
+	expectGatewayStatus(t, first, http.StatusOK, "")
+	gatewayRequest(t, server, "PUT", "idempotent-key", `{"value": "2"}`)
+	retried := gatewayRequest(t, server, "PUT", "idempotent-key", `{"value": "1"}`,
+		"Idempotency-Key", "request-1")
+	expectGatewayStatus(t, retried, http.StatusOK, "")
+	if retried.etag != first.etag {
+		t.Fatalf("retried put has ETag %s, want the ETag %s of the first attempt",
+			retried.etag, first.etag)
+	}
+	if ret := gatewayRequest(t, server, "GET", "idempotent-key", ""); ret.body.Value != "2" {
+		t.Fatalf("value is %q after the retried put, want 2", ret.body.Value)
+	}
+
+	// Another key is another request.
+	other := gatewayRequest(t, server, "PUT", "idempotent-key", `{"value": "3"}`,
+		"Idempotency-Key", "request-2")
+	expectGatewayStatus(t, other, http.StatusOK, "")
+	if other.etag == first.etag {
+		t.Fatalf("put with another Idempotency-Key has the ETag %s of the first", other.etag)
+	}
+}
+
+func TestGatewayUnavailableAndDeadlineStatuses(t *testing.T) {
+	c := harness.Start(t, harness.DefaultConfig())
+	server := startGateway(t, c)
+	handler := c.ControlManagers[c.WaitForLeader(-1)].CreateHttpGatewayHandler()
+	paused_key := harness.KeysOnShard("gateway-", "1", c.NumShards(), 1)[0]
+	killed_key := harness.KeysOnShard("gateway-", "2", c.NumShards(), 1)[0]
+	for _, key := range []string{paused_key, killed_key} {
+		expectGatewayStatus(t, gatewayRequest(t, server, "PUT", key, `{"value": "1"}`),
+			http.StatusOK, "")
+	}
+
+	// A request whose deadline expires while waiting for the worker.
+	c.Pause(c.OwnerOfShard("1"))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder,
+		httptest.NewRequest("GET", "/v1/keys/"+paused_key, nil).WithContext(ctx))
+	expectGatewayStatus(t, decodeGatewayResponse(t, recorder.Code, recorder.Header(),
+		recorder.Body), http.StatusGatewayTimeout, "kDeadlineExceeded")
+	c.Resume(c.OwnerOfShard("1"))
+
+	// A request for a shard whose worker is unreachable may be retried.
+	c.Kill(c.OwnerOfShard("2"))
+	ret := gatewayRequest(t, server, "GET", killed_key, "")
+	expectGatewayStatus(t, ret, http.StatusServiceUnavailable, "kUnavailable")
+	ret = gatewayRequest(t, server, "GET", paused_key, "")
+	expectGatewayStatus(t, ret, http.StatusOK, "")
+}
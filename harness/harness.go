@@ -0,0 +1,308 @@
+// Package harness runs multi node kvstore clusters inside Go tests. It wraps
+// a local cluster whose node traffic is proxied, so that tests can kill,
+// pause, restart and partition control managers and workers, and provides
+// helpers to talk to the cluster and wait for it to converge.
+package harness
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"kvstore/client"
+	"kvstore/local"
+	"kvstore/membership"
+	pb "kvstore/protos"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Time to wait for a cluster to elect a leader and know all shard owners.
+const readyTimeout = 30 * time.Second
+
+// Cluster under test.
+type Cluster struct {
+	*local.Cluster
+	t      testing.TB
+	config local.ClusterConfig
+}
+
+// Helper method to get the default config of a cluster under test. Node
+// traffic is proxied and sessions are short so that failures are noticed
+// quickly. Faults can be injected into the workers.
+func DefaultConfig() local.ClusterConfig {
+	config := local.DefaultClusterConfig()
+	config.ProxyNodeTraffic = true
+	config.SessionTtlSecs = 2
+	config.EnableFaultInjection = true
+	return config
+}
+
+// Start a cluster for the test and wait until it is ready. The cluster is
+// stopped and its data removed once the test finishes. Skipped in short mode.
+func Start(t testing.TB, config local.ClusterConfig) *Cluster {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("skipping multi node cluster test in short mode")
+	}
+	if config.DataDir == "" {
+		config.DataDir = t.TempDir()
+	}
+	c := &Cluster{Cluster: local.NewCluster(config), t: t, config: config}
+	if err := c.Cluster.Start(); err != nil {
+		t.Fatalf("failed to start cluster: %v", err)
+	}
+	t.Cleanup(c.Cluster.Stop)
+	c.WaitUntilReady()
+	return c
+}
+
+// Wait until a control manager leads and knows the owner of every shard.
+func (c *Cluster) WaitUntilReady() {
+	c.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), readyTimeout)
+	defer cancel()
+	if err := c.Cluster.WaitUntilReady(ctx); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// Wait until a control manager other than exclude leads and return its
+// ordinal. Pass -1 to accept any leader.
+func (c *Cluster) WaitForLeader(exclude int) int {
+	c.t.Helper()
+	leader := -1
+	Eventually(c.t, readyTimeout, func() error {
+		leader = c.Leader()
+		if leader < 0 || leader == exclude {
+			return fmt.Errorf("no new leader elected, leader is %d", leader)
+		}
+		return nil
+	})
+	return leader
+}
+
+// Create a client talking to the i-th control manager. The client is closed
+// once the test finishes.
+func (c *Cluster) Client(i int, opts ...client.Option) *client.Client {
+	c.t.Helper()
+	if c.ControlManagers[i] == nil {
+		c.t.Fatalf("%s is not running", local.ControlManagerName(i))
+	}
+	kv_client, err := client.New(c.ControlManagers[i].Address(), opts...)
+	if err != nil {
+		c.t.Fatalf("failed to create client: %v", err)
+	}
+	c.t.Cleanup(func() { kv_client.Close() })
+	return kv_client
+}
+
+// Helper method to find num_ports consecutive free ports of the local host,
+// e.g. to serve the HTTP gateway or the Redis front end of every control
+// manager. Returns the first port.
+func FreePorts(t testing.TB, num_ports int) int {
+	t.Helper()
+	for attempt := 0; attempt < 100; attempt++ {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to find a free port: %v", err)
+		}
+		port := lis.Addr().(*net.TCPAddr).Port
+		listeners := []net.Listener{lis}
+		for i := 1; i < num_ports; i++ {
+			lis, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port+i)))
+			if err != nil {
+				break
+			}
+			listeners = append(listeners, lis)
+		}
+		for _, lis := range listeners {
+			lis.Close()
+		}
+		if len(listeners) == num_ports {
+			return port
+		}
+	}
+	t.Fatalf("failed to find %d consecutive free ports", num_ports)
+	return 0
+}
+
+// Address of the Redis front end of the i-th control manager. The cluster
+// must be started with a RedisPort.
+func (c *Cluster) RedisAddress(i int) string {
+	c.t.Helper()
+	if c.config.RedisPort == 0 {
+		c.t.Fatalf("the Redis front end is disabled")
+	}
+	return net.JoinHostPort(c.config.Host, strconv.Itoa(c.config.RedisPort+i))
+}
+
+// Create an RPC client talking to the i-th worker directly. The connection
+// is closed once the test finishes.
+func (c *Cluster) WorkerClient(i int) pb.KvStoreServiceClient {
+	c.t.Helper()
+	return pb.NewKvStoreServiceClient(c.dialWorker(i))
+}
+
+// Create an RPC client talking to the WorkerAdmin service of the i-th
+// worker. The connection is closed once the test finishes.
+func (c *Cluster) WorkerAdminClient(i int) pb.WorkerAdminClient {
+	c.t.Helper()
+	return pb.NewWorkerAdminClient(c.dialWorker(i))
+}
+
+// Create a client of the health service of the i-th worker. The connection
+// is closed once the test finishes.
+func (c *Cluster) WorkerHealthClient(i int) healthpb.HealthClient {
+	c.t.Helper()
+	return healthpb.NewHealthClient(c.dialWorker(i))
+}
+
+// Create a client of the health service of the i-th control manager. The
+// connection is closed once the test finishes.
+func (c *Cluster) ControlManagerHealthClient(i int) healthpb.HealthClient {
+	c.t.Helper()
+	if c.ControlManagers[i] == nil {
+		c.t.Fatalf("%s is not running", local.ControlManagerName(i))
+	}
+	return healthpb.NewHealthClient(c.dial(local.ControlManagerName(i),
+		c.ControlManagers[i].Address()))
+}
+
+// Helper method to connect to the i-th worker until the test finishes.
+func (c *Cluster) dialWorker(i int) *grpc.ClientConn {
+	c.t.Helper()
+	if c.Workers[i] == nil {
+		c.t.Fatalf("%s is not running", local.WorkerName(i))
+	}
+	return c.dial(local.WorkerName(i), c.Workers[i].Address())
+}
+
+// Helper method to connect to a node until the test finishes.
+func (c *Cluster) dial(name string, address string) *grpc.ClientConn {
+	c.t.Helper()
+	conn, err := grpc.NewClient(address,
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		c.t.Fatalf("failed to connect to %s: %v", name, err)
+	}
+	c.t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// Number of workers and shards of the cluster.
+func (c *Cluster) NumWorkers() int {
+	return c.config.NumWorkers
+}
+
+func (c *Cluster) NumShards() int {
+	return c.config.NumShards
+}
+
+// Helper method to fail the test if a fault cannot be injected.
+func (c *Cluster) must(err error) {
+	c.t.Helper()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// Kill a node abruptly, see local.Cluster.Kill.
+func (c *Cluster) Kill(name string) {
+	c.t.Helper()
+	c.must(c.Cluster.Kill(name))
+}
+
+// Restart a node at the same address, see local.Cluster.Restart.
+func (c *Cluster) Restart(name string) {
+	c.t.Helper()
+	c.must(c.Cluster.Restart(name))
+}
+
+// Hold the traffic of a node, see local.Cluster.Pause.
+func (c *Cluster) Pause(name string) {
+	c.t.Helper()
+	c.must(c.Cluster.Pause(name))
+}
+
+// Resume a paused node, see local.Cluster.Resume.
+func (c *Cluster) Resume(name string) {
+	c.t.Helper()
+	c.must(c.Cluster.Resume(name))
+}
+
+// Cut a node from everything, see local.Cluster.Partition.
+func (c *Cluster) Partition(name string) {
+	c.t.Helper()
+	c.must(c.Cluster.Partition(name))
+}
+
+// Cut the gRPC server of a node from its clients, see
+// local.Cluster.PartitionGrpc.
+func (c *Cluster) PartitionGrpc(name string) {
+	c.t.Helper()
+	c.must(c.Cluster.PartitionGrpc(name))
+}
+
+// Heal a partitioned node, see local.Cluster.Heal.
+func (c *Cluster) Heal(name string) {
+	c.t.Helper()
+	c.must(c.Cluster.Heal(name))
+}
+
+// Replace the faults injected into a worker, see local.Cluster.SetFaultRules.
+func (c *Cluster) SetFaultRules(name string, rules ...*pb.FaultRule) {
+	c.t.Helper()
+	c.must(c.Cluster.SetFaultRules(name, rules...))
+}
+
+// Call cond until it returns nil, failing the test with its last error if it
+// does not within timeout.
+func Eventually(t testing.TB, timeout time.Duration, cond func() error) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		err := cond()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("condition not met after %v: %v", timeout, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Helper method to get a context bounded by timeout for a single request.
+func RequestContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// Generate count distinct keys with the given prefix which belong to shard.
+func KeysOnShard(prefix string, shard_id string, num_shards int, count int) []string {
+	var keys []string
+	for i := 0; len(keys) < count; i++ {
+		key := fmt.Sprintf("%s%d", prefix, i)
+		if membership.GetShardForKey(key, num_shards) == shard_id {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Name of the worker owning shard.
+func (c *Cluster) OwnerOfShard(shard_id string) string {
+	for i := 0; i < c.config.NumWorkers; i++ {
+		owned_shards, _ := membership.OwnedShards(local.WorkerName(i),
+			c.config.NumWorkers, c.config.NumShards)
+		for _, owned_shard := range owned_shards {
+			if owned_shard == shard_id {
+				return local.WorkerName(i)
+			}
+		}
+	}
+	return ""
+}
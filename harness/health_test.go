@@ -0,0 +1,114 @@
+package harness_test
+
+import (
+	"fmt"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"kvstore/harness"
+	"kvstore/health"
+	"kvstore/local"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Helper method to get the serving status of a service of a node.
+func servingStatus(health_client healthpb.HealthClient,
+	service string) (healthpb.HealthCheckResponse_ServingStatus, error) {
+	ctx, cancel := harness.RequestContext(time.Second)
+	defer cancel()
+	resp, err := health_client.Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+	if err != nil {
+		return healthpb.HealthCheckResponse_UNKNOWN, err
+	}
+	return resp.GetStatus(), nil
+}
+
+// Helper method to wait until a service of a node reports the given status.
+func waitForStatus(t *testing.T, health_client healthpb.HealthClient, service string,
+	want healthpb.HealthCheckResponse_ServingStatus) {
+	t.Helper()
+	harness.Eventually(t, 20*time.Second, func() error {
+		status, err := servingStatus(health_client, service)
+		if err != nil {
+			return err
+		}
+		if status != want {
+			return fmt.Errorf("service %q is %v, want %v", service, status, want)
+		}
+		return nil
+	})
+}
+
+func TestHealthServingOnceReady(t *testing.T) {
+	config := harness.DefaultConfig()
+	config.NumControlManagers = 2
+	c := harness.Start(t, config)
+	leader := c.WaitForLeader(-1)
+	// The standby forwards requests to the leader, so both serve.
+	for i := 0; i < config.NumControlManagers; i++ {
+		health_client := c.ControlManagerHealthClient(i)
+		for _, service := range []string{"", "main.KvStoreInterface", health.LivenessService} {
+			waitForStatus(t, health_client, service, healthpb.HealthCheckResponse_SERVING)
+		}
+	}
+	for i := 0; i < c.NumWorkers(); i++ {
+		health_client := c.WorkerHealthClient(i)
+		for _, service := range []string{"", "main.KvStoreService", health.LivenessService} {
+			waitForStatus(t, health_client, service, healthpb.HealthCheckResponse_SERVING)
+		}
+	}
+	if _, err := servingStatus(c.ControlManagerHealthClient(leader), "unknown"); err == nil {
+		t.Errorf("health check of an unknown service succeeded")
+	}
+}
+
+func TestHealthControlManagerNotServingWithoutWorker(t *testing.T) {
+	c := harness.Start(t, harness.DefaultConfig())
+	leader := c.WaitForLeader(-1)
+	kv_client := c.Client(leader)
+	health_client := c.ControlManagerHealthClient(leader)
+	waitForStatus(t, health_client, "", healthpb.HealthCheckResponse_SERVING)
+
+	// Without a reachable owner for some shards, the control manager is
+	// taken out of the service but stays alive. Requests it still receives
+	// for the other shards are served.
+	worker := local.WorkerName(1)
+	c.Kill(worker)
+	waitForStatus(t, health_client, "", healthpb.HealthCheckResponse_NOT_SERVING)
+	if status, err := servingStatus(health_client, health.LivenessService); err != nil ||
+		status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("liveness is %v without %s, want SERVING: %v", status, worker, err)
+	}
+	mustPut(t, kv_client, harness.KeysOnShard("health-", "0", c.NumShards(), 1)[0], "value")
+
+	// Ready again once the worker is back, without any request to it.
+	c.Restart(worker)
+	waitForStatus(t, health_client, "", healthpb.HealthCheckResponse_SERVING)
+}
+
+func TestHealthWorkerNotServingWithoutWritableMount(t *testing.T) {
+	c := harness.Start(t, harness.DefaultConfig())
+	health_client := c.WorkerHealthClient(0)
+	waitForStatus(t, health_client, "", healthpb.HealthCheckResponse_SERVING)
+
+	// Replace the mount with a file, in which nothing can be written.
+	mount_path := c.WorkerConfig(0).MountPath
+	moved_path := filepath.Join(filepath.Dir(mount_path), "moved")
+	if err := os.Rename(mount_path, moved_path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(mount_path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitForStatus(t, health_client, "", healthpb.HealthCheckResponse_NOT_SERVING)
+	waitForStatus(t, health_client, health.LivenessService, healthpb.HealthCheckResponse_SERVING)
+
+	if err := os.Remove(mount_path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(moved_path, mount_path); err != nil {
+		t.Fatal(err)
+	}
+	waitForStatus(t, health_client, "", healthpb.HealthCheckResponse_SERVING)
+}
@@ -0,0 +1,91 @@
+package harness_test
+
+import (
+	"errors"
+	"kvstore/controlmanager"
+	"kvstore/harness"
+	"kvstore/membership"
+	"kvstore/worker"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Name of the file recording the cluster identity in a worker mount.
+const clusterIdentityFile = "cluster_identity.json"
+
+func TestNodesRefuseToServeWithAnotherShardCount(t *testing.T) {
+	c := harness.Start(t, harness.DefaultConfig())
+	kv_client := c.Client(c.WaitForLeader(-1))
+	identity := getClusterStatus(t, kv_client).GetClusterIdentity()
+	if identity.GetClusterId() == "" || int(identity.GetNumShards()) != c.NumShards() ||
+		identity.GetPartitioner() != membership.Partitioner {
+		t.Fatalf("cluster identity = %v, want %d shards", identity, c.NumShards())
+	}
+
+	// A control manager configured with another shard count does not start.
+	cm_config := c.ControlManagerConfig(0)
+	cm_config.PodName = "control-manager-misconfigured"
+	cm_config.NumShards = c.NumShards() + 1
+	cm_config.GrpcServerPort, cm_config.HttpGatewayPort, cm_config.RedisPort = 0, 0, 0
+	cm_config.MetricsPort = 0
+	cm := controlmanager.New(cm_config)
+	if err := cm.Start(); !errors.Is(err, membership.ErrClusterIdentityMismatch) {
+		t.Errorf("control manager with %d shards started: %v", cm_config.NumShards, err)
+	}
+
+	// Nor does a worker, which leaves its mount untouched.
+	worker_config := c.WorkerConfig(0)
+	worker_config.NumShards = c.NumShards() + 1
+	worker_config.GrpcServerPort, worker_config.MetricsPort = 0, 0
+	mount_path := t.TempDir()
+	worker_config.MountPath = filepath.Join(mount_path, "data")
+	worker_config.OracleTimestampPath = filepath.Join(mount_path, "oracle")
+	worker_config.DedupPath = filepath.Join(mount_path, "dedup")
+	w := worker.New(worker_config)
+	if err := w.Start(); !errors.Is(err, membership.ErrClusterIdentityMismatch) {
+		t.Errorf("worker with %d shards started: %v", worker_config.NumShards, err)
+	}
+	if files, _ := os.ReadDir(mount_path); len(files) > 0 {
+		t.Errorf("misconfigured worker wrote to its mount: %v", files)
+	}
+
+	// The cluster keeps serving.
+	mustPut(t, kv_client, "identity-key", "value")
+}
+
+func TestWorkerRefusesMountOfAnotherCluster(t *testing.T) {
+	c := harness.Start(t, harness.DefaultConfig())
+	kv_client := c.Client(c.WaitForLeader(-1))
+	cluster_id := getClusterStatus(t, kv_client).GetClusterIdentity().GetClusterId()
+	file_path := filepath.Join(c.WorkerConfig(0).MountPath, clusterIdentityFile)
+	data, err := os.ReadFile(file_path)
+	if err != nil || !strings.Contains(string(data), cluster_id) {
+		t.Fatalf("mount of worker-0 records %q, want cluster %s: %v", data, cluster_id, err)
+	}
+
+	// A mount stamped by another cluster is refused.
+	c.StopWorker(0)
+	other := strings.ReplaceAll(string(data), cluster_id, "another-cluster")
+	if err := os.WriteFile(file_path, []byte(other), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.StartWorker(0); !errors.Is(err, membership.ErrClusterIdentityMismatch) {
+		t.Fatalf("worker-0 started on the mount of another cluster: %v", err)
+	}
+
+	// A mount without identity, e.g. from before identities were recorded,
+	// is stamped with the identity of the cluster.
+	if err := os.Remove(file_path); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.StartWorker(0); err != nil {
+		t.Fatalf("worker-0 did not start on a mount without identity: %v", err)
+	}
+	if data, err := os.ReadFile(file_path); err != nil || !strings.Contains(string(data), cluster_id) {
+		t.Errorf("mount of worker-0 records %q, want cluster %s: %v", data, cluster_id, err)
+	}
+	c.WaitUntilReady()
+	mustPut(t, kv_client, harness.KeysOnShard("identity-", "0", c.NumShards(), 1)[0], "value")
+}
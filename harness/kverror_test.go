@@ -0,0 +1,38 @@
+package harness_test
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"kvstore/harness"
+	"kvstore/kverror"
+	pb "kvstore/protos"
+	"testing"
+	"time"
+)
+
+func TestStatusErrorsOnlyWhenRequested(t *testing.T) {
+	c := harness.Start(t, harness.DefaultConfig())
+	shard_id := "1"
+	key := harness.KeysOnShard("missing-", shard_id, c.NumShards(), 1)[0]
+	worker_client := c.WorkerClient(workerIndex(t, c, c.OwnerOfShard(shard_id)))
+	arg := &pb.GetKeyInternalArg{ReqId: "status-request", Key: key}
+
+	// Without the metadata, the failure is reported in the response.
+	ctx, cancel := harness.RequestContext(5 * time.Second)
+	defer cancel()
+	r, err := worker_client.GetKeyInternal(ctx, arg)
+	if err != nil || r.GetSuccess() || r.GetErrorCode() != pb.ErrorCode_kNotFound {
+		t.Fatalf("get %s = %v, %v, want kNotFound in the response", key, r, err)
+	}
+
+	// With it, the failure is a status error carrying the KvError.
+	r, err = worker_client.GetKeyInternal(kverror.WithStatusErrors(ctx), arg)
+	if r != nil || status.Code(err) != codes.NotFound {
+		t.Fatalf("get %s = %v, %v, want a NotFound status error", key, r, err)
+	}
+	kv_error := kverror.FromStatusError(err)
+	if kv_error.GetErrorType() != pb.ErrorCode_kNotFound || kv_error.GetErrorDetails() == "" {
+		t.Errorf("status error of get %s carries %v, want the kNotFound KvError", key,
+			kv_error)
+	}
+}
@@ -0,0 +1,71 @@
+package harness_test
+
+import (
+	"context"
+	"flag"
+	"github.com/anishathalye/porcupine"
+	"kvstore/harness"
+	"kvstore/linearizability"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	linearizability_duration = flag.Duration("linearizability_duration", 10*time.Second,
+		"Duration of the workload of the linearizability tests.")
+	linearizability_check_timeout = flag.Duration("linearizability_check_timeout", 2*time.Minute,
+		"Time after which the linearizability checker gives up.")
+)
+
+// Helper method to run the workload against the cluster while faults are
+// injected, then check the history.
+func runLinearizabilityTest(t *testing.T, faults []harness.Fault) {
+	config := harness.DefaultConfig()
+	config.NumControlManagers = 3
+	c := harness.Start(t, config)
+	var endpoints []linearizability.KvClient
+	for i := range c.ControlManagers {
+		endpoints = append(endpoints, c.Client(i))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *linearizability_duration)
+	defer cancel()
+	var wg sync.WaitGroup
+	if len(faults) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.RunNemesis(ctx, faults, time.Second+time.Duration(config.SessionTtlSecs)*time.Second)
+		}()
+	}
+	history := linearizability.RunWorkload(ctx, linearizability.DefaultWorkloadConfig(), endpoints)
+	wg.Wait()
+
+	stats := history.Stats()
+	t.Logf("recorded %+v", stats)
+	if stats.TotalOperations-stats.Unknown < 100 {
+		t.Fatalf("only %d operations completed", stats.TotalOperations-stats.Unknown)
+	}
+	result := history.Check(*linearizability_check_timeout)
+	switch result.Result {
+	case porcupine.Ok:
+	case porcupine.Unknown:
+		t.Logf("linearizability check timed out after %v", *linearizability_check_timeout)
+	default:
+		path, err := result.WriteVisualization(os.TempDir())
+		if err != nil {
+			t.Fatalf("history is not linearizable and %v", err)
+		}
+		t.Fatalf("history is not linearizable, see %s", path)
+	}
+}
+
+func TestLinearizability(t *testing.T) {
+	runLinearizabilityTest(t, nil)
+}
+
+func TestLinearizabilityUnderFaults(t *testing.T) {
+	runLinearizabilityTest(t, harness.AllFaults())
+}
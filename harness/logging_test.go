@@ -0,0 +1,123 @@
+package harness_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"kvstore/harness"
+	"kvstore/logging"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Buffer collecting the records logged by all nodes.
+type logBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+// Helper method to get the records logged so far, decoded from JSON.
+func (b *logBuffer) Records(t *testing.T) []map[string]any {
+	t.Helper()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var records []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		record := make(map[string]any)
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("log record is not JSON: %q: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// Helper method to log the records of all nodes as JSON to a buffer until
+// the test finishes.
+func captureLogs(t *testing.T, config logging.Config) *logBuffer {
+	buf := &logBuffer{}
+	config.Format = logging.FormatJson
+	config.Output = buf
+	if err := logging.Configure(config); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { logging.Configure(logging.Config{}) })
+	return buf
+}
+
+// Helper method to find the first record with the given message.
+func findRecord(records []map[string]any, msg string) map[string]any {
+	for _, record := range records {
+		if record["msg"] == msg {
+			return record
+		}
+	}
+	return nil
+}
+
+func TestLogsCarryRequestContextAndRedactValues(t *testing.T) {
+	logs := captureLogs(t, logging.Config{ComponentLevels: "control_manager=debug,worker=debug"})
+	c := harness.Start(t, harness.DefaultConfig())
+	shard_id := "0"
+	worker := c.OwnerOfShard(shard_id)
+	key := harness.KeysOnShard("logging-", shard_id, c.NumShards(), 1)[0]
+	value := "secret-value-of-the-test"
+	mustPut(t, c.Client(c.WaitForLeader(-1)), key, value)
+
+	records := logs.Records(t)
+	for _, record := range records {
+		line, _ := json.Marshal(record)
+		if strings.Contains(string(line), value) {
+			t.Errorf("value logged in full: %s", line)
+		}
+	}
+	received := findRecord(records, "Received RPC PutKey")
+	if received == nil {
+		t.Fatalf("PutKey not logged by the control manager")
+	}
+	req_id, _ := received["request_id"].(string)
+	if req_id == "" {
+		t.Errorf("PutKey record has no request id: %v", received)
+	}
+	written := findRecord(records, "Key written to disk")
+	if written == nil {
+		t.Fatalf("disk write not logged by the worker")
+	}
+	want := map[string]any{
+		"component":  "worker",
+		"node":       worker,
+		"request_id": req_id,
+		"shard":      shard_id,
+		"key":        key,
+		"value":      "<redacted 24 bytes>",
+	}
+	for attr, want_value := range want {
+		if written[attr] != want_value {
+			t.Errorf("disk write record %s = %v, want %v", attr, written[attr], want_value)
+		}
+	}
+}
+
+func TestLogValuesWhenEnabled(t *testing.T) {
+	logs := captureLogs(t, logging.Config{ComponentLevels: "worker=debug", LogValues: true})
+	c := harness.Start(t, harness.DefaultConfig())
+	key := harness.KeysOnShard("logging-", "0", c.NumShards(), 1)[0]
+	mustPut(t, c.Client(c.WaitForLeader(-1)), key, "logged-value")
+
+	written := findRecord(logs.Records(t), "Key written to disk")
+	if written == nil {
+		t.Fatalf("disk write not logged by the worker")
+	}
+	if written["value"] != "logged-value" {
+		t.Errorf("disk write record value = %v, want logged-value", written["value"])
+	}
+}
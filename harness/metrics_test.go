@@ -0,0 +1,192 @@
+package harness_test
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"kvstore/harness"
+	pb "kvstore/protos"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Helper method to sum the value of the series of a metric matching labels.
+// Histograms count their observations.
+func metricValue(t *testing.T, gatherer prometheus.Gatherer, name string,
+	labels map[string]string) float64 {
+	t.Helper()
+	families, err := gatherer.Gather()
+	if err != nil {
+		t.Fatalf("gather metrics: %v", err)
+	}
+	total := 0.0
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	series:
+		for _, metric := range family.GetMetric() {
+			for label, value := range labels {
+				found := false
+				for _, pair := range metric.GetLabel() {
+					if pair.GetName() == label && pair.GetValue() == value {
+						found = true
+					}
+				}
+				if !found {
+					continue series
+				}
+			}
+			switch {
+			case metric.GetCounter() != nil:
+				total += metric.GetCounter().GetValue()
+			case metric.GetGauge() != nil:
+				total += metric.GetGauge().GetValue()
+			case metric.GetHistogram() != nil:
+				total += float64(metric.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	return total
+}
+
+// Helper method to check the value of a metric.
+func expectMetric(t *testing.T, gatherer prometheus.Gatherer, name string,
+	labels map[string]string, want float64) {
+	t.Helper()
+	if got := metricValue(t, gatherer, name, labels); got != want {
+		t.Errorf("%s%v = %v, want %v", name, labels, got, want)
+	}
+}
+
+// Helper method to get the ordinal of a worker.
+func workerOrdinal(name string) int {
+	ordinal, _ := strconv.Atoi(name[len("worker-"):])
+	return ordinal
+}
+
+func TestMetricsRecordRequests(t *testing.T) {
+	c := harness.Start(t, harness.DefaultConfig())
+	shard_id := "0"
+	worker := c.OwnerOfShard(shard_id)
+	keys := harness.KeysOnShard("metrics-", shard_id, c.NumShards(), 2)
+	leader := c.WaitForLeader(-1)
+	kv_client := c.Client(leader)
+	ts := mustPut(t, kv_client, keys[0], "value")
+	ctx, cancel := harness.RequestContext(5 * time.Second)
+	defer cancel()
+	_, err := kv_client.Get(ctx, keys[1])
+	expectErrorCode(t, err, pb.ErrorCode_kNotFound)
+
+	cm_metrics := c.ControlManagers[leader].Metrics()
+	expectMetric(t, cm_metrics, "kvstore_rpc_duration_seconds",
+		map[string]string{"method": "PutKey", "error_code": "kNoError"}, 1)
+	expectMetric(t, cm_metrics, "kvstore_rpc_duration_seconds",
+		map[string]string{"method": "GetKey", "error_code": "kNotFound"}, 1)
+	expectMetric(t, cm_metrics, "kvstore_control_manager_worker_rpc_duration_seconds",
+		map[string]string{"worker": worker, "method": "PutKeyInternal"}, 1)
+	expectMetric(t, cm_metrics, "kvstore_control_manager_is_leader", nil, 1)
+	expectMetric(t, cm_metrics, "kvstore_control_manager_worker_breaker_state",
+		map[string]string{"worker": worker, "state": "kBreakerClosed"}, 1)
+	expectMetric(t, cm_metrics, "kvstore_control_manager_worker_connection_state",
+		map[string]string{"worker": worker, "state": "READY"}, 1)
+
+	worker_metrics := c.Workers[workerOrdinal(worker)].Metrics()
+	expectMetric(t, worker_metrics, "kvstore_rpc_duration_seconds",
+		map[string]string{"method": "PutKeyInternal", "error_code": "kNoError"}, 1)
+	expectMetric(t, worker_metrics, "kvstore_rpc_duration_seconds",
+		map[string]string{"method": "GetKeyInternal", "error_code": "kNotFound"}, 1)
+	expectMetric(t, worker_metrics, "kvstore_worker_shard_keys",
+		map[string]string{"shard": shard_id}, 1)
+	expectMetric(t, worker_metrics, "kvstore_worker_oracle_timestamp",
+		map[string]string{"shard": shard_id}, float64(ts))
+	for _, file := range []string{"kv", "oracle_timestamp"} {
+		expectMetric(t, worker_metrics, "kvstore_worker_disk_write_seconds",
+			map[string]string{"file": file}, 1)
+		expectMetric(t, worker_metrics, "kvstore_worker_disk_fsync_seconds",
+			map[string]string{"file": file}, 1)
+	}
+	if bytes := metricValue(t, worker_metrics, "kvstore_worker_shard_bytes",
+		map[string]string{"shard": shard_id}); bytes <= 0 {
+		t.Errorf("kvstore_worker_shard_bytes = %v, want > 0", bytes)
+	}
+}
+
+func TestMetricsRecordOraclePersistFailures(t *testing.T) {
+	c := harness.Start(t, harness.DefaultConfig())
+	shard_id := "1"
+	worker := c.OwnerOfShard(shard_id)
+	key := harness.KeysOnShard("metrics-", shard_id, c.NumShards(), 1)[0]
+	leader := c.WaitForLeader(-1)
+	kv_client := c.Client(leader)
+	c.SetFaultRules(worker, &pb.FaultRule{
+		Point:  pb.FaultPoint_kPersistOracleTimestamp,
+		Action: pb.FaultAction_kFaultFail,
+		Shards: []string{shard_id},
+	})
+	ctx, cancel := harness.RequestContext(5 * time.Second)
+	defer cancel()
+	_, err := kv_client.Put(ctx, key, "value")
+	expectErrorCode(t, err, pb.ErrorCode_kBackendError)
+
+	expectMetric(t, c.ControlManagers[leader].Metrics(), "kvstore_rpc_duration_seconds",
+		map[string]string{"method": "PutKey", "error_code": "kBackendError"}, 1)
+	worker_metrics := c.Workers[workerOrdinal(worker)].Metrics()
+	expectMetric(t, worker_metrics, "kvstore_worker_oracle_persist_failures_total",
+		map[string]string{"shard": shard_id}, 1)
+	expectMetric(t, worker_metrics, "kvstore_rpc_duration_seconds",
+		map[string]string{"method": "PutKeyInternal", "error_code": "kBackendError"}, 1)
+	expectMetric(t, worker_metrics, "kvstore_worker_shard_keys",
+		map[string]string{"shard": shard_id}, 0)
+}
+
+func TestMetricsTrackShardUsage(t *testing.T) {
+	c := harness.Start(t, harness.DefaultConfig())
+	shard_id := "2"
+	worker := workerOrdinal(c.OwnerOfShard(shard_id))
+	keys := harness.KeysOnShard("usage-", shard_id, c.NumShards(), 3)
+	kv_client := c.Client(c.WaitForLeader(-1))
+
+	// The cached usage follows puts, overwrites and deletes.
+	for _, key := range keys {
+		mustPut(t, kv_client, key, "value")
+	}
+	mustPut(t, kv_client, keys[0], strings.Repeat("longer value", 100))
+	ctx, cancel := harness.RequestContext(5 * time.Second)
+	defer cancel()
+	if err := kv_client.Delete(ctx, keys[1]); err != nil {
+		t.Fatalf("delete %s: %v", keys[1], err)
+	}
+
+	// It matches the files of the shard.
+	files, err := os.ReadDir(filepath.Join(c.WorkerConfig(worker).MountPath, shard_id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want_bytes int64
+	for _, file := range files {
+		info, err := file.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want_bytes += info.Size()
+	}
+	worker_metrics := c.Workers[worker].Metrics()
+	labels := map[string]string{"shard": shard_id}
+	expectMetric(t, worker_metrics, "kvstore_worker_shard_keys", labels, 2)
+	expectMetric(t, worker_metrics, "kvstore_worker_shard_bytes", labels, float64(want_bytes))
+	worker_status, err := c.WorkerAdminClient(worker).GetWorkerStatus(ctx,
+		&pb.GetWorkerStatusArg{})
+	if err != nil || !worker_status.GetSuccess() {
+		t.Fatalf("worker status: %v %v", err, worker_status.GetErrorDetails())
+	}
+	for _, shard := range worker_status.GetShards() {
+		if shard.GetShardId() == shard_id &&
+			(shard.GetKeyCount() != 2 || shard.GetBytes() != want_bytes) {
+			t.Errorf("worker status of shard %s has %d keys and %d bytes, want 2 and %d",
+				shard_id, shard.GetKeyCount(), shard.GetBytes(), want_bytes)
+		}
+	}
+}
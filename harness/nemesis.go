@@ -0,0 +1,176 @@
+package harness
+
+import (
+	"context"
+	"fmt"
+	"kvstore/local"
+	pb "kvstore/protos"
+	"math/rand"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+// NEMESIS
+//------------------------------------------------------------------------------
+
+// Fault injected by the nemesis. Returns a description of the fault and a
+// function undoing it, or an error if the fault cannot be injected right
+// now.
+type Fault func(c *Cluster, rng *rand.Rand) (string, func() error, error)
+
+// Kill the leading control manager and restart it once healed.
+func KillLeader(c *Cluster, rng *rand.Rand) (string, func() error, error) {
+	leader := c.Leader()
+	if leader < 0 {
+		return "", nil, fmt.Errorf("no leader")
+	}
+	name := local.ControlManagerName(leader)
+	if err := c.Cluster.Kill(name); err != nil {
+		return "", nil, err
+	}
+	return "kill " + name, func() error { return c.Cluster.Restart(name) }, nil
+}
+
+// Pause the leading control manager for longer than its session TTL. Once
+// resumed it stops on its own, after which it is restarted.
+func PauseLeader(c *Cluster, rng *rand.Rand) (string, func() error, error) {
+	leader := c.Leader()
+	if leader < 0 {
+		return "", nil, fmt.Errorf("no leader")
+	}
+	name := local.ControlManagerName(leader)
+	cm := c.ControlManagers[leader]
+	if err := c.Cluster.Pause(name); err != nil {
+		return "", nil, err
+	}
+	return "pause " + name, func() error {
+		if err := c.Cluster.Resume(name); err != nil {
+			return err
+		}
+		stopped := make(chan struct{})
+		go func() {
+			cm.Wait()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+			return c.Cluster.Restart(name)
+		case <-time.After(time.Duration(c.config.SessionTtlSecs+1) * time.Second):
+			// The session survived the pause.
+			return nil
+		}
+	}, nil
+}
+
+// Kill a random worker and restart it once healed.
+func KillWorker(c *Cluster, rng *rand.Rand) (string, func() error, error) {
+	name := local.WorkerName(rng.Intn(c.config.NumWorkers))
+	if err := c.Cluster.Kill(name); err != nil {
+		return "", nil, err
+	}
+	return "kill " + name, func() error { return c.Cluster.Restart(name) }, nil
+}
+
+// Pause a random worker.
+func PauseWorker(c *Cluster, rng *rand.Rand) (string, func() error, error) {
+	name := local.WorkerName(rng.Intn(c.config.NumWorkers))
+	if err := c.Cluster.Pause(name); err != nil {
+		return "", nil, err
+	}
+	return "pause " + name, func() error { return c.Cluster.Resume(name) }, nil
+}
+
+// Cut the gRPC server of a random worker from the control managers.
+func PartitionWorker(c *Cluster, rng *rand.Rand) (string, func() error, error) {
+	name := local.WorkerName(rng.Intn(c.config.NumWorkers))
+	if err := c.Cluster.PartitionGrpc(name); err != nil {
+		return "", nil, err
+	}
+	return "partition " + name, func() error { return c.Cluster.Heal(name) }, nil
+}
+
+// Helper method to inject faults into a random worker until healed.
+func injectWorkerFaults(c *Cluster, rng *rand.Rand, description string,
+	rules ...*pb.FaultRule) (string, func() error, error) {
+	name := local.WorkerName(rng.Intn(c.config.NumWorkers))
+	if err := c.Cluster.SetFaultRules(name, rules...); err != nil {
+		return "", nil, err
+	}
+	return description + " on " + name, func() error { return c.Cluster.SetFaultRules(name) }, nil
+}
+
+// Drop half of the responses of a random worker after applying the request,
+// so that the control managers retry writes which already took effect.
+func DropWorkerResponses(c *Cluster, rng *rand.Rand) (string, func() error, error) {
+	return injectWorkerFaults(c, rng, "drop responses", &pb.FaultRule{
+		Point:       pb.FaultPoint_kWorkerRpc,
+		Action:      pb.FaultAction_kFaultDropResponse,
+		Probability: 0.5,
+	})
+}
+
+// Fail a fifth of the oracle timestamp persists and disk writes of a random
+// worker.
+func FailWorkerWrites(c *Cluster, rng *rand.Rand) (string, func() error, error) {
+	return injectWorkerFaults(c, rng, "fail writes", &pb.FaultRule{
+		Point:       pb.FaultPoint_kPersistOracleTimestamp,
+		Action:      pb.FaultAction_kFaultFail,
+		Probability: 0.2,
+	}, &pb.FaultRule{
+		Point:       pb.FaultPoint_kWriteKvToDisk,
+		Action:      pb.FaultAction_kFaultFail,
+		Probability: 0.2,
+	})
+}
+
+// Delay the disk operations of a random worker.
+func SlowWorkerDisk(c *Cluster, rng *rand.Rand) (string, func() error, error) {
+	var rules []*pb.FaultRule
+	for _, point := range []pb.FaultPoint{pb.FaultPoint_kPersistOracleTimestamp,
+		pb.FaultPoint_kWriteKvToDisk, pb.FaultPoint_kGetValueFromDisk} {
+		rules = append(rules, &pb.FaultRule{
+			Point:   point,
+			Action:  pb.FaultAction_kFaultDelay,
+			DelayMs: 50,
+		})
+	}
+	return injectWorkerFaults(c, rng, "slow disk", rules...)
+}
+
+// Faults injected by default. Injected worker faults require
+// EnableFaultInjection and are skipped otherwise.
+func AllFaults() []Fault {
+	return []Fault{KillLeader, PauseLeader, KillWorker, PauseWorker, PartitionWorker,
+		DropWorkerResponses, FailWorkerWrites, SlowWorkerDisk}
+}
+
+// Inject random faults until ctx is done. Every fault lasts for duration and
+// is followed by duration without faults. The last fault is healed before
+// returning. Must not run concurrently with other methods of the cluster.
+func (c *Cluster) RunNemesis(ctx context.Context, faults []Fault, duration time.Duration) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for ctx.Err() == nil {
+		fault := faults[rng.Intn(len(faults))]
+		description, heal, err := fault(c, rng)
+		if err != nil {
+			c.t.Logf("nemesis: skipping fault: %v", err)
+		} else {
+			c.t.Logf("nemesis: %s", description)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(duration):
+		}
+		if heal != nil {
+			if err := heal(); err != nil {
+				c.t.Errorf("nemesis: failed to heal %s: %v", description, err)
+				return
+			}
+			c.t.Logf("nemesis: healed %s", description)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(duration):
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package harness_test
+
+import (
+	"fmt"
+	"kvstore/client"
+	"kvstore/harness"
+	pb "kvstore/protos"
+	"testing"
+	"time"
+)
+
+// Helper method to put keys back to back and return the db_modified_ts of
+// the last write.
+func putBackToBack(t *testing.T, c *harness.Cluster, keys []string) int64 {
+	t.Helper()
+	kv_client := c.Client(c.WaitForLeader(-1))
+	var last_ts int64
+	for _, key := range keys {
+		ctx, cancel := harness.RequestContext(5 * time.Second)
+		ts, err := kv_client.Put(ctx, key, "value")
+		cancel()
+		if err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+		if ts <= last_ts {
+			t.Fatalf("put %s returned db_modified_ts %d, not after %d", key, ts, last_ts)
+		}
+		last_ts = ts
+	}
+	return last_ts
+}
+
+// Helper method to restart the owner of shard and check that the oracle
+// timestamps of the shard keep increasing across the restart.
+func testOracleRecovery(t *testing.T, restart func(c *harness.Cluster, worker string)) {
+	c := harness.Start(t, harness.DefaultConfig())
+	shard_id := "1"
+	worker := c.OwnerOfShard(shard_id)
+	keys := harness.KeysOnShard("oracle-", shard_id, c.NumShards(), 40)
+
+	// Writes within the same second push the oracle of the shard ahead of
+	// the wall clock, so a worker which forgot it would hand out older
+	// timestamps after the restart.
+	last_ts := putBackToBack(t, c, keys[:30])
+	if last_ts <= time.Now().Unix() {
+		t.Fatalf("oracle timestamp %d did not move ahead of the wall clock", last_ts)
+	}
+
+	restart(c, worker)
+	c.WaitUntilReady()
+
+	kv_client := c.Client(c.WaitForLeader(-1))
+	var first_ts int64
+	harness.Eventually(t, failoverTimeout, func() error {
+		ctx, cancel := harness.RequestContext(5 * time.Second)
+		defer cancel()
+		ts, err := kv_client.Put(ctx, keys[30], "value")
+		first_ts = ts
+		return err
+	})
+	if first_ts <= last_ts {
+		t.Fatalf("db_modified_ts %d after restart is not after %d before restart",
+			first_ts, last_ts)
+	}
+	putBackToBack(t, c, keys[31:])
+
+	// The writes before the restart are still readable with their
+	// timestamps.
+	ctx, cancel := harness.RequestContext(5 * time.Second)
+	defer cancel()
+	value, err := kv_client.Get(ctx, keys[29])
+	if err != nil {
+		t.Fatalf("get %s: %v", keys[29], err)
+	}
+	if value.DbModifiedTs != last_ts {
+		t.Fatalf("get %s returned db_modified_ts %d, want %d", keys[29],
+			value.DbModifiedTs, last_ts)
+	}
+}
+
+func TestWorkerRestartRecoversOracleTimestamps(t *testing.T) {
+	testOracleRecovery(t, func(c *harness.Cluster, worker string) {
+		c.Restart(worker)
+	})
+}
+
+func TestKilledWorkerRecoversOracleTimestamps(t *testing.T) {
+	testOracleRecovery(t, func(c *harness.Cluster, worker string) {
+		c.Kill(worker)
+		c.Restart(worker)
+	})
+}
+
+func TestKilledWorkerOnlyAffectsItsShards(t *testing.T) {
+	c := harness.Start(t, harness.DefaultConfig())
+	leader := c.WaitForLeader(-1)
+	kv_client := c.Client(leader)
+	killed_keys := harness.KeysOnShard("killed-", "0", c.NumShards(), 5)
+	live_keys := harness.KeysOnShard("live-", "1", c.NumShards(), 5)
+	worker := c.OwnerOfShard("0")
+	if c.OwnerOfShard("1") == worker {
+		t.Fatalf("shards 0 and 1 are both owned by %s", worker)
+	}
+	for _, key := range append(killed_keys, live_keys...) {
+		ctx, cancel := harness.RequestContext(5 * time.Second)
+		_, err := kv_client.Put(ctx, key, key)
+		cancel()
+		if err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+	}
+
+	c.Kill(worker)
+	for _, key := range killed_keys {
+		ctx, cancel := harness.RequestContext(5 * time.Second)
+		_, err := kv_client.Get(ctx, key)
+		cancel()
+		if err == nil {
+			t.Fatalf("get %s succeeded while %s was down", key, worker)
+		}
+	}
+	checkKeys(t, c, leader, map[string]string{live_keys[0]: live_keys[0]})
+
+	c.Restart(worker)
+	values := make(map[string]string)
+	for _, key := range append(killed_keys, live_keys...) {
+		values[key] = key
+	}
+	checkKeys(t, c, leader, values)
+}
+
+func TestKilledWorkerRecoversDedupEntries(t *testing.T) {
+	c := harness.Start(t, harness.DefaultConfig())
+	worker := c.OwnerOfShard("1")
+	key := harness.KeysOnShard("dedup-", "1", c.NumShards(), 1)[0]
+	kv_client := c.Client(c.WaitForLeader(-1))
+	ts := mustPut(t, kv_client, key, "first", client.WithRequestId("dedup-request"))
+
+	// The entry of the write is synced before the write is acknowledged, so
+	// a retry after a crash is still answered from the dedup table.
+	c.Kill(worker)
+	c.Restart(worker)
+	c.WaitUntilReady()
+	var retry_ts int64
+	harness.Eventually(t, failoverTimeout, func() error {
+		ctx, cancel := harness.RequestContext(5 * time.Second)
+		defer cancel()
+		var err error
+		retry_ts, err = kv_client.Put(ctx, key, "second", client.WithRequestId("dedup-request"))
+		return err
+	})
+	if retry_ts != ts {
+		t.Fatalf("retried put returned db_modified_ts %d, want %d", retry_ts, ts)
+	}
+	expectValue(t, kv_client, key, "first", ts)
+}
+
+func TestWorkerKilledBeforeRecordingDedupEntry(t *testing.T) {
+	c := harness.Start(t, harness.DefaultConfig())
+	shard_id := "1"
+	worker := c.OwnerOfShard(shard_id)
+	ordinal := workerIndex(t, c, worker)
+	key := harness.KeysOnShard("dedup-", shard_id, c.NumShards(), 1)[0]
+	arg := &pb.PutKeyInternalArg{ReqId: "crash-request", Key: key, Value: "first"}
+
+	// Hold the write once its value is on disk, before its dedup entry is
+	// recorded, and kill the worker meanwhile.
+	c.SetFaultRules(worker, &pb.FaultRule{
+		Point:     pb.FaultPoint_kRecordDedupEntry,
+		Action:    pb.FaultAction_kFaultDelay,
+		Keys:      []string{key},
+		DelayMs:   (10 * time.Second).Milliseconds(),
+		MaxFaults: 1,
+	})
+	worker_client := c.WorkerClient(ordinal)
+	go func() {
+		ctx, cancel := harness.RequestContext(10 * time.Second)
+		defer cancel()
+		worker_client.PutKeyInternal(ctx, arg)
+	}()
+	admin_client := c.WorkerAdminClient(ordinal)
+	harness.Eventually(t, 5*time.Second, func() error {
+		ctx, cancel := harness.RequestContext(time.Second)
+		defer cancel()
+		resp, err := admin_client.GetFaultRules(ctx, &pb.GetFaultRulesArg{})
+		if err != nil {
+			return err
+		}
+		if len(resp.GetRules()) == 0 || resp.GetRules()[0].GetInjectedFaults() == 0 {
+			return fmt.Errorf("write of %s not held yet", key)
+		}
+		return nil
+	})
+	c.Kill(worker)
+	c.Restart(worker)
+	c.WaitUntilReady()
+	kv_client := c.Client(c.WaitForLeader(-1))
+	ctx, cancel := harness.RequestContext(5 * time.Second)
+	defer cancel()
+	got, err := kv_client.Get(ctx, key)
+	if err != nil || got.Value != "first" {
+		t.Fatalf("get %s = %v, %v, want the value of the killed write", key, got, err)
+	}
+
+	// The retry is not applied again: the value carries its request id.
+	var r *pb.PutKeyInternalRet
+	harness.Eventually(t, failoverTimeout, func() error {
+		ctx, cancel := harness.RequestContext(5 * time.Second)
+		defer cancel()
+		var err error
+		r, err = c.WorkerClient(ordinal).PutKeyInternal(ctx, arg)
+		return err
+	})
+	if !r.GetSuccess() || r.GetDbModifiedTs() != got.DbModifiedTs {
+		t.Fatalf("retried put = %v, want success at db_modified_ts %d", r, got.DbModifiedTs)
+	}
+	expectValue(t, kv_client, key, "first", got.DbModifiedTs)
+	// The entry is recorded again, so the retry is answered once the value
+	// changed as well.
+	mustPut(t, kv_client, key, "second")
+	ctx, cancel = harness.RequestContext(5 * time.Second)
+	defer cancel()
+	r, err = c.WorkerClient(ordinal).PutKeyInternal(ctx, arg)
+	if err != nil || !r.GetSuccess() || r.GetDbModifiedTs() != got.DbModifiedTs {
+		t.Fatalf("retried put = %v, %v, want success at db_modified_ts %d", r, err,
+			got.DbModifiedTs)
+	}
+}
@@ -0,0 +1,442 @@
+package harness_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"kvstore/harness"
+	"kvstore/local"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Error reply of the Redis front end.
+type respErrorReply string
+
+// Map reply of the Redis front end, as a flat list of keys and values.
+type respMapReply []any
+
+// Raw RESP connection to the Redis front end of a control manager.
+type respTestConn struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Helper method to start a cluster serving the Redis front end.
+func startRedisCluster(t *testing.T, num_control_managers int) *harness.Cluster {
+	config := harness.DefaultConfig()
+	config.NumControlManagers = num_control_managers
+	config.RedisPort = harness.FreePorts(t, num_control_managers)
+	c := harness.Start(t, config)
+	c.WaitForLeader(-1)
+	return c
+}
+
+// Helper method to connect to the Redis front end of the i-th control
+// manager. The connection is closed once the test finishes.
+func dialRedis(t *testing.T, c *harness.Cluster, i int) *respTestConn {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", c.RedisAddress(i), 5*time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect to the Redis front end: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &respTestConn{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// Helper method to encode a command as an array of bulk strings.
+func encodeRespCommand(args ...string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return b.String()
+}
+
+// Helper method to send raw bytes on the connection.
+func (c *respTestConn) send(raw string) {
+	c.t.Helper()
+	c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(c.conn, raw); err != nil {
+		c.t.Fatalf("failed to send %q: %v", raw, err)
+	}
+}
+
+// Helper method to read the next reply.
+func (c *respTestConn) read() any {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	reply, err := readRespReply(c.reader)
+	if err != nil {
+		c.t.Fatalf("failed to read reply: %v", err)
+	}
+	return reply
+}
+
+// Helper method to send a command and read its reply.
+func (c *respTestConn) do(args ...string) any {
+	c.t.Helper()
+	c.send(encodeRespCommand(args...))
+	return c.read()
+}
+
+// Helper method to send a command and check its reply.
+func (c *respTestConn) expect(want any, args ...string) {
+	c.t.Helper()
+	if got := c.do(args...); !reflect.DeepEqual(got, want) {
+		c.t.Fatalf("%s = %#v, want %#v", strings.Join(args, " "), got, want)
+	}
+}
+
+// Helper method to send a command and check that it fails with an error
+// starting with prefix.
+func (c *respTestConn) expectError(prefix string, args ...string) {
+	c.t.Helper()
+	got := c.do(args...)
+	if reply_error, ok := got.(respErrorReply); !ok ||
+		!strings.HasPrefix(string(reply_error), prefix) {
+		c.t.Fatalf("%s = %#v, want an error starting with %q", strings.Join(args, " "), got,
+			prefix)
+	}
+}
+
+// Helper method to send a command replying with an integer.
+func (c *respTestConn) integer(args ...string) int64 {
+	c.t.Helper()
+	got := c.do(args...)
+	n, ok := got.(int64)
+	if !ok {
+		c.t.Fatalf("%s = %#v, want an integer", strings.Join(args, " "), got)
+	}
+	return n
+}
+
+// Helper method to decode a reply. Simple and bulk strings are returned as
+// strings, integers as int64, nulls as nil and arrays as []any.
+func readRespReply(reader *bufio.Reader) (any, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(line, "\r\n") || len(line) < 3 {
+		return nil, fmt.Errorf("malformed reply line %q", line)
+	}
+	body := line[1 : len(line)-2]
+	switch line[0] {
+	case '+':
+		return body, nil
+	case '-':
+		return respErrorReply(body), nil
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '_':
+		return nil, nil
+	case '$':
+		length, err := strconv.Atoi(body)
+		if err != nil || length < 0 {
+			return nil, err
+		}
+		buf := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:length]), nil
+	case '*', '%':
+		length, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		if line[0] == '%' {
+			length *= 2
+		}
+		elements := make([]any, length)
+		for i := range elements {
+			if elements[i], err = readRespReply(reader); err != nil {
+				return nil, err
+			}
+		}
+		if line[0] == '%' {
+			return respMapReply(elements), nil
+		}
+		return elements, nil
+	}
+	return nil, fmt.Errorf("unknown reply type in %q", line)
+}
+
+func TestRedisParser(t *testing.T) {
+	c := startRedisCluster(t, 1)
+	conn := dialRedis(t, c, 0)
+
+	// Inline commands, as typed into telnet.
+	conn.send("PING\r\n")
+	if got := conn.read(); got != "PONG" {
+		t.Fatalf("inline PING = %#v, want PONG", got)
+	}
+	conn.send("\r\nECHO hello\r\n")
+	if got := conn.read(); got != "hello" {
+		t.Fatalf("inline ECHO = %#v, want hello", got)
+	}
+
+	// Bulk strings carry any bytes, including CRLF.
+	value := "line\r\nbreak \x00 and utf8 ✓"
+	conn.expect("OK", "SET", "resp-binary", value)
+	conn.expect(value, "GET", "resp-binary")
+
+	// Pipelined commands are answered in order.
+	conn.send(encodeRespCommand("SET", "resp-pipelined", "1") +
+		encodeRespCommand("GET", "resp-pipelined") + encodeRespCommand("DEL", "resp-pipelined") +
+		encodeRespCommand("EXISTS", "resp-pipelined"))
+	for _, want := range []any{"OK", "1", int64(1), int64(0)} {
+		if got := conn.read(); got != want {
+			t.Fatalf("pipelined reply = %#v, want %#v", got, want)
+		}
+	}
+
+	// Unknown commands and wrong arities fail without closing the connection.
+	conn.expectError("ERR unknown command 'NOPE'", "NOPE")
+	conn.expectError("ERR wrong number of arguments", "GET")
+	conn.expectError("ERR empty values are not supported", "SET", "resp-empty", "")
+	conn.expect("PONG", "PING")
+
+	// Protocol errors are answered, then the connection is closed.
+	for _, raw := range []string{"*1\r\n$x\r\n", "*1\r\n$4\r\nPINGxx", "*2\r\n+PING\r\n"} {
+		conn := dialRedis(t, c, 0)
+		conn.send(raw)
+		got := conn.read()
+		if reply_error, ok := got.(respErrorReply); !ok ||
+			!strings.HasPrefix(string(reply_error), "ERR Protocol error") {
+			t.Fatalf("reply to %q = %#v, want a protocol error", raw, got)
+		}
+		conn.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.reader.ReadByte(); err != io.EOF {
+			t.Fatalf("connection still open after %q: %v", raw, err)
+		}
+	}
+}
+
+func TestRedisSetOptionsAndTtl(t *testing.T) {
+	c := startRedisCluster(t, 1)
+	conn := dialRedis(t, c, 0)
+
+	// NX writes missing keys only, XX existing keys only.
+	conn.expect(nil, "SET", "resp-xx", "1", "XX")
+	conn.expect(nil, "GET", "resp-xx")
+	conn.expect("OK", "SET", "resp-nx", "1", "NX")
+	conn.expect(nil, "SET", "resp-nx", "2", "NX")
+	conn.expect("OK", "SET", "resp-nx", "3", "xx")
+	conn.expect("3", "GET", "resp-nx")
+	conn.expectError("ERR syntax error", "SET", "resp-nx", "4", "NX", "XX")
+	conn.expectError("ERR syntax error", "SET", "resp-nx", "4", "EX", "10", "PX", "10")
+	conn.expectError("ERR syntax error", "SET", "resp-nx", "4", "EX")
+	conn.expectError("ERR invalid expire time", "SET", "resp-nx", "4", "EX", "0")
+	conn.expectError("ERR value is not an integer", "SET", "resp-nx", "4", "PX", "soon")
+	conn.expect("3", "GET", "resp-nx")
+
+	// TTL is -2 for missing keys and -1 for keys without expiry.
+	conn.expect(int64(-2), "TTL", "resp-missing")
+	conn.expect(int64(-2), "PTTL", "resp-missing")
+	conn.expect(int64(-1), "TTL", "resp-nx")
+	conn.expect(int64(-1), "PTTL", "resp-nx")
+
+	conn.expect("OK", "SET", "resp-ex", "1", "EX", "100")
+	if ttl := conn.integer("TTL", "resp-ex"); ttl < 99 || ttl > 100 {
+		t.Errorf("TTL after EX 100 = %d, want about 100", ttl)
+	}
+	conn.expect("OK", "SET", "resp-px", "1", "PX", "300", "NX")
+	if pttl := conn.integer("PTTL", "resp-px"); pttl <= 0 || pttl > 300 {
+		t.Errorf("PTTL after PX 300 = %d, want within (0, 300]", pttl)
+	}
+	harness.Eventually(t, 5*time.Second, func() error {
+		if got := conn.do("GET", "resp-px"); got != nil {
+			return fmt.Errorf("GET of an expired key = %#v, want nil", got)
+		}
+		return nil
+	})
+	conn.expect(int64(-2), "PTTL", "resp-px")
+	// An expired key counts as missing for NX.
+	conn.expect("OK", "SET", "resp-px", "2", "NX")
+}
+
+func TestRedisIncr(t *testing.T) {
+	c := startRedisCluster(t, 1)
+	conn := dialRedis(t, c, 0)
+
+	conn.expect(int64(1), "INCR", "resp-counter")
+	conn.expect(int64(2), "INCR", "resp-counter")
+	conn.expect("2", "GET", "resp-counter")
+	conn.expect("OK", "SET", "resp-text", "abc")
+	conn.expectError("ERR value is not an integer", "INCR", "resp-text")
+	conn.expect("OK", "SET", "resp-max", strconv.FormatInt(1<<63-1, 10))
+	conn.expectError("ERR increment or decrement would overflow", "INCR", "resp-max")
+
+	// The expiry of the key is kept.
+	conn.expect("OK", "SET", "resp-expiring", "41", "EX", "100")
+	conn.expect(int64(42), "INCR", "resp-expiring")
+	if ttl := conn.integer("TTL", "resp-expiring"); ttl <= 0 {
+		t.Errorf("TTL after INCR = %d, want the expiry kept", ttl)
+	}
+
+	// Concurrent increments are not lost: each one is a compare-and-set on
+	// the value it read, retried on conflicts.
+	const num_clients, num_increments = 4, 10
+	var (
+		wg        sync.WaitGroup
+		lock      sync.Mutex
+		num_acked int64
+	)
+	for i := 0; i < num_clients; i++ {
+		conn := dialRedis(t, c, 0)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < num_increments; j++ {
+				_, err := io.WriteString(conn.conn, encodeRespCommand("INCR", "resp-concurrent"))
+				var reply any
+				if err == nil {
+					reply, err = readRespReply(conn.reader)
+				}
+				if err != nil {
+					t.Errorf("INCR failed: %v", err)
+					return
+				}
+				if _, ok := reply.(int64); ok {
+					lock.Lock()
+					num_acked++
+					lock.Unlock()
+				} else if reply_error, ok := reply.(respErrorReply); !ok ||
+					!strings.HasPrefix(string(reply_error), "ERR too many concurrent updates") {
+					t.Errorf("INCR = %#v, want an integer", reply)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if num_acked == 0 {
+		t.Fatalf("no concurrent INCR succeeded")
+	}
+	conn.expect(strconv.FormatInt(num_acked, 10), "GET", "resp-concurrent")
+}
+
+// Helper method to scan all keys matching pattern, count at a time.
+func scanAll(t *testing.T, conn *respTestConn, pattern string, count int) []string {
+	t.Helper()
+	var keys []string
+	cursor := "0"
+	for num_pages := 0; ; num_pages++ {
+		if num_pages > 1000 {
+			t.Fatalf("scan of %s does not end", pattern)
+		}
+		reply, ok := conn.do("SCAN", cursor, "MATCH", pattern, "COUNT",
+			strconv.Itoa(count)).([]any)
+		if !ok || len(reply) != 2 {
+			t.Fatalf("SCAN %s = %#v, want a cursor and keys", cursor, reply)
+		}
+		for _, key := range reply[1].([]any) {
+			keys = append(keys, key.(string))
+		}
+		if cursor = reply[0].(string); cursor == "0" {
+			return keys
+		}
+	}
+}
+
+func TestRedisScan(t *testing.T) {
+	c := startRedisCluster(t, 2)
+	conn := dialRedis(t, c, 0)
+	var want []string
+	for i := 0; i < 25; i++ {
+		key := fmt.Sprintf("resp-scan-%02d", i)
+		conn.expect("OK", "SET", key, "1")
+		want = append(want, key)
+	}
+	conn.expect("OK", "SET", "resp-other", "1")
+
+	// Every matching key is returned once, whatever the page size.
+	for _, count := range []int{1, 7, 10, 100} {
+		if got := scanAll(t, conn, "resp-scan-*", count); !reflect.DeepEqual(got, want) {
+			t.Errorf("SCAN with COUNT %d = %v, want %v", count, got, want)
+		}
+	}
+	got := scanAll(t, conn, "resp-scan-?[05]", 4)
+	sort.Strings(got)
+	if want := []string{"resp-scan-00", "resp-scan-05", "resp-scan-10", "resp-scan-15",
+		"resp-scan-20"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SCAN MATCH resp-scan-?[05] = %v, want %v", got, want)
+	}
+
+	conn.expectError("ERR invalid cursor", "SCAN", "abc")
+	conn.expectError("ERR invalid cursor", "SCAN", "123456789")
+	conn.expectError("ERR syntax error", "SCAN", "0", "COUNT", "0")
+	conn.expectError("ERR syntax error", "SCAN", "0", "TYPE", "string")
+
+	// Cursors are kept in the memory of the control manager handing them
+	// out, so a scan must be continued on the same control manager.
+	reply := conn.do("SCAN", "0", "MATCH", "resp-scan-*", "COUNT", "5").([]any)
+	cursor := reply[0].(string)
+	dialRedis(t, c, 1).expectError("ERR invalid cursor", "SCAN", cursor)
+	if reply, ok := dialRedis(t, c, 0).do("SCAN", cursor).([]any); !ok || len(reply) != 2 {
+		t.Errorf("SCAN %s on another connection = %#v, want a page", cursor, reply)
+	}
+
+	// A scan started on a standby survives the failover of the leader.
+	leader := c.WaitForLeader(-1)
+	standby_conn := dialRedis(t, c, 1-leader)
+	reply = standby_conn.do("SCAN", "0", "MATCH", "resp-scan-*", "COUNT", "10").([]any)
+	got = nil
+	for _, key := range reply[1].([]any) {
+		got = append(got, key.(string))
+	}
+	c.Kill(local.ControlManagerName(leader))
+	c.WaitForLeader(leader)
+	for cursor = reply[0].(string); cursor != "0"; cursor = reply[0].(string) {
+		reply = standby_conn.do("SCAN", cursor, "MATCH", "resp-scan-*", "COUNT", "10").([]any)
+		for _, key := range reply[1].([]any) {
+			got = append(got, key.(string))
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SCAN across a failover = %v, want %v", got, want)
+	}
+}
+
+func TestRedisHello(t *testing.T) {
+	c := startRedisCluster(t, 1)
+	conn := dialRedis(t, c, 0)
+
+	// RESP2 until HELLO 3: maps are flat arrays and nulls are null bulk
+	// strings.
+	conn.send(encodeRespCommand("GET", "resp-hello"))
+	conn.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if line, err := conn.reader.ReadString('\n'); err != nil || line != "$-1\r\n" {
+		t.Fatalf("GET of a missing key in RESP2 = %q, %v, want a null bulk string", line, err)
+	}
+	hello, ok := conn.do("HELLO").([]any)
+	if !ok || len(hello) != 14 || hello[4] != "proto" || hello[5] != int64(2) {
+		t.Fatalf("HELLO = %#v, want 7 flat fields with proto 2", hello)
+	}
+
+	conn.expectError("NOPROTO", "HELLO", "4")
+	conn.expectError("ERR syntax error", "HELLO", "3", "AUTH", "user")
+	map_reply, ok := conn.do("HELLO", "3", "AUTH", "user", "password", "SETNAME",
+		"test").(respMapReply)
+	if !ok || len(map_reply) != 14 || map_reply[0] != "server" || map_reply[1] != "kvstore" ||
+		map_reply[5] != int64(3) {
+		t.Fatalf("HELLO 3 = %#v, want a map with proto 3", map_reply)
+	}
+	conn.send(encodeRespCommand("GET", "resp-hello"))
+	if line, err := conn.reader.ReadString('\n'); err != nil || line != "_\r\n" {
+		t.Fatalf("GET of a missing key in RESP3 = %q, %v, want a RESP3 null", line, err)
+	}
+	conn.expect(int64(-2), "TTL", "resp-hello")
+}
@@ -0,0 +1,208 @@
+package harness_test
+
+import (
+	"fmt"
+	"kvstore/client"
+	"kvstore/harness"
+	"kvstore/local"
+	"kvstore/membership"
+	pb "kvstore/protos"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShardMapMatchesOwnership(t *testing.T) {
+	c := harness.Start(t, harness.DefaultConfig())
+	kv_client := c.Client(c.WaitForLeader(-1))
+	ctx, cancel := harness.RequestContext(5 * time.Second)
+	defer cancel()
+	shard_map, err := kv_client.GetShardMap(ctx)
+	if err != nil {
+		t.Fatalf("get shard map: %v", err)
+	}
+	if int(shard_map.GetNumShards()) != c.NumShards() {
+		t.Fatalf("shard map has %d shards, want %d", shard_map.GetNumShards(), c.NumShards())
+	}
+	if len(shard_map.GetShards()) != c.NumShards() {
+		t.Fatalf("shard map assigns %d shards, want %d", len(shard_map.GetShards()),
+			c.NumShards())
+	}
+	for i, assignment := range shard_map.GetShards() {
+		if assignment.GetShardId() != strconv.Itoa(i) {
+			t.Errorf("shard %s listed at position %d", assignment.GetShardId(), i)
+		}
+		owner := c.OwnerOfShard(assignment.GetShardId())
+		if assignment.GetWorkerName() != owner {
+			t.Errorf("shard %s assigned to %s, want %s", assignment.GetShardId(),
+				assignment.GetWorkerName(), owner)
+		}
+		ordinal, _ := strconv.Atoi(owner[len("worker-"):])
+		if assignment.GetAddress() != c.Workers[ordinal].Address() {
+			t.Errorf("shard %s assigned to address %s, want %s", assignment.GetShardId(),
+				assignment.GetAddress(), c.Workers[ordinal].Address())
+		}
+	}
+}
+
+func TestKeysAreStoredOnTheirShardOwner(t *testing.T) {
+	c := harness.Start(t, harness.DefaultConfig())
+	kv_client := c.Client(c.WaitForLeader(-1))
+	var keys []string
+	for k := 0; k < 100; k++ {
+		key := fmt.Sprintf("routing-%d", k)
+		ctx, cancel := harness.RequestContext(5 * time.Second)
+		_, err := kv_client.Put(ctx, key, key)
+		cancel()
+		if err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+		keys = append(keys, key)
+	}
+
+	workers := make([]pb.KvStoreServiceClient, c.NumWorkers())
+	for i := range workers {
+		workers[i] = c.WorkerClient(i)
+	}
+	for _, key := range keys {
+		owner := c.OwnerOfShard(membership.GetShardForKey(key, c.NumShards()))
+		for i, worker := range workers {
+			ctx, cancel := harness.RequestContext(5 * time.Second)
+			r, err := worker.GetKeyInternal(ctx, &pb.GetKeyInternalArg{
+				ReqId: "routing-test",
+				Key:   key,
+			})
+			cancel()
+			if err != nil {
+				t.Fatalf("get %s from %s: %v", key, local.WorkerName(i), err)
+			}
+			if local.WorkerName(i) == owner {
+				if !r.GetSuccess() || r.GetKvObject().GetValue() != key {
+					t.Errorf("owner %s of %s returned %v", owner, key, r)
+				}
+			} else if r.GetErrorCode() != pb.ErrorCode_kWrongShard {
+				t.Errorf("%s served %s owned by %s: %v", local.WorkerName(i), key, owner, r)
+			}
+		}
+	}
+}
+
+func TestSmartClientRoutesLikeControlManager(t *testing.T) {
+	c := harness.Start(t, harness.DefaultConfig())
+	leader := c.WaitForLeader(-1)
+	kv_client := c.Client(leader)
+	smart_client := c.Client(leader, client.WithSmartRouting())
+	for k := 0; k < 50; k++ {
+		key := fmt.Sprintf("smart-%d", k)
+		writer, reader := kv_client, smart_client
+		if k%2 == 1 {
+			writer, reader = smart_client, kv_client
+		}
+		ctx, cancel := harness.RequestContext(5 * time.Second)
+		ts, err := writer.Put(ctx, key, key)
+		if err != nil {
+			cancel()
+			t.Fatalf("put %s: %v", key, err)
+		}
+		value, err := reader.Get(ctx, key)
+		cancel()
+		if err != nil {
+			t.Fatalf("get %s: %v", key, err)
+		}
+		if value.Value != key || value.DbModifiedTs != ts {
+			t.Fatalf("get %s returned %+v, want value %s at %d", key, value, key, ts)
+		}
+	}
+}
+
+func TestWorkersValidateWrites(t *testing.T) {
+	c := harness.Start(t, harness.DefaultConfig())
+	shard_id := "1"
+	key := harness.KeysOnShard("validate-", shard_id, c.NumShards(), 1)[0]
+	worker := c.WorkerClient(workerIndex(t, c, c.OwnerOfShard(shard_id)))
+	for _, arg := range []*pb.PutKeyInternalArg{
+		{ReqId: "validate-empty", Key: key},
+		{ReqId: "validate-expiry", Key: key, Value: "value", ExpiresAtMs: -1},
+		{ReqId: strings.Repeat("r", 200), Key: key, Value: "value"},
+		{ReqId: "validate-conditions", Key: key, Value: "value",
+			Condition: &pb.WriteCondition{IfExists: true, IfNotExists: true}},
+	} {
+		ctx, cancel := harness.RequestContext(5 * time.Second)
+		r, err := worker.PutKeyInternal(ctx, arg)
+		cancel()
+		if err != nil || r.GetErrorCode() != pb.ErrorCode_kInvalidArgument {
+			t.Errorf("put %v = %v, %v, want kInvalidArgument", arg, r, err)
+		}
+	}
+
+	// The client rejects them before picking a route.
+	smart_client := c.Client(c.WaitForLeader(-1), client.WithSmartRouting())
+	ctx, cancel := harness.RequestContext(5 * time.Second)
+	defer cancel()
+	_, err := smart_client.Put(ctx, key, "value", client.WithTtl(-time.Second))
+	expectErrorCode(t, err, pb.ErrorCode_kInvalidArgument)
+}
+
+func TestKeysCannotEscapeTheirShardDirectory(t *testing.T) {
+	c := harness.Start(t, harness.DefaultConfig())
+	kv_client := c.Client(c.WaitForLeader(-1))
+	worker := c.WorkerClient(0)
+	for _, key := range []string{"..", ".", "../escape", "a/b", "a\\b", "a\x00b"} {
+		ctx, cancel := harness.RequestContext(5 * time.Second)
+		_, err := kv_client.Put(ctx, key, "value")
+		expectErrorCode(t, err, pb.ErrorCode_kInvalidArgument)
+		_, err = kv_client.Get(ctx, key)
+		expectErrorCode(t, err, pb.ErrorCode_kInvalidArgument)
+		r, err := worker.DeleteKeyInternal(ctx, &pb.DeleteKeyInternalArg{
+			ReqId: "escape-request",
+			Key:   key,
+		})
+		cancel()
+		if err != nil || r.GetErrorCode() != pb.ErrorCode_kInvalidArgument {
+			t.Errorf("delete %q from worker-0 = %v, %v, want kInvalidArgument", key, r, err)
+		}
+	}
+	// Dots within a key are fine.
+	mustPut(t, kv_client, "a..b", "value")
+}
+
+func TestPartitionedWorkerOnlyAffectsItsShards(t *testing.T) {
+	c := harness.Start(t, harness.DefaultConfig())
+	kv_client := c.Client(c.WaitForLeader(-1))
+	partitioned := c.OwnerOfShard("2")
+	cut_keys := harness.KeysOnShard("cut-", "2", c.NumShards(), 5)
+	live_keys := harness.KeysOnShard("live-", "0", c.NumShards(), 5)
+
+	// The worker keeps its registration but the control manager cannot
+	// reach it.
+	c.PartitionGrpc(partitioned)
+	for _, key := range cut_keys {
+		ctx, cancel := harness.RequestContext(5 * time.Second)
+		_, err := kv_client.Put(ctx, key, key)
+		cancel()
+		if err == nil {
+			t.Fatalf("put %s succeeded while %s was partitioned", key, partitioned)
+		}
+	}
+	for _, key := range live_keys {
+		ctx, cancel := harness.RequestContext(5 * time.Second)
+		_, err := kv_client.Put(ctx, key, key)
+		cancel()
+		if err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+	}
+
+	// Writes succeed again once the partition heals and the circuit breaker
+	// lets a probe through.
+	c.Heal(partitioned)
+	for _, key := range cut_keys {
+		harness.Eventually(t, failoverTimeout, func() error {
+			ctx, cancel := harness.RequestContext(5 * time.Second)
+			defer cancel()
+			_, err := kv_client.Put(ctx, key, key)
+			return err
+		})
+	}
+}
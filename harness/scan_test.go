@@ -0,0 +1,174 @@
+package harness_test
+
+import (
+	"fmt"
+	"kvstore/client"
+	"kvstore/harness"
+	"kvstore/local"
+	"kvstore/membership"
+	pb "kvstore/protos"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Helper method to scan the keys of a worker directly.
+func scanWorker(t *testing.T, c *harness.Cluster, worker int, prefix string, start_after string,
+	limit int32) *pb.ScanKeysInternalRet {
+	t.Helper()
+	ctx, cancel := harness.RequestContext(10 * time.Second)
+	defer cancel()
+	ret, err := c.WorkerClient(worker).ScanKeysInternal(ctx, &pb.ScanKeysInternalArg{
+		ReqId: "scan-test", Prefix: prefix, StartAfter: start_after, Limit: limit})
+	if err != nil || !ret.GetSuccess() {
+		t.Fatalf("scan of %s after %q = %v, %v", local.WorkerName(worker), start_after, ret, err)
+	}
+	return ret
+}
+
+// Helper method to scan all the keys of a worker, limit keys at a time.
+func scanWorkerKeys(t *testing.T, c *harness.Cluster, worker int, prefix string,
+	limit int32) []string {
+	t.Helper()
+	var keys []string
+	start_after := ""
+	for {
+		ret := scanWorker(t, c, worker, prefix, start_after, limit)
+		for _, entry := range ret.GetEntries() {
+			if entry.GetKey() <= start_after {
+				t.Fatalf("scan returned %q after %q, want key order", entry.GetKey(),
+					start_after)
+			}
+			keys = append(keys, entry.GetKey())
+			start_after = entry.GetKey()
+		}
+		if !ret.GetHasMore() {
+			return keys
+		}
+	}
+}
+
+// Helper method to put keys concurrently.
+func putKeysConcurrently(t *testing.T, kv_client *client.Client, keys []string, opts ...client.PutOption) {
+	t.Helper()
+	var wg sync.WaitGroup
+	errs := make(chan error, len(keys))
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := i; j < len(keys); j += 8 {
+				ctx, cancel := harness.RequestContext(10 * time.Second)
+				_, err := kv_client.Put(ctx, keys[j], "value", opts...)
+				cancel()
+				if err != nil {
+					errs <- fmt.Errorf("put %s: %w", keys[j], err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+// Helper method to return the keys with prefix stored on the shards of worker.
+func keysOnWorker(c *harness.Cluster, worker int, prefix string, count int) []string {
+	var keys []string
+	for shard := 0; shard < c.NumShards(); shard++ {
+		shard_id := strconv.Itoa(shard)
+		if c.OwnerOfShard(shard_id) == local.WorkerName(worker) {
+			keys = append(keys, harness.KeysOnShard(prefix+shard_id+"-", shard_id,
+				c.NumShards(), count)...)
+		}
+	}
+	return keys
+}
+
+func TestWorkerScanLimit(t *testing.T) {
+	c := harness.Start(t, harness.DefaultConfig())
+	c.WaitForLeader(-1)
+	keys := keysOnWorker(c, 0, "scan-", 700)
+	putKeysConcurrently(t, c.Client(0), keys)
+
+	// A missing or negative limit means the default, a huge one is capped.
+	for _, test := range []struct {
+		limit    int32
+		want_len int
+	}{{0, 100}, {-5, 100}, {10, 10}, {1 << 30, 1000}} {
+		ret := scanWorker(t, c, 0, "scan-", "", test.limit)
+		if len(ret.GetEntries()) != test.want_len || !ret.GetHasMore() {
+			t.Errorf("scan with limit %d returned %d entries, has_more %t, want %d and true",
+				test.limit, len(ret.GetEntries()), ret.GetHasMore(), test.want_len)
+		}
+	}
+	if got := scanWorkerKeys(t, c, 0, "scan-", 1<<30); len(got) != len(keys) {
+		t.Fatalf("scan of all pages returned %d keys, want %d", len(got), len(keys))
+	}
+	// The keys of the first shard of the worker.
+	shard_prefix := keys[0][:strings.LastIndex(keys[0], "-")+1]
+	if got := scanWorkerKeys(t, c, 0, shard_prefix, 7); len(got) != 700 {
+		t.Fatalf("scan of prefix %s returned %d keys, want 700", shard_prefix, len(got))
+	}
+}
+
+func TestWorkerScanOnlyOwnedShards(t *testing.T) {
+	c := harness.Start(t, harness.DefaultConfig())
+	c.WaitForLeader(-1)
+	owned_keys := keysOnWorker(c, 0, "owned-", 2)
+	other_keys := keysOnWorker(c, 1, "owned-", 2)
+	putKeysConcurrently(t, c.Client(0), append(owned_keys, other_keys...))
+
+	// Left over files of a shard owned by another worker, e.g. after the
+	// shard moved, are not returned.
+	for _, key := range other_keys {
+		shard_id := membership.GetShardForKey(key, c.NumShards())
+		data, err := os.ReadFile(filepath.Join(c.WorkerConfig(1).MountPath, shard_id, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		shard_dir := filepath.Join(c.WorkerConfig(0).MountPath, shard_id)
+		if err := os.MkdirAll(shard_dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(shard_dir, key), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	slices.Sort(owned_keys)
+	if got := scanWorkerKeys(t, c, 0, "owned-", 0); !slices.Equal(got, owned_keys) {
+		t.Fatalf("scan of worker-0 returned %v, want %v", got, owned_keys)
+	}
+}
+
+func TestWorkerScanSkipsExpiredKeys(t *testing.T) {
+	c := harness.Start(t, harness.DefaultConfig())
+	c.WaitForLeader(-1)
+	kv_client := c.Client(0)
+
+	// Runs of expired keys longer than a page between live keys.
+	keys := keysOnWorker(c, 0, "expiry-", 10)
+	slices.Sort(keys)
+	var live_keys, expiring_keys []string
+	for i, key := range keys {
+		if i%7 == 0 {
+			live_keys = append(live_keys, key)
+		} else {
+			expiring_keys = append(expiring_keys, key)
+		}
+	}
+	putKeysConcurrently(t, kv_client, live_keys)
+	putKeysConcurrently(t, kv_client, expiring_keys, client.WithTtl(time.Second))
+	time.Sleep(1500 * time.Millisecond)
+
+	if got := scanWorkerKeys(t, c, 0, "expiry-", 2); !slices.Equal(got, live_keys) {
+		t.Fatalf("scan returned %v, want the live keys %v", got, live_keys)
+	}
+}
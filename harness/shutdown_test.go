@@ -0,0 +1,200 @@
+package harness_test
+
+import (
+	"fmt"
+	"kvstore/client"
+	"kvstore/harness"
+	"kvstore/local"
+	pb "kvstore/protos"
+	"kvstore/worker"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Time for which the disk writes of the tests are held, so that the nodes
+// are stopped while serving them.
+const writeDelay = time.Second
+
+// Helper method to get the ordinal of a worker from its name.
+func workerIndex(t *testing.T, c *harness.Cluster, name string) int {
+	t.Helper()
+	for i := 0; i < c.NumWorkers(); i++ {
+		if local.WorkerName(i) == name {
+			return i
+		}
+	}
+	t.Fatalf("unknown worker %s", name)
+	return -1
+}
+
+// Helper method to start a Put whose disk write is held by the worker, which
+// owns the key, and to wait until the write is being served. The outcome of
+// the Put is sent on the returned channel.
+func startDelayedPut(t *testing.T, c *harness.Cluster, kv_client *client.Client,
+	worker int, key string, value string) <-chan error {
+	t.Helper()
+	c.SetFaultRules(local.WorkerName(worker), &pb.FaultRule{
+		Point:     pb.FaultPoint_kWriteKvToDisk,
+		Action:    pb.FaultAction_kFaultDelay,
+		Keys:      []string{key},
+		DelayMs:   writeDelay.Milliseconds(),
+		MaxFaults: 1,
+	})
+	put_err := make(chan error, 1)
+	go func() {
+		ctx, cancel := harness.RequestContext(10 * time.Second)
+		defer cancel()
+		_, err := kv_client.Put(ctx, key, value)
+		put_err <- err
+	}()
+	admin_client := c.WorkerAdminClient(worker)
+	harness.Eventually(t, 5*time.Second, func() error {
+		ctx, cancel := harness.RequestContext(time.Second)
+		defer cancel()
+		resp, err := admin_client.GetFaultRules(ctx, &pb.GetFaultRulesArg{})
+		if err != nil {
+			return err
+		}
+		if len(resp.GetRules()) == 0 || resp.GetRules()[0].GetInjectedFaults() == 0 {
+			return fmt.Errorf("write of %s not held yet", key)
+		}
+		return nil
+	})
+	return put_err
+}
+
+func TestShutdownWorkerDrainsRequests(t *testing.T) {
+	c := harness.Start(t, harness.DefaultConfig())
+	shard_id := "1"
+	worker := workerIndex(t, c, c.OwnerOfShard(shard_id))
+	key := harness.KeysOnShard("shutdown-", shard_id, c.NumShards(), 1)[0]
+	kv_client := c.Client(c.WaitForLeader(-1))
+	put_err := startDelayedPut(t, c, kv_client, worker, key, "value")
+
+	// The write being served finishes before the worker stops.
+	start := time.Now()
+	c.StopWorker(worker)
+	if err := <-put_err; err != nil {
+		t.Fatalf("put %s while the worker was stopping: %v", key, err)
+	}
+	if elapsed := time.Since(start); elapsed > writeDelay+5*time.Second {
+		t.Errorf("worker took %v to stop", elapsed)
+	}
+	tmp_files, _ := filepath.Glob(filepath.Join(c.WorkerConfig(worker).MountPath, "tmp", "*"))
+	if len(tmp_files) != 0 {
+		t.Errorf("temporary files left behind: %v", tmp_files)
+	}
+
+	if err := c.StartWorker(worker); err != nil {
+		t.Fatal(err)
+	}
+	harness.Eventually(t, 10*time.Second, func() error {
+		ctx, cancel := harness.RequestContext(time.Second)
+		defer cancel()
+		got, err := kv_client.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		if got.Value != "value" {
+			return fmt.Errorf("get %s = %q, want value", key, got.Value)
+		}
+		return nil
+	})
+}
+
+func TestShutdownWorkerIgnoresTornTemporaryFiles(t *testing.T) {
+	c := harness.Start(t, harness.DefaultConfig())
+	shard_id := "0"
+	worker := workerIndex(t, c, c.OwnerOfShard(shard_id))
+	key := harness.KeysOnShard("shutdown-", shard_id, c.NumShards(), 1)[0]
+	kv_client := c.Client(c.WaitForLeader(-1))
+	ts := mustPut(t, kv_client, key, "value")
+
+	// Leave behind the temporary files of writes interrupted by a crash.
+	c.Kill(local.WorkerName(worker))
+	config := c.WorkerConfig(worker)
+	torn_files := []string{
+		filepath.Join(config.MountPath, "tmp", key+"-1.tmp"),
+		filepath.Join(config.OracleTimestampPath, shard_id+"-1.tmp"),
+	}
+	for _, torn_file := range torn_files {
+		if err := os.MkdirAll(filepath.Dir(torn_file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(torn_file, []byte("torn"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.Restart(local.WorkerName(worker))
+	c.WaitUntilReady()
+	expectValue(t, kv_client, key, "value", ts)
+	if _, err := os.Stat(torn_files[0]); !os.IsNotExist(err) {
+		t.Errorf("temporary file of the mount not cleaned up: %v", err)
+	}
+}
+
+func TestShutdownControlManagerDrainsRequestsAndResigns(t *testing.T) {
+	config := harness.DefaultConfig()
+	config.NumControlManagers = 2
+	// Long enough that a failover within it is due to the resignation.
+	config.SessionTtlSecs = 30
+	c := harness.Start(t, config)
+	leader := c.WaitForLeader(-1)
+	shard_id := "2"
+	worker := workerIndex(t, c, c.OwnerOfShard(shard_id))
+	key := harness.KeysOnShard("shutdown-", shard_id, c.NumShards(), 1)[0]
+	put_err := startDelayedPut(t, c, c.Client(leader), worker, key, "value")
+
+	start := time.Now()
+	c.StopControlManager(leader)
+	if err := <-put_err; err != nil {
+		t.Fatalf("put %s while the leader was stopping: %v", key, err)
+	}
+	new_leader := c.WaitForLeader(leader)
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("new leader elected after %v", elapsed)
+	}
+	ctx, cancel := harness.RequestContext(5 * time.Second)
+	defer cancel()
+	got, err := c.Client(new_leader).Get(ctx, key)
+	if err != nil || got.Value != "value" {
+		t.Fatalf("get %s = (%v, %v), want value", key, got, err)
+	}
+}
+
+func TestWorkerFailingToStartStops(t *testing.T) {
+	c := harness.Start(t, harness.DefaultConfig())
+	c.WaitForLeader(-1)
+	// The gRPC port of worker-0 is taken by worker-0 itself.
+	_, port, err := net.SplitHostPort(c.Workers[0].Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	worker_config := c.WorkerConfig(0)
+	worker_config.GrpcServerPort, _ = strconv.Atoi(port)
+	worker_config.MetricsPort = 0
+	mount_path := t.TempDir()
+	worker_config.MountPath = filepath.Join(mount_path, "data")
+	worker_config.OracleTimestampPath = filepath.Join(mount_path, "oracle")
+	worker_config.DedupPath = filepath.Join(mount_path, "dedup")
+	w := worker.New(worker_config)
+	start_err := w.Start()
+	if start_err == nil {
+		t.Fatalf("worker started on the port of worker-0")
+	}
+	// The failed worker released its resources and reports why it stopped.
+	waited := make(chan error, 1)
+	go func() { waited <- w.Wait() }()
+	select {
+	case err := <-waited:
+		if err == nil || err.Error() != start_err.Error() {
+			t.Errorf("wait returned %v, want %v", err, start_err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("worker which failed to start did not stop")
+	}
+}
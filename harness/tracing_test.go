@@ -0,0 +1,150 @@
+package harness_test
+
+import (
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"kvstore/harness"
+	pb "kvstore/protos"
+	"kvstore/tracing"
+	"testing"
+	"time"
+)
+
+// Helper method to start a cluster recording the spans of all nodes.
+func startTracedCluster(t *testing.T) (*harness.Cluster, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+	config := harness.DefaultConfig()
+	config.Tracing.SpanExporter = exporter
+	return harness.Start(t, config), exporter
+}
+
+// Helper method to wait for the span of the PutKey RPC served by a control
+// manager and return the spans of its trace. The server span ends once the
+// response is sent, possibly after the client got it.
+func waitForPutKeyTrace(t *testing.T, exporter *tracetest.InMemoryExporter) tracetest.SpanStubs {
+	t.Helper()
+	var spans tracetest.SpanStubs
+	harness.Eventually(t, 5*time.Second, func() error {
+		spans = nil
+		all_spans := exporter.GetSpans()
+		for _, span := range all_spans {
+			if span.Name == "main.KvStoreInterface/PutKey" && span.SpanKind == trace.SpanKindServer {
+				for _, other := range all_spans {
+					if other.SpanContext.TraceID() == span.SpanContext.TraceID() {
+						spans = append(spans, other)
+					}
+				}
+				return nil
+			}
+		}
+		return fmt.Errorf("no PutKey span recorded")
+	})
+	return spans
+}
+
+// Helper method to find the span of a trace with the given name and kind.
+func findSpan(t *testing.T, spans tracetest.SpanStubs, name string,
+	kind trace.SpanKind) tracetest.SpanStub {
+	t.Helper()
+	for _, span := range spans {
+		if span.Name == name && span.SpanKind == kind {
+			return span
+		}
+	}
+	t.Fatalf("no %v span %s in the trace", kind, name)
+	return tracetest.SpanStub{}
+}
+
+// Helper method to get the value of a span attribute.
+func spanAttribute(span tracetest.SpanStub, key attribute.Key) string {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value.Emit()
+		}
+	}
+	return ""
+}
+
+func TestTracePropagatesToWorker(t *testing.T) {
+	c, exporter := startTracedCluster(t)
+	shard_id := "0"
+	worker := c.OwnerOfShard(shard_id)
+	key := harness.KeysOnShard("tracing-", shard_id, c.NumShards(), 1)[0]
+	kv_client := c.Client(c.WaitForLeader(-1))
+	ts := mustPut(t, kv_client, key, "value")
+
+	spans := waitForPutKeyTrace(t, exporter)
+	put_key := findSpan(t, spans, "main.KvStoreInterface/PutKey", trace.SpanKindServer)
+	req_id := spanAttribute(put_key, tracing.RequestIdKey)
+	if req_id == "" {
+		t.Errorf("PutKey span has no request id")
+	}
+	if got := spanAttribute(put_key, tracing.ErrorCodeKey); got != "kNoError" {
+		t.Errorf("PutKey span error code = %q, want kNoError", got)
+	}
+	for _, name := range []string{"ValidatePutKeyArg", "RouteKey", "CallWorker"} {
+		findSpan(t, spans, name, trace.SpanKindInternal)
+	}
+	if got := spanAttribute(findSpan(t, spans, "RouteKey", trace.SpanKindInternal),
+		tracing.WorkerKey); got != worker {
+		t.Errorf("RouteKey span worker = %q, want %s", got, worker)
+	}
+	// The spans of the worker belong to the trace of the control manager.
+	put_key_internal := findSpan(t, spans, "main.KvStoreService/PutKeyInternal",
+		trace.SpanKindServer)
+	if got := spanAttribute(put_key_internal, tracing.RequestIdKey); got != req_id {
+		t.Errorf("PutKeyInternal span request id = %q, want %q", got, req_id)
+	}
+	for _, name := range []string{"GenerateOracleTimestampForShard",
+		"PersistOracleTimestampForShard", "WriteKvToDisk"} {
+		span := findSpan(t, spans, name, trace.SpanKindInternal)
+		if span.Parent.SpanID() != put_key_internal.SpanContext.SpanID() {
+			t.Errorf("%s span is not a child of the PutKeyInternal span", name)
+		}
+		if got := spanAttribute(span, tracing.ShardKey); got != shard_id {
+			t.Errorf("%s span shard = %q, want %s", name, got, shard_id)
+		}
+		if got := spanAttribute(span, tracing.DbModifiedTsKey); got != fmt.Sprint(ts) {
+			t.Errorf("%s span db_modified_ts = %q, want %d", name, got, ts)
+		}
+	}
+}
+
+func TestTraceRecordsFailedOraclePersist(t *testing.T) {
+	c, exporter := startTracedCluster(t)
+	shard_id := "1"
+	worker := c.OwnerOfShard(shard_id)
+	key := harness.KeysOnShard("tracing-", shard_id, c.NumShards(), 1)[0]
+	kv_client := c.Client(c.WaitForLeader(-1))
+	c.SetFaultRules(worker, &pb.FaultRule{
+		Point:  pb.FaultPoint_kPersistOracleTimestamp,
+		Action: pb.FaultAction_kFaultFail,
+		Shards: []string{shard_id},
+	})
+	ctx, cancel := harness.RequestContext(5 * time.Second)
+	defer cancel()
+	_, err := kv_client.Put(ctx, key, "value")
+	expectErrorCode(t, err, pb.ErrorCode_kBackendError)
+
+	spans := waitForPutKeyTrace(t, exporter)
+	put_key := findSpan(t, spans, "main.KvStoreInterface/PutKey", trace.SpanKindServer)
+	if got := spanAttribute(put_key, tracing.ErrorCodeKey); got != "kBackendError" {
+		t.Errorf("PutKey span error code = %q, want kBackendError", got)
+	}
+	if put_key.Status.Code != codes.Error {
+		t.Errorf("PutKey span status = %v, want Error", put_key.Status.Code)
+	}
+	persist := findSpan(t, spans, "PersistOracleTimestampForShard", trace.SpanKindInternal)
+	if persist.Status.Code != codes.Error {
+		t.Errorf("PersistOracleTimestampForShard span status = %v, want Error",
+			persist.Status.Code)
+	}
+	for _, span := range spans {
+		if span.Name == "WriteKvToDisk" {
+			t.Errorf("key written to disk although the oracle timestamp was not persisted")
+		}
+	}
+}
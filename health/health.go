@@ -0,0 +1,141 @@
+// Package health serves the standard grpc.health.v1 service of the control
+// manager and the worker.
+//
+// The overall status, i.e. the one of the empty service name, tells whether
+// the node is ready to serve requests, as decided by a readiness check of the
+// node. It is evaluated on every Check and refreshed periodically for the
+// watchers. The liveness service is serving for as long as the gRPC server
+// is, so that a node which is alive but not ready, e.g. a control manager
+// which cannot reach its workers, is taken out of the load balancing but not
+// restarted.
+package health
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"kvstore/logging"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Service name of the liveness status.
+const LivenessService = "liveness"
+
+// Time between two evaluations of the readiness check for the watchers.
+const refreshInterval = time.Second
+
+// Readiness check of a node. Returns nil if the node is ready to serve, or
+// why it is not.
+type ReadinessCheck func() error
+
+// Health server of a node.
+type Server struct {
+	*grpchealth.Server
+	check ReadinessCheck
+	// Services of the node, whose status is the overall status.
+	services []string
+	logger   *slog.Logger
+	// Last outcome of the readiness check, used to log the transitions.
+	refresh_lock sync.Mutex
+	is_ready     bool
+	last_err     error
+}
+
+// Helper method to instantiate the health server of a node. The node is not
+// ready until check says so. services are the names of the gRPC services of
+// the node, which report the overall status as well.
+func NewServer(check ReadinessCheck, logger *slog.Logger, services ...string) *Server {
+	s := &Server{
+		Server:   grpchealth.NewServer(),
+		check:    check,
+		services: services,
+		logger:   logger,
+	}
+	s.Server.SetServingStatus(LivenessService, healthpb.HealthCheckResponse_SERVING)
+	s.setReadiness(healthpb.HealthCheckResponse_NOT_SERVING)
+	return s
+}
+
+// Register the health service on a gRPC server.
+func (s *Server) Register(grpc_server *grpc.Server) {
+	healthpb.RegisterHealthServer(grpc_server, s)
+}
+
+// Refresh the readiness periodically until ctx is done, so that watchers
+// learn about changes.
+func (s *Server) Run(ctx context.Context) {
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+	for {
+		s.Refresh()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check the status of a service, evaluating the readiness check first so
+// that the status is up to date.
+func (s *Server) Check(ctx context.Context,
+	in *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	s.Refresh()
+	return s.Server.Check(ctx, in)
+}
+
+// Evaluate the readiness check and update the overall status. Returns the
+// reason why the node is not ready, if any.
+func (s *Server) Refresh() error {
+	s.refresh_lock.Lock()
+	defer s.refresh_lock.Unlock()
+	err := s.check()
+	if err == nil {
+		if !s.is_ready {
+			s.logger.Info("Ready to serve")
+		}
+		s.setReadiness(healthpb.HealthCheckResponse_SERVING)
+	} else {
+		if s.is_ready {
+			s.logger.Warn("No longer ready to serve", logging.Err(err))
+		} else if s.last_err == nil || s.last_err.Error() != err.Error() {
+			s.logger.Info("Not ready to serve", logging.Err(err))
+		}
+		s.setReadiness(healthpb.HealthCheckResponse_NOT_SERVING)
+	}
+	s.is_ready = err == nil
+	s.last_err = err
+	return err
+}
+
+// Stop a gRPC server gracefully. The node reports NOT_SERVING from now on so
+// that it is taken out of the load balancing, new RPCs are rejected and the
+// RPCs being served are given until ctx is done to finish, after which they
+// are cancelled. Returns false if the RPCs did not finish in time.
+func (s *Server) Drain(ctx context.Context, grpc_server *grpc.Server) bool {
+	s.Shutdown()
+	stopped := make(chan struct{})
+	go func() {
+		grpc_server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return true
+	case <-ctx.Done():
+		grpc_server.Stop()
+		<-stopped
+		return false
+	}
+}
+
+// Helper method to set the overall status and the status of the services.
+func (s *Server) setReadiness(status healthpb.HealthCheckResponse_ServingStatus) {
+	s.Server.SetServingStatus("", status)
+	for _, service := range s.services {
+		s.Server.SetServingStatus(service, status)
+	}
+}
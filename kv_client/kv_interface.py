@@ -16,7 +16,15 @@ class KvStoreInterface:
         response = self.stub.GetKey(request)
         return response
 
-    def put_key(self, key, value):
-        request = kv_store_interface_pb2.PutKeyArg(key=key, value=value)
+    def put_key(self, key, value, request_id=""):
+        # Pass the same request_id when retrying a put so that it is applied
+        # only once.
+        request = kv_store_interface_pb2.PutKeyArg(
+            key=key, value=value, request_id=request_id)
         response = self.stub.PutKey(request)
-        return response
\ No newline at end of file
+        return response
+
+    def delete_key(self, key):
+        request = kv_store_interface_pb2.DeleteKeyArg(key=key)
+        response = self.stub.DeleteKey(request)
+        return response
@@ -0,0 +1,146 @@
+// Package kverror maps kvstore ErrorCodes onto canonical gRPC status codes.
+//
+// Both kvstore services report failures inside the response message and
+// return a nil gRPC error, which generic gRPC middleware sees as success.
+// Clients may opt in to receiving a proper status error instead by setting the
+// kv-error-mode metadata key to grpc-status on their requests. The status
+// carries the KvError as a detail so that no information is lost.
+package kverror
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	pb "kvstore/protos"
+)
+
+// Metadata key and value used by clients to opt in to gRPC status errors.
+const (
+	ErrorModeMetadataKey = "kv-error-mode"
+	ErrorModeGrpcStatus  = "grpc-status"
+)
+
+// Helper method to map a kvstore ErrorCode onto a gRPC status code.
+func GrpcCode(error_code pb.ErrorCode) codes.Code {
+	switch error_code {
+	case pb.ErrorCode_kNoError:
+		return codes.OK
+	case pb.ErrorCode_kNotFound:
+		return codes.NotFound
+	case pb.ErrorCode_kInvalidArgument:
+		return codes.InvalidArgument
+	case pb.ErrorCode_kInternalError, pb.ErrorCode_kBackendError:
+		return codes.Internal
+	case pb.ErrorCode_kNotLeader, pb.ErrorCode_kUnavailable:
+		// The request may be retried, against the leader for kNotLeader.
+		return codes.Unavailable
+	case pb.ErrorCode_kDeadlineExceeded:
+		return codes.DeadlineExceeded
+	case pb.ErrorCode_kConditionFailed:
+		return codes.FailedPrecondition
+	case pb.ErrorCode_kWrongShard:
+		// The caller must refresh its shard map before retrying.
+		return codes.FailedPrecondition
+	}
+	return codes.Unknown
+}
+
+// Helper method to convert a KvError to a gRPC status error carrying the
+// KvError as a detail. Returns nil if kv_error reports no error.
+func ToStatusError(kv_error *pb.KvError) error {
+	if kv_error.GetErrorType() == pb.ErrorCode_kNoError {
+		return nil
+	}
+	st := status.New(GrpcCode(kv_error.GetErrorType()), kv_error.GetErrorDetails())
+	if with_details, err := st.WithDetails(kv_error); err == nil {
+		st = with_details
+	}
+	return st.Err()
+}
+
+// Helper method to extract the KvError attached to a status error. Returns
+// nil if err does not carry one.
+func FromStatusError(err error) *pb.KvError {
+	st, ok := status.FromError(err)
+	if !ok {
+		return nil
+	}
+	for _, detail := range st.Details() {
+		if kv_error, ok := detail.(*pb.KvError); ok {
+			return kv_error
+		}
+	}
+	return nil
+}
+
+// Helper method to opt in to gRPC status errors for an outgoing request.
+func WithStatusErrors(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, ErrorModeMetadataKey, ErrorModeGrpcStatus)
+}
+
+// Helper method to check whether the caller opted in to gRPC status errors.
+func wantsStatusErrors(ctx context.Context) bool {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return false
+	}
+	for _, mode := range md.Get(ErrorModeMetadataKey) {
+		if mode == ErrorModeGrpcStatus {
+			return true
+		}
+	}
+	return false
+}
+
+// Response carrying a KvError, i.e. the KvStoreInterface rets.
+type kvErrorRet interface {
+	GetKvError() *pb.KvError
+}
+
+// Response carrying an ErrorCode, i.e. the KvStoreService rets.
+type errorCodeRet interface {
+	GetSuccess() bool
+	GetErrorCode() pb.ErrorCode
+	GetErrorDetails() string
+}
+
+// Helper method to get the error reported inside a response message of either
+// kvstore service. Returns nil if the response reports success.
+func ResponseError(resp any) *pb.KvError {
+	switch ret := resp.(type) {
+	case kvErrorRet:
+		if ret.GetKvError().GetErrorType() != pb.ErrorCode_kNoError {
+			return ret.GetKvError()
+		}
+	case errorCodeRet:
+		if !ret.GetSuccess() {
+			error_code := ret.GetErrorCode()
+			if error_code == pb.ErrorCode_kNoError {
+				error_code = pb.ErrorCode_kInternalError
+			}
+			return &pb.KvError{
+				ErrorType:    error_code,
+				ErrorDetails: ret.GetErrorDetails(),
+			}
+		}
+	}
+	return nil
+}
+
+// Unary server interceptor returning a gRPC status error for failed requests
+// of callers that opted in. Other callers get the response message as is.
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (any, error) {
+		resp, err := handler(ctx, req)
+		if err != nil || !wantsStatusErrors(ctx) {
+			return resp, err
+		}
+		if kv_error := ResponseError(resp); kv_error != nil {
+			return nil, ToStatusError(kv_error)
+		}
+		return resp, nil
+	}
+}
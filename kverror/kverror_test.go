@@ -0,0 +1,153 @@
+package kverror
+
+import (
+	"context"
+	"errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	pb "kvstore/protos"
+	"testing"
+)
+
+func TestGrpcCode(t *testing.T) {
+	want := map[pb.ErrorCode]codes.Code{
+		pb.ErrorCode_kNoError:          codes.OK,
+		pb.ErrorCode_kNotFound:         codes.NotFound,
+		pb.ErrorCode_kInvalidArgument:  codes.InvalidArgument,
+		pb.ErrorCode_kInternalError:    codes.Internal,
+		pb.ErrorCode_kBackendError:     codes.Internal,
+		pb.ErrorCode_kNotLeader:        codes.Unavailable,
+		pb.ErrorCode_kDeadlineExceeded: codes.DeadlineExceeded,
+		pb.ErrorCode_kConditionFailed:  codes.FailedPrecondition,
+		pb.ErrorCode_kWrongShard:       codes.FailedPrecondition,
+		pb.ErrorCode_kUnavailable:      codes.Unavailable,
+	}
+	// Every ErrorCode must be mapped, including those added later.
+	for value, name := range pb.ErrorCode_name {
+		error_code := pb.ErrorCode(value)
+		code, exists := want[error_code]
+		if !exists {
+			t.Errorf("no gRPC code expected for %s", name)
+			continue
+		}
+		if got := GrpcCode(error_code); got != code {
+			t.Errorf("GrpcCode(%s) = %s, want %s", name, got, code)
+		}
+	}
+	if got := GrpcCode(pb.ErrorCode(-1)); got != codes.Unknown {
+		t.Errorf("GrpcCode(-1) = %s, want %s", got, codes.Unknown)
+	}
+}
+
+func TestStatusErrorRoundTrip(t *testing.T) {
+	if err := ToStatusError(&pb.KvError{ErrorType: pb.ErrorCode_kNoError}); err != nil {
+		t.Fatalf("ToStatusError(kNoError) = %v, want nil", err)
+	}
+	kv_error := &pb.KvError{
+		ErrorType:     pb.ErrorCode_kNotLeader,
+		ErrorDetails:  "not the leader",
+		LeaderAddress: "cm-1:8080",
+	}
+	err := ToStatusError(kv_error)
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("ToStatusError(%v) = %v, want an Unavailable status error", kv_error, err)
+	}
+	if got := FromStatusError(err); !proto.Equal(got, kv_error) {
+		t.Errorf("FromStatusError(%v) = %v, want %v", err, got, kv_error)
+	}
+	if got := FromStatusError(status.Error(codes.Unavailable, "no detail")); got != nil {
+		t.Errorf("FromStatusError of a status without detail = %v, want nil", got)
+	}
+	if got := FromStatusError(errors.New("not a status")); got != nil {
+		t.Errorf("FromStatusError of a plain error = %v, want nil", got)
+	}
+}
+
+func TestResponseError(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		resp any
+		want *pb.KvError
+	}{
+		{"interface success", &pb.GetKeyRet{Success: true,
+			KvError: &pb.KvError{ErrorType: pb.ErrorCode_kNoError}}, nil},
+		{"interface failure", &pb.GetKeyRet{
+			KvError: &pb.KvError{ErrorType: pb.ErrorCode_kUnavailable, ErrorDetails: "down"}},
+			&pb.KvError{ErrorType: pb.ErrorCode_kUnavailable, ErrorDetails: "down"}},
+		{"worker success", &pb.GetKeyInternalRet{Success: true}, nil},
+		{"worker failure", &pb.GetKeyInternalRet{ErrorCode: pb.ErrorCode_kNotFound,
+			ErrorDetails: "missing"},
+			&pb.KvError{ErrorType: pb.ErrorCode_kNotFound, ErrorDetails: "missing"}},
+		{"worker failure without code", &pb.GetKeyInternalRet{ErrorDetails: "failed"},
+			&pb.KvError{ErrorType: pb.ErrorCode_kInternalError, ErrorDetails: "failed"}},
+		{"other response", &pb.KvError{ErrorType: pb.ErrorCode_kNotFound}, nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := ResponseError(test.resp); !proto.Equal(got, test.want) {
+				t.Errorf("ResponseError(%v) = %v, want %v", test.resp, got, test.want)
+			}
+		})
+	}
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	handler_err := status.Error(codes.Unavailable, "handler failed")
+	failed := &pb.GetKeyInternalRet{ErrorCode: pb.ErrorCode_kWrongShard,
+		ErrorDetails: "wrong shard"}
+	succeeded := &pb.GetKeyInternalRet{Success: true}
+	for _, test := range []struct {
+		name        string
+		opt_in      bool
+		resp        any
+		handler_err error
+		want_resp   any
+		want_code   codes.Code
+	}{
+		{"failure without opt in", false, failed, nil, failed, codes.OK},
+		{"success without opt in", false, succeeded, nil, succeeded, codes.OK},
+		{"failure with opt in", true, failed, nil, nil, codes.FailedPrecondition},
+		{"success with opt in", true, succeeded, nil, succeeded, codes.OK},
+		{"handler error with opt in", true, nil, handler_err, nil, codes.Unavailable},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			if test.opt_in {
+				ctx = metadata.NewIncomingContext(ctx,
+					metadata.Pairs(ErrorModeMetadataKey, ErrorModeGrpcStatus))
+			}
+			resp, err := UnaryServerInterceptor()(ctx, &pb.GetKeyInternalArg{},
+				&grpc.UnaryServerInfo{FullMethod: "/main.KvStoreService/GetKeyInternal"},
+				func(ctx context.Context, req any) (any, error) {
+					return test.resp, test.handler_err
+				})
+			if resp != test.want_resp || status.Code(err) != test.want_code {
+				t.Fatalf("interceptor = %v, %v, want %v with code %s", resp, err,
+					test.want_resp, test.want_code)
+			}
+			if test.want_code == codes.FailedPrecondition {
+				if kv_error := FromStatusError(err); kv_error.GetErrorType() !=
+					pb.ErrorCode_kWrongShard {
+					t.Errorf("status error carries %v, want the kWrongShard KvError", kv_error)
+				}
+			}
+		})
+	}
+}
+
+func TestWithStatusErrors(t *testing.T) {
+	if wantsStatusErrors(context.Background()) {
+		t.Errorf("status errors wanted without metadata")
+	}
+	other := metadata.NewIncomingContext(context.Background(),
+		metadata.Pairs(ErrorModeMetadataKey, "response"))
+	if wantsStatusErrors(other) {
+		t.Errorf("status errors wanted with another error mode")
+	}
+	md, _ := metadata.FromOutgoingContext(WithStatusErrors(context.Background()))
+	if !wantsStatusErrors(metadata.NewIncomingContext(context.Background(), md)) {
+		t.Errorf("status errors not wanted with the metadata set by WithStatusErrors")
+	}
+}
@@ -0,0 +1,122 @@
+package linearizability
+
+import (
+	"fmt"
+	"github.com/anishathalye/porcupine"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// History of the operations run by concurrent clients. A History is safe for
+// concurrent use.
+type History struct {
+	lock  sync.Mutex
+	start time.Time
+	ops   []porcupine.Operation
+}
+
+// Helper method to instantiate a new empty history.
+func NewHistory() *History {
+	return &History{start: time.Now()}
+}
+
+// Time of an invocation or response relative to the start of the history.
+func (h *History) Now() int64 {
+	return time.Since(h.start).Nanoseconds()
+}
+
+// Record an operation invoked at call which returned output at ret. Failed
+// operations whose effect is unknown may have taken effect at any time after
+// their invocation, so they are recorded as never returning. Failed reads
+// have no effect and are dropped.
+func (h *History) Record(client_id int, input KvInput, output KvOutput, call int64, ret int64) {
+	if output.Unknown {
+		if input.Kind == OpGet {
+			return
+		}
+		ret = math.MaxInt64
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.ops = append(h.ops, porcupine.Operation{
+		ClientId: client_id,
+		Input:    input,
+		Call:     call,
+		Output:   output,
+		Return:   ret,
+	})
+}
+
+// Operations recorded so far.
+func (h *History) Operations() []porcupine.Operation {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return append([]porcupine.Operation(nil), h.ops...)
+}
+
+// Summary of the recorded operations.
+type HistoryStats struct {
+	Gets, Puts, Cas int
+	ConditionFailed int
+	Unknown         int
+	NotFound        int
+	TotalOperations int
+}
+
+// Count the recorded operations by kind and outcome.
+func (h *History) Stats() HistoryStats {
+	var stats HistoryStats
+	for _, op := range h.Operations() {
+		in := op.Input.(KvInput)
+		out := op.Output.(KvOutput)
+		stats.TotalOperations++
+		switch in.Kind {
+		case OpGet:
+			stats.Gets++
+			if !out.Found {
+				stats.NotFound++
+			}
+		case OpPut:
+			stats.Puts++
+		case OpCas:
+			stats.Cas++
+		}
+		if out.Unknown {
+			stats.Unknown++
+		}
+		if out.ConditionFailed {
+			stats.ConditionFailed++
+		}
+	}
+	return stats
+}
+
+// Result of a linearizability check.
+type CheckResult struct {
+	Result porcupine.CheckResult
+	info   porcupine.LinearizationInfo
+}
+
+// Check whether the recorded history is linearizable. The check gives up
+// with porcupine.Unknown after timeout.
+func (h *History) Check(timeout time.Duration) *CheckResult {
+	result, info := porcupine.CheckOperationsVerbose(KvModel, h.Operations(), timeout)
+	return &CheckResult{Result: result, info: info}
+}
+
+// Write an HTML visualization of the checked history to a new file in dir
+// and return its path. For a history which is not linearizable it shows the
+// longest linearizable prefix of every key.
+func (r *CheckResult) WriteVisualization(dir string) (string, error) {
+	file, err := os.CreateTemp(dir, "kvstore-linearizability-*.html")
+	if err != nil {
+		return "", fmt.Errorf("failed to create visualization file: %v", err)
+	}
+	defer file.Close()
+	if err := porcupine.Visualize(KvModel, r.info, file); err != nil {
+		return "", fmt.Errorf("failed to write visualization: %v", err)
+	}
+	return file.Name(), nil
+}
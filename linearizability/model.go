@@ -0,0 +1,223 @@
+// Package linearizability checks whether the histories recorded by clients
+// of the kvstore are linearizable. Concurrent clients run Put, Get and CAS
+// operations against a cluster while recording when every operation was
+// invoked and when it returned; the history is then checked with porcupine
+// against a sequential model of a single key.
+package linearizability
+
+import (
+	"fmt"
+	"github.com/anishathalye/porcupine"
+)
+
+// Kind of operation run against a key.
+type OpKind int
+
+const (
+	OpGet OpKind = iota
+	OpPut
+	// Put conditional on the db_modified_ts of the key, or on the key not
+	// existing if the expected timestamp is 0.
+	OpCas
+)
+
+func (k OpKind) String() string {
+	switch k {
+	case OpGet:
+		return "get"
+	case OpPut:
+		return "put"
+	case OpCas:
+		return "cas"
+	}
+	return fmt.Sprintf("op(%d)", int(k))
+}
+
+// Input of an operation.
+type KvInput struct {
+	Kind  OpKind
+	Key   string
+	Value string
+	// Expected db_modified_ts of a CAS, 0 if the key must not exist.
+	ExpectedTs int64
+}
+
+// Output of an operation.
+type KvOutput struct {
+	// The request failed and may or may not have taken effect.
+	Unknown bool
+	// Result of a Get.
+	Found bool
+	Value string
+	// db_modified_ts returned by a Get, Put or successful CAS.
+	Ts int64
+	// The condition of a CAS did not hold.
+	ConditionFailed bool
+}
+
+// State of a single key. Every write gets a db_modified_ts greater than the
+// previous one of its shard, hence of its key.
+type kvState struct {
+	Exists bool
+	Value  string
+	// db_modified_ts of the latest write, 0 if it was never observed because
+	// the write returned no result.
+	Ts int64
+	// Lower bound of the db_modified_ts of the next write.
+	MinTs int64
+}
+
+// Helper method to check whether ts may be the db_modified_ts of the current
+// value.
+func (s kvState) matchesTs(ts int64) bool {
+	if s.Ts != 0 {
+		return ts == s.Ts
+	}
+	return ts > s.MinTs
+}
+
+// Helper method to get the state after a write of value. ts is 0 if the
+// write returned no result.
+func (s kvState) write(value string, ts int64) kvState {
+	min_ts := max(s.Ts, s.MinTs)
+	return kvState{Exists: true, Value: value, Ts: ts, MinTs: min_ts}
+}
+
+// Helper method to check whether ts may be the db_modified_ts of a write
+// following the current value.
+func (s kvState) followedBy(ts int64) bool {
+	return ts > max(s.Ts, s.MinTs)
+}
+
+// Step of the model. Returns all states the key may be in after the
+// operation, none if the operation cannot have returned output.
+func step(state interface{}, input interface{}, output interface{}) []interface{} {
+	s := state.(kvState)
+	in := input.(KvInput)
+	out := output.(KvOutput)
+	switch in.Kind {
+	case OpGet:
+		if !s.Exists {
+			if out.Found {
+				return nil
+			}
+			return []interface{}{s}
+		}
+		if !out.Found || out.Value != s.Value || !s.matchesTs(out.Ts) {
+			return nil
+		}
+		// The read tells us the timestamp of an unacknowledged write.
+		s.Ts = out.Ts
+		return []interface{}{s}
+
+	case OpPut:
+		if out.Unknown {
+			return []interface{}{s.write(in.Value, 0)}
+		}
+		if !s.followedBy(out.Ts) {
+			return nil
+		}
+		return []interface{}{s.write(in.Value, out.Ts)}
+
+	case OpCas:
+		// The condition may hold or not if the current timestamp was never
+		// observed.
+		may_hold, may_fail := false, false
+		if in.ExpectedTs == 0 {
+			may_hold, may_fail = !s.Exists, s.Exists
+		} else if s.Exists {
+			may_hold = s.matchesTs(in.ExpectedTs)
+			may_fail = s.Ts == 0 || s.Ts != in.ExpectedTs
+		} else {
+			may_fail = true
+		}
+		var states []interface{}
+		switch {
+		case out.Unknown:
+			if may_hold {
+				states = append(states, s.write(in.Value, 0))
+			}
+			if may_fail {
+				states = append(states, s)
+			}
+		case out.ConditionFailed:
+			if may_fail {
+				states = append(states, s)
+			}
+		default:
+			if may_hold && s.followedBy(out.Ts) {
+				states = append(states, s.write(in.Value, out.Ts))
+			}
+		}
+		return states
+	}
+	return nil
+}
+
+// Helper method to split a history into the operations of every key. Keys
+// are independent, so the history is linearizable if the history of every
+// key is.
+func partitionByKey(history []porcupine.Operation) [][]porcupine.Operation {
+	index := make(map[string]int)
+	var partitions [][]porcupine.Operation
+	for _, op := range history {
+		key := op.Input.(KvInput).Key
+		i, exists := index[key]
+		if !exists {
+			i = len(partitions)
+			index[key] = i
+			partitions = append(partitions, nil)
+		}
+		partitions[i] = append(partitions[i], op)
+	}
+	return partitions
+}
+
+// Helper method to describe an operation in visualizations.
+func describeOperation(input interface{}, output interface{}) string {
+	in := input.(KvInput)
+	out := output.(KvOutput)
+	var call string
+	switch in.Kind {
+	case OpGet:
+		call = fmt.Sprintf("get(%s)", in.Key)
+	case OpPut:
+		call = fmt.Sprintf("put(%s, %s)", in.Key, in.Value)
+	case OpCas:
+		call = fmt.Sprintf("cas(%s, %d, %s)", in.Key, in.ExpectedTs, in.Value)
+	}
+	switch {
+	case out.Unknown:
+		return call + " -> ?"
+	case out.ConditionFailed:
+		return call + " -> condition failed"
+	case in.Kind == OpGet && !out.Found:
+		return call + " -> not found"
+	case in.Kind == OpGet:
+		return fmt.Sprintf("%s -> %s@%d", call, out.Value, out.Ts)
+	}
+	return fmt.Sprintf("%s -> %d", call, out.Ts)
+}
+
+// Helper method to describe the state of a key in visualizations.
+func describeState(state interface{}) string {
+	s := state.(kvState)
+	if !s.Exists {
+		return "not found"
+	}
+	if s.Ts == 0 {
+		return fmt.Sprintf("%s@>%d", s.Value, s.MinTs)
+	}
+	return fmt.Sprintf("%s@%d", s.Value, s.Ts)
+}
+
+// Model of a single key of the kvstore, partitioned by key.
+var KvModel = (&porcupine.NondeterministicModel{
+	Partition: partitionByKey,
+	Init: func() []interface{} {
+		return []interface{}{kvState{}}
+	},
+	Step:              step,
+	DescribeOperation: describeOperation,
+	DescribeState:     describeState,
+}).ToModel()
@@ -0,0 +1,141 @@
+package linearizability
+
+import (
+	"github.com/anishathalye/porcupine"
+	"math"
+	"testing"
+)
+
+// Helper method to build an operation of client 0.
+func op(input KvInput, output KvOutput, call int64, ret int64) porcupine.Operation {
+	return porcupine.Operation{Input: input, Output: output, Call: call, Return: ret}
+}
+
+func put(key string, value string) KvInput {
+	return KvInput{Kind: OpPut, Key: key, Value: value}
+}
+
+func get(key string) KvInput {
+	return KvInput{Kind: OpGet, Key: key}
+}
+
+func cas(key string, expected_ts int64, value string) KvInput {
+	return KvInput{Kind: OpCas, Key: key, ExpectedTs: expected_ts, Value: value}
+}
+
+func found(value string, ts int64) KvOutput {
+	return KvOutput{Found: true, Value: value, Ts: ts}
+}
+
+func written(ts int64) KvOutput {
+	return KvOutput{Ts: ts}
+}
+
+func TestModel(t *testing.T) {
+	tests := []struct {
+		name         string
+		history      []porcupine.Operation
+		linearizable bool
+	}{
+		{
+			name: "sequential writes and reads",
+			history: []porcupine.Operation{
+				op(get("a"), KvOutput{}, 0, 1),
+				op(put("a", "x"), written(10), 2, 3),
+				op(get("a"), found("x", 10), 4, 5),
+				op(cas("a", 10, "y"), written(11), 6, 7),
+				op(get("a"), found("y", 11), 8, 9),
+			},
+			linearizable: true,
+		},
+		{
+			name: "stale read",
+			history: []porcupine.Operation{
+				op(put("a", "x"), written(10), 0, 1),
+				op(put("a", "y"), written(11), 2, 3),
+				op(get("a"), found("x", 10), 4, 5),
+			},
+			linearizable: false,
+		},
+		{
+			name: "concurrent write may be read either way",
+			history: []porcupine.Operation{
+				op(put("a", "x"), written(10), 0, 1),
+				op(put("a", "y"), written(11), 2, 6),
+				op(get("a"), found("x", 10), 3, 4),
+				op(get("a"), found("y", 11), 5, 7),
+			},
+			linearizable: true,
+		},
+		{
+			name: "timestamps must increase",
+			history: []porcupine.Operation{
+				op(put("a", "x"), written(10), 0, 1),
+				op(put("a", "y"), written(9), 2, 3),
+			},
+			linearizable: false,
+		},
+		{
+			name: "cas with stale expectation must fail",
+			history: []porcupine.Operation{
+				op(put("a", "x"), written(10), 0, 1),
+				op(put("a", "y"), written(11), 2, 3),
+				op(cas("a", 10, "z"), written(12), 4, 5),
+			},
+			linearizable: false,
+		},
+		{
+			name: "cas if not exists succeeds once",
+			history: []porcupine.Operation{
+				op(cas("a", 0, "x"), written(10), 0, 3),
+				op(cas("a", 0, "y"), KvOutput{ConditionFailed: true}, 1, 2),
+			},
+			linearizable: true,
+		},
+		{
+			name: "failed write may take effect later",
+			history: []porcupine.Operation{
+				op(put("a", "x"), written(10), 0, 1),
+				op(put("a", "y"), KvOutput{Unknown: true}, 2, math.MaxInt64),
+				op(get("a"), found("x", 10), 3, 4),
+				op(get("a"), found("y", 15), 5, 6),
+				op(cas("a", 15, "z"), written(16), 7, 8),
+			},
+			linearizable: true,
+		},
+		{
+			name: "failed write may never take effect",
+			history: []porcupine.Operation{
+				op(put("a", "x"), written(10), 0, 1),
+				op(cas("a", 10, "y"), KvOutput{Unknown: true}, 2, math.MaxInt64),
+				op(get("a"), found("x", 10), 3, 4),
+			},
+			linearizable: true,
+		},
+		{
+			name: "unknown write cannot be read before it was invoked",
+			history: []porcupine.Operation{
+				op(get("a"), found("x", 10), 0, 1),
+				op(put("a", "x"), KvOutput{Unknown: true}, 2, math.MaxInt64),
+			},
+			linearizable: false,
+		},
+		{
+			name: "keys are independent",
+			history: []porcupine.Operation{
+				op(put("a", "x"), written(10), 0, 1),
+				op(put("b", "x"), written(5), 2, 3),
+				op(get("a"), found("x", 10), 4, 5),
+				op(get("b"), found("x", 5), 4, 5),
+			},
+			linearizable: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := porcupine.CheckOperations(KvModel, test.history); got != test.linearizable {
+				t.Errorf("CheckOperations() = %v, want %v", got, test.linearizable)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package linearizability
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"kvstore/client"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Client the workload runs operations with. *client.Client implements it.
+type KvClient interface {
+	Get(ctx context.Context, key string) (*client.Value, error)
+	Put(ctx context.Context, key string, value string, opts ...client.PutOption) (int64, error)
+}
+
+// Config of a workload.
+type WorkloadConfig struct {
+	// Number of concurrent clients, each running one operation at a time.
+	NumClients int
+	// Number of distinct keys. Few keys mean more contention.
+	NumKeys   int
+	KeyPrefix string
+	// Fractions of Gets and CAS operations; the rest are Puts.
+	GetRatio float64
+	CasRatio float64
+	// Timeout of every operation. An operation which times out is recorded
+	// with an unknown result.
+	RequestTimeout time.Duration
+	// Time a client waits after a failed operation. Every failed write may
+	// take effect at any later time, which makes the history expensive to
+	// check, so clients back off instead of piling them up during faults.
+	FailureBackoff time.Duration
+}
+
+// Helper method to get the default config of a workload.
+func DefaultWorkloadConfig() WorkloadConfig {
+	return WorkloadConfig{
+		NumClients:     8,
+		NumKeys:        20,
+		KeyPrefix:      "lin-",
+		GetRatio:       0.5,
+		CasRatio:       0.25,
+		RequestTimeout: time.Second,
+		FailureBackoff: 200 * time.Millisecond,
+	}
+}
+
+// Run the workload until ctx is done and return the recorded history. The
+// i-th client starts with endpoints[i % len(endpoints)] and moves to the next
+// endpoint after every failed operation, so that the workload keeps going
+// while control managers fail over.
+func RunWorkload(ctx context.Context, config WorkloadConfig, endpoints []KvClient) *History {
+	history := NewHistory()
+	var wg sync.WaitGroup
+	for client_id := 0; client_id < config.NumClients; client_id++ {
+		wg.Add(1)
+		go func(client_id int) {
+			defer wg.Done()
+			runClient(ctx, config, endpoints, client_id, history)
+		}(client_id)
+	}
+	wg.Wait()
+	return history
+}
+
+// Helper method to run the operations of a single client until ctx is done.
+func runClient(ctx context.Context, config WorkloadConfig, endpoints []KvClient,
+	client_id int, history *History) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano() + int64(client_id)))
+	endpoint := client_id % len(endpoints)
+	// Latest db_modified_ts this client observed for every key, used as the
+	// expectation of its CAS operations.
+	observed_ts := make(map[string]int64)
+	for seq := 0; ctx.Err() == nil; seq++ {
+		input := KvInput{
+			Key:   fmt.Sprintf("%s%d", config.KeyPrefix, rng.Intn(config.NumKeys)),
+			Value: fmt.Sprintf("c%d-%d", client_id, seq),
+		}
+		switch p := rng.Float64(); {
+		case p < config.GetRatio:
+			input.Kind = OpGet
+		case p < config.GetRatio+config.CasRatio:
+			input.Kind = OpCas
+			input.ExpectedTs = observed_ts[input.Key]
+		default:
+			input.Kind = OpPut
+		}
+		call := history.Now()
+		output := runOperation(ctx, config, endpoints[endpoint], input)
+		history.Record(client_id, input, output, call, history.Now())
+		if output.Unknown {
+			endpoint = (endpoint + 1) % len(endpoints)
+			select {
+			case <-ctx.Done():
+			case <-time.After(config.FailureBackoff):
+			}
+			continue
+		}
+		if output.Ts != 0 {
+			observed_ts[input.Key] = output.Ts
+		} else if input.Kind == OpGet && !output.Found {
+			delete(observed_ts, input.Key)
+		}
+	}
+}
+
+// Helper method to run a single operation and convert its result.
+func runOperation(ctx context.Context, config WorkloadConfig, kv_client KvClient,
+	input KvInput) KvOutput {
+	ctx, cancel := context.WithTimeout(ctx, config.RequestTimeout)
+	defer cancel()
+	switch input.Kind {
+	case OpGet:
+		value, err := kv_client.Get(ctx, input.Key)
+		if client.IsNotFound(err) {
+			return KvOutput{}
+		}
+		if err != nil {
+			return KvOutput{Unknown: true}
+		}
+		return KvOutput{Found: true, Value: value.Value, Ts: value.DbModifiedTs}
+	case OpPut, OpCas:
+		// A request id lets the control manager retry the write safely.
+		opts := []client.PutOption{client.WithRequestId(uuid.New().String())}
+		if input.Kind == OpCas {
+			if input.ExpectedTs == 0 {
+				opts = append(opts, client.WithIfNotExists())
+			} else {
+				opts = append(opts, client.WithIfDbModifiedTs(input.ExpectedTs))
+			}
+		}
+		ts, err := kv_client.Put(ctx, input.Key, input.Value, opts...)
+		if client.IsConditionFailed(err) {
+			return KvOutput{ConditionFailed: true}
+		}
+		if err != nil {
+			return KvOutput{Unknown: true}
+		}
+		return KvOutput{Ts: ts}
+	}
+	return KvOutput{Unknown: true}
+}
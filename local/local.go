@@ -0,0 +1,593 @@
+// Package local runs a complete kvstore cluster inside a single process: an
+// embedded etcd server, the control managers and the workers, all listening
+// on localhost. It backs the `kvstore local` command and lets tests and
+// benchmarks spin up a cluster without kubernetes.
+package local
+
+import (
+	"context"
+	"fmt"
+	"go.etcd.io/etcd/server/v3/embed"
+	"go.uber.org/zap"
+	"kvstore/client"
+	"kvstore/controlmanager"
+	"kvstore/logging"
+	pb "kvstore/protos"
+	"kvstore/tracing"
+	"kvstore/worker"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Namespace reported by the pods of a local cluster.
+const localNamespace = "local"
+
+// Time to wait for the embedded etcd server to be ready.
+const etcdStartTimeout = 30 * time.Second
+
+var logger = logging.Logger("local")
+
+// Config of a local cluster.
+type ClusterConfig struct {
+	NumWorkers         int
+	NumControlManagers int
+	NumShards          int
+	// Directory holding the etcd data and the worker mounts. A temporary
+	// directory is created, and removed once the cluster stops, if empty.
+	DataDir string
+	// Host all servers listen on. Defaults to 127.0.0.1.
+	Host string
+	// Ports of the servers of the first control manager. The i-th control
+	// manager uses port + i. A free port is picked for gRPC if 0; the HTTP
+	// gateway and the Redis front end are disabled if 0.
+	GrpcServerPort  int
+	HttpGatewayPort int
+	RedisPort       int
+	// Port of the metrics server of the first control manager. The i-th
+	// control manager uses port + i and the i-th worker port +
+	// NumControlManagers + i. Metrics are not served if 0.
+	MetricsPort int
+	// Tracing of every node. A file exporter is shared by all nodes.
+	Tracing tracing.Config
+	// TTL of the etcd sessions and leases. Short TTLs speed up failover.
+	SessionTtlSecs int
+	// Time given to the requests being served to finish when a node is
+	// stopped.
+	ShutdownTimeout time.Duration
+	// If true, the gRPC traffic to every node and the etcd traffic from every
+	// node go through a proxy, which lets Pause and Partition cut them.
+	ProxyNodeTraffic bool
+	// If true, faults can be injected into the workers through their
+	// WorkerAdmin service.
+	EnableFaultInjection bool
+}
+
+// Helper method to get the default config of a local cluster.
+func DefaultClusterConfig() ClusterConfig {
+	return ClusterConfig{
+		NumWorkers:         3,
+		NumControlManagers: 1,
+		NumShards:          9,
+		Host:               "127.0.0.1",
+		SessionTtlSecs:     5,
+		Tracing:            tracing.Config{SampleRatio: 1},
+		ShutdownTimeout:    5 * time.Second,
+	}
+}
+
+// Cluster running in the current process. Its methods must not be called
+// concurrently.
+type Cluster struct {
+	config ClusterConfig
+	// Root of the etcd data and worker mounts.
+	data_dir        string
+	remove_data_dir bool
+	etcd            *embed.Etcd
+	etcd_endpoints  []string
+	// Ports and proxies of the nodes, keyed by node name. They are kept
+	// across restarts so that a restarted node comes back at the same
+	// address.
+	nodes map[string]*node
+	// Control managers and workers, indexed by ordinal. A stopped node stays
+	// in place until it is restarted.
+	ControlManagers []*controlmanager.ControlManager
+	Workers         []*worker.Worker
+}
+
+// Helper method to instantiate a new local cluster. The cluster does not run
+// until Start is called.
+func NewCluster(config ClusterConfig) *Cluster {
+	if config.Host == "" {
+		config.Host = "127.0.0.1"
+	}
+	if config.SessionTtlSecs == 0 {
+		config.SessionTtlSecs = 5
+	}
+	return &Cluster{
+		config:          config,
+		nodes:           make(map[string]*node),
+		ControlManagers: make([]*controlmanager.ControlManager, config.NumControlManagers),
+		Workers:         make([]*worker.Worker, config.NumWorkers),
+	}
+}
+
+// Start etcd, the workers and the control managers. Returns once every node
+// serves; use WaitUntilReady to wait for a leader and a complete shard map.
+func (c *Cluster) Start() error {
+	if c.config.NumWorkers <= 0 || c.config.NumControlManagers <= 0 || c.config.NumShards <= 0 {
+		return fmt.Errorf("a local cluster needs at least one worker, control manager and shard")
+	}
+	c.data_dir = c.config.DataDir
+	if c.data_dir == "" {
+		data_dir, err := os.MkdirTemp("", "kvstore-local-")
+		if err != nil {
+			return fmt.Errorf("failed to create data dir: %v", err)
+		}
+		c.data_dir = data_dir
+		c.remove_data_dir = true
+	}
+	if err := c.startEtcd(); err != nil {
+		c.Stop()
+		return err
+	}
+	for i := range c.Workers {
+		if err := c.StartWorker(i); err != nil {
+			c.Stop()
+			return err
+		}
+	}
+	for i := range c.ControlManagers {
+		if err := c.StartControlManager(i); err != nil {
+			c.Stop()
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop all nodes and etcd, then remove the data dir if it is temporary.
+func (c *Cluster) Stop() {
+	for i := range c.ControlManagers {
+		c.StopControlManager(i)
+	}
+	for i := range c.Workers {
+		c.StopWorker(i)
+	}
+	for name, n := range c.nodes {
+		n.close()
+		delete(c.nodes, name)
+	}
+	if c.etcd != nil {
+		c.etcd.Close()
+		c.etcd = nil
+	}
+	if c.remove_data_dir {
+		os.RemoveAll(c.data_dir)
+	}
+}
+
+// Endpoints of the embedded etcd server.
+func (c *Cluster) EtcdEndpoints() []string {
+	return c.etcd_endpoints
+}
+
+// Address of the gRPC server of the first control manager.
+func (c *Cluster) Address() string {
+	return c.ControlManagers[0].Address()
+}
+
+// Addresses of the gRPC servers of all control managers.
+func (c *Cluster) Addresses() []string {
+	var addresses []string
+	for _, cm := range c.ControlManagers {
+		if cm != nil {
+			addresses = append(addresses, cm.Address())
+		}
+	}
+	return addresses
+}
+
+// Returns the ordinal of the leading control manager, or -1 if none of the
+// running control managers leads.
+func (c *Cluster) Leader() int {
+	for i, cm := range c.ControlManagers {
+		if cm != nil && cm.IsLeader() {
+			return i
+		}
+	}
+	return -1
+}
+
+// Wait until a control manager leads and knows the owner of every shard.
+func (c *Cluster) WaitUntilReady(ctx context.Context) error {
+	for {
+		if c.isReady(ctx) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("local cluster not ready: %v", ctx.Err())
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// Helper method to check whether the leader knows the owner of every shard.
+func (c *Cluster) isReady(ctx context.Context) bool {
+	leader := c.Leader()
+	if leader < 0 {
+		return false
+	}
+	kv_client, err := client.New(c.ControlManagers[leader].Address())
+	if err != nil {
+		return false
+	}
+	defer kv_client.Close()
+	shard_map, err := kv_client.GetShardMap(ctx)
+	if err != nil {
+		return false
+	}
+	return len(shard_map.GetShards()) == c.config.NumShards
+}
+
+//------------------------------------------------------------------------------
+// NODES
+//------------------------------------------------------------------------------
+
+// Name of the i-th worker.
+func WorkerName(i int) string {
+	return "worker-" + strconv.Itoa(i)
+}
+
+// Name of the i-th control manager.
+func ControlManagerName(i int) string {
+	return "control-manager-" + strconv.Itoa(i)
+}
+
+// Network endpoints of a node, kept across restarts.
+type node struct {
+	// Port the gRPC server of the node listens on.
+	grpc_port int
+	// Proxy in front of the gRPC server of the node and proxy between the
+	// node and etcd. Both are nil unless node traffic is proxied.
+	grpc_proxy *nodeProxy
+	etcd_proxy *nodeProxy
+}
+
+// Helper method to close the proxies of a node.
+func (n *node) close() {
+	if n.grpc_proxy != nil {
+		n.grpc_proxy.Close()
+	}
+	if n.etcd_proxy != nil {
+		n.etcd_proxy.Close()
+	}
+}
+
+// Helper method to get the endpoints of a node, picking its port and starting
+// its proxies the first time it starts.
+func (c *Cluster) getNode(name string, grpc_port int) (*node, error) {
+	if n, exists := c.nodes[name]; exists {
+		return n, nil
+	}
+	if grpc_port == 0 {
+		lis, err := net.Listen("tcp", net.JoinHostPort(c.config.Host, "0"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to find a free port: %v", err)
+		}
+		grpc_port = lis.Addr().(*net.TCPAddr).Port
+		lis.Close()
+	}
+	n := &node{grpc_port: grpc_port}
+	if c.config.ProxyNodeTraffic {
+		var err error
+		n.grpc_proxy, err = startNodeProxy(c.config.Host,
+			net.JoinHostPort(c.config.Host, strconv.Itoa(grpc_port)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to start proxy for %s: %v", name, err)
+		}
+		n.etcd_proxy, err = startNodeProxy(c.config.Host, c.etcd_endpoints[0])
+		if err != nil {
+			n.close()
+			return nil, fmt.Errorf("failed to start etcd proxy for %s: %v", name, err)
+		}
+	}
+	c.nodes[name] = n
+	return n, nil
+}
+
+// Helper method to get the gRPC address and etcd endpoints a node uses.
+func (c *Cluster) getNodeEndpoints(n *node) (string, []string) {
+	if n.grpc_proxy != nil {
+		return n.grpc_proxy.Address(), []string{n.etcd_proxy.Address()}
+	}
+	return net.JoinHostPort(c.config.Host, strconv.Itoa(n.grpc_port)), c.etcd_endpoints
+}
+
+// Helper method to get the config of the i-th worker. Its mount lives under
+// data_dir/worker-i so that a restarted worker recovers its shards.
+func (c *Cluster) WorkerConfig(i int) worker.Config {
+	mount_path := filepath.Join(c.data_dir, WorkerName(i))
+	return worker.Config{
+		PodName:              WorkerName(i),
+		PodIp:                c.config.Host,
+		PodNamespace:         localNamespace,
+		EtcdEndpoints:        c.etcd_endpoints,
+		ListenHost:           c.config.Host,
+		NumShards:            c.config.NumShards,
+		NumWorkerPods:        c.config.NumWorkers,
+		DedupTableSize:       1000,
+		LeaseTtlSecs:         int64(c.config.SessionTtlSecs),
+		MountPath:            filepath.Join(mount_path, "data"),
+		OracleTimestampPath:  filepath.Join(mount_path, "oracle"),
+		DedupPath:            filepath.Join(mount_path, "dedup"),
+		EnableFaultInjection: c.config.EnableFaultInjection,
+		MetricsPort:          portForOrdinal(c.config.MetricsPort, c.config.NumControlManagers+i),
+		Tracing:              c.config.Tracing,
+		ShutdownTimeout:      c.config.ShutdownTimeout,
+	}
+}
+
+// Helper method to get the config of the i-th control manager.
+func (c *Cluster) ControlManagerConfig(i int) controlmanager.Config {
+	return controlmanager.Config{
+		PodName:                 ControlManagerName(i),
+		PodIp:                   c.config.Host,
+		PodNamespace:            localNamespace,
+		EtcdEndpoints:           c.etcd_endpoints,
+		ListenHost:              c.config.Host,
+		GrpcServerPort:          portForOrdinal(c.config.GrpcServerPort, i),
+		HttpGatewayPort:         portForOrdinal(c.config.HttpGatewayPort, i),
+		RedisPort:               portForOrdinal(c.config.RedisPort, i),
+		NumShards:               c.config.NumShards,
+		ElectionSessionTtlSecs:  c.config.SessionTtlSecs,
+		WorkerRpcTimeout:        5 * time.Second,
+		WorkerRpcTotalTimeout:   10 * time.Second,
+		RetryMaxAttempts:        3,
+		RetryInitialBackoff:     50 * time.Millisecond,
+		RetryMaxBackoff:         time.Second,
+		BreakerFailureThreshold: 5,
+		BreakerOpenDuration:     time.Second,
+		ForwardToLeader:         true,
+		MetricsPort:             portForOrdinal(c.config.MetricsPort, i),
+		Tracing:                 c.config.Tracing,
+		ShutdownTimeout:         c.config.ShutdownTimeout,
+	}
+}
+
+// Helper method to get the port of the i-th node from the base port. Port 0
+// stays 0.
+func portForOrdinal(port int, i int) int {
+	if port == 0 {
+		return 0
+	}
+	return port + i
+}
+
+// Start the i-th worker. The worker must not be running.
+func (c *Cluster) StartWorker(i int) error {
+	config := c.WorkerConfig(i)
+	n, err := c.getNode(config.PodName, config.GrpcServerPort)
+	if err != nil {
+		return err
+	}
+	config.GrpcServerPort = n.grpc_port
+	config.AdvertiseAddress, config.EtcdEndpoints = c.getNodeEndpoints(n)
+	for _, dir := range []string{config.MountPath, config.OracleTimestampPath, config.DedupPath} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create dir %s: %v", dir, err)
+		}
+	}
+	w := worker.New(config)
+	if err := w.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %w", config.PodName, err)
+	}
+	c.Workers[i] = w
+	return nil
+}
+
+// Stop the i-th worker if it is running. Its mount is kept.
+func (c *Cluster) StopWorker(i int) {
+	if c.Workers[i] == nil {
+		return
+	}
+	c.Workers[i].Stop()
+	c.Workers[i] = nil
+}
+
+// Start the i-th control manager. The control manager must not be running.
+func (c *Cluster) StartControlManager(i int) error {
+	config := c.ControlManagerConfig(i)
+	n, err := c.getNode(config.PodName, config.GrpcServerPort)
+	if err != nil {
+		return err
+	}
+	config.GrpcServerPort = n.grpc_port
+	config.AdvertiseAddress, config.EtcdEndpoints = c.getNodeEndpoints(n)
+	cm := controlmanager.New(config)
+	if err := cm.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %w", config.PodName, err)
+	}
+	c.ControlManagers[i] = cm
+	return nil
+}
+
+// Stop the i-th control manager if it is running. It resigns leadership so
+// that another control manager takes over right away.
+func (c *Cluster) StopControlManager(i int) {
+	if c.ControlManagers[i] == nil {
+		return
+	}
+	c.ControlManagers[i].Stop()
+	c.ControlManagers[i] = nil
+}
+
+//------------------------------------------------------------------------------
+// NODE FAULTS
+//------------------------------------------------------------------------------
+
+// Helper method to parse a node name into its kind and ordinal.
+func (c *Cluster) parseNodeName(name string) (bool, int, error) {
+	for i := range c.Workers {
+		if name == WorkerName(i) {
+			return true, i, nil
+		}
+	}
+	for i := range c.ControlManagers {
+		if name == ControlManagerName(i) {
+			return false, i, nil
+		}
+	}
+	return false, 0, fmt.Errorf("unknown node %q", name)
+}
+
+// Kill a node abruptly, as if its process crashed. A killed worker stays
+// registered and a killed leader stays elected until its lease expires.
+func (c *Cluster) Kill(name string) error {
+	is_worker, i, err := c.parseNodeName(name)
+	if err != nil {
+		return err
+	}
+	if is_worker {
+		if c.Workers[i] != nil {
+			c.Workers[i].Kill()
+			c.Workers[i] = nil
+		}
+	} else if c.ControlManagers[i] != nil {
+		c.ControlManagers[i].Kill()
+		c.ControlManagers[i] = nil
+	}
+	return nil
+}
+
+// Restart a node at the same address. A running node is stopped first; a
+// restarted worker recovers its shards from its mount.
+func (c *Cluster) Restart(name string) error {
+	is_worker, i, err := c.parseNodeName(name)
+	if err != nil {
+		return err
+	}
+	if is_worker {
+		c.StopWorker(i)
+		return c.StartWorker(i)
+	}
+	c.StopControlManager(i)
+	return c.StartControlManager(i)
+}
+
+// Pause a node as if its process were frozen: its gRPC and etcd traffic is
+// held until Resume. Its leases expire if it stays paused for longer than
+// their TTL. Requires ProxyNodeTraffic.
+func (c *Cluster) Pause(name string) error {
+	return c.setNodeMode(name, proxyHold, proxyHold)
+}
+
+// Resume a paused node. Its held traffic is delivered.
+func (c *Cluster) Resume(name string) error {
+	return c.setNodeMode(name, proxyPass, proxyPass)
+}
+
+// Partition a node away from everything: its gRPC and etcd connections are
+// closed and new ones refused until Heal. Requires ProxyNodeTraffic.
+func (c *Cluster) Partition(name string) error {
+	return c.setNodeMode(name, proxyDrop, proxyDrop)
+}
+
+// Partition the gRPC server of a node away from its clients while the node
+// keeps its etcd session. Requires ProxyNodeTraffic.
+func (c *Cluster) PartitionGrpc(name string) error {
+	return c.setNodeMode(name, proxyDrop, proxyPass)
+}
+
+// Heal a partitioned node.
+func (c *Cluster) Heal(name string) error {
+	return c.setNodeMode(name, proxyPass, proxyPass)
+}
+
+// Replace the faults injected into a running worker. Requires
+// EnableFaultInjection. The faults are cleared when the worker restarts.
+func (c *Cluster) SetFaultRules(name string, rules ...*pb.FaultRule) error {
+	is_worker, i, err := c.parseNodeName(name)
+	if err != nil {
+		return err
+	}
+	if !is_worker {
+		return fmt.Errorf("faults can only be injected into workers, not %s", name)
+	}
+	if c.Workers[i] == nil {
+		return fmt.Errorf("%s is not running", name)
+	}
+	return c.Workers[i].SetFaultRules(rules)
+}
+
+// Helper method to set the mode of the proxies of a node.
+func (c *Cluster) setNodeMode(name string, grpc_mode proxyMode, etcd_mode proxyMode) error {
+	if _, _, err := c.parseNodeName(name); err != nil {
+		return err
+	}
+	n, exists := c.nodes[name]
+	if !exists || n.grpc_proxy == nil {
+		return fmt.Errorf("traffic of node %s is not proxied", name)
+	}
+	n.grpc_proxy.SetMode(grpc_mode)
+	n.etcd_proxy.SetMode(etcd_mode)
+	return nil
+}
+
+//------------------------------------------------------------------------------
+// EMBEDDED ETCD
+//------------------------------------------------------------------------------
+
+// Helper method to start a single node etcd server under data_dir/etcd.
+func (c *Cluster) startEtcd() error {
+	client_url, err := c.getFreeUrl()
+	if err != nil {
+		return err
+	}
+	peer_url, err := c.getFreeUrl()
+	if err != nil {
+		return err
+	}
+	config := embed.NewConfig()
+	config.Name = "local"
+	config.Dir = filepath.Join(c.data_dir, "etcd")
+	config.ListenClientUrls = []url.URL{*client_url}
+	config.AdvertiseClientUrls = []url.URL{*client_url}
+	config.ListenPeerUrls = []url.URL{*peer_url}
+	config.AdvertisePeerUrls = []url.URL{*peer_url}
+	config.InitialCluster = config.InitialClusterFromName(config.Name)
+	// etcd logs errors for the listeners it closes on shutdown. Our own logs
+	// tell what the cluster does.
+	config.ZapLoggerBuilder = embed.NewZapLoggerBuilder(zap.NewNop())
+
+	etcd, err := embed.StartEtcd(config)
+	if err != nil {
+		return fmt.Errorf("failed to start etcd: %v", err)
+	}
+	select {
+	case <-etcd.Server.ReadyNotify():
+	case <-time.After(etcdStartTimeout):
+		etcd.Close()
+		return fmt.Errorf("etcd not ready after %v", etcdStartTimeout)
+	}
+	c.etcd = etcd
+	c.etcd_endpoints = []string{client_url.Host}
+	logger.Info("Embedded etcd serving", slog.String("address", client_url.Host),
+		slog.String("dir", config.Dir))
+	return nil
+}
+
+// Helper method to get the URL of a free port on the cluster host.
+func (c *Cluster) getFreeUrl() (*url.URL, error) {
+	lis, err := net.Listen("tcp", net.JoinHostPort(c.config.Host, "0"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find a free port: %v", err)
+	}
+	defer lis.Close()
+	return &url.URL{Scheme: "http", Host: lis.Addr().String()}, nil
+}
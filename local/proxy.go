@@ -0,0 +1,200 @@
+package local
+
+import (
+	"io"
+	"kvstore/logging"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+// NODE PROXY
+//------------------------------------------------------------------------------
+
+// A node proxy forwards the TCP connections to or from a node so that its
+// traffic can be held or cut to simulate pauses and network partitions.
+type proxyMode int
+
+const (
+	// Traffic flows.
+	proxyPass proxyMode = iota
+	// Traffic is held until the proxy passes again, as if the node were
+	// frozen. Connections stay open.
+	proxyHold
+	// Connections are closed and new ones refused, as if the node were
+	// partitioned away.
+	proxyDrop
+)
+
+// Time to wait for a connection to the proxy target.
+const proxyDialTimeout = 5 * time.Second
+
+type nodeProxy struct {
+	listener net.Listener
+	lock     sync.Mutex
+	// Signalled whenever mode, target or closed changes.
+	cond   *sync.Cond
+	target string
+	mode   proxyMode
+	closed bool
+	// Open connections, both accepted and dialed.
+	conns map[net.Conn]bool
+}
+
+// Helper method to start a proxy listening on a free port of host. target
+// may be set later through SetTarget.
+func startNodeProxy(host string, target string) (*nodeProxy, error) {
+	lis, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return nil, err
+	}
+	p := &nodeProxy{
+		listener: lis,
+		target:   target,
+		conns:    make(map[net.Conn]bool),
+	}
+	p.cond = sync.NewCond(&p.lock)
+	go p.serve()
+	return p, nil
+}
+
+// Address the proxy listens on.
+func (p *nodeProxy) Address() string {
+	return p.listener.Addr().String()
+}
+
+// Change the address connections are forwarded to. Open connections keep
+// their target.
+func (p *nodeProxy) SetTarget(target string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.target = target
+	p.cond.Broadcast()
+}
+
+// Change the mode of the proxy. Open connections are closed when dropping.
+func (p *nodeProxy) SetMode(mode proxyMode) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.mode = mode
+	if mode == proxyDrop {
+		p.closeConnsLocked()
+	}
+	p.cond.Broadcast()
+}
+
+// Close the proxy and all its connections.
+func (p *nodeProxy) Close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.closed = true
+	p.listener.Close()
+	p.closeConnsLocked()
+	p.cond.Broadcast()
+}
+
+// Helper method to close the open connections. Caller must hold p.lock.
+func (p *nodeProxy) closeConnsLocked() {
+	for conn := range p.conns {
+		conn.Close()
+		delete(p.conns, conn)
+	}
+}
+
+// Helper method to accept connections until the proxy is closed.
+func (p *nodeProxy) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			p.lock.Lock()
+			closed := p.closed
+			p.lock.Unlock()
+			if closed {
+				return
+			}
+			logger.Error("Proxy failed to accept connection", logging.Err(err))
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go p.forward(conn)
+	}
+}
+
+// Helper method to wait while traffic is held. Returns false if the
+// connection must be closed instead. Caller must hold p.lock.
+func (p *nodeProxy) waitForPassLocked() bool {
+	for p.mode == proxyHold && !p.closed {
+		p.cond.Wait()
+	}
+	return p.mode == proxyPass && !p.closed
+}
+
+// Helper method to forward an accepted connection to the target.
+func (p *nodeProxy) forward(conn net.Conn) {
+	p.lock.Lock()
+	if !p.waitForPassLocked() || p.target == "" {
+		p.lock.Unlock()
+		conn.Close()
+		return
+	}
+	target := p.target
+	p.conns[conn] = true
+	p.lock.Unlock()
+
+	target_conn, err := net.DialTimeout("tcp", target, proxyDialTimeout)
+	if err != nil {
+		p.untrack(conn)
+		return
+	}
+	p.lock.Lock()
+	if p.closed || p.mode == proxyDrop || !p.conns[conn] {
+		p.lock.Unlock()
+		target_conn.Close()
+		p.untrack(conn)
+		return
+	}
+	p.conns[target_conn] = true
+	p.lock.Unlock()
+
+	go p.copy(target_conn, conn)
+	p.copy(conn, target_conn)
+}
+
+// Helper method to copy the bytes read from src to dst, holding them while
+// traffic is held. Both connections are closed once either side is done.
+func (p *nodeProxy) copy(dst net.Conn, src net.Conn) {
+	defer p.untrack(src)
+	defer p.untrack(dst)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			p.lock.Lock()
+			pass := p.waitForPassLocked()
+			p.lock.Unlock()
+			if !pass {
+				return
+			}
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				logger.Debug("Proxy connection closed",
+					slog.String("address", dst.RemoteAddr().String()), logging.Err(err))
+			}
+			return
+		}
+	}
+}
+
+// Helper method to close a connection and stop tracking it.
+func (p *nodeProxy) untrack(conn net.Conn) {
+	conn.Close()
+	p.lock.Lock()
+	delete(p.conns, conn)
+	p.lock.Unlock()
+}
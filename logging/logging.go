@@ -0,0 +1,266 @@
+// Package logging holds the structured logging of the control manager and
+// the worker, built on log/slog.
+//
+// Every component logs through its own logger, whose level can be set apart
+// from the others, e.g. to debug the election without the noise of the
+// request path. Attributes of the request being served, such as its request
+// id and shard, are carried by the context and added to every record logged
+// with it, along with the ids of the current trace and span. Values stored
+// in the kvstore are redacted unless explicitly enabled.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Formats of the log records.
+const (
+	FormatText = "text"
+	FormatJson = "json"
+)
+
+// Config of the logging of the process.
+type Config struct {
+	// Minimum level of the records logged: debug, info, warn or error.
+	// Defaults to info.
+	Level string
+	// Levels of the components overriding Level, e.g.
+	// "worker=debug,election=warn".
+	ComponentLevels string
+	// text or json. Defaults to text.
+	Format string
+	// If true, the values stored in the kvstore are logged in full rather
+	// than redacted. Only meant for debugging.
+	LogValues bool
+	// Writer of the records. Defaults to stderr.
+	Output io.Writer
+}
+
+// Levels in effect, replaced as a whole when the config changes.
+type levels struct {
+	level            slog.Level
+	component_levels map[string]slog.Level
+}
+
+// Helper method to get the level of a component.
+func (l *levels) forComponent(component string) slog.Level {
+	if level, exists := l.component_levels[component]; exists {
+		return level
+	}
+	return l.level
+}
+
+// Global state of the logging. Loggers are created at init time, before the
+// config is known, so they look it up on every record.
+var (
+	currentLevels  atomic.Pointer[levels]
+	currentHandler atomic.Pointer[slog.Handler]
+	logValues      atomic.Bool
+	loggersLock    sync.Mutex
+	loggers        = make(map[string]*slog.Logger)
+)
+
+func init() {
+	if err := Configure(Config{}); err != nil {
+		panic(err)
+	}
+}
+
+// Helper method to parse a level name.
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if name == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return 0, fmt.Errorf("invalid log level %q, must be one of debug, info, warn or error", name)
+	}
+	return level, nil
+}
+
+// Helper method to parse the levels of the components, given as
+// component=level pairs separated by commas.
+func ParseComponentLevels(spec string) (map[string]slog.Level, error) {
+	component_levels := make(map[string]slog.Level)
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		component, name, found := strings.Cut(pair, "=")
+		if !found || component == "" {
+			return nil, fmt.Errorf("invalid component log level %q, must be component=level", pair)
+		}
+		level, err := ParseLevel(name)
+		if err != nil {
+			return nil, err
+		}
+		component_levels[component] = level
+	}
+	return component_levels, nil
+}
+
+// Apply config to all loggers, including the ones already created. May be
+// called again to change the levels at runtime.
+func Configure(config Config) error {
+	level, err := ParseLevel(config.Level)
+	if err != nil {
+		return err
+	}
+	component_levels, err := ParseComponentLevels(config.ComponentLevels)
+	if err != nil {
+		return err
+	}
+	output := config.Output
+	if output == nil {
+		output = os.Stderr
+	}
+	// Levels are filtered per component, the handler logs everything it is
+	// handed.
+	opts := &slog.HandlerOptions{Level: slog.Level(-100)}
+	var handler slog.Handler
+	switch config.Format {
+	case "", FormatText:
+		handler = slog.NewTextHandler(output, opts)
+	case FormatJson:
+		handler = slog.NewJSONHandler(output, opts)
+	default:
+		return fmt.Errorf("invalid log format %q, must be text or json", config.Format)
+	}
+	currentLevels.Store(&levels{level: level, component_levels: component_levels})
+	currentHandler.Store(&handler)
+	logValues.Store(config.LogValues)
+	return nil
+}
+
+// Logger of a component. Loggers of the same component are shared.
+func Logger(component string) *slog.Logger {
+	loggersLock.Lock()
+	defer loggersLock.Unlock()
+	logger, exists := loggers[component]
+	if !exists {
+		logger = slog.New(&componentHandler{component: component})
+		loggers[component] = logger
+	}
+	return logger
+}
+
+//------------------------------------------------------------------------------
+// REQUEST CONTEXT
+//------------------------------------------------------------------------------
+
+type contextKey struct{}
+
+// Return a copy of ctx whose records carry attrs as well, e.g. the request id
+// of the request being served.
+func WithAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	ctx_attrs, _ := ctx.Value(contextKey{}).([]slog.Attr)
+	all_attrs := make([]slog.Attr, 0, len(ctx_attrs)+len(attrs))
+	all_attrs = append(append(all_attrs, ctx_attrs...), attrs...)
+	return context.WithValue(ctx, contextKey{}, all_attrs)
+}
+
+// Attribute holding the request id of the request being served.
+func RequestId(req_id string) slog.Attr {
+	return slog.String("request_id", req_id)
+}
+
+// Attribute holding a shard id.
+func Shard(shard_id string) slog.Attr {
+	return slog.String("shard", shard_id)
+}
+
+// Attribute holding the name of the worker a request is sent to.
+func Worker(worker_pod string) slog.Attr {
+	return slog.String("worker", worker_pod)
+}
+
+// Attribute holding the name of the pod logging, so that the nodes of a
+// local cluster can be told apart.
+func Node(pod_name string) slog.Attr {
+	return slog.String("node", pod_name)
+}
+
+// Attribute holding a key of the kvstore.
+func Key(key string) slog.Attr {
+	return slog.String("key", key)
+}
+
+// Attribute holding an error.
+func Err(err error) slog.Attr {
+	return slog.Any("error", err)
+}
+
+// Attribute holding a value stored in the kvstore. Only its size is logged
+// unless values are logged in full.
+func Value(value string) slog.Attr {
+	return slog.Any("value", redactedValue(value))
+}
+
+// Value resolved when the record is logged, so that changing LogValues
+// applies right away.
+type redactedValue string
+
+func (v redactedValue) LogValue() slog.Value {
+	if logValues.Load() {
+		return slog.StringValue(string(v))
+	}
+	return slog.StringValue(fmt.Sprintf("<redacted %d bytes>", len(v)))
+}
+
+//------------------------------------------------------------------------------
+// COMPONENT HANDLER
+//------------------------------------------------------------------------------
+
+// Handler of the records of a component. Filters them with the level of the
+// component and adds the component, the attributes of the context and the
+// trace ids before passing them to the current handler.
+type componentHandler struct {
+	component string
+	// Set through With and WithGroup, applied in order.
+	ops []func(slog.Handler) slog.Handler
+}
+
+func (h *componentHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= currentLevels.Load().forComponent(h.component)
+}
+
+func (h *componentHandler) Handle(ctx context.Context, record slog.Record) error {
+	attrs := []slog.Attr{slog.String("component", h.component)}
+	if ctx != nil {
+		if ctx_attrs, ok := ctx.Value(contextKey{}).([]slog.Attr); ok {
+			attrs = append(attrs, ctx_attrs...)
+		}
+		if span_context := trace.SpanContextFromContext(ctx); span_context.IsValid() {
+			attrs = append(attrs, slog.String("trace_id", span_context.TraceID().String()),
+				slog.String("span_id", span_context.SpanID().String()))
+		}
+	}
+	handler := (*currentHandler.Load()).WithAttrs(attrs)
+	for _, op := range h.ops {
+		handler = op(handler)
+	}
+	return handler.Handle(ctx, record)
+}
+
+func (h *componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler { return handler.WithAttrs(attrs) })
+}
+
+func (h *componentHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler { return handler.WithGroup(name) })
+}
+
+// Helper method to copy the handler with one more operation.
+func (h *componentHandler) with(op func(slog.Handler) slog.Handler) slog.Handler {
+	ops := make([]func(slog.Handler) slog.Handler, 0, len(h.ops)+1)
+	return &componentHandler{component: h.component, ops: append(append(ops, h.ops...), op)}
+}
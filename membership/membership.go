@@ -0,0 +1,358 @@
+// Package membership implements worker registration and discovery for the
+// kvstore cluster. Workers publish a WorkerRegistration under a lease in etcd
+// and the control manager watches the prefix to learn about workers as they
+// come and go.
+package membership
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"go.etcd.io/etcd/client/v3"
+	"google.golang.org/protobuf/encoding/protojson"
+	"hash/fnv"
+	"kvstore/logging"
+	pb "kvstore/protos"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prefix under which all worker registrations are stored in etcd.
+const WorkerPrefix = "/kvstore/workers/"
+
+// Time to wait before retrying a failed registration or watch.
+const retryInterval = time.Second
+
+var logger = logging.Logger("membership")
+
+// Helper method to get the etcd endpoint for the given pod namespace.
+func EtcdEndpoint(pod_namespace string) string {
+	return "etcd." + pod_namespace + ".svc.cluster.local:2379"
+}
+
+// Helper method to create a new etcd client for the given pod namespace.
+func NewEtcdClient(pod_namespace string) (*clientv3.Client, error) {
+	return NewEtcdClientForEndpoints([]string{EtcdEndpoint(pod_namespace)})
+}
+
+// Helper method to create a new etcd client for the given endpoints.
+func NewEtcdClientForEndpoints(endpoints []string) (*clientv3.Client, error) {
+	return clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: 5 * time.Second,
+	})
+}
+
+// Helper method to get the shard of a key. Every component routing keys must
+// use this method so that they agree on the placement of keys. Changing the
+// placement requires changing Partitioner.
+func GetShardForKey(key string, num_shards int) string {
+	// FNV-1a: fast, decent distribution
+	h := fnv.New32a()
+	// hash the key
+	h.Write([]byte(key))
+	shard_id := int(h.Sum32()) % num_shards
+	return strconv.Itoa(shard_id)
+}
+
+// Helper method to compute the shards owned by a worker. Shard s is owned by
+// worker-(s % num_workers), which matches the routing done by the control
+// manager.
+func OwnedShards(worker_name string, num_workers int, num_shards int) ([]string, error) {
+	ordinal, err := WorkerOrdinal(worker_name)
+	if err != nil {
+		return nil, err
+	}
+	var shards []string
+	for shard_id := 0; shard_id < num_shards; shard_id++ {
+		if shard_id%num_workers == ordinal {
+			shards = append(shards, strconv.Itoa(shard_id))
+		}
+	}
+	return shards, nil
+}
+
+// Helper method to parse the ordinal of a worker from its name,
+// worker-<ordinal>.
+func WorkerOrdinal(worker_name string) (int, error) {
+	ordinal, err := strconv.Atoi(strings.TrimPrefix(worker_name, "worker-"))
+	if err != nil || !strings.HasPrefix(worker_name, "worker-") {
+		return 0, fmt.Errorf("cannot parse ordinal from worker name %q", worker_name)
+	}
+	return ordinal, nil
+}
+
+//------------------------------------------------------------------------------
+// CLUSTER IDENTITY
+//------------------------------------------------------------------------------
+
+// Key under which the identity of the cluster is stored in etcd.
+const ClusterIdentityKey = "/kvstore/cluster_identity"
+
+// Name of the partitioner implemented by GetShardForKey, recorded in the
+// cluster identity so that nodes placing keys differently refuse to serve.
+const Partitioner = "fnv1a32-mod"
+
+// Error returned when the config of a node disagrees with the identity of the
+// cluster.
+var ErrClusterIdentityMismatch = errors.New("config disagrees with the cluster identity")
+
+// Helper method to get the identity of a new cluster with num_shards shards.
+func NewClusterIdentity(num_shards int) *pb.ClusterIdentity {
+	return &pb.ClusterIdentity{
+		ClusterId:   uuid.NewString(),
+		NumShards:   int32(num_shards),
+		Partitioner: Partitioner,
+	}
+}
+
+// Helper method to check that a node configured with num_shards shards places
+// keys as the cluster does.
+func CheckClusterIdentity(identity *pb.ClusterIdentity, num_shards int) error {
+	if int(identity.GetNumShards()) != num_shards {
+		return fmt.Errorf("%w: configured with %d shards, but cluster %s has %d shards",
+			ErrClusterIdentityMismatch, num_shards, identity.GetClusterId(),
+			identity.GetNumShards())
+	}
+	if identity.GetPartitioner() != Partitioner {
+		return fmt.Errorf("%w: keys are placed with the %s partitioner, but cluster %s uses %s",
+			ErrClusterIdentityMismatch, Partitioner, identity.GetClusterId(),
+			identity.GetPartitioner())
+	}
+	return nil
+}
+
+// Helper method to get the identity of the cluster stored in etcd. If the
+// cluster has none yet, proposed is stored, unless another node stores its
+// own first. Returns whether proposed was stored.
+func LoadClusterIdentity(ctx context.Context, cli *clientv3.Client,
+	proposed *pb.ClusterIdentity) (*pb.ClusterIdentity, bool, error) {
+	value, err := protojson.Marshal(proposed)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to marshal cluster identity: %v", err)
+	}
+	resp, err := cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(ClusterIdentityKey), "=", 0)).
+		Then(clientv3.OpPut(ClusterIdentityKey, string(value))).
+		Else(clientv3.OpGet(ClusterIdentityKey)).
+		Commit()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to load cluster identity: %v", err)
+	}
+	if resp.Succeeded {
+		return proposed, true, nil
+	}
+	kvs := resp.Responses[0].GetResponseRange().GetKvs()
+	if len(kvs) == 0 {
+		return nil, false, errors.New("cluster identity removed while loading it")
+	}
+	identity := &pb.ClusterIdentity{}
+	if err := protojson.Unmarshal(kvs[0].Value, identity); err != nil {
+		return nil, false, fmt.Errorf("failed to parse cluster identity: %v", err)
+	}
+	return identity, false, nil
+}
+
+//------------------------------------------------------------------------------
+// WORKER REGISTRATION
+//------------------------------------------------------------------------------
+
+// WorkerRegistrar keeps a worker's registration alive in etcd. If the lease is
+// lost (for example after an etcd outage) the registration is re-created.
+type WorkerRegistrar struct {
+	cli      *clientv3.Client
+	ttl_secs int64
+
+	lock         sync.Mutex
+	registration *pb.WorkerRegistration
+	lease_id     clientv3.LeaseID
+}
+
+// Helper method to instantiate a new registrar for the given registration.
+func NewWorkerRegistrar(cli *clientv3.Client, registration *pb.WorkerRegistration,
+	ttl_secs int64) *WorkerRegistrar {
+	return &WorkerRegistrar{
+		cli:          cli,
+		ttl_secs:     ttl_secs,
+		registration: registration,
+	}
+}
+
+// Register the worker and keep the registration alive until ctx is done.
+// Returns an error only if the initial registration fails.
+func (r *WorkerRegistrar) Start(ctx context.Context) error {
+	keep_alive, err := r.register(ctx)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			// Drain keep alive responses until the lease is lost.
+			for range keep_alive {
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Warn("Lost etcd lease, re-registering",
+				logging.Node(r.registration.GetWorkerName()))
+			for {
+				keep_alive, err = r.register(ctx)
+				if err == nil {
+					break
+				}
+				logger.Error("Failed to re-register worker",
+					logging.Node(r.registration.GetWorkerName()), logging.Err(err))
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(retryInterval):
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Update the state published in the worker registration.
+func (r *WorkerRegistrar) SetState(ctx context.Context, state pb.WorkerState) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.registration.State = state
+	return r.putLocked(ctx)
+}
+
+// Remove the registration by revoking its lease. The context passed to Start
+// must be done already, otherwise the worker is registered again.
+func (r *WorkerRegistrar) Deregister(ctx context.Context) error {
+	r.lock.Lock()
+	lease_id := r.lease_id
+	r.lock.Unlock()
+	if _, err := r.cli.Revoke(ctx, lease_id); err != nil {
+		return fmt.Errorf("failed to revoke lease: %v", err)
+	}
+	return nil
+}
+
+// Helper method to grant a new lease and publish the registration under it.
+func (r *WorkerRegistrar) register(ctx context.Context) (<-chan *clientv3.LeaseKeepAliveResponse, error) {
+	lease, err := r.cli.Grant(ctx, r.ttl_secs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to grant lease: %v", err)
+	}
+	r.lock.Lock()
+	r.lease_id = lease.ID
+	err = r.putLocked(ctx)
+	r.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	keep_alive, err := r.cli.KeepAlive(ctx, lease.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to keep lease alive: %v", err)
+	}
+	logger.Info("Registered worker", logging.Node(r.registration.GetWorkerName()),
+		slog.String("address", r.registration.GetAddress()),
+		slog.String("lease", fmt.Sprintf("%x", lease.ID)))
+	return keep_alive, nil
+}
+
+// Helper method to write the registration to etcd. Caller must hold r.lock.
+func (r *WorkerRegistrar) putLocked(ctx context.Context) error {
+	value, err := protojson.Marshal(r.registration)
+	if err != nil {
+		return fmt.Errorf("failed to marshal registration: %v", err)
+	}
+	key := WorkerPrefix + r.registration.GetWorkerName()
+	if _, err := r.cli.Put(ctx, key, string(value), clientv3.WithLease(r.lease_id)); err != nil {
+		return fmt.Errorf("failed to put registration: %v", err)
+	}
+	return nil
+}
+
+//------------------------------------------------------------------------------
+// WORKER DISCOVERY
+//------------------------------------------------------------------------------
+
+// Callback invoked with the full set of registered workers, keyed by worker
+// name, every time the membership changes.
+type MembershipHandler func(workers map[string]*pb.WorkerRegistration)
+
+// Watch the worker prefix until ctx is done, calling handler with the current
+// membership after the initial listing and after every change. The watch is
+// re-established from a fresh listing if it fails.
+func WatchWorkers(ctx context.Context, cli *clientv3.Client, handler MembershipHandler) {
+	for ctx.Err() == nil {
+		err := watchWorkersOnce(ctx, cli, handler)
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Error("Worker membership watch failed, retrying", logging.Err(err))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// Helper method to list the worker prefix and watch it for changes.
+func watchWorkersOnce(ctx context.Context, cli *clientv3.Client, handler MembershipHandler) error {
+	resp, err := cli.Get(ctx, WorkerPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+	workers := make(map[string]*pb.WorkerRegistration)
+	for _, kv := range resp.Kvs {
+		if registration := parseRegistration(kv.Value); registration != nil {
+			workers[strings.TrimPrefix(string(kv.Key), WorkerPrefix)] = registration
+		}
+	}
+	handler(copyMembership(workers))
+
+	watch_ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	watch_chan := cli.Watch(watch_ctx, WorkerPrefix, clientv3.WithPrefix(),
+		clientv3.WithRev(resp.Header.Revision+1))
+	for watch_resp := range watch_chan {
+		if err := watch_resp.Err(); err != nil {
+			return err
+		}
+		for _, ev := range watch_resp.Events {
+			worker_name := strings.TrimPrefix(string(ev.Kv.Key), WorkerPrefix)
+			switch ev.Type {
+			case clientv3.EventTypePut:
+				if registration := parseRegistration(ev.Kv.Value); registration != nil {
+					workers[worker_name] = registration
+				}
+			case clientv3.EventTypeDelete:
+				delete(workers, worker_name)
+			}
+		}
+		handler(copyMembership(workers))
+	}
+	return fmt.Errorf("watch channel closed")
+}
+
+// Helper method to parse a registration stored in etcd. Returns nil if the
+// value cannot be parsed.
+func parseRegistration(value []byte) *pb.WorkerRegistration {
+	var registration pb.WorkerRegistration
+	if err := protojson.Unmarshal(value, &registration); err != nil {
+		logger.Error("Failed to unmarshal worker registration", logging.Err(err))
+		return nil
+	}
+	return &registration
+}
+
+// Helper method to copy the membership map so that handlers may keep it.
+func copyMembership(workers map[string]*pb.WorkerRegistration) map[string]*pb.WorkerRegistration {
+	result := make(map[string]*pb.WorkerRegistration, len(workers))
+	for name, registration := range workers {
+		result[name] = registration
+	}
+	return result
+}
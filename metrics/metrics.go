@@ -0,0 +1,194 @@
+// Package metrics holds the Prometheus metrics shared by the control manager
+// and the worker, and serves them over HTTP at /metrics.
+//
+// Every node registers its metrics in a registry of its own rather than in
+// the default registry, so that several nodes can run in one process, as in
+// local mode.
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"kvstore/kverror"
+	"kvstore/logging"
+	pb "kvstore/protos"
+	"log/slog"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+)
+
+// Namespace of all kvstore metrics.
+const Namespace = "kvstore"
+
+// Buckets of the latency histograms, from 100us to about 13s.
+var LatencyBuckets = prometheus.ExponentialBuckets(0.0001, 2, 18)
+
+// Helper method to create the registry of a node, holding the Go runtime
+// and process metrics.
+func NewRegistry() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return registry
+}
+
+//------------------------------------------------------------------------------
+// RPC METRICS
+//------------------------------------------------------------------------------
+
+// Helper method to get the label of the outcome of an RPC: the name of the
+// ErrorCode reported in the response or carried by the status error, or the
+// gRPC status code prefixed by grpc: for failures without an ErrorCode.
+func ErrorCodeLabel(resp any, err error) string {
+	if err != nil {
+		if kv_error := kverror.FromStatusError(err); kv_error != nil {
+			return kv_error.GetErrorType().String()
+		}
+		return "grpc:" + status.Code(err).String()
+	}
+	if kv_error := kverror.ResponseError(resp); kv_error != nil {
+		return kv_error.GetErrorType().String()
+	}
+	return pb.ErrorCode_kNoError.String()
+}
+
+// Helper method to split a full gRPC method name, e.g.
+// /main.KvStoreInterface/PutKey, into its service and method.
+func splitMethodName(full_method string) (string, string) {
+	return path.Base(path.Dir(full_method)), path.Base(full_method)
+}
+
+// Latency of the RPCs served by a node. The histogram counts hold the number
+// of RPCs by method and outcome.
+type ServerMetrics struct {
+	duration *prometheus.HistogramVec
+}
+
+// Helper method to create and register the metrics of served RPCs.
+func NewServerMetrics(registry prometheus.Registerer) *ServerMetrics {
+	m := &ServerMetrics{
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Name:      "rpc_duration_seconds",
+			Help:      "Latency of served RPCs by service, method and ErrorCode.",
+			Buckets:   LatencyBuckets,
+		}, []string{"service", "method", "error_code"}),
+	}
+	registry.MustRegister(m.duration)
+	return m
+}
+
+// Unary server interceptor recording the latency and outcome of every RPC.
+// Must come first in the chain so that RPCs failed by later interceptors are
+// recorded as well.
+func (m *ServerMetrics) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (any, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		service, method := splitMethodName(info.FullMethod)
+		m.duration.WithLabelValues(service, method, ErrorCodeLabel(resp, err)).
+			Observe(time.Since(start).Seconds())
+		return resp, err
+	}
+}
+
+// Latency of the RPCs sent by a node to its peers, by peer.
+type ClientMetrics struct {
+	duration   *prometheus.HistogramVec
+	peer_label string
+}
+
+// Helper method to create and register the metrics of RPCs sent to peers.
+// name is the name of the metric, e.g. worker_rpc_duration_seconds, and
+// peer_label the label holding the name of the peer.
+func NewClientMetrics(registry prometheus.Registerer, name string, help string,
+	peer_label string) *ClientMetrics {
+	m := &ClientMetrics{
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Name:      name,
+			Help:      help,
+			Buckets:   LatencyBuckets,
+		}, []string{peer_label, "method", "error_code"}),
+		peer_label: peer_label,
+	}
+	registry.MustRegister(m.duration)
+	return m
+}
+
+// Unary client interceptor recording the latency and outcome of every
+// attempt of an RPC sent to peer.
+func (m *ClientMetrics) UnaryClientInterceptor(peer string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, full_method string, req, reply any,
+		cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		start := time.Now()
+		err := invoker(ctx, full_method, req, reply, cc, opts...)
+		_, method := splitMethodName(full_method)
+		m.duration.WithLabelValues(peer, method, ErrorCodeLabel(reply, err)).
+			Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+// Forget the RPCs sent to a peer which left the cluster.
+func (m *ClientMetrics) DeletePeer(peer string) {
+	m.duration.DeletePartialMatch(prometheus.Labels{m.peer_label: peer})
+}
+
+//------------------------------------------------------------------------------
+// METRICS SERVER
+//------------------------------------------------------------------------------
+
+// HTTP server exposing the metrics of a registry at /metrics.
+type Server struct {
+	listener    net.Listener
+	http_server *http.Server
+}
+
+// Helper method to serve the metrics of registry at host:port in the
+// background. on_error is called if serving fails.
+func StartServer(host string, port int, registry *prometheus.Registry,
+	on_error func(error)) (*Server, error) {
+	lis, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for metrics: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{
+		Registry: registry,
+	}))
+	s := &Server{
+		listener:    lis,
+		http_server: &http.Server{Handler: mux},
+	}
+	logging.Logger("metrics").Info("Metrics server listening",
+		slog.String("address", lis.Addr().String()))
+	go func() {
+		if err := s.http_server.Serve(lis); !errors.Is(err, http.ErrServerClosed) {
+			on_error(fmt.Errorf("failed to serve metrics: %v", err))
+		}
+	}()
+	return s, nil
+}
+
+// host:port the metrics are served at.
+func (s *Server) Address() string {
+	return s.listener.Addr().String()
+}
+
+// Stop serving the metrics.
+func (s *Server) Close() {
+	s.http_server.Close()
+}
@@ -0,0 +1,291 @@
+// Package tracing sets up the OpenTelemetry tracing of the control manager
+// and the worker.
+//
+// Every node owns a tracer provider of its own rather than using the global
+// one, so that several nodes can run in one process, as in local mode, and
+// still report their own service name. The trace context travels between the
+// nodes in the gRPC metadata using the W3C trace context format.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc/filters"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"google.golang.org/grpc"
+	"kvstore/kverror"
+	"kvstore/logging"
+	pb "kvstore/protos"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Exporters of the spans.
+const (
+	// Spans are not exported.
+	ExporterNone = "none"
+	// Spans are sent to an OpenTelemetry collector over OTLP/gRPC.
+	ExporterOtlp = "otlp"
+	// Spans are written to stdout or to a file as JSON, one span per line.
+	// Only meant for testing.
+	ExporterStdout = "stdout"
+	ExporterFile   = "file"
+)
+
+// Attributes of the kvstore spans.
+const (
+	RequestIdKey    = attribute.Key("kv.request_id")
+	ShardKey        = attribute.Key("kv.shard")
+	WorkerKey       = attribute.Key("kv.worker")
+	ErrorCodeKey    = attribute.Key("kv.error_code")
+	DbModifiedTsKey = attribute.Key("kv.db_modified_ts")
+)
+
+// Config of the tracing of a node.
+type Config struct {
+	// One of none, otlp, stdout or file. Tracing is disabled if empty or
+	// none, though the trace context of incoming requests is still passed
+	// on.
+	Exporter string
+	// host:port of the OTLP/gRPC collector. Defaults to the
+	// OTEL_EXPORTER_OTLP_ENDPOINT environment variable, or localhost:4317.
+	OtlpEndpoint string
+	// File the spans are appended to by the file exporter.
+	FilePath string
+	// Fraction of the traces started by this node which are recorded. Traces
+	// started by a caller follow the decision of the caller.
+	SampleRatio float64
+	// Exporter used instead of Exporter if set, e.g. an in-memory exporter
+	// in tests.
+	SpanExporter sdktrace.SpanExporter
+}
+
+// Tracer of a node. A nil tracer records nothing.
+type Tracer struct {
+	provider trace.TracerProvider
+	tracer   trace.Tracer
+	// Set if tracing is enabled, flushed on Shutdown.
+	sdk_provider *sdktrace.TracerProvider
+	file         *os.File
+}
+
+var logger = logging.Logger("tracing")
+
+// Propagator of the trace context between the nodes.
+var propagator = propagation.NewCompositeTextMapPropagator(
+	propagation.TraceContext{}, propagation.Baggage{})
+
+// Helper method to create the tracer of a node. service_name is the kind of
+// the node, e.g. worker, and instance its pod name.
+func New(service_name string, instance string, config Config) (*Tracer, error) {
+	t := &Tracer{}
+	var exporter sdktrace.SpanExporter
+	// Spans of the stdout, file and custom exporters are exported as soon as
+	// they end, so that tests see them right away.
+	is_batched := false
+	switch {
+	case config.SpanExporter != nil:
+		exporter = config.SpanExporter
+	case config.Exporter == "" || config.Exporter == ExporterNone:
+		t.provider = noop.NewTracerProvider()
+		t.tracer = t.provider.Tracer("kvstore")
+		return t, nil
+	case config.Exporter == ExporterOtlp:
+		opts := []otlptracegrpc.Option{otlptracegrpc.WithInsecure()}
+		if config.OtlpEndpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(config.OtlpEndpoint))
+		}
+		// The exporter connects lazily, an unreachable collector does not
+		// keep the node from starting.
+		otlp_exporter, err := otlptracegrpc.New(context.Background(), opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create OTLP exporter: %v", err)
+		}
+		exporter = otlp_exporter
+		is_batched = true
+	case config.Exporter == ExporterStdout:
+		stdout_exporter, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create stdout exporter: %v", err)
+		}
+		exporter = stdout_exporter
+	case config.Exporter == ExporterFile:
+		if config.FilePath == "" {
+			return nil, fmt.Errorf("the file exporter needs a file path")
+		}
+		file, err := os.OpenFile(config.FilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open trace file: %v", err)
+		}
+		file_exporter, err := stdouttrace.New(stdouttrace.WithWriter(file))
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to create file exporter: %v", err)
+		}
+		t.file = file
+		exporter = file_exporter
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q, must be one of none, otlp, stdout or file",
+			config.Exporter)
+	}
+	if config.SampleRatio < 0 || config.SampleRatio > 1 {
+		return nil, fmt.Errorf("trace sample ratio %v is not in [0, 1]", config.SampleRatio)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(service_name), semconv.ServiceInstanceID(instance)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace resource: %v", err)
+	}
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(
+			sdktrace.TraceIDRatioBased(config.SampleRatio))),
+	}
+	if is_batched {
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	} else {
+		opts = append(opts, sdktrace.WithSyncer(exporter))
+	}
+	t.sdk_provider = sdktrace.NewTracerProvider(opts...)
+	t.provider = t.sdk_provider
+	t.tracer = t.provider.Tracer("kvstore")
+	logger.Info("Tracing enabled", slog.String("service", service_name), logging.Node(instance),
+		slog.String("exporter", config.Exporter), slog.Float64("sample_ratio", config.SampleRatio))
+	return t, nil
+}
+
+// Start a span as a child of the span of ctx.
+func (t *Tracer) Start(ctx context.Context, name string,
+	attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if t == nil {
+		return noop.NewTracerProvider().Tracer("kvstore").Start(ctx, name)
+	}
+	return t.tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// Start the span of a request served outside of gRPC, e.g. by the HTTP
+// gateway or the Redis front end.
+func (t *Tracer) StartServer(ctx context.Context, name string) (context.Context, trace.Span) {
+	return t.getProvider().Tracer("kvstore").Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindServer))
+}
+
+// Wrap an HTTP handler in a span, as a child of the span of the caller if
+// the request carries a trace context.
+func (t *Tracer) HttpHandler(name string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := t.StartServer(ctx, name)
+		defer span.End()
+		handler(w, r.WithContext(ctx))
+	}
+}
+
+// gRPC server option creating a span for every incoming RPC, as a child of
+// the span of the caller. The health checks of the probes are not traced.
+func (t *Tracer) ServerOption() grpc.ServerOption {
+	return grpc.StatsHandler(otelgrpc.NewServerHandler(
+		otelgrpc.WithTracerProvider(t.getProvider()), otelgrpc.WithPropagators(propagator),
+		otelgrpc.WithFilter(filters.Not(filters.HealthCheck()))))
+}
+
+// gRPC dial option creating a span for every outgoing RPC and passing the
+// trace context on to the callee.
+func (t *Tracer) DialOption() grpc.DialOption {
+	return grpc.WithStatsHandler(otelgrpc.NewClientHandler(
+		otelgrpc.WithTracerProvider(t.getProvider()), otelgrpc.WithPropagators(propagator)))
+}
+
+// Helper method to get the tracer provider, which records nothing for a nil
+// tracer.
+func (t *Tracer) getProvider() trace.TracerProvider {
+	if t == nil {
+		return noop.NewTracerProvider()
+	}
+	return t.provider
+}
+
+// Flush the spans not exported yet and stop tracing.
+func (t *Tracer) Shutdown() {
+	if t == nil || t.sdk_provider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := t.sdk_provider.Shutdown(ctx); err != nil {
+		logger.Error("Failed to flush spans", logging.Err(err))
+	}
+	if t.file != nil {
+		t.file.Close()
+	}
+}
+
+// Helper method to end a span, recording the ErrorCode of the operation. The
+// span is marked as failed unless the operation succeeded, or only found the
+// key missing or the write condition false.
+func EndSpan(span trace.Span, error_code pb.ErrorCode, error_details string) {
+	span.SetAttributes(ErrorCodeKey.String(error_code.String()))
+	switch error_code {
+	case pb.ErrorCode_kNoError, pb.ErrorCode_kNotFound, pb.ErrorCode_kConditionFailed:
+	default:
+		span.SetStatus(codes.Error, error_details)
+	}
+	span.End()
+}
+
+// Helper method to end a span, recording err if the operation failed.
+func EndSpanWithError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Helper method to record the request id on the span of the RPC serving it.
+func SetRequestId(ctx context.Context, req_id string) {
+	trace.SpanFromContext(ctx).SetAttributes(RequestIdKey.String(req_id))
+}
+
+// Unary server interceptor recording the request id and the ErrorCode of
+// every RPC on its span. Must come after the status errors are created, i.e.
+// before kverror in the chain.
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (any, error) {
+		// The internal RPCs carry the request id of the control manager.
+		if with_req_id, ok := req.(interface{ GetReqId() string }); ok &&
+			with_req_id.GetReqId() != "" {
+			SetRequestId(ctx, with_req_id.GetReqId())
+		}
+		resp, err := handler(ctx, req)
+		span := trace.SpanFromContext(ctx)
+		kv_error := kverror.ResponseError(resp)
+		if err != nil {
+			kv_error = kverror.FromStatusError(err)
+		}
+		if kv_error != nil {
+			span.SetAttributes(ErrorCodeKey.String(kv_error.GetErrorType().String()))
+			switch kv_error.GetErrorType() {
+			case pb.ErrorCode_kNotFound, pb.ErrorCode_kConditionFailed:
+			default:
+				span.SetStatus(codes.Error, kv_error.GetErrorDetails())
+			}
+		} else if err == nil {
+			span.SetAttributes(ErrorCodeKey.String(pb.ErrorCode_kNoError.String()))
+		}
+		return resp, err
+	}
+}
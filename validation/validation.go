@@ -0,0 +1,105 @@
+// Package validation checks the arguments of the kvstore requests.
+//
+// The control manager validates every request it serves. Workers validate the
+// requests sent to them as well, since smart clients reach them directly, and
+// the client validates its writes before picking a route. Sharing the checks
+// keeps both routes equally strict.
+package validation
+
+import (
+	"fmt"
+	pb "kvstore/protos"
+	"strings"
+)
+
+// Maximum length of a client supplied request id.
+const MaxRequestIdLength = 128
+
+// Add validation for PutKey.
+// Returns true if arg is valid, else returns false along with error details.
+func ValidatePutKeyArg(in *pb.PutKeyArg) (bool, string) {
+	is_valid, error_details := validateWrite(in.GetKey(), in.GetValue(),
+		in.GetCondition(), in.GetRequestId())
+	if !is_valid {
+		return false, error_details
+	}
+	if in.GetTtlMs() < 0 {
+		return false, "Time to live cannot be negative."
+	}
+	return true, ""
+}
+
+// Add validation for PutKeyInternal, i.e. a PutKey sent to a worker.
+// Returns true if arg is valid, else returns false along with error details.
+func ValidatePutKeyInternalArg(in *pb.PutKeyInternalArg) (bool, string) {
+	is_valid, error_details := validateWrite(in.GetKey(), in.GetValue(),
+		in.GetCondition(), in.GetReqId())
+	if !is_valid {
+		return false, error_details
+	}
+	if in.GetExpiresAtMs() < 0 {
+		return false, "Expiry time cannot be negative."
+	}
+	return true, ""
+}
+
+// Helper method to validate the arguments shared by PutKey and
+// PutKeyInternal.
+func validateWrite(key string, value string, condition *pb.WriteCondition,
+	req_id string) (bool, string) {
+	if key == "" {
+		return false, "Cannot send empty key to kvstore."
+	}
+	if is_valid, error_details := validateKeyName(key); !is_valid {
+		return false, error_details
+	}
+	if value == "" {
+		return false, "Cannot send empty value to kvstore."
+	}
+	num_conditions := 0
+	for _, is_set := range []bool{condition.GetIfDbModifiedTs() != 0,
+		condition.GetIfNotExists(), condition.GetIfExists()} {
+		if is_set {
+			num_conditions++
+		}
+	}
+	if num_conditions > 1 {
+		return false, "At most one write condition may be set."
+	}
+	if len(req_id) > MaxRequestIdLength {
+		return false, fmt.Sprintf("Request id cannot be longer than %d bytes.",
+			MaxRequestIdLength)
+	}
+	return true, ""
+}
+
+// Add validation for GetKey and GetKeyInternal.
+// Returns true if key is valid, else returns false along with error details.
+func ValidateGetKey(key string) (bool, string) {
+	if key == "" {
+		return false, "Cannot fetch empty key from kvstore"
+	}
+	return validateKeyName(key)
+}
+
+// Add validation for DeleteKey and DeleteKeyInternal.
+// Returns true if key is valid, else returns false along with error details.
+func ValidateDeleteKey(key string) (bool, string) {
+	if key == "" {
+		return false, "Cannot delete empty key from kvstore"
+	}
+	return validateKeyName(key)
+}
+
+// Helper method to check that a key can be stored as a file of the directory
+// of its shard, which workers join to the key. A key holding a path separator
+// or naming a parent directory could otherwise escape the directory.
+func validateKeyName(key string) (bool, string) {
+	if key == "." || key == ".." {
+		return false, fmt.Sprintf("Key cannot be %q.", key)
+	}
+	if strings.ContainsAny(key, "/\\\x00") {
+		return false, "Key cannot contain '/', '\\' or NUL characters."
+	}
+	return true, ""
+}
@@ -0,0 +1,303 @@
+package worker
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/encoding/protojson"
+	"kvstore/logging"
+	pb "kvstore/protos"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+//------------------------------------------------------------------------------
+// DEDUP TABLE RELATED STRUCTS AND METHODS
+//------------------------------------------------------------------------------
+
+// Table of recently applied writes for a shard. A write carrying a request id
+// found in the table is not applied again; the original result is returned
+// instead. The table is bounded to max_entries entries. Every write appends
+// its entry to a synced log, which is compacted into a snapshot of the table
+// in the background once it holds max_entries entries.
+type ShardDedupTable struct {
+	// Serializes the writes to the shard so that the dedup check, the write
+	// and recording its result happen atomically.
+	shard_lock sync.Mutex
+	// Key is the request id.
+	entries map[string]*pb.DedupEntry
+	// Request ids in the order they were applied, oldest first.
+	order []string
+	// Maximum number of entries kept in the table.
+	max_entries int
+	// File the snapshot of the table is persisted to.
+	file_path string
+	// Log of the entries recorded since the last snapshot, opened on the
+	// first write.
+	log_file *os.File
+	// Number of entries in the log.
+	log_entries int
+	// Whether a compaction of the log is pending.
+	is_compacting bool
+	// Whether the table was flushed, after which the log is not reopened.
+	is_closed bool
+	logger    *slog.Logger
+}
+
+// Extension of the log next to the snapshot of a dedup table.
+const dedupLogExt = ".log"
+
+type DedupTableMap struct {
+	dedup_lock sync.Mutex
+	// Key is the shard id.
+	shards map[string]*ShardDedupTable
+}
+
+// Helper method to instantiate a new dedup table map.
+func CreateDedupTableMap() *DedupTableMap {
+	return &DedupTableMap{
+		shards: make(map[string]*ShardDedupTable),
+	}
+}
+
+// Helper method to instantiate an empty dedup table for a shard. Failures to
+// persist the table are logged through logger.
+func CreateShardDedupTable(max_entries int, file_path string, logger *slog.Logger) *ShardDedupTable {
+	return &ShardDedupTable{
+		entries:     make(map[string]*pb.DedupEntry),
+		max_entries: max_entries,
+		file_path:   file_path,
+		logger:      logger,
+	}
+}
+
+// Helper method to get the dedup table of a shard, creating it if needed.
+func (w *Worker) GetShardDedupTable(shard_id string) *ShardDedupTable {
+	w.dedup_tables.dedup_lock.Lock()
+	defer w.dedup_tables.dedup_lock.Unlock()
+	table, exists := w.dedup_tables.shards[shard_id]
+	if !exists {
+		table = CreateShardDedupTable(w.config.DedupTableSize,
+			filepath.Join(w.config.DedupPath, shard_id), w.logger.With(logging.Shard(shard_id)))
+		w.dedup_tables.shards[shard_id] = table
+	}
+	return table
+}
+
+// Returns the entry recorded for req_id, or nil if the request has not been
+// applied. Caller must hold shard_lock.
+func (t *ShardDedupTable) Lookup(req_id string) *pb.DedupEntry {
+	if req_id == "" {
+		return nil
+	}
+	return t.entries[req_id]
+}
+
+// Record an applied write and append it to the log of the table. Evicts the
+// oldest entries once the table is full. A failure to append is only logged:
+// the value written carries the request id, which tells a retry that the
+// write was applied. Caller must hold shard_lock.
+func (t *ShardDedupTable) Record(entry *pb.DedupEntry) {
+	if entry.GetReqId() == "" {
+		return
+	}
+	t.add(entry)
+	if err := t.appendLog(entry); err != nil {
+		t.logger.Error("Failed to persist dedup entry", slog.String("file", t.logPath()),
+			logging.Err(err))
+		return
+	}
+	if t.log_entries >= t.max_entries && !t.is_compacting {
+		t.is_compacting = true
+		go t.compactInBackground()
+	}
+}
+
+// Helper method to add an entry to the in memory table.
+func (t *ShardDedupTable) add(entry *pb.DedupEntry) {
+	if _, exists := t.entries[entry.GetReqId()]; exists {
+		return
+	}
+	t.entries[entry.GetReqId()] = entry
+	t.order = append(t.order, entry.GetReqId())
+	for len(t.order) > t.max_entries {
+		delete(t.entries, t.order[0])
+		t.order = t.order[1:]
+	}
+}
+
+// Helper method to get the path of the log of the table.
+func (t *ShardDedupTable) logPath() string {
+	return t.file_path + dedupLogExt
+}
+
+// Helper method to append an entry to the log and sync it. The log is opened
+// on the first write. Caller must hold shard_lock.
+func (t *ShardDedupTable) appendLog(entry *pb.DedupEntry) error {
+	if t.is_closed {
+		return errors.New("dedup table is closed")
+	}
+	if t.log_file == nil {
+		if err := os.MkdirAll(filepath.Dir(t.file_path), 0755); err != nil {
+			return fmt.Errorf("failed to create dir: %v", err)
+		}
+		file, err := os.OpenFile(t.logPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open log: %v", err)
+		}
+		if err := syncDir(filepath.Dir(t.file_path)); err != nil {
+			file.Close()
+			return err
+		}
+		t.log_file = file
+	}
+	data, err := protojson.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal dedup entry: %v", err)
+	}
+	if _, err := t.log_file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("error writing to log: %v", err)
+	}
+	if err := t.log_file.Sync(); err != nil {
+		return fmt.Errorf("error syncing log: %v", err)
+	}
+	t.log_entries++
+	return nil
+}
+
+// Helper method to compact the log of the table off the write path.
+func (t *ShardDedupTable) compactInBackground() {
+	t.shard_lock.Lock()
+	defer t.shard_lock.Unlock()
+	t.is_compacting = false
+	if t.is_closed {
+		return
+	}
+	if err := t.compact(); err != nil {
+		t.logger.Error("Failed to compact dedup log", slog.String("file", t.logPath()),
+			logging.Err(err))
+	}
+}
+
+// Helper method to write a synced snapshot of the table, then truncate its
+// log. A crash in between replays the log over the snapshot, which records
+// the same entries again. Caller must hold shard_lock.
+func (t *ShardDedupTable) compact() error {
+	table := &pb.DedupTable{}
+	for _, req_id := range t.order {
+		table.Entries = append(table.Entries, t.entries[req_id])
+	}
+	data, err := protojson.Marshal(table)
+	if err != nil {
+		return fmt.Errorf("failed to marshal dedup table: %v", err)
+	}
+	if err := replaceFile(t.file_path, filepath.Dir(t.file_path), data, true, nil, ""); err != nil {
+		return err
+	}
+	if t.log_file == nil {
+		return nil
+	}
+	if err := t.log_file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate log: %v", err)
+	}
+	if err := t.log_file.Sync(); err != nil {
+		return fmt.Errorf("error syncing log: %v", err)
+	}
+	t.log_entries = 0
+	return nil
+}
+
+// Helper method to compact the log of the table and close it, e.g. when the
+// worker stops. Caller must hold shard_lock.
+func (t *ShardDedupTable) flush() error {
+	err := t.compact()
+	if t.log_file != nil {
+		if close_err := t.log_file.Close(); err == nil && close_err != nil {
+			err = fmt.Errorf("error closing log: %v", close_err)
+		}
+		t.log_file = nil
+	}
+	t.is_closed = true
+	return err
+}
+
+// Helper method to replay the log of a dedup table over its snapshot. A torn
+// last line, left by a crash mid-append, is skipped.
+func (t *ShardDedupTable) replayLog() error {
+	content, err := os.ReadFile(t.logPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(nil, len(content)+1)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		entry := &pb.DedupEntry{}
+		if err := protojson.Unmarshal(scanner.Bytes(), entry); err != nil {
+			t.logger.Warn("Skipping torn dedup log entry", slog.String("file", t.logPath()),
+				logging.Err(err))
+			continue
+		}
+		t.add(entry)
+		t.log_entries++
+	}
+	return scanner.Err()
+}
+
+// Helper method to init the dedup tables from disk: the snapshot of each
+// shard, then its log. Make sure this method is called before the worker
+// starts serving writes.
+func (w *Worker) InitShardDedupTables() {
+	w.dedup_tables = CreateDedupTableMap()
+	files, err := os.ReadDir(w.config.DedupPath)
+	if err != nil {
+		w.logger.Warn("Error reading dedup directory. May be this is a first time bootup "+
+			"of kvstore.", logging.Err(err))
+		return
+	}
+	shard_ids := make(map[string]bool)
+	for _, file := range files {
+		if !file.Type().IsRegular() || filepath.Ext(file.Name()) == ".tmp" {
+			continue
+		}
+		shard_ids[strings.TrimSuffix(file.Name(), dedupLogExt)] = true
+	}
+	for shard_id := range shard_ids {
+		file_path := filepath.Join(w.config.DedupPath, shard_id)
+		shard_table := CreateShardDedupTable(w.config.DedupTableSize, file_path,
+			w.logger.With(logging.Shard(shard_id)))
+		content, err := os.ReadFile(file_path)
+		if err != nil && !os.IsNotExist(err) {
+			w.logger.Error("Error reading file", logging.Shard(shard_id), logging.Err(err))
+			continue
+		}
+		if err == nil {
+			var table pb.DedupTable
+			if err := protojson.Unmarshal(content, &table); err != nil {
+				w.logger.Error("Failed to unmarshal dedup table", logging.Shard(shard_id),
+					logging.Err(err))
+				continue
+			}
+			for _, entry := range table.GetEntries() {
+				shard_table.add(entry)
+			}
+		}
+		if err := shard_table.replayLog(); err != nil {
+			w.logger.Error("Error reading dedup log", logging.Shard(shard_id),
+				logging.Err(err))
+			continue
+		}
+		w.dedup_tables.shards[shard_id] = shard_table
+		w.logger.Info("Loaded dedup entries", logging.Shard(shard_id),
+			slog.Int("entries", len(shard_table.order)))
+	}
+}
@@ -0,0 +1,326 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"kvstore/logging"
+	pb "kvstore/protos"
+	"log/slog"
+	"math/rand"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+// FAULT INJECTION
+//------------------------------------------------------------------------------
+
+// Injects the faults described by a set of rules into the disk operations and
+// the incoming RPCs of a worker. Only created when fault injection is
+// enabled; a nil injector injects nothing.
+type FaultInjector struct {
+	lock  sync.Mutex
+	rules []*faultRule
+	rng   *rand.Rand
+	// Maps a key to its shard, to match RPCs against the shards of rules.
+	shard_for_key func(key string) string
+	logger        *slog.Logger
+}
+
+// Configured rule along with its lookup sets.
+type faultRule struct {
+	rule     *pb.FaultRule
+	keys     map[string]bool
+	shards   map[string]bool
+	methods  map[string]bool
+	injected int64
+}
+
+// Helper method to instantiate a new fault injector without rules. Injected
+// faults are logged as warnings through logger.
+func NewFaultInjector(shard_for_key func(key string) string, logger *slog.Logger) *FaultInjector {
+	return &FaultInjector{
+		rng:           rand.New(rand.NewSource(time.Now().UnixNano())),
+		shard_for_key: shard_for_key,
+		logger:        logger,
+	}
+}
+
+// Helper method to parse rules given as the protojson of a SetFaultRulesArg,
+// e.g. {"rules": [{"point": "kWriteKvToDisk", "action": "kFaultFail"}]}.
+func ParseFaultRules(rules_json string) ([]*pb.FaultRule, error) {
+	var arg pb.SetFaultRulesArg
+	if err := protojson.Unmarshal([]byte(rules_json), &arg); err != nil {
+		return nil, fmt.Errorf("failed to parse fault rules: %v", err)
+	}
+	return arg.GetRules(), nil
+}
+
+// Helper method to check that a rule can be injected.
+func validateFaultRule(rule *pb.FaultRule) error {
+	is_rpc := rule.GetPoint() == pb.FaultPoint_kWorkerRpc
+	switch rule.GetPoint() {
+	case pb.FaultPoint_kPersistOracleTimestamp, pb.FaultPoint_kWriteKvToDisk,
+		pb.FaultPoint_kGetValueFromDisk, pb.FaultPoint_kWorkerRpc,
+		pb.FaultPoint_kRecordDedupEntry:
+	default:
+		return fmt.Errorf("unknown fault point %v", rule.GetPoint())
+	}
+	switch rule.GetAction() {
+	case pb.FaultAction_kFaultFail:
+	case pb.FaultAction_kFaultDelay:
+		if rule.GetDelayMs() <= 0 {
+			return fmt.Errorf("delay_ms must be positive for %v", rule.GetAction())
+		}
+	case pb.FaultAction_kFaultCorrupt:
+		if is_rpc || rule.GetPoint() == pb.FaultPoint_kRecordDedupEntry {
+			return fmt.Errorf("%v is not supported for %v", rule.GetAction(), rule.GetPoint())
+		}
+	case pb.FaultAction_kFaultDropRequest, pb.FaultAction_kFaultDropResponse:
+		if !is_rpc {
+			return fmt.Errorf("%v is only supported for %v", rule.GetAction(),
+				pb.FaultPoint_kWorkerRpc)
+		}
+	default:
+		return fmt.Errorf("unknown fault action %v", rule.GetAction())
+	}
+	if rule.GetProbability() < 0 || rule.GetProbability() > 1 {
+		return fmt.Errorf("probability %v is not in [0, 1]", rule.GetProbability())
+	}
+	if len(rule.GetMethods()) > 0 && !is_rpc {
+		return fmt.Errorf("methods are only supported for %v", pb.FaultPoint_kWorkerRpc)
+	}
+	if rule.GetMaxFaults() < 0 {
+		return fmt.Errorf("max_faults must not be negative")
+	}
+	return nil
+}
+
+// Helper method to build a lookup set of strings. Returns nil if values is
+// empty, which matches everything.
+func stringSet(values []string) map[string]bool {
+	if len(values) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		set[value] = true
+	}
+	return set
+}
+
+// Replace all the configured rules. The rules are left unchanged if any of
+// them is invalid.
+func (f *FaultInjector) SetRules(rules []*pb.FaultRule) error {
+	fault_rules := make([]*faultRule, 0, len(rules))
+	for i, rule := range rules {
+		if err := validateFaultRule(rule); err != nil {
+			return fmt.Errorf("invalid fault rule %d: %v", i, err)
+		}
+		fault_rules = append(fault_rules, &faultRule{
+			rule:    proto.Clone(rule).(*pb.FaultRule),
+			keys:    stringSet(rule.GetKeys()),
+			shards:  stringSet(rule.GetShards()),
+			methods: stringSet(rule.GetMethods()),
+		})
+	}
+	f.lock.Lock()
+	f.rules = fault_rules
+	f.lock.Unlock()
+	f.logger.Info("Configured fault injection rules", slog.Int("rules", len(fault_rules)))
+	return nil
+}
+
+// Configured rules and the number of faults each of them injected.
+func (f *FaultInjector) RuleStatuses() []*pb.FaultRuleStatus {
+	if f == nil {
+		return nil
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	statuses := make([]*pb.FaultRuleStatus, 0, len(f.rules))
+	for _, fault_rule := range f.rules {
+		statuses = append(statuses, &pb.FaultRuleStatus{
+			Rule:           proto.Clone(fault_rule.rule).(*pb.FaultRule),
+			InjectedFaults: fault_rule.injected,
+		})
+	}
+	return statuses
+}
+
+// Helper method to pick the rules injecting a fault into an operation. An
+// empty key, shard or method only matches rules which do not filter on it.
+func (f *FaultInjector) pickRules(point pb.FaultPoint, key string, shard_id string,
+	method string) []*pb.FaultRule {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var picked []*pb.FaultRule
+	for _, fault_rule := range f.rules {
+		rule := fault_rule.rule
+		if rule.GetPoint() != point ||
+			(fault_rule.keys != nil && !fault_rule.keys[key]) ||
+			(fault_rule.shards != nil && !fault_rule.shards[shard_id]) ||
+			(fault_rule.methods != nil && !fault_rule.methods[method]) {
+			continue
+		}
+		if rule.GetMaxFaults() > 0 && fault_rule.injected >= rule.GetMaxFaults() {
+			continue
+		}
+		if rule.GetProbability() > 0 && f.rng.Float64() >= rule.GetProbability() {
+			continue
+		}
+		fault_rule.injected++
+		picked = append(picked, rule)
+	}
+	return picked
+}
+
+// Helper method to sleep for the delay of a rule, or until ctx is done.
+func sleepForFault(ctx context.Context, rule *pb.FaultRule) {
+	timer := time.NewTimer(time.Duration(rule.GetDelayMs()) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// Inject the faults configured for a disk operation on a key of a shard.
+// Delays are applied before returning. Returns whether the data written or
+// read must be corrupted, and an error if the operation must fail.
+func (f *FaultInjector) InjectDiskFault(ctx context.Context, point pb.FaultPoint,
+	key string, shard_id string) (bool, error) {
+	if f == nil {
+		return false, nil
+	}
+	corrupt := false
+	for _, rule := range f.pickRules(point, key, shard_id, "") {
+		switch rule.GetAction() {
+		case pb.FaultAction_kFaultFail:
+			f.logger.WarnContext(ctx, "Injecting failure", slog.Any("point", point),
+				logging.Key(key), logging.Shard(shard_id))
+			return false, fmt.Errorf("injected failure into %v", point)
+		case pb.FaultAction_kFaultDelay:
+			f.logger.WarnContext(ctx, "Injecting delay", slog.Any("point", point),
+				slog.Int64("delay_ms", rule.GetDelayMs()), logging.Key(key),
+				logging.Shard(shard_id))
+			sleepForFault(ctx, rule)
+		case pb.FaultAction_kFaultCorrupt:
+			f.logger.WarnContext(ctx, "Injecting corruption", slog.Any("point", point),
+				logging.Key(key), logging.Shard(shard_id))
+			corrupt = true
+		}
+	}
+	return corrupt, nil
+}
+
+// Helper method to flip a random byte of data in place.
+func (f *FaultInjector) Corrupt(data []byte) []byte {
+	if len(data) == 0 {
+		return data
+	}
+	f.lock.Lock()
+	i := f.rng.Intn(len(data))
+	f.lock.Unlock()
+	data[i] ^= 0xff
+	return data
+}
+
+// Server interceptor injecting the faults configured for incoming
+// KvStoreService RPCs. Other services are never faulted, so that the faults
+// can always be changed through the WorkerAdmin service.
+func (f *FaultInjector) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	service_prefix := "/" + pb.KvStoreService_ServiceDesc.ServiceName + "/"
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (any, error) {
+		if !strings.HasPrefix(info.FullMethod, service_prefix) {
+			return handler(ctx, req)
+		}
+		method := path.Base(info.FullMethod)
+		var key, shard_id string
+		if keyed, ok := req.(interface{ GetKey() string }); ok {
+			key = keyed.GetKey()
+			shard_id = f.shard_for_key(key)
+		}
+		drop_response := false
+		for _, rule := range f.pickRules(pb.FaultPoint_kWorkerRpc, key, shard_id, method) {
+			switch rule.GetAction() {
+			case pb.FaultAction_kFaultFail:
+				f.logger.WarnContext(ctx, "Injecting failure into RPC",
+					slog.String("method", method), logging.Key(key))
+				return nil, status.Errorf(codes.Unavailable, "injected failure into %s", method)
+			case pb.FaultAction_kFaultDelay:
+				f.logger.WarnContext(ctx, "Injecting delay into RPC",
+					slog.String("method", method), slog.Int64("delay_ms", rule.GetDelayMs()),
+					logging.Key(key))
+				sleepForFault(ctx, rule)
+			case pb.FaultAction_kFaultDropRequest:
+				f.logger.WarnContext(ctx, "Dropping request of RPC",
+					slog.String("method", method), logging.Key(key))
+				<-ctx.Done()
+				return nil, status.FromContextError(ctx.Err()).Err()
+			case pb.FaultAction_kFaultDropResponse:
+				drop_response = true
+			}
+		}
+		resp, err := handler(ctx, req)
+		if drop_response && err == nil {
+			f.logger.WarnContext(ctx, "Dropping response of RPC",
+				slog.String("method", method), logging.Key(key))
+			return nil, status.Errorf(codes.Unavailable, "injected drop of the %s response", method)
+		}
+		return resp, err
+	}
+}
+
+//------------------------------------------------------------------------------
+// WORKER ADMIN SERVICE
+//------------------------------------------------------------------------------
+
+// Error returned when changing the faults of a worker started without fault
+// injection.
+var ErrFaultInjectionDisabled = errors.New("fault injection is disabled on this worker")
+
+// Replace the faults injected into the worker. Only valid once the worker
+// started.
+func (w *Worker) SetFaultRules(rules []*pb.FaultRule) error {
+	if w.faults == nil {
+		return ErrFaultInjectionDisabled
+	}
+	return w.faults.SetRules(rules)
+}
+
+// Implement the WorkerAdminServer
+type adminServer struct {
+	pb.UnimplementedWorkerAdminServer
+	*Worker
+}
+
+// Implement the SetFaultRules RPC method.
+func (s *adminServer) SetFaultRules(ctx context.Context, in *pb.SetFaultRulesArg) (*pb.SetFaultRulesRet, error) {
+	s.logger.Info("Received RPC SetFaultRules", slog.Int("rules", len(in.GetRules())))
+	if err := s.Worker.SetFaultRules(in.GetRules()); err != nil {
+		return &pb.SetFaultRulesRet{
+			Success:      false,
+			ErrorDetails: err.Error(),
+			ErrorCode:    pb.ErrorCode_kInvalidArgument,
+		}, nil
+	}
+	return &pb.SetFaultRulesRet{Success: true}, nil
+}
+
+// Implement the GetFaultRules RPC method.
+func (s *adminServer) GetFaultRules(ctx context.Context, in *pb.GetFaultRulesArg) (*pb.GetFaultRulesRet, error) {
+	return &pb.GetFaultRulesRet{
+		Enabled: s.faults != nil,
+		Rules:   s.faults.RuleStatuses(),
+	}, nil
+}
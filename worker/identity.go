@@ -0,0 +1,86 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"kvstore/membership"
+	pb "kvstore/protos"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+//------------------------------------------------------------------------------
+// CLUSTER IDENTITY
+//------------------------------------------------------------------------------
+
+// Name of the file of the mount recording the identity of the cluster its
+// shards belong to.
+const clusterIdentityFile = "cluster_identity.json"
+
+// Helper method to read the cluster identity recorded in the mount. Returns
+// nil if the mount has none yet.
+func (w *Worker) readMountClusterIdentity() (*pb.ClusterIdentity, error) {
+	data, err := os.ReadFile(filepath.Join(w.config.MountPath, clusterIdentityFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cluster identity of the mount: %v", err)
+	}
+	identity := &pb.ClusterIdentity{}
+	if err := protojson.Unmarshal(data, identity); err != nil {
+		return nil, fmt.Errorf("failed to parse cluster identity of the mount: %v", err)
+	}
+	return identity, nil
+}
+
+// Helper method to check that the config of the worker and the shards of its
+// mount belong to the cluster whose identity is stored in etcd. A mount
+// without identity, e.g. of a new worker, is stamped with the identity of the
+// cluster. If etcd has no identity yet, the one of the mount is restored, or a
+// new one is drawn from the config.
+func (w *Worker) CheckClusterIdentity(ctx context.Context) error {
+	mount_identity, err := w.readMountClusterIdentity()
+	if err != nil {
+		return err
+	}
+	proposed := mount_identity
+	if proposed == nil {
+		proposed = membership.NewClusterIdentity(w.config.NumShards)
+	}
+	identity, is_stored, err := membership.LoadClusterIdentity(ctx, w.etcd_client, proposed)
+	if err != nil {
+		return err
+	}
+	if is_stored {
+		w.logger.Info("Stored cluster identity in etcd",
+			slog.String("cluster_id", identity.GetClusterId()),
+			slog.Int("num_shards", int(identity.GetNumShards())))
+	}
+	if err := membership.CheckClusterIdentity(identity, w.config.NumShards); err != nil {
+		return err
+	}
+	if mount_identity != nil {
+		if !proto.Equal(mount_identity, identity) {
+			return fmt.Errorf("%w: mount %s belongs to cluster %s with %d shards, not to "+
+				"cluster %s", membership.ErrClusterIdentityMismatch, w.config.MountPath,
+				mount_identity.GetClusterId(), mount_identity.GetNumShards(),
+				identity.GetClusterId())
+		}
+		return nil
+	}
+	data, err := protojson.Marshal(identity)
+	if err != nil {
+		return fmt.Errorf("failed to marshal cluster identity: %v", err)
+	}
+	file_path := filepath.Join(w.config.MountPath, clusterIdentityFile)
+	if err := replaceFile(file_path, w.getTmpPath(), data, true, nil, ""); err != nil {
+		return fmt.Errorf("failed to write cluster identity of the mount: %v", err)
+	}
+	w.logger.Info("Recorded cluster identity in the mount",
+		slog.String("cluster_id", identity.GetClusterId()))
+	return nil
+}
@@ -0,0 +1,139 @@
+package worker
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"kvstore/logging"
+	"kvstore/metrics"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+// WORKER METRICS
+//------------------------------------------------------------------------------
+
+// Files written by the worker, used to label the disk latencies.
+const (
+	diskFileKv              = "kv"
+	diskFileOracleTimestamp = "oracle_timestamp"
+)
+
+// Prometheus metrics of a worker.
+type workerMetrics struct {
+	registry *prometheus.Registry
+	rpcs     *metrics.ServerMetrics
+	// Latency of writing a file and of syncing it to disk, by file.
+	disk_write_seconds *prometheus.HistogramVec
+	disk_fsync_seconds *prometheus.HistogramVec
+	// Writes failed because the oracle timestamp could not be persisted, by
+	// shard.
+	oracle_persist_failures *prometheus.CounterVec
+}
+
+// Helper method to create the metrics of a worker.
+func newWorkerMetrics(w *Worker) *workerMetrics {
+	registry := metrics.NewRegistry()
+	m := &workerMetrics{
+		registry: registry,
+		rpcs:     metrics.NewServerMetrics(registry),
+		disk_write_seconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: "worker",
+			Name:      "disk_write_seconds",
+			Help:      "Latency of writing a file, before syncing it, by file.",
+			Buckets:   metrics.LatencyBuckets,
+		}, []string{"file"}),
+		disk_fsync_seconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: "worker",
+			Name:      "disk_fsync_seconds",
+			Help:      "Latency of syncing a written file to disk, by file.",
+			Buckets:   metrics.LatencyBuckets,
+		}, []string{"file"}),
+		oracle_persist_failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metrics.Namespace,
+			Subsystem: "worker",
+			Name:      "oracle_persist_failures_total",
+			Help:      "Writes failed because the oracle timestamp could not be persisted, by shard.",
+		}, []string{"shard"}),
+	}
+	registry.MustRegister(m.disk_write_seconds, m.disk_fsync_seconds,
+		m.oracle_persist_failures, &shardCollector{w: w})
+	return m
+}
+
+// Helper method to record the time since start as the latency of writing a
+// file. Nothing is recorded by nil metrics.
+func (m *workerMetrics) observeDiskWrite(file string, start time.Time) {
+	if m == nil {
+		return
+	}
+	m.disk_write_seconds.WithLabelValues(file).Observe(time.Since(start).Seconds())
+}
+
+// Helper method to record the time since start as the latency of syncing a
+// file. Nothing is recorded by nil metrics.
+func (m *workerMetrics) observeDiskFsync(file string, start time.Time) {
+	if m == nil {
+		return
+	}
+	m.disk_fsync_seconds.WithLabelValues(file).Observe(time.Since(start).Seconds())
+}
+
+// Registry holding the metrics of the worker.
+func (w *Worker) Metrics() *prometheus.Registry {
+	return w.metrics.registry
+}
+
+// Descriptions of the per shard metrics.
+var (
+	shardKeysDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "worker", "shard_keys"),
+		"Number of keys stored on disk, including expired keys not yet removed, by shard.",
+		[]string{"shard"}, nil)
+	shardBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "worker", "shard_bytes"),
+		"Size of the keys stored on disk, by shard.",
+		[]string{"shard"}, nil)
+	oracleTimestampDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "worker", "oracle_timestamp"),
+		"Latest oracle timestamp generated, by shard.",
+		[]string{"shard"}, nil)
+)
+
+// Collector of the per shard metrics. The usage of the owned shards is
+// cached by the worker, so that a scrape does not walk the shards.
+type shardCollector struct {
+	w *Worker
+}
+
+func (c *shardCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- shardKeysDesc
+	ch <- shardBytesDesc
+	ch <- oracleTimestampDesc
+}
+
+func (c *shardCollector) Collect(ch chan<- prometheus.Metric) {
+	w := c.w
+	for shard_id := range w.owned_shards {
+		key_count, bytes, err := w.getShardUsage(shard_id)
+		if err != nil {
+			w.logger.Error("Failed to get shard usage for metrics", logging.Shard(shard_id),
+				logging.Err(err))
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(shardKeysDesc, prometheus.GaugeValue,
+			float64(key_count), shard_id)
+		ch <- prometheus.MustNewConstMetric(shardBytesDesc, prometheus.GaugeValue,
+			float64(bytes), shard_id)
+	}
+	// The oracle timestamps are only known once the worker started.
+	if w.oracle_timestamps == nil {
+		return
+	}
+	w.oracle_timestamps.oracle_timestamp_lock.RLock()
+	defer w.oracle_timestamps.oracle_timestamp_lock.RUnlock()
+	for shard_id, oracle_ts := range w.oracle_timestamps.timestamp_map {
+		ch <- prometheus.MustNewConstMetric(oracleTimestampDesc, prometheus.GaugeValue,
+			float64(oracle_ts), shard_id)
+	}
+}
@@ -0,0 +1,163 @@
+package worker
+
+import (
+	"context"
+	"kvstore/logging"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+// SHARD USAGE RELATED STRUCTS AND METHODS
+//------------------------------------------------------------------------------
+
+// Interval at which the usage of the shards is counted again from disk, to
+// catch up with the files changed behind the worker's back.
+const shardUsageRefreshInterval = time.Minute
+
+// Number of keys stored on disk for a shard and their total size in bytes.
+type shardUsage struct {
+	key_count int64
+	bytes     int64
+	// Set once counted from disk, after which the writes keep it up to date.
+	is_loaded bool
+	// Number of changes recorded, so that a count of the disk racing with a
+	// write is dropped.
+	generation int64
+}
+
+// Usage of the shards, counted from disk once and then kept up to date by the
+// writes and deletes, so that reporting it does not walk the shards.
+type ShardUsageMap struct {
+	usage_lock sync.Mutex
+	// Key is the shard id.
+	usage_map map[string]*shardUsage
+}
+
+// Helper method to instantiate a new shard usage map.
+func CreateShardUsageMap() *ShardUsageMap {
+	return &ShardUsageMap{
+		usage_map: make(map[string]*shardUsage),
+	}
+}
+
+// Helper method to get the usage of a shard, creating it if needed. Caller
+// must hold usage_lock.
+func (m *ShardUsageMap) getLocked(shard_id string) *shardUsage {
+	usage, exists := m.usage_map[shard_id]
+	if !exists {
+		usage = &shardUsage{}
+		m.usage_map[shard_id] = usage
+	}
+	return usage
+}
+
+// Helper method to record a change of the keys stored for a shard. Caller
+// must hold the shard_lock of the shard, so that the changes of a key are
+// recorded in the order they were applied.
+func (m *ShardUsageMap) Add(shard_id string, key_count int64, bytes int64) {
+	m.usage_lock.Lock()
+	defer m.usage_lock.Unlock()
+	usage := m.getLocked(shard_id)
+	usage.key_count += key_count
+	usage.bytes += bytes
+	usage.generation++
+}
+
+// Helper method to get a copy of the usage of a shard.
+func (m *ShardUsageMap) Get(shard_id string) shardUsage {
+	m.usage_lock.Lock()
+	defer m.usage_lock.Unlock()
+	return *m.getLocked(shard_id)
+}
+
+// Helper method to replace the usage of a shard with the one counted from
+// disk, unless changes were recorded since generation, in which case the
+// count may miss them.
+func (m *ShardUsageMap) Set(shard_id string, key_count int64, bytes int64, generation int64) {
+	m.usage_lock.Lock()
+	defer m.usage_lock.Unlock()
+	usage := m.getLocked(shard_id)
+	if usage.generation == generation {
+		usage.key_count, usage.bytes, usage.is_loaded = key_count, bytes, true
+	}
+}
+
+// Helper method to count the keys stored on disk for a shard and their total
+// size in bytes.
+func (w *Worker) countShardUsage(shard_id string) (int64, int64, error) {
+	files, err := os.ReadDir(filepath.Join(w.config.MountPath, shard_id))
+	if os.IsNotExist(err) {
+		// The shard was never written.
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	var key_count, bytes int64
+	for _, file := range files {
+		if !file.Type().IsRegular() {
+			continue
+		}
+		info, err := file.Info()
+		if os.IsNotExist(err) {
+			// Deleted while we were listing the shard.
+			continue
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		key_count++
+		bytes += info.Size()
+	}
+	return key_count, bytes, nil
+}
+
+// Helper method to count the usage of a shard from disk and cache it.
+// Returns the number of keys and their total size in bytes.
+func (w *Worker) refreshShardUsage(shard_id string) (int64, int64, error) {
+	generation := w.shard_usage.Get(shard_id).generation
+	key_count, bytes, err := w.countShardUsage(shard_id)
+	if err != nil {
+		return 0, 0, err
+	}
+	// A write racing with the count is picked up by the next refresh.
+	w.shard_usage.Set(shard_id, key_count, bytes, generation)
+	return key_count, bytes, nil
+}
+
+// Helper method to get the number of keys stored for a shard and their total
+// size in bytes. The shard is only counted from disk the first time.
+func (w *Worker) getShardUsage(shard_id string) (int64, int64, error) {
+	if usage := w.shard_usage.Get(shard_id); usage.is_loaded {
+		return usage.key_count, usage.bytes, nil
+	}
+	return w.refreshShardUsage(shard_id)
+}
+
+// Helper method to count the usage of the owned shards from disk.
+func (w *Worker) refreshOwnedShardUsage() {
+	for shard_id := range w.owned_shards {
+		if _, _, err := w.refreshShardUsage(shard_id); err != nil {
+			w.logger.Error("Failed to count shard usage", logging.Shard(shard_id),
+				logging.Err(err))
+		}
+	}
+}
+
+// Count the usage of the owned shards from disk periodically until ctx is
+// done.
+func (w *Worker) refreshShardUsagePeriodically(ctx context.Context) {
+	ticker := time.NewTicker(shardUsageRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.refreshOwnedShardUsage()
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"kvstore/membership"
+	pb "kvstore/protos"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+//------------------------------------------------------------------------------
+// WORKER STATUS
+//------------------------------------------------------------------------------
+
+// Helper method to get the disk usage of the worker: the bytes used by the
+// mount, the oracle timestamps and the dedup tables, and the size and free
+// space of the filesystem holding the mount.
+func (w *Worker) getDiskUsage() (*pb.DiskUsage, error) {
+	disk_usage := &pb.DiskUsage{}
+	var dirs []string
+	for _, dir := range []string{w.config.MountPath, w.config.OracleTimestampPath, w.config.DedupPath} {
+		// Directories within the mount are already counted with it.
+		if dir != w.config.MountPath &&
+			strings.HasPrefix(dir, w.config.MountPath+string(filepath.Separator)) {
+			continue
+		}
+		dirs = append(dirs, dir)
+	}
+	for _, dir := range dirs {
+		err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+			if os.IsNotExist(err) {
+				// Removed while we were walking, e.g. a temporary file.
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if !entry.Type().IsRegular() {
+				return nil
+			}
+			info, err := entry.Info()
+			if os.IsNotExist(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			disk_usage.UsedBytes += info.Size()
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(w.config.MountPath, &stat); err != nil {
+		return nil, err
+	}
+	disk_usage.TotalBytes = int64(stat.Blocks) * int64(stat.Bsize)
+	disk_usage.AvailableBytes = int64(stat.Bavail) * int64(stat.Bsize)
+	return disk_usage, nil
+}
+
+// Helper method to get a copy of the oracle timestamp map.
+func (w *Worker) getOracleTimestamps() map[string]int64 {
+	w.oracle_timestamps.oracle_timestamp_lock.RLock()
+	defer w.oracle_timestamps.oracle_timestamp_lock.RUnlock()
+	oracle_timestamps := make(map[string]int64, len(w.oracle_timestamps.timestamp_map))
+	for shard_id, oracle_ts := range w.oracle_timestamps.timestamp_map {
+		oracle_timestamps[shard_id] = oracle_ts
+	}
+	return oracle_timestamps
+}
+
+// Implement the GetWorkerStatus RPC method. Reports the keys stored and the
+// latest oracle timestamp of every owned shard, along with the disk usage.
+func (s *adminServer) GetWorkerStatus(ctx context.Context, in *pb.GetWorkerStatusArg) (*pb.GetWorkerStatusRet, error) {
+	if !s.is_recovered.Load() {
+		return &pb.GetWorkerStatusRet{
+			Success:      false,
+			ErrorDetails: "Shard state not recovered from disk yet",
+			ErrorCode:    pb.ErrorCode_kInternalError,
+		}, nil
+	}
+	owned_shards, err := membership.OwnedShards(
+		s.config.PodName, s.config.NumWorkerPods, s.config.NumShards)
+	if err != nil {
+		return &pb.GetWorkerStatusRet{
+			Success:      false,
+			ErrorDetails: fmt.Sprintf("Failed to compute owned shards: %v", err),
+			ErrorCode:    pb.ErrorCode_kInternalError,
+		}, nil
+	}
+	ret := &pb.GetWorkerStatusRet{
+		Success:          true,
+		WorkerName:       s.config.PodName,
+		OracleTimestamps: s.getOracleTimestamps(),
+	}
+	for _, shard_id := range owned_shards {
+		key_count, bytes, err := s.getShardUsage(shard_id)
+		if err != nil {
+			return &pb.GetWorkerStatusRet{
+				Success:      false,
+				ErrorDetails: fmt.Sprintf("Failed to read shard %s: %v", shard_id, err),
+				ErrorCode:    pb.ErrorCode_kBackendError,
+			}, nil
+		}
+		ret.Shards = append(ret.Shards, &pb.ShardStatus{
+			ShardId:  shard_id,
+			KeyCount: key_count,
+			Bytes:    bytes,
+			OracleTs: ret.OracleTimestamps[shard_id],
+		})
+	}
+	if ret.DiskUsage, err = s.getDiskUsage(); err != nil {
+		return &pb.GetWorkerStatusRet{
+			Success:      false,
+			ErrorDetails: fmt.Sprintf("Failed to get disk usage: %v", err),
+			ErrorCode:    pb.ErrorCode_kBackendError,
+		}, nil
+	}
+	return ret, nil
+}
@@ -0,0 +1,1302 @@
+// Package worker implements the kvstore worker. A worker owns a subset of the
+// shards, stores their keys on its mount and serves the KvStoreService RPCs of
+// the control manager.
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protojson"
+	"io"
+	"io/ioutil"
+	"kvstore/health"
+	"kvstore/kverror"
+	"kvstore/logging"
+	"kvstore/membership"
+	"kvstore/metrics"
+	pb "kvstore/protos"
+	"kvstore/tracing"
+	"kvstore/validation"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config of a worker.
+type Config struct {
+	// Name of the worker pod, worker-<ordinal>. The ordinal determines the
+	// shards owned by the worker.
+	PodName string
+	// Address at which the control manager reaches the worker.
+	PodIp        string
+	PodNamespace string
+	// etcd endpoints used for worker membership. Defaults to the etcd service
+	// of PodNamespace.
+	EtcdEndpoints []string
+	// Host the gRPC server listens on. Listens on all interfaces if empty.
+	ListenHost string
+	// Port of the gRPC server. A free port is picked if 0.
+	GrpcServerPort int
+	// Address published in the registration. Defaults to PodIp and the port
+	// of the gRPC server; set it if the worker is reached through a proxy.
+	AdvertiseAddress string
+	// Total number of shards and of worker pods in the cluster.
+	NumShards     int
+	NumWorkerPods int
+	// Number of recently applied request ids remembered per shard.
+	DedupTableSize int
+	// TTL of the etcd lease backing the worker registration.
+	LeaseTtlSecs int64
+	// Directories holding the keys, the oracle timestamps and the dedup
+	// tables of the shards.
+	MountPath           string
+	OracleTimestampPath string
+	DedupPath           string
+	// If true, faults can be injected into the disk operations and the RPCs
+	// of the worker through FaultRules and the WorkerAdmin service. Only meant
+	// for testing.
+	EnableFaultInjection bool
+	// Faults injected from the start. Requires EnableFaultInjection.
+	FaultRules []*pb.FaultRule
+	// Port of the HTTP server exposing the Prometheus metrics at /metrics.
+	// Disabled if 0.
+	MetricsPort int
+	// Exporter and sampling of the OpenTelemetry traces.
+	Tracing tracing.Config
+	// Time given to the RPCs being served to finish when the worker is
+	// stopped. RPCs still running afterwards are cancelled. May be changed
+	// with Reconfigure.
+	ShutdownTimeout time.Duration
+}
+
+// Error returned by Wait once the worker was killed.
+var ErrKilled = errors.New("worker killed")
+
+// Worker serving the KvStoreService.
+type Worker struct {
+	config Config
+	// Copy of config holding the settings changed by Reconfigure, which are
+	// read from here.
+	runtime_config atomic.Pointer[Config]
+	// Logger of the worker, carrying its pod name.
+	logger *slog.Logger
+	// Set once the oracle timestamps and the dedup tables are recovered from
+	// disk.
+	is_recovered atomic.Bool
+	// Health service, serving once the worker is ready.
+	health *health.Server
+	// Shards owned by the worker, the keys of other shards are rejected.
+	owned_shards map[string]bool
+	// Latest oracle timestamp of every shard.
+	oracle_timestamps *OracleTimestampMap
+	// Recently applied writes of every shard.
+	dedup_tables *DedupTableMap
+	// Keys and bytes stored on disk for every shard.
+	shard_usage *ShardUsageMap
+	// Injects faults for testing, nil unless fault injection is enabled.
+	faults *FaultInjector
+	// Prometheus metrics, served by metrics_server if enabled.
+	metrics        *workerMetrics
+	metrics_server *metrics.Server
+	// Tracer of the RPCs served, set once we start.
+	tracer      *tracing.Tracer
+	etcd_client *clientv3.Client
+	registrar   *membership.WorkerRegistrar
+	listener    net.Listener
+	grpc_server *grpc.Server
+	// Cancels the registration keep alive.
+	cancel context.CancelFunc
+	// Closed once the worker stopped serving, after which err holds the
+	// reason.
+	done      chan struct{}
+	stop_once sync.Once
+	err       error
+}
+
+// Helper method to instantiate a new worker. The worker does not serve until
+// Start is called.
+func New(config Config) *Worker {
+	w := &Worker{
+		config:      config,
+		logger:      logging.Logger("worker").With(logging.Node(config.PodName)),
+		done:        make(chan struct{}),
+		shard_usage: CreateShardUsageMap(),
+	}
+	w.runtime_config.Store(&config)
+	// An invalid pod name leaves the worker without shards, Start fails on it
+	// when registering.
+	w.owned_shards = make(map[string]bool)
+	owned_shards, _ := membership.OwnedShards(config.PodName, config.NumWorkerPods,
+		config.NumShards)
+	for _, shard_id := range owned_shards {
+		w.owned_shards[shard_id] = true
+	}
+	w.metrics = newWorkerMetrics(w)
+	w.health = health.NewServer(w.CheckReadiness, w.logger,
+		pb.KvStoreService_ServiceDesc.ServiceName)
+	return w
+}
+
+// Apply the settings of config which may change while the worker runs, i.e.
+// the shutdown timeout. The other settings are ignored.
+func (w *Worker) Reconfigure(config Config) {
+	runtime_config := *w.runtime_config.Load()
+	runtime_config.ShutdownTimeout = config.ShutdownTimeout
+	w.runtime_config.Store(&runtime_config)
+	w.logger.Info("Reconfigured worker",
+		slog.Duration("shutdown_timeout", config.ShutdownTimeout))
+}
+
+//------------------------------------------------------------------------------
+// GRPC Service Implementations
+//------------------------------------------------------------------------------
+// Implememt the MapReduceServiceServer
+type server struct {
+	pb.UnimplementedKvStoreServiceServer
+	*Worker
+}
+
+// Implement the PutKeyInternal RPC method.
+func (s *server) PutKeyInternal(ctx context.Context, in *pb.PutKeyInternalArg) (*pb.PutKeyInternalRet, error) {
+	key := in.GetKey()
+	value := in.GetValue()
+	req_id := in.GetReqId()
+	shard_id := s.getShardFromKey(key)
+	// Records logged while serving the request carry its id and shard.
+	ctx = logging.WithAttrs(ctx, logging.RequestId(req_id), logging.Shard(shard_id))
+	s.logger.DebugContext(ctx, "Received RPC PutKeyInternal", logging.Key(key),
+		logging.Value(value))
+	// Smart clients send their writes here directly, so the arguments are
+	// checked like the control manager does.
+	if is_valid_arg, error_details := validation.ValidatePutKeyInternalArg(in); !is_valid_arg {
+		return &pb.PutKeyInternalRet{
+			Success:      false,
+			ErrorDetails: error_details,
+			ErrorCode:    pb.ErrorCode_kInvalidArgument,
+		}, nil
+	}
+	if is_owned, error_details := s.checkShardOwned(shard_id); !is_owned {
+		return &pb.PutKeyInternalRet{
+			Success:      false,
+			ErrorDetails: error_details,
+			ErrorCode:    pb.ErrorCode_kWrongShard,
+		}, nil
+	}
+	// Bail out early if the caller already gave up on this request.
+	if err := ctx.Err(); err != nil {
+		return &pb.PutKeyInternalRet{
+			Success:      false,
+			ErrorDetails: fmt.Sprintf("Request aborted before write: %v", err),
+			ErrorCode:    pb.ErrorCode_kDeadlineExceeded,
+		}, nil
+	}
+	// Serialize the writes to this shard and check whether this request has
+	// already been applied, in which case we return the original result.
+	// Request ids drawn by the control manager are never retried.
+	dedup_req_id := req_id
+	if in.GetSkipDedup() {
+		dedup_req_id = ""
+	}
+	dedup_table := s.GetShardDedupTable(shard_id)
+	dedup_table.shard_lock.Lock()
+	defer dedup_table.shard_lock.Unlock()
+	if entry := dedup_table.Lookup(dedup_req_id); entry != nil {
+		if entry.GetKey() != key {
+			return &pb.PutKeyInternalRet{
+				Success: false,
+				ErrorDetails: fmt.Sprintf(
+					"Request id %s was already used for a different key", req_id),
+				ErrorCode: pb.ErrorCode_kInvalidArgument,
+			}, nil
+		}
+		s.logger.InfoContext(ctx, "Request id already applied, returning original result",
+			logging.Key(key))
+		return &pb.PutKeyInternalRet{
+			Success:      true,
+			DbModifiedTs: entry.GetDbModifiedTs(),
+		}, nil
+	}
+	// The dedup entry of an applied write is lost if we crash right after
+	// writing the value, but the value carries the request id of its write.
+	if entry := s.lookupAppliedWrite(ctx, key, dedup_req_id); entry != nil {
+		s.logger.InfoContext(ctx, "Request id stored with the value, returning original result",
+			logging.Key(key))
+		dedup_table.Record(entry)
+		return &pb.PutKeyInternalRet{
+			Success:      true,
+			DbModifiedTs: entry.GetDbModifiedTs(),
+		}, nil
+	}
+	// Check the write condition. Holding the shard lock makes the check and
+	// the write atomic.
+	if in.GetCondition() != nil {
+		condition_ctx, span := s.tracer.Start(ctx, "CheckWriteCondition",
+			tracing.ShardKey.String(shard_id))
+		error_code, error_details := s.CheckWriteCondition(condition_ctx, key, in.GetCondition())
+		tracing.EndSpan(span, error_code, error_details)
+		if error_code != pb.ErrorCode_kNoError {
+			return &pb.PutKeyInternalRet{
+				Success:      false,
+				ErrorDetails: error_details,
+				ErrorCode:    error_code,
+			}, nil
+		}
+	}
+	// Generate the oracle timestamp for this write
+	_, span := s.tracer.Start(ctx, "GenerateOracleTimestampForShard",
+		tracing.ShardKey.String(shard_id))
+	db_modified_ts := s.GenerateOracleTimestampForShard(shard_id)
+	span.SetAttributes(tracing.DbModifiedTsKey.Int64(db_modified_ts))
+	span.End()
+	s.logger.DebugContext(ctx, "Generated oracle timestamp",
+		slog.Int64("oracle_ts", db_modified_ts))
+	// Persist this oracle timestamp for shard
+	persist_ctx, span := s.tracer.Start(ctx, "PersistOracleTimestampForShard",
+		tracing.ShardKey.String(shard_id), tracing.DbModifiedTsKey.Int64(db_modified_ts))
+	success := s.PersistOracleTimestampForShard(persist_ctx, shard_id, db_modified_ts)
+	if !success {
+		s.metrics.oracle_persist_failures.WithLabelValues(shard_id).Inc()
+		error_details := fmt.Sprintf(
+			"Failed to persist oracle timestamp for shard: %s", shard_id)
+		tracing.EndSpan(span, getErrorCodeForFailedWrite(ctx), error_details)
+		return &pb.PutKeyInternalRet{
+			Success:      false,
+			ErrorDetails: error_details,
+			ErrorCode:    getErrorCodeForFailedWrite(ctx),
+		}, nil
+	}
+	span.End()
+	write_ctx, span := s.tracer.Start(ctx, "WriteKvToDisk",
+		tracing.ShardKey.String(shard_id), tracing.DbModifiedTsKey.Int64(db_modified_ts))
+	is_write_success, error_details := s.WriteKvToDisk(write_ctx, key, value, shard_id,
+		db_modified_ts, in.GetExpiresAtMs(), dedup_req_id)
+	if !is_write_success {
+		tracing.EndSpan(span, getErrorCodeForFailedWrite(ctx), error_details)
+		return &pb.PutKeyInternalRet{
+			Success:      false,
+			ErrorDetails: error_details,
+			ErrorCode:    getErrorCodeForFailedWrite(ctx),
+		}, nil
+	}
+	span.End()
+	// Remember the applied write so that a retry returns the same result.
+	s.RecordDedupEntry(ctx, dedup_table, &pb.DedupEntry{
+		ReqId:        dedup_req_id,
+		Key:          key,
+		DbModifiedTs: db_modified_ts,
+	})
+	return &pb.PutKeyInternalRet{
+		Success:      true,
+		DbModifiedTs: db_modified_ts,
+	}, nil
+}
+
+// Helper method to check whether the current value of key was written by the
+// request req_id. Returns its dedup entry if so, else nil. Caller must hold
+// the shard lock.
+func (w *Worker) lookupAppliedWrite(ctx context.Context, key string, req_id string) *pb.DedupEntry {
+	if req_id == "" {
+		return nil
+	}
+	error_code, _, kv_object := w.GetValueFromDisk(ctx, key)
+	if error_code != pb.ErrorCode_kNoError || kv_object.GetReqId() != req_id {
+		return nil
+	}
+	return &pb.DedupEntry{
+		ReqId:        req_id,
+		Key:          key,
+		DbModifiedTs: kv_object.GetDbModifiedTs(),
+	}
+}
+
+// Helper method to record the dedup entry of an applied write. The entry is
+// not recorded if the caller gave up in the meantime, as if we crashed; a
+// retry then finds the request id stored with the value. Caller must hold the
+// shard lock.
+func (w *Worker) RecordDedupEntry(ctx context.Context, dedup_table *ShardDedupTable,
+	entry *pb.DedupEntry) {
+	if _, err := w.faults.InjectDiskFault(ctx, pb.FaultPoint_kRecordDedupEntry,
+		entry.GetKey(), w.getShardFromKey(entry.GetKey())); err != nil {
+		w.logger.ErrorContext(ctx, "Failed to record dedup entry", logging.Err(err))
+		return
+	}
+	if err := ctx.Err(); err != nil {
+		w.logger.WarnContext(ctx, "Request aborted before recording dedup entry",
+			logging.Err(err))
+		return
+	}
+	dedup_table.Record(entry)
+}
+
+// Helper method to check the condition of a conditional write against the
+// current value of the key. Returns kNoError if the condition holds and
+// kConditionFailed if it does not. Caller must hold the shard lock.
+// Returns (error_code, error_details)
+func (w *Worker) CheckWriteCondition(ctx context.Context, key string,
+	condition *pb.WriteCondition) (pb.ErrorCode, string) {
+	error_code, error_details, kv_object := w.GetValueFromDisk(ctx, key)
+	exists := error_code == pb.ErrorCode_kNoError
+	if !exists && error_code != pb.ErrorCode_kNotFound {
+		return error_code, error_details
+	}
+	switch {
+	case condition.GetIfNotExists():
+		if exists {
+			return pb.ErrorCode_kConditionFailed,
+				fmt.Sprintf("Key already exists: %s", key)
+		}
+	case condition.GetIfExists():
+		if !exists {
+			return pb.ErrorCode_kConditionFailed, fmt.Sprintf("Key not found: %s", key)
+		}
+	case condition.GetIfDbModifiedTs() != 0:
+		if !exists {
+			return pb.ErrorCode_kConditionFailed, fmt.Sprintf("Key not found: %s", key)
+		}
+		if kv_object.GetDbModifiedTs() != condition.GetIfDbModifiedTs() {
+			return pb.ErrorCode_kConditionFailed, fmt.Sprintf(
+				"Key %s was modified at %d, expected %d", key,
+				kv_object.GetDbModifiedTs(), condition.GetIfDbModifiedTs())
+		}
+	}
+	return pb.ErrorCode_kNoError, ""
+}
+
+// Helper method to get the error code for a failed write. Writes skipped
+// because the caller gave up are not reported as backend failures.
+func getErrorCodeForFailedWrite(ctx context.Context) pb.ErrorCode {
+	if ctx.Err() != nil {
+		return pb.ErrorCode_kDeadlineExceeded
+	}
+	return pb.ErrorCode_kBackendError
+}
+
+// Implement the GetKeyInternal RPC method
+func (s *server) GetKeyInternal(ctx context.Context, in *pb.GetKeyInternalArg) (*pb.GetKeyInternalRet, error) {
+	key := in.GetKey()
+	shard_id := s.getShardFromKey(key)
+	ctx = logging.WithAttrs(ctx, logging.RequestId(in.GetReqId()), logging.Shard(shard_id))
+	s.logger.DebugContext(ctx, "Received RPC GetKeyInternal", logging.Key(key))
+	if is_valid_arg, error_details := validation.ValidateGetKey(key); !is_valid_arg {
+		return &pb.GetKeyInternalRet{
+			Success:      false,
+			ErrorDetails: error_details,
+			ErrorCode:    pb.ErrorCode_kInvalidArgument}, nil
+	}
+	if is_owned, error_details := s.checkShardOwned(shard_id); !is_owned {
+		return &pb.GetKeyInternalRet{
+			Success:      false,
+			ErrorDetails: error_details,
+			ErrorCode:    pb.ErrorCode_kWrongShard}, nil
+	}
+	read_ctx, span := s.tracer.Start(ctx, "GetValueFromDisk",
+		tracing.ShardKey.String(shard_id))
+	error_code, error_details, kv_object := s.GetValueFromDisk(read_ctx, key)
+	tracing.EndSpan(span, error_code, error_details)
+	return &pb.GetKeyInternalRet{
+		Success:      error_code == pb.ErrorCode_kNoError,
+		KvObject:     kv_object,
+		ErrorDetails: error_details,
+		ErrorCode:    error_code}, nil
+}
+
+// Implement the DeleteKeyInternal RPC method
+func (s *server) DeleteKeyInternal(ctx context.Context, in *pb.DeleteKeyInternalArg) (*pb.DeleteKeyInternalRet, error) {
+	key := in.GetKey()
+	shard_id := s.getShardFromKey(key)
+	ctx = logging.WithAttrs(ctx, logging.RequestId(in.GetReqId()), logging.Shard(shard_id))
+	s.logger.DebugContext(ctx, "Received RPC DeleteKeyInternal", logging.Key(key))
+	if is_valid_arg, error_details := validation.ValidateDeleteKey(key); !is_valid_arg {
+		return &pb.DeleteKeyInternalRet{
+			Success:      false,
+			ErrorDetails: error_details,
+			ErrorCode:    pb.ErrorCode_kInvalidArgument}, nil
+	}
+	if is_owned, error_details := s.checkShardOwned(shard_id); !is_owned {
+		return &pb.DeleteKeyInternalRet{
+			Success:      false,
+			ErrorDetails: error_details,
+			ErrorCode:    pb.ErrorCode_kWrongShard}, nil
+	}
+	// Serialize with the writes to this shard.
+	dedup_table := s.GetShardDedupTable(shard_id)
+	dedup_table.shard_lock.Lock()
+	defer dedup_table.shard_lock.Unlock()
+	delete_ctx, span := s.tracer.Start(ctx, "DeleteKeyFromDisk", tracing.ShardKey.String(shard_id))
+	// Expired keys are removed from disk as well but reported as missing.
+	read_code, read_details, _ := s.GetValueFromDisk(delete_ctx, key)
+	error_code, error_details := s.DeleteKeyFromDisk(delete_ctx, key)
+	if error_code == pb.ErrorCode_kNoError && read_code == pb.ErrorCode_kNotFound {
+		error_code, error_details = read_code, read_details
+	}
+	tracing.EndSpan(span, error_code, error_details)
+	return &pb.DeleteKeyInternalRet{
+		Success:      error_code == pb.ErrorCode_kNoError,
+		ErrorDetails: error_details,
+		ErrorCode:    error_code}, nil
+}
+
+// Implement the ScanKeysInternal RPC method
+func (s *server) ScanKeysInternal(ctx context.Context, in *pb.ScanKeysInternalArg) (*pb.ScanKeysInternalRet, error) {
+	ctx = logging.WithAttrs(ctx, logging.RequestId(in.GetReqId()))
+	s.logger.DebugContext(ctx, "Received RPC ScanKeysInternal",
+		slog.String("prefix", in.GetPrefix()))
+	scan_ctx, span := s.tracer.Start(ctx, "ScanKeysFromDisk")
+	error_code, error_details, entries, has_more := s.ScanKeysFromDisk(
+		scan_ctx, in.GetPrefix(), in.GetStartAfter(), int(in.GetLimit()))
+	tracing.EndSpan(span, error_code, error_details)
+	return &pb.ScanKeysInternalRet{
+		Success:      error_code == pb.ErrorCode_kNoError,
+		Entries:      entries,
+		HasMore:      has_more,
+		ErrorDetails: error_details,
+		ErrorCode:    error_code}, nil
+}
+
+//------------------------------------------------------------------------------
+// KV-Store related methods.
+//------------------------------------------------------------------------------
+
+// Helper method to get shard from key
+func (w *Worker) getShardFromKey(key string) string {
+	return membership.GetShardForKey(key, w.config.NumShards)
+}
+
+// Helper method to check that the worker owns a shard. Keys of other shards
+// are rejected with kWrongShard, e.g. when sent by a client whose shard map
+// is stale. Returns false along with error details if not owned.
+func (w *Worker) checkShardOwned(shard_id string) (bool, string) {
+	if w.owned_shards[shard_id] {
+		return true, ""
+	}
+	return false, fmt.Sprintf("Shard %s is not owned by %s", shard_id,
+		w.config.PodName)
+}
+
+// Helper method to get the directory holding the files being written, which
+// lives on the mount so that they can be renamed into place.
+func (w *Worker) getTmpPath() string {
+	return filepath.Join(w.config.MountPath, "tmp")
+}
+
+// Helper method to replace the file at file_path with data, so that neither
+// readers nor a crash ever see a partially written file. data is written to
+// a temporary file in tmp_dir, which must be on the same filesystem, and
+// renamed over file_path. If is_synced, the file and its directory are synced
+// before returning so that the new content survives a crash. The latencies
+// are recorded as disk_file in m if set.
+func replaceFile(file_path string, tmp_dir string, data []byte, is_synced bool,
+	m *workerMetrics, disk_file string) error {
+	write_start := time.Now()
+	dir_path := filepath.Dir(file_path)
+	for _, dir := range []string{dir_path, tmp_dir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create dir: %v", err)
+		}
+	}
+	file, err := os.CreateTemp(tmp_dir, filepath.Base(file_path)+"-*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create file: %v", err)
+	}
+	tmp_path := file.Name()
+	write_err := func(format string, err error) error {
+		file.Close()
+		os.Remove(tmp_path)
+		return fmt.Errorf(format, err)
+	}
+	if err := file.Chmod(0644); err != nil {
+		return write_err("failed to set file mode: %v", err)
+	}
+	if _, err := file.Write(data); err != nil {
+		return write_err("error writing to file: %v", err)
+	}
+	m.observeDiskWrite(disk_file, write_start)
+	fsync_start := time.Now()
+	if is_synced {
+		if err := file.Sync(); err != nil {
+			return write_err("error syncing file: %v", err)
+		}
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmp_path)
+		return fmt.Errorf("error closing file: %v", err)
+	}
+	if err := os.Rename(tmp_path, file_path); err != nil {
+		os.Remove(tmp_path)
+		return fmt.Errorf("error renaming file: %v", err)
+	}
+	if is_synced {
+		if err := syncDir(dir_path); err != nil {
+			return fmt.Errorf("error syncing dir: %v", err)
+		}
+		m.observeDiskFsync(disk_file, fsync_start)
+	}
+	return nil
+}
+
+// Helper method to sync a directory, making the files created or renamed in
+// it durable.
+func syncDir(dir_path string) error {
+	dir, err := os.Open(dir_path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// Helper method to write KV to pod disk. The value is stored along with the
+// request id of the write, if any. Function returns true if the write was
+// successful, else returns false. The write is skipped if ctx is already
+// done.
+func (w *Worker) WriteKvToDisk(ctx context.Context, key string, value string, shard_id string,
+	db_modified_ts int64, expires_at_ms int64, req_id string) (bool, string) {
+	corrupt, err := w.faults.InjectDiskFault(ctx, pb.FaultPoint_kWriteKvToDisk, key, shard_id)
+	if err != nil {
+		error_str := fmt.Sprintf("Failed to write key %s: %v", key, err)
+		w.logger.ErrorContext(ctx, "Failed to write key", logging.Key(key), logging.Err(err))
+		return false, error_str
+	}
+	if err := ctx.Err(); err != nil {
+		error_str := fmt.Sprintf("Request aborted before disk write: %v", err)
+		w.logger.WarnContext(ctx, "Request aborted before disk write", logging.Err(err))
+		return false, error_str
+	}
+	filePath := filepath.Join(w.config.MountPath, shard_id, key)
+
+	// Prepare the kv store object to be flushed to disk
+	kv_object := &pb.KvStoreObject{
+		Value:        value,
+		DbModifiedTs: db_modified_ts,
+		ExpiresAtMs:  expires_at_ms,
+		ReqId:        req_id,
+	}
+	// Convert the object to Json string.
+	json_str := protojson.Format(kv_object)
+	if corrupt {
+		json_str = string(w.faults.Corrupt([]byte(json_str)))
+	}
+
+	// Size of the previous value, if any, to keep the shard usage up to date.
+	previous_info, stat_err := os.Stat(filePath)
+
+	// Sync the file so that an acknowledged write survives a crash. The
+	// previous value stays in place until the new one is complete.
+	if err := replaceFile(filePath, w.getTmpPath(), []byte(json_str), true,
+		w.metrics, diskFileKv); err != nil {
+		error_str := fmt.Sprintf("Failed to write key %s: %v", key, err)
+		w.logger.ErrorContext(ctx, "Failed to write key", logging.Key(key), logging.Err(err))
+		return false, error_str
+	}
+	if stat_err == nil {
+		w.shard_usage.Add(shard_id, 0, int64(len(json_str))-previous_info.Size())
+	} else {
+		w.shard_usage.Add(shard_id, 1, int64(len(json_str)))
+	}
+
+	w.logger.DebugContext(ctx, "Key written to disk", logging.Key(key), logging.Value(value),
+		slog.Int64("db_modified_ts", db_modified_ts))
+	// Return true in case of success. Let error string be empty.
+	return true, ""
+}
+
+// Helper method to fetch the key value pair from disk. Function returns
+// kNoError if the disk read was successful, kNotFound if the key does not
+// exist and kBackendError for any other disk or parsing failure.
+// Returns (error_code, error_details, value)
+func (w *Worker) GetValueFromDisk(ctx context.Context, key string) (pb.ErrorCode, string, *pb.KvStoreObject) {
+	if err := ctx.Err(); err != nil {
+		error_str := fmt.Sprintf("Request aborted before disk read: %v", err)
+		w.logger.WarnContext(ctx, "Request aborted before disk read", logging.Err(err))
+		return pb.ErrorCode_kDeadlineExceeded, error_str, nil
+	}
+	shard_id := w.getShardFromKey(key)
+	corrupt, err := w.faults.InjectDiskFault(ctx, pb.FaultPoint_kGetValueFromDisk, key, shard_id)
+	if err != nil {
+		error_str := fmt.Sprintf("Failed to read key %s: %v", key, err)
+		w.logger.ErrorContext(ctx, "Failed to read key", logging.Key(key), logging.Err(err))
+		return pb.ErrorCode_kBackendError, error_str, nil
+	}
+	filePath := w.config.MountPath + "/" + shard_id + "/" + key
+	data, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		error_str := fmt.Sprintf("Key not found: %s", key)
+		w.logger.DebugContext(ctx, "Key not found", logging.Key(key))
+		return pb.ErrorCode_kNotFound, error_str, nil
+	}
+	if err != nil {
+		error_str := fmt.Sprintf("Error reading file: %v", err)
+		w.logger.ErrorContext(ctx, "Error reading file", logging.Key(key), logging.Err(err))
+		return pb.ErrorCode_kBackendError, error_str, nil
+	}
+	if corrupt {
+		data = w.faults.Corrupt(data)
+	}
+
+	// Parse this into a KvStoreObject.
+	var kv_object pb.KvStoreObject
+	if err := protojson.Unmarshal(data, &kv_object); err != nil {
+		// The parse error may quote corrupted bytes, which cannot be sent in
+		// the error details unless made valid UTF-8.
+		error_str := strings.ToValidUTF8(
+			fmt.Sprintf("Failed to unmarshal proto object for key:%s with error %v",
+				key, err), "\uFFFD")
+		w.logger.ErrorContext(ctx, "Failed to unmarshal proto object", logging.Key(key))
+		return pb.ErrorCode_kBackendError, error_str, nil
+	}
+	if isExpired(&kv_object) {
+		error_str := fmt.Sprintf("Key not found: %s", key)
+		w.logger.DebugContext(ctx, "Key expired", logging.Key(key),
+			slog.Int64("expires_at_ms", kv_object.GetExpiresAtMs()))
+		return pb.ErrorCode_kNotFound, error_str, nil
+	}
+
+	w.logger.DebugContext(ctx, "Key read from disk", logging.Key(key))
+	// Return success and the data fetched.
+	return pb.ErrorCode_kNoError, "", &kv_object
+}
+
+// Helper method to check whether the key value pair has expired.
+func isExpired(kv_object *pb.KvStoreObject) bool {
+	return kv_object.GetExpiresAtMs() != 0 &&
+		time.Now().UnixMilli() >= kv_object.GetExpiresAtMs()
+}
+
+// Helper method to delete the key value pair from disk. Function returns
+// kNoError if the key was deleted, kNotFound if the key does not exist and
+// kBackendError for any other disk failure.
+// Returns (error_code, error_details)
+func (w *Worker) DeleteKeyFromDisk(ctx context.Context, key string) (pb.ErrorCode, string) {
+	if err := ctx.Err(); err != nil {
+		error_str := fmt.Sprintf("Request aborted before disk delete: %v", err)
+		w.logger.WarnContext(ctx, "Request aborted before disk delete", logging.Err(err))
+		return pb.ErrorCode_kDeadlineExceeded, error_str
+	}
+	shard_id := w.getShardFromKey(key)
+	file_path := filepath.Join(w.config.MountPath, shard_id, key)
+	// Size of the value, to keep the shard usage up to date.
+	info, stat_err := os.Stat(file_path)
+	err := os.Remove(file_path)
+	if os.IsNotExist(err) {
+		return pb.ErrorCode_kNotFound, fmt.Sprintf("Key not found: %s", key)
+	}
+	if err != nil {
+		error_str := fmt.Sprintf("Error deleting file: %v", err)
+		w.logger.ErrorContext(ctx, "Error deleting file", logging.Key(key), logging.Err(err))
+		return pb.ErrorCode_kBackendError, error_str
+	}
+	if stat_err == nil {
+		w.shard_usage.Add(shard_id, -1, -info.Size())
+	}
+	w.logger.DebugContext(ctx, "Key deleted from disk", logging.Key(key))
+	return pb.ErrorCode_kNoError, ""
+}
+
+// Default and maximum number of entries returned by a scan, as in the
+// control manager.
+const (
+	defaultScanLimit = 100
+	maxScanLimit     = 1000
+)
+
+// Number of directory entries read at once while listing the keys of a
+// shard.
+const scanReadDirBatchSize = 1000
+
+// Helper method to scan the keys stored in the shards owned by this worker.
+// Returns at most limit entries with keys starting with prefix and sorting
+// after start_after, in key order, along with whether more keys match. A
+// limit of 0 or less means the default, and limits above maxScanLimit are
+// capped.
+// Returns (error_code, error_details, entries, has_more)
+func (w *Worker) ScanKeysFromDisk(ctx context.Context, prefix string, start_after string,
+	limit int) (pb.ErrorCode, string, []*pb.KeyValue, bool) {
+	if limit <= 0 {
+		limit = defaultScanLimit
+	}
+	limit = min(limit, maxScanLimit)
+	var entries []*pb.KeyValue
+	for {
+		// One more key than needed tells whether more keys match.
+		keys, has_more, err := w.listKeysFromDisk(ctx, prefix, start_after,
+			limit-len(entries)+1)
+		if ctx.Err() != nil {
+			error_str := fmt.Sprintf("Request aborted during disk scan: %v", ctx.Err())
+			w.logger.WarnContext(ctx, "Request aborted during disk scan", logging.Err(ctx.Err()))
+			return pb.ErrorCode_kDeadlineExceeded, error_str, nil, false
+		}
+		if err != nil {
+			error_str := fmt.Sprintf("Error reading directory: %v", err)
+			w.logger.ErrorContext(ctx, "Error reading directory", logging.Err(err))
+			return pb.ErrorCode_kBackendError, error_str, nil, false
+		}
+		// Keys may have expired or have been deleted since they were listed,
+		// in which case we list the next ones.
+		for _, key := range keys {
+			if len(entries) == limit {
+				return pb.ErrorCode_kNoError, "", entries, true
+			}
+			error_code, error_details, kv_object := w.GetValueFromDisk(ctx, key)
+			if error_code == pb.ErrorCode_kNotFound {
+				continue
+			}
+			if error_code != pb.ErrorCode_kNoError {
+				return error_code, error_details, nil, false
+			}
+			entries = append(entries, &pb.KeyValue{
+				Key:          key,
+				Value:        kv_object.GetValue(),
+				DbModifiedTs: kv_object.GetDbModifiedTs(),
+			})
+		}
+		if !has_more {
+			return pb.ErrorCode_kNoError, "", entries, false
+		}
+		start_after = keys[len(keys)-1]
+	}
+}
+
+// Helper method to list the first max_keys keys of the owned shards which
+// start with prefix and sort after start_after, in key order, along with
+// whether more keys match. The shard directories are read in batches and at
+// most 2 * max_keys keys are held at once, so a page costs a single pass over
+// the directories whatever the number of keys stored.
+func (w *Worker) listKeysFromDisk(ctx context.Context, prefix string, start_after string,
+	max_keys int) ([]string, bool, error) {
+	var keys []string
+	has_more := false
+	// Keep the first max_keys keys seen so far.
+	truncate := func() {
+		sort.Strings(keys)
+		if len(keys) > max_keys {
+			keys, has_more = keys[:max_keys], true
+		}
+	}
+	for shard_id := range w.owned_shards {
+		dir, err := os.Open(filepath.Join(w.config.MountPath, shard_id))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		for {
+			files, err := dir.ReadDir(scanReadDirBatchSize)
+			for _, file := range files {
+				key := file.Name()
+				if file.Type().IsRegular() && strings.HasPrefix(key, prefix) &&
+					key > start_after {
+					keys = append(keys, key)
+				}
+			}
+			if len(keys) >= 2*max_keys {
+				truncate()
+			}
+			if err == io.EOF {
+				break
+			}
+			if err == nil {
+				err = ctx.Err()
+			}
+			if err != nil {
+				dir.Close()
+				return nil, false, err
+			}
+		}
+		dir.Close()
+	}
+	truncate()
+	return keys, has_more, nil
+}
+
+//------------------------------------------------------------------------------
+// ORACLE TIMESTAMP RELATED STRUCTS AND METHODS
+//------------------------------------------------------------------------------
+
+type OracleTimestampMap struct {
+	oracle_timestamp_lock sync.RWMutex
+	// Key should be the shard for the worker. Value should be the associated
+	// oracle timestamp of the shard.
+	timestamp_map map[string]int64
+}
+
+// Helper method to instantiate a new oracle timestamp map.
+func CreateOracleTimestampMap() *OracleTimestampMap {
+	return &OracleTimestampMap{
+		timestamp_map: make(map[string]int64),
+	}
+}
+
+// Helper method to generate new oracle timestamp for a shard write.
+// This oracle time will be used as db_modified_ts for entity write.
+// We shall generate the oracle time and try to persist it to disk before every
+// entity write. If oracle timestamp write as well as entity write to disk
+// both are successful we shall claim that oracle time as db_modified_ts.
+func (w *Worker) GenerateOracleTimestampForShard(shard_id string) int64 {
+	// Take a read lock on oracle timestamp map.
+	w.oracle_timestamps.oracle_timestamp_lock.Lock()
+	prev_ts, exists := w.oracle_timestamps.timestamp_map[shard_id]
+	var oracle_time int64
+	if exists {
+		// Previous timestamp exists, generate new oracle timestamp based on
+		// that
+		current_time := time.Now().Unix()
+		oracle_time = max(current_time, prev_ts) + 1
+	} else {
+		// If no entry for prev db_modified_ts exists, use the current time.
+		oracle_time = time.Now().Unix()
+	}
+	w.oracle_timestamps.timestamp_map[shard_id] = oracle_time
+	w.oracle_timestamps.oracle_timestamp_lock.Unlock()
+	return oracle_time
+}
+
+// Helper method to persist the Oracle Timestamp to disk. The write is
+// skipped if ctx is already done.
+func (w *Worker) PersistOracleTimestampForShard(ctx context.Context, shard_id string, oracle_ts int64) bool {
+	corrupt, err := w.faults.InjectDiskFault(ctx, pb.FaultPoint_kPersistOracleTimestamp, "", shard_id)
+	if err != nil {
+		w.logger.ErrorContext(ctx, "Failed to persist oracle timestamp", logging.Err(err))
+		return false
+	}
+	if err := ctx.Err(); err != nil {
+		w.logger.WarnContext(ctx, "Request aborted before persisting oracle timestamp",
+			logging.Err(err))
+		return false
+	}
+	oracle_ts_str := strconv.FormatInt(oracle_ts, 10)
+	if corrupt {
+		oracle_ts_str = string(w.faults.Corrupt([]byte(oracle_ts_str)))
+	}
+	if err := w.writeOracleTimestamp(shard_id, oracle_ts_str); err != nil {
+		w.logger.ErrorContext(ctx, "Failed to persist oracle timestamp", logging.Err(err))
+		return false
+	}
+	// Oracle timestamp successfully persisted to disk.
+	return true
+}
+
+// Helper method to write the oracle timestamp of a shard to its own file. The
+// file is synced so that a timestamp handed out is never reused after a
+// crash, and replaced as a whole so that a crash never leaves it empty.
+func (w *Worker) writeOracleTimestamp(shard_id string, oracle_ts_str string) error {
+	return replaceFile(filepath.Join(w.config.OracleTimestampPath, shard_id),
+		w.config.OracleTimestampPath, []byte(oracle_ts_str), true, w.metrics,
+		diskFileOracleTimestamp)
+}
+
+// Helper method to init the DbModifiedTimestampMap. Make sure this method is
+// called before any oracle timestamp method is called.
+func (w *Worker) InitShardOracleTimestampMap() {
+	w.oracle_timestamps = CreateOracleTimestampMap()
+	// TODO: Logic to read the persisted db modified timestamp for shards
+	// goes here.
+	w.oracle_timestamps.oracle_timestamp_lock.Lock()
+	// Read directory contents
+	files, err := ioutil.ReadDir(w.config.OracleTimestampPath)
+	if err != nil {
+		w.logger.Warn("Error reading oracle timestamp directory. May be this is a first "+
+			"time bootup of kvstore.", logging.Err(err))
+	} else {
+		for _, file := range files {
+			// Skip the temporary files of writes cut short by a crash.
+			if file.Mode().IsRegular() && filepath.Ext(file.Name()) != ".tmp" {
+				shard_id := file.Name()
+				w.logger.Info("Reading oracle timestamp", logging.Shard(shard_id))
+				// Read file content
+				content, err := os.ReadFile(filepath.Join(w.config.OracleTimestampPath, file.Name()))
+				if err != nil {
+					w.logger.Error("Error reading file", logging.Shard(shard_id), logging.Err(err))
+					continue
+				}
+
+				// Convert content to int64
+				oracle_ts, err := strconv.ParseInt(string(content), 10, 64)
+				if err != nil {
+					w.logger.Error("Invalid integer in file", logging.Shard(shard_id),
+						logging.Err(err))
+					continue
+				}
+
+				w.oracle_timestamps.timestamp_map[shard_id] = oracle_ts
+			}
+		}
+	}
+	w.oracle_timestamps.oracle_timestamp_lock.Unlock()
+
+}
+
+//------------------------------------------------------------------------------
+// WORKER MEMBERSHIP
+//------------------------------------------------------------------------------
+
+// Helper method to create the etcd client used for worker membership.
+func (w *Worker) InitEtcdClient() error {
+	endpoints := w.config.EtcdEndpoints
+	if len(endpoints) == 0 {
+		endpoints = []string{membership.EtcdEndpoint(w.config.PodNamespace)}
+	}
+	cli, err := membership.NewEtcdClientForEndpoints(endpoints)
+	if err != nil {
+		return fmt.Errorf("failed to create etcd client: %v", err)
+	}
+	w.etcd_client = cli
+	return nil
+}
+
+// Helper method to register this worker in etcd so that the control manager
+// can discover it. The registration is kept alive until ctx is done. The
+// worker is registered as starting, see SetRegistrationState.
+func (w *Worker) RegisterWorker(ctx context.Context) error {
+	owned_shards, err := membership.OwnedShards(
+		w.config.PodName, w.config.NumWorkerPods, w.config.NumShards)
+	if err != nil {
+		return fmt.Errorf("failed to compute owned shards: %v", err)
+	}
+	registration := &pb.WorkerRegistration{
+		WorkerName:  w.config.PodName,
+		Address:     w.Address(),
+		OwnedShards: owned_shards,
+		State:       pb.WorkerState_kWorkerStarting,
+	}
+	w.registrar = membership.NewWorkerRegistrar(w.etcd_client, registration,
+		w.config.LeaseTtlSecs)
+	if err := w.registrar.Start(ctx); err != nil {
+		return fmt.Errorf("failed to register worker: %v", err)
+	}
+	w.logger.Info("Worker registered", slog.Any("owned_shards", owned_shards))
+	return nil
+}
+
+// Helper method to publish the state of the worker in its registration, so
+// that operators see whether it is starting, serving or draining.
+func (w *Worker) SetRegistrationState(state pb.WorkerState) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := w.registrar.SetState(ctx, state); err != nil {
+		return fmt.Errorf("failed to publish worker state %v: %v", state, err)
+	}
+	w.logger.Info("Published worker state", slog.String("state", state.String()))
+	return nil
+}
+
+//------------------------------------------------------------------------------
+// WORKER LIFECYCLE
+//------------------------------------------------------------------------------
+
+// Address at which the control manager reaches the worker. Only valid once
+// the worker started.
+func (w *Worker) Address() string {
+	if w.config.AdvertiseAddress != "" {
+		return w.config.AdvertiseAddress
+	}
+	port := w.listener.Addr().(*net.TCPAddr).Port
+	return net.JoinHostPort(w.config.PodIp, strconv.Itoa(port))
+}
+
+// Readiness check of the worker. The worker is ready once the shard state is
+// recovered from disk, as long as the mount is writable.
+func (w *Worker) CheckReadiness() error {
+	if !w.is_recovered.Load() {
+		return errors.New("shard state not recovered from disk yet")
+	}
+	if err := os.MkdirAll(w.getTmpPath(), 0755); err != nil {
+		return fmt.Errorf("mount not writable: %v", err)
+	}
+	file, err := os.CreateTemp(w.getTmpPath(), "health-*")
+	if err != nil {
+		return fmt.Errorf("mount not writable: %v", err)
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write([]byte("ok"))
+	if close_err := file.Close(); err == nil {
+		err = close_err
+	}
+	if err != nil {
+		return fmt.Errorf("mount not writable: %v", err)
+	}
+	return nil
+}
+
+// Helper method to create the tracer of the RPCs served. Spans are only
+// exported if an exporter is configured.
+func (w *Worker) InitTracing() error {
+	tracer, err := tracing.New("worker", w.config.PodName, w.config.Tracing)
+	if err != nil {
+		return err
+	}
+	w.tracer = tracer
+	return nil
+}
+
+// Helper method to serve the Prometheus metrics if enabled.
+func (w *Worker) MayBeStartMetricsServer() error {
+	if w.config.MetricsPort == 0 {
+		return nil
+	}
+	metrics_server, err := metrics.StartServer(w.config.ListenHost, w.config.MetricsPort,
+		w.metrics.registry, w.stop)
+	if err != nil {
+		return err
+	}
+	w.metrics_server = metrics_server
+	return nil
+}
+
+// host:port at which the metrics are served, or an empty string if they are
+// not. Only valid once the worker started.
+func (w *Worker) MetricsAddress() string {
+	if w.metrics_server == nil {
+		return ""
+	}
+	return w.metrics_server.Address()
+}
+
+// Start the worker. The worker is registered as starting once it listens,
+// and published as serving once the shard state is recovered from disk and
+// the gRPC server started, so that no request is served with stale oracle
+// timestamps. Returns once the worker is serving.
+func (w *Worker) Start() error {
+	w.logger.Info("Starting worker", slog.String("pod_ip", w.config.PodIp),
+		slog.String("pod_namespace", w.config.PodNamespace))
+
+	if err := w.InitTracing(); err != nil {
+		w.stop(err)
+		return err
+	}
+
+	// Faults are injected from the first disk operation on.
+	if w.config.EnableFaultInjection {
+		w.logger.Warn("Fault injection is enabled")
+		w.faults = NewFaultInjector(w.getShardFromKey,
+			logging.Logger("faults").With(logging.Node(w.config.PodName)))
+		if err := w.faults.SetRules(w.config.FaultRules); err != nil {
+			w.stop(err)
+			return err
+		}
+	} else if len(w.config.FaultRules) > 0 {
+		err := errors.New("fault rules require fault injection to be enabled")
+		w.stop(err)
+		return err
+	}
+
+	// Refuse to touch the mount unless it and the config belong to the
+	// cluster, since keys would otherwise be routed to the wrong shards.
+	if err := w.InitEtcdClient(); err != nil {
+		w.stop(err)
+		return err
+	}
+	identity_ctx, cancel_identity := context.WithTimeout(context.Background(), 10*time.Second)
+	err := w.CheckClusterIdentity(identity_ctx)
+	cancel_identity()
+	if err != nil {
+		w.stop(err)
+		return err
+	}
+
+	// Listen before registering so that the registration carries the port
+	// actually used. Requests are only served once we recovered.
+	lis, err := net.Listen("tcp", net.JoinHostPort(w.config.ListenHost,
+		strconv.Itoa(w.config.GrpcServerPort)))
+	if err != nil {
+		err = fmt.Errorf("failed to listen: %v", err)
+		w.stop(err)
+		return err
+	}
+	w.listener = lis
+
+	// Register this worker as starting so that the control manager can
+	// discover it.
+	ctx, cancel := context.WithCancel(context.Background())
+	w.cancel = cancel
+	if err := w.RegisterWorker(ctx); err != nil {
+		w.stop(err)
+		return err
+	}
+
+	// Remove the files of writes cut short by a crash.
+	if err := os.RemoveAll(w.getTmpPath()); err != nil {
+		err = fmt.Errorf("failed to remove temporary files: %v", err)
+		w.stop(err)
+		return err
+	}
+
+	// Init the oracle timestamp map
+	w.InitShardOracleTimestampMap()
+
+	// Load the dedup tables of recently applied writes.
+	w.InitShardDedupTables()
+
+	// Count the keys of the owned shards, which the writes then keep up to
+	// date.
+	w.refreshOwnedShardUsage()
+	w.is_recovered.Store(true)
+
+	// Start the gRPC server.
+	// RPCs are measured and traced first so that injected RPC faults are
+	// recorded. Then injected RPC faults apply before anything else. Callers
+	// may opt in to gRPC status errors for failed requests.
+	interceptors := []grpc.UnaryServerInterceptor{
+		w.metrics.rpcs.UnaryServerInterceptor(),
+		tracing.UnaryServerInterceptor(),
+	}
+	if w.faults != nil {
+		interceptors = append(interceptors, w.faults.UnaryServerInterceptor())
+	}
+	interceptors = append(interceptors, kverror.UnaryServerInterceptor())
+	w.grpc_server = grpc.NewServer(w.tracer.ServerOption(),
+		grpc.ChainUnaryInterceptor(interceptors...))
+	pb.RegisterKvStoreServiceServer(w.grpc_server, &server{Worker: w})
+	pb.RegisterWorkerAdminServer(w.grpc_server, &adminServer{Worker: w})
+	w.health.Register(w.grpc_server)
+	w.logger.Info("Worker grpc service listening", slog.Any("address", lis.Addr()))
+	go func() {
+		if err := w.grpc_server.Serve(lis); err != nil {
+			w.stop(fmt.Errorf("failed to serve: %v", err))
+		}
+	}()
+
+	// Expose the metrics if enabled.
+	if err := w.MayBeStartMetricsServer(); err != nil {
+		w.stop(err)
+		return err
+	}
+
+	// Tell the control manager that we serve.
+	if err := w.SetRegistrationState(pb.WorkerState_kWorkerServing); err != nil {
+		w.stop(err)
+		return err
+	}
+	go w.health.Run(ctx)
+	go w.refreshShardUsagePeriodically(ctx)
+	return nil
+}
+
+// Stop serving gracefully. The worker is published as draining, new requests
+// are rejected, the requests being served are given ShutdownTimeout to finish
+// and the shard state is flushed to disk before the registration is removed.
+func (w *Worker) Stop() {
+	w.stop(nil)
+}
+
+// Stop serving abruptly, as if the process crashed. The registration is left
+// to expire with its lease.
+func (w *Worker) Kill() {
+	w.stop(ErrKilled)
+}
+
+// Wait until the worker stopped. Returns the failure which made the worker
+// stop, or nil if it was stopped through Stop.
+func (w *Worker) Wait() error {
+	<-w.done
+	return w.err
+}
+
+// Helper method to stop serving once the RPCs being served finished, or the
+// shutdown timeout expired, and flush the shard state to disk.
+func (w *Worker) drain() {
+	shutdown_timeout := w.runtime_config.Load().ShutdownTimeout
+	w.logger.Info("Draining worker", slog.Duration("timeout", shutdown_timeout))
+	ctx, cancel := context.WithTimeout(context.Background(), shutdown_timeout)
+	defer cancel()
+	if !w.health.Drain(ctx, w.grpc_server) {
+		w.logger.Warn("Shutdown timeout expired, cancelled the remaining RPCs")
+	}
+	if err := w.FlushState(); err != nil {
+		w.logger.Error("Failed to flush shard state", logging.Err(err))
+	}
+}
+
+// Flush the state of the shards to disk: the dedup tables, whose logs are
+// compacted into snapshots, and the oracle timestamps. Must only be called
+// once no write is served anymore.
+func (w *Worker) FlushState() error {
+	if !w.is_recovered.Load() {
+		return nil
+	}
+	var errs []error
+	w.dedup_tables.dedup_lock.Lock()
+	dedup_tables := make(map[string]*ShardDedupTable, len(w.dedup_tables.shards))
+	for shard_id, table := range w.dedup_tables.shards {
+		dedup_tables[shard_id] = table
+	}
+	w.dedup_tables.dedup_lock.Unlock()
+	for shard_id, table := range dedup_tables {
+		table.shard_lock.Lock()
+		err := table.flush()
+		table.shard_lock.Unlock()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to flush dedup table of shard %s: %v",
+				shard_id, err))
+		}
+	}
+	w.oracle_timestamps.oracle_timestamp_lock.Lock()
+	oracle_timestamps := make(map[string]int64, len(w.oracle_timestamps.timestamp_map))
+	for shard_id, oracle_ts := range w.oracle_timestamps.timestamp_map {
+		oracle_timestamps[shard_id] = oracle_ts
+	}
+	w.oracle_timestamps.oracle_timestamp_lock.Unlock()
+	for shard_id, oracle_ts := range oracle_timestamps {
+		if err := w.writeOracleTimestamp(shard_id, strconv.FormatInt(oracle_ts, 10)); err != nil {
+			errs = append(errs, fmt.Errorf("failed to flush oracle timestamp of shard %s: %v",
+				shard_id, err))
+		}
+	}
+	w.logger.Info("Flushed shard state", slog.Int("dedup_tables", len(dedup_tables)),
+		slog.Int("oracle_timestamps", len(oracle_timestamps)))
+	return errors.Join(errs...)
+}
+
+// Helper method to stop the worker once, recording the reason.
+func (w *Worker) stop(err error) {
+	w.stop_once.Do(func() {
+		if err != nil {
+			w.logger.Error("Stopping worker", logging.Err(err))
+		}
+		if err == nil && w.grpc_server != nil {
+			if err := w.SetRegistrationState(pb.WorkerState_kWorkerDraining); err != nil {
+				w.logger.Error("Failed to publish draining state", logging.Err(err))
+			}
+			w.drain()
+		} else {
+			w.health.Shutdown()
+		}
+		// Stop the keep alive first so that revoking the lease does not
+		// trigger a re-registration.
+		if w.cancel != nil {
+			w.cancel()
+		}
+		if w.registrar != nil && err != ErrKilled {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if err := w.registrar.Deregister(ctx); err != nil {
+				w.logger.Error("Failed to deregister worker", logging.Err(err))
+			}
+			cancel()
+		}
+		if w.grpc_server != nil {
+			w.grpc_server.Stop()
+		} else if w.listener != nil {
+			w.listener.Close()
+		}
+		if w.metrics_server != nil {
+			w.metrics_server.Close()
+		}
+		if w.etcd_client != nil {
+			w.etcd_client.Close()
+		}
+		// Flush the spans of the RPCs served last.
+		w.tracer.Shutdown()
+		w.err = err
+		close(w.done)
+	})
+}